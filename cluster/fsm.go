@@ -0,0 +1,96 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/queue"
+)
+
+type commandKind string
+
+const (
+	commandAddQueue    commandKind = "add-queue"
+	commandDeleteQueue commandKind = "delete-queue"
+	commandClearQueue  commandKind = "clear-queue"
+	commandEnqueue     commandKind = "enqueue"
+	commandDequeue     commandKind = "dequeue"
+	commandPeek        commandKind = "peek"
+)
+
+// A namespace operation, as stored in log entries. Every node applies the
+// same commands in the same order to its namespace; heaps are deterministic,
+// so dequeues return the same message on every node.
+type command struct {
+	Kind            commandKind `json:"kind"`
+	QueueId         uint32      `json:"queue_id"`
+	QueueName       string      `json:"queue_name,omitempty"`
+	EnableDLQ       bool        `json:"enable_dlq,omitempty"`
+	EnableInvisible bool        `json:"enable_invisible,omitempty"`
+	MessageId       uuid.UUID   `json:"message_id,omitzero"`
+	Priority        uint64      `json:"priority,omitempty"`
+	GroupKey        string      `json:"group_key,omitempty"`
+}
+
+type applyResult struct {
+	item *queue.QueueItem
+	err  error
+}
+
+// Apply an entry to the namespace. Errors of the command every node gets
+// the same, like a missing or full queue, are results. Any other error, like
+// a failed write or a corrupted page, is local to this node and returned
+// as a failure to apply the entry: the namespace of the node can no longer
+// be trusted to match the others.
+func applyEntry(namespace *queue.Namespace, entry Entry) (applyResult, error) {
+	if entry.Command == nil {
+		return applyResult{}, nil
+	}
+	cmd := &command{}
+	if err := json.Unmarshal(entry.Command, cmd); err != nil {
+		return applyResult{err: fmt.Errorf("failed to decode command of entry %d: %w", entry.Index, err)}, nil
+	}
+	if cmd.Kind == commandAddQueue {
+		if q, exists := namespace.Queues[cmd.QueueId]; exists && q != nil {
+			return applyResult{err: fmt.Errorf("queue with id %d already exists", cmd.QueueId)}, nil
+		}
+		_, err := namespace.AddQueue(&queue.QueueConfiguration{QueueName: cmd.QueueName, QueueId: cmd.QueueId, EnableDLQ: cmd.EnableDLQ, EnableInvisible: cmd.EnableInvisible})
+		return outcome(entry, nil, err)
+	}
+	q, err := namespace.GetQueue(cmd.QueueId)
+	if err == nil && q == nil {
+		err = fmt.Errorf("queue with id %d not found", cmd.QueueId)
+	}
+	if err != nil {
+		return applyResult{err: err}, nil
+	}
+	switch cmd.Kind {
+	case commandDeleteQueue:
+		if err = namespace.DeleteQueue(cmd.QueueId); err == nil {
+			delete(namespace.Queues, cmd.QueueId)
+		}
+		return outcome(entry, nil, err)
+	case commandClearQueue:
+		return outcome(entry, nil, namespace.ClearQueue(cmd.QueueId))
+	case commandEnqueue:
+		return outcome(entry, nil, q.Enqueue(&queue.QueueItem{MessageId: cmd.MessageId, Priority: cmd.Priority, GroupKey: cmd.GroupKey}))
+	case commandDequeue:
+		item, err := q.Dequeue()
+		return outcome(entry, item, err)
+	case commandPeek:
+		item, err := q.Peek()
+		return outcome(entry, item, err)
+	}
+	return applyResult{err: fmt.Errorf("unknown command %q of entry %d", cmd.Kind, entry.Index)}, nil
+}
+
+// Result of a command applied to a queue, or the failure to apply it.
+func outcome(entry Entry, item *queue.QueueItem, err error) (applyResult, error) {
+	var full *queue.ErrQueueFull
+	if err == nil || errors.As(err, &full) || errors.Is(err, queue.ErrHeapEmpty) || errors.Is(err, queue.ErrDuplicateMessage) {
+		return applyResult{item: item, err: err}, nil
+	}
+	return applyResult{}, fmt.Errorf("failed to apply entry %d: %w", entry.Index, err)
+}
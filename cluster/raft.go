@@ -0,0 +1,732 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kokaq/core/internals/logger"
+	"github.com/kokaq/core/queue"
+	"github.com/kokaq/core/utils"
+)
+
+// A cluster replicates a namespace across nodes with Raft. Every operation
+// is an entry of the replicated log, appended by the leader and applied by
+// each node to its own copy of the namespace once a majority stored it.
+// Writes and dequeues are only accepted by the leader and return once
+// applied there, so they are linearizable.
+//
+// The namespace directory is the state machine. The log is compacted by
+// snapshotting the namespace with Namespace.Snapshot, and a node restarts
+// from its last snapshot and the entries after it. Followers too far
+// behind the leader's log are sent the snapshot archive.
+type State uint8
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return "follower"
+}
+
+var (
+	// ErrNotLeader is returned by operations sent to a node that is not the leader.
+	ErrNotLeader = errors.New("node is not the leader")
+	// ErrLeadershipLost is returned when an operation was replaced in the log
+	// by a new leader. It was not applied.
+	ErrLeadershipLost = errors.New("leadership lost before the operation was committed")
+	ErrNodeClosed     = errors.New("node is closed")
+	// ErrNodeFailed is returned by a node that failed to apply an entry of
+	// its log to its namespace, like on a full disk or a corrupted page. It
+	// stops applying entries and leading until it is restarted, which
+	// rebuilds its namespace.
+	ErrNodeFailed = errors.New("node failed to apply its log")
+)
+
+const (
+	stateFileName      = "state.json"
+	logFileName        = "raft.log"
+	snapshotsDirectory = "snapshots"
+	dataDirectory      = "data"
+	maxAppendEntries   = 256
+)
+
+type Config struct {
+	Id        string
+	Peers     []string // ids of every node of the cluster, this one included
+	Dir       string   // raft state, log, snapshots and namespace of the node
+	Namespace queue.NamespaceConfig
+	Transport Transport
+
+	// Followers start an election after not hearing from a leader for a
+	// random duration between ElectionTimeout and twice that.
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// Entries applied since the last snapshot before the log is compacted.
+	SnapshotThreshold uint64
+}
+
+func (c *Config) setDefaults() error {
+	if c.Id == "" || c.Dir == "" || c.Transport == nil {
+		return fmt.Errorf("node id, directory and transport are required")
+	}
+	if !slices.Contains(c.Peers, c.Id) {
+		return fmt.Errorf("peers %v do not include node %s", c.Peers, c.Id)
+	}
+	if c.ElectionTimeout == 0 {
+		c.ElectionTimeout = 300 * time.Millisecond
+	}
+	if c.HeartbeatInterval == 0 {
+		c.HeartbeatInterval = c.ElectionTimeout / 6
+	}
+	if c.HeartbeatInterval >= c.ElectionTimeout {
+		return fmt.Errorf("heartbeat interval %s must be below the election timeout %s", c.HeartbeatInterval, c.ElectionTimeout)
+	}
+	if c.SnapshotThreshold == 0 {
+		c.SnapshotThreshold = 8192
+	}
+	return nil
+}
+
+type Status struct {
+	Id            string
+	State         State
+	Term          uint64
+	Leader        string // empty while unknown
+	CommitIndex   uint64
+	LastApplied   uint64
+	SnapshotIndex uint64
+	LastIndex     uint64
+	Failure       error // wraps ErrNodeFailed once the node failed to apply an entry
+}
+
+type proposal struct {
+	term uint64
+	done chan applyResult
+}
+
+type Node struct {
+	config Config
+	peers  []string // every node but this one
+
+	mu              sync.Mutex
+	applyCond       *sync.Cond // signalled when entries are committed or the node closes
+	state           State
+	term            uint64
+	votedFor        string
+	leader          string
+	log             *logStore
+	commitIndex     uint64
+	lastApplied     uint64
+	snapshot        string // archive of the entries up to the log's first index
+	lastContact     time.Time
+	electionTimeout time.Duration
+	nextIndex       map[string]uint64
+	matchIndex      map[string]uint64
+	lastAck         map[string]time.Time
+	inflight        map[string]bool
+	resend          map[string]bool
+	proposals       map[uint64]*proposal
+	closed          bool
+	failure         error // why applying an entry failed, nil while the node is healthy
+
+	applyMu   sync.Mutex // held while the namespace is used
+	namespace *queue.Namespace
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewNode starts a node of a cluster. Its namespace is rebuilt from the
+// last snapshot and the log entries after it as the leader commits them.
+func NewNode(config Config) (*Node, error) {
+	if err := config.setDefaults(); err != nil {
+		return nil, err
+	}
+	snapshots := filepath.Join(config.Dir, snapshotsDirectory)
+	if err := utils.EnsureDirectoryCreated(snapshots); err != nil {
+		return nil, err
+	}
+	state, err := loadState(filepath.Join(config.Dir, stateFileName))
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		config:     config,
+		term:       state.Term,
+		votedFor:   state.VotedFor,
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		lastAck:    make(map[string]time.Time),
+		inflight:   make(map[string]bool),
+		resend:     make(map[string]bool),
+		proposals:  make(map[uint64]*proposal),
+		stop:       make(chan struct{}),
+	}
+	n.applyCond = sync.NewCond(&n.mu)
+	for _, peer := range config.Peers {
+		if peer != config.Id {
+			n.peers = append(n.peers, peer)
+		}
+	}
+
+	latest := snapshotInfo{}
+	if available, err := listSnapshots(snapshots); err != nil {
+		return nil, err
+	} else if len(available) > 0 {
+		latest = available[0]
+	}
+	if err = n.restoreNamespace(latest.path); err != nil {
+		return nil, err
+	}
+	if n.log, err = openLogStore(filepath.Join(config.Dir, logFileName), latest.index, latest.term); err != nil {
+		n.namespace.Close()
+		return nil, err
+	}
+	n.snapshot = latest.path
+	n.commitIndex = latest.index
+	n.lastApplied = latest.index
+	n.resetElectionTimer()
+
+	if err = config.Transport.Serve(n); err != nil {
+		n.namespace.Close()
+		n.log.close()
+		return nil, fmt.Errorf("failed to serve node %s: %w", config.Id, err)
+	}
+	n.wg.Add(2)
+	go n.run()
+	go n.applyCommitted()
+	return n, nil
+}
+
+// Replace the namespace with the one of a snapshot archive, or an empty one
+// without. Callers hold applyMu or own the node.
+func (n *Node) restoreNamespace(archive string) error {
+	if n.namespace != nil {
+		if err := n.namespace.Close(); err != nil {
+			return fmt.Errorf("failed to close namespace: %w", err)
+		}
+		n.namespace = nil
+	}
+	data := filepath.Join(n.config.Dir, dataDirectory)
+	if err := utils.EnsureDirectoryDeleted(data); err != nil {
+		return fmt.Errorf("failed to delete namespace directory %s: %w", data, err)
+	}
+	if archive == "" {
+		namespace, err := queue.NewNamespace(data, n.config.Namespace)
+		if err != nil {
+			return fmt.Errorf("failed to create namespace: %w", err)
+		}
+		n.namespace = namespace
+		return nil
+	}
+	namespace, err := queue.RestoreNamespace(archive, data)
+	if err != nil {
+		return fmt.Errorf("failed to restore snapshot %s: %w", archive, err)
+	}
+	n.namespace = namespace
+	return nil
+}
+
+// Close stops the node and closes its namespace. Operations waiting to be
+// applied fail with ErrNodeClosed.
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	close(n.stop)
+	n.applyCond.Broadcast()
+	for index, p := range n.proposals {
+		p.done <- applyResult{err: ErrNodeClosed}
+		delete(n.proposals, index)
+	}
+	n.mu.Unlock()
+	errs := []error{n.config.Transport.Close()}
+	n.wg.Wait()
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.namespace != nil {
+		errs = append(errs, n.namespace.Close())
+	}
+	errs = append(errs, n.log.close())
+	return errors.Join(errs...)
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		Id:            n.config.Id,
+		State:         n.state,
+		Term:          n.term,
+		Leader:        n.leader,
+		CommitIndex:   n.commitIndex,
+		LastApplied:   n.lastApplied,
+		SnapshotIndex: n.log.firstIndex(),
+		LastIndex:     n.log.lastIndex(),
+		Failure:       n.failure,
+	}
+}
+
+func (n *Node) AddQueue(ctx context.Context, config queue.QueueConfiguration) error {
+	_, err := n.propose(ctx, &command{Kind: commandAddQueue, QueueId: config.QueueId, QueueName: config.QueueName, EnableDLQ: config.EnableDLQ, EnableInvisible: config.EnableInvisible})
+	return err
+}
+
+func (n *Node) DeleteQueue(ctx context.Context, queueId uint32) error {
+	_, err := n.propose(ctx, &command{Kind: commandDeleteQueue, QueueId: queueId})
+	return err
+}
+
+func (n *Node) ClearQueue(ctx context.Context, queueId uint32) error {
+	_, err := n.propose(ctx, &command{Kind: commandClearQueue, QueueId: queueId})
+	return err
+}
+
+func (n *Node) Enqueue(ctx context.Context, queueId uint32, item *queue.QueueItem) error {
+	if len(item.GroupKey) > queue.MaxGroupKeyLength {
+		return fmt.Errorf("group key of message %s is longer than %d bytes", item.MessageId, queue.MaxGroupKeyLength)
+	}
+	_, err := n.propose(ctx, &command{Kind: commandEnqueue, QueueId: queueId, MessageId: item.MessageId, Priority: item.Priority, GroupKey: item.GroupKey})
+	return err
+}
+
+// Dequeue removes the highest-priority message of a queue. A message is
+// dequeued by a single caller across the cluster.
+func (n *Node) Dequeue(ctx context.Context, queueId uint32) (*queue.QueueItem, error) {
+	return n.propose(ctx, &command{Kind: commandDequeue, QueueId: queueId})
+}
+
+// Peek returns the highest-priority message of a queue as of the time it
+// is applied in the log, which makes it linearizable with the other operations.
+func (n *Node) Peek(ctx context.Context, queueId uint32) (*queue.QueueItem, error) {
+	return n.propose(ctx, &command{Kind: commandPeek, QueueId: queueId})
+}
+
+// View calls fn with the namespace of this node as it is now, which on a
+// follower may lag behind the leader's. fn must not modify the namespace.
+func (n *Node) View(fn func(*queue.Namespace) error) error {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	if n.namespace == nil {
+		return fmt.Errorf("namespace of node %s is not available", n.config.Id)
+	}
+	return fn(n.namespace)
+}
+
+// Append a command to the log and wait for the leader to apply it.
+func (n *Node) propose(ctx context.Context, cmd *command) (*queue.QueueItem, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode command: %w", err)
+	}
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil, ErrNodeClosed
+	}
+	if n.failure != nil {
+		err = n.failure
+		n.mu.Unlock()
+		return nil, err
+	}
+	if n.state != Leader {
+		leader := n.leader
+		n.mu.Unlock()
+		return nil, fmt.Errorf("%w, the leader is %q", ErrNotLeader, leader)
+	}
+	entry := Entry{Index: n.log.lastIndex() + 1, Term: n.term, Command: data}
+	if err = n.log.append(entry); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	p := &proposal{term: n.term, done: make(chan applyResult, 1)}
+	n.proposals[entry.Index] = p
+	n.advanceCommit()
+	n.broadcast()
+	n.mu.Unlock()
+
+	select {
+	case result := <-p.done:
+		return result.item, result.err
+	case <-ctx.Done():
+		n.mu.Lock()
+		if n.proposals[entry.Index] == p {
+			delete(n.proposals, entry.Index)
+		}
+		n.mu.Unlock()
+		return nil, fmt.Errorf("operation of entry %d has an unknown outcome: %w", entry.Index, ctx.Err())
+	}
+}
+
+// Drive elections and heartbeats until the node closes.
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		switch {
+		case n.state == Leader && !n.hasQuorumContact():
+			// A leader cut off from the majority stops accepting operations it cannot commit
+			n.leader = ""
+			n.state = Follower
+			n.resetElectionTimer()
+		case n.state == Leader:
+			n.broadcast()
+		case time.Since(n.lastContact) >= n.electionTimeout && n.failure == nil:
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+func (n *Node) quorum() int {
+	return len(n.config.Peers)/2 + 1
+}
+
+// Whether a majority acknowledged the leader within an election timeout.
+// Callers hold mu.
+func (n *Node) hasQuorumContact() bool {
+	contacts := 1
+	for _, peer := range n.peers {
+		if time.Since(n.lastAck[peer]) < n.config.ElectionTimeout {
+			contacts++
+		}
+	}
+	return contacts >= n.quorum()
+}
+
+// Callers hold mu.
+func (n *Node) resetElectionTimer() {
+	n.lastContact = time.Now()
+	n.electionTimeout = n.config.ElectionTimeout + rand.N(n.config.ElectionTimeout)
+}
+
+// Callers hold mu.
+func (n *Node) persistState() error {
+	return saveState(filepath.Join(n.config.Dir, stateFileName), persistentState{Term: n.term, VotedFor: n.votedFor})
+}
+
+// Follow a leader of term, or of a term to be elected. Callers hold mu.
+func (n *Node) stepDown(term uint64) error {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.leader = ""
+		if err := n.persistState(); err != nil {
+			return err
+		}
+	}
+	n.state = Follower
+	return nil
+}
+
+// Callers hold mu.
+func (n *Node) startElection() {
+	n.state = Candidate
+	n.term++
+	n.votedFor = n.config.Id
+	n.leader = ""
+	n.resetElectionTimer()
+	if err := n.persistState(); err != nil {
+		logger.ConsoleLog("ERROR", "node %s failed to start an election: %v", n.config.Id, err)
+		return
+	}
+	term := n.term
+	req := &RequestVoteRequest{Term: term, Candidate: n.config.Id, LastLogIndex: n.log.lastIndex(), LastLogTerm: n.log.lastTerm()}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for _, peer := range n.peers {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), n.config.ElectionTimeout)
+			defer cancel()
+			resp, err := n.config.Transport.RequestVote(ctx, peer, req)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if n.closed {
+				return
+			}
+			if resp.Term > n.term {
+				if err = n.stepDown(resp.Term); err != nil {
+					logger.ConsoleLog("ERROR", "node %s failed to step down: %v", n.config.Id, err)
+				}
+				return
+			}
+			if n.state != Candidate || n.term != term || !resp.Granted {
+				return
+			}
+			if votes++; votes == n.quorum() {
+				n.becomeLeader()
+			}
+		}()
+	}
+}
+
+// Callers hold mu.
+func (n *Node) becomeLeader() {
+	n.state = Leader
+	n.leader = n.config.Id
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.log.lastIndex() + 1
+		n.matchIndex[peer] = 0
+		n.lastAck[peer] = time.Now()
+	}
+	// Entries of earlier terms are committed along with one of this term
+	if err := n.log.append(Entry{Index: n.log.lastIndex() + 1, Term: n.term}); err != nil {
+		logger.ConsoleLog("ERROR", "node %s failed to append to its log: %v", n.config.Id, err)
+		n.state = Follower
+		n.leader = ""
+		return
+	}
+	n.advanceCommit()
+	n.broadcast()
+}
+
+// Commit the last entry of this term stored by a majority. Callers hold mu.
+func (n *Node) advanceCommit() {
+	for index := n.log.lastIndex(); index > n.commitIndex; index-- {
+		if term, _ := n.log.term(index); term != n.term {
+			return
+		}
+		stored := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				stored++
+			}
+		}
+		if stored >= n.quorum() {
+			n.commitIndex = index
+			n.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+// Send new entries, or a heartbeat, to every follower. Callers hold mu.
+func (n *Node) broadcast() {
+	for _, peer := range n.peers {
+		if n.inflight[peer] {
+			n.resend[peer] = true
+			continue
+		}
+		n.inflight[peer] = true
+		n.wg.Add(1)
+		go n.replicate(peer, n.term)
+	}
+}
+
+// Replicate the log to a follower while this node leads in term, until
+// the follower is up to date or cannot be reached.
+func (n *Node) replicate(peer string, term uint64) {
+	defer n.wg.Done()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	defer func() { n.inflight[peer] = false }()
+	for n.state == Leader && n.term == term && !n.closed {
+		n.resend[peer] = false
+		var more bool
+		var err error
+		if n.nextIndex[peer] <= n.log.firstIndex() {
+			more, err = n.sendSnapshot(peer, term)
+		} else {
+			more, err = n.sendEntries(peer, term)
+		}
+		if err != nil || !(more || n.resend[peer]) {
+			return
+		}
+	}
+}
+
+// Called with mu held, which is released while the request is sent.
+func (n *Node) sendEntries(peer string, term uint64) (bool, error) {
+	prevIndex := n.nextIndex[peer] - 1
+	prevTerm, _ := n.log.term(prevIndex)
+	req := &AppendEntriesRequest{
+		Term:         term,
+		Leader:       n.config.Id,
+		PrevLogIndex: prevIndex,
+		PrevLogTerm:  prevTerm,
+		Entries:      n.log.slice(prevIndex+1, maxAppendEntries),
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), n.config.ElectionTimeout)
+	resp, err := n.config.Transport.AppendEntries(ctx, peer, req)
+	cancel()
+	n.mu.Lock()
+	if err != nil {
+		return false, err
+	}
+	if resp.Term > n.term {
+		return false, n.stepDown(resp.Term)
+	}
+	if n.state != Leader || n.term != term {
+		return false, nil
+	}
+	n.lastAck[peer] = time.Now()
+	if !resp.Success {
+		// Back off to the follower's hint, at least one entry
+		n.nextIndex[peer] = max(1, min(n.nextIndex[peer]-1, resp.LastIndex+1))
+		return true, nil
+	}
+	match := prevIndex + uint64(len(req.Entries))
+	if match > n.matchIndex[peer] {
+		n.matchIndex[peer] = match
+		n.advanceCommit()
+	}
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+	return n.nextIndex[peer] <= n.log.lastIndex(), nil
+}
+
+// Called with mu held, which is released while the request is sent.
+func (n *Node) sendSnapshot(peer string, term uint64) (bool, error) {
+	index, snapshotTerm, path := n.log.firstIndex(), n.log.entries[0].Term, n.snapshot
+	n.mu.Unlock()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		n.mu.Lock()
+		return false, fmt.Errorf("failed to read snapshot %s: %w", path, err)
+	}
+	req := &InstallSnapshotRequest{Term: term, Leader: n.config.Id, LastIncludedIndex: index, LastIncludedTerm: snapshotTerm, Data: data}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*n.config.ElectionTimeout)
+	resp, err := n.config.Transport.InstallSnapshot(ctx, peer, req)
+	cancel()
+	n.mu.Lock()
+	if err != nil {
+		return false, err
+	}
+	if resp.Term > n.term {
+		return false, n.stepDown(resp.Term)
+	}
+	if n.state != Leader || n.term != term {
+		return false, nil
+	}
+	n.lastAck[peer] = time.Now()
+	n.matchIndex[peer] = max(n.matchIndex[peer], index)
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+	n.advanceCommit()
+	return n.nextIndex[peer] <= n.log.lastIndex(), nil
+}
+
+// Apply committed entries to the namespace in log order until the node closes.
+func (n *Node) applyCommitted() {
+	defer n.wg.Done()
+	for {
+		n.mu.Lock()
+		for n.lastApplied >= n.commitIndex && !n.closed {
+			n.applyCond.Wait()
+		}
+		closed := n.closed
+		n.mu.Unlock()
+		if closed {
+			return
+		}
+
+		n.applyMu.Lock()
+		n.mu.Lock()
+		// A snapshot may have been installed meanwhile
+		entries := n.log.slice(n.lastApplied+1, int(min(n.commitIndex-n.lastApplied, maxAppendEntries)))
+		n.mu.Unlock()
+		for _, entry := range entries {
+			result, err := applyEntry(n.namespace, entry)
+			if err != nil {
+				n.mu.Lock()
+				n.fail(err)
+				n.mu.Unlock()
+				n.applyMu.Unlock()
+				return
+			}
+			n.mu.Lock()
+			n.lastApplied = entry.Index
+			if p, exists := n.proposals[entry.Index]; exists {
+				if p.term != entry.Term {
+					result = applyResult{err: ErrLeadershipLost}
+				}
+				p.done <- result
+				delete(n.proposals, entry.Index)
+			}
+			n.mu.Unlock()
+		}
+		if err := n.compact(); err != nil {
+			logger.ConsoleLog("ERROR", "node %s failed to compact its log: %v", n.config.Id, err)
+		}
+		n.applyMu.Unlock()
+	}
+}
+
+// Stop applying entries and leading after failing to apply an entry,
+// failing the operations waiting for theirs. Callers hold mu.
+func (n *Node) fail(err error) {
+	n.failure = fmt.Errorf("%w: %w", ErrNodeFailed, err)
+	logger.ConsoleLog("ERROR", "node %s stopped: %v", n.config.Id, err)
+	if n.state == Leader {
+		n.state = Follower
+		n.leader = ""
+	}
+	for index, p := range n.proposals {
+		p.done <- applyResult{err: n.failure}
+		delete(n.proposals, index)
+	}
+}
+
+// Snapshot the namespace and drop the entries it covers from the log once
+// enough entries were applied. Callers hold applyMu.
+func (n *Node) compact() error {
+	n.mu.Lock()
+	index := n.lastApplied
+	term, _ := n.log.term(index)
+	due := index-n.log.firstIndex() >= n.config.SnapshotThreshold
+	n.mu.Unlock()
+	if !due {
+		return nil
+	}
+	snapshots := filepath.Join(n.config.Dir, snapshotsDirectory)
+	path := snapshotPath(snapshots, index, term)
+	if err := n.namespace.Snapshot(path); err != nil {
+		return fmt.Errorf("failed to snapshot namespace at entry %d: %w", index, err)
+	}
+	n.mu.Lock()
+	err := n.log.compact(index, term)
+	if err == nil {
+		n.snapshot = path
+	}
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return pruneSnapshots(snapshots, path)
+}
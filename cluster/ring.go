@@ -0,0 +1,164 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/kokaq/core/utils/murmur"
+)
+
+// DefaultVirtualNodes is the number of ring points of a member of weight 1.
+const DefaultVirtualNodes = 128
+
+// QueueKey identifies a queue across namespaces.
+type QueueKey struct {
+	NamespaceId uint32
+	QueueId     uint32
+}
+
+func (k QueueKey) String() string {
+	return fmt.Sprintf("%d/%d", k.NamespaceId, k.QueueId)
+}
+
+func (k QueueKey) hash() uint32 {
+	data := binary.LittleEndian.AppendUint32(nil, k.NamespaceId)
+	return murmur.Sum32(binary.LittleEndian.AppendUint32(data, k.QueueId))
+}
+
+// Migration of a queue whose owner changes between two rings.
+type Migration struct {
+	Queue QueueKey
+	From  string // empty when the queue had no owner
+	To    string // empty when the queue has no owner anymore
+}
+
+type ringPoint struct {
+	hash   uint32
+	member string
+}
+
+// Ring assigns queues to members with consistent hashing. Every member owns
+// weight * virtual nodes points on a ring of murmur3 hashes, and a queue is
+// owned by the member of the first point at or after its hash. Adding or
+// removing a member only moves the queues of the points it gains or loses.
+type Ring struct {
+	mu           sync.RWMutex
+	virtualNodes int
+	weights      map[string]int
+	points       []ringPoint // sorted by hash, then member
+}
+
+// NewRing returns an empty ring giving every member virtualNodes points per
+// unit of weight, DefaultVirtualNodes if not positive.
+func NewRing(virtualNodes int) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	return &Ring{virtualNodes: virtualNodes, weights: make(map[string]int)}
+}
+
+// Add a member, or change the weight of one.
+func (r *Ring) Add(member string, weight int) error {
+	if member == "" {
+		return fmt.Errorf("member name is required")
+	}
+	if weight < 1 {
+		return fmt.Errorf("weight of member %s must be positive, got %d", member, weight)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.weights[member] = weight
+	r.build()
+	return nil
+}
+
+func (r *Ring) Remove(member string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.weights[member]; !exists {
+		return fmt.Errorf("member %s is not in the ring", member)
+	}
+	delete(r.weights, member)
+	r.build()
+	return nil
+}
+
+// Members of the ring, sorted.
+func (r *Ring) Members() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return slices.Sorted(maps.Keys(r.weights))
+}
+
+// Clone returns a copy of the ring, to plan membership changes on.
+func (r *Ring) Clone() *Ring {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return &Ring{virtualNodes: r.virtualNodes, weights: maps.Clone(r.weights), points: slices.Clone(r.points)}
+}
+
+// Callers hold mu for writing.
+func (r *Ring) build() {
+	r.points = r.points[:0]
+	for member, weight := range r.weights {
+		for i := range weight * r.virtualNodes {
+			r.points = append(r.points, ringPoint{hash: murmur.Sum32(fmt.Appendf(nil, "%s#%d", member, i)), member: member})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].member < r.points[j].member
+	})
+}
+
+// Owner returns the member owning a queue, false on an empty ring.
+func (r *Ring) Owner(key QueueKey) (string, bool) {
+	owners := r.Owners(key, 1)
+	if len(owners) == 0 {
+		return "", false
+	}
+	return owners[0], true
+}
+
+// Owners returns up to count distinct members for a queue, in ring order
+// from its owner: the members to hold its replicas.
+func (r *Ring) Owners(key QueueKey, count int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	count = min(count, len(r.weights))
+	owners := make([]string, 0, count)
+	if count <= 0 {
+		return owners
+	}
+	hash := key.hash()
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	for i := range r.points {
+		member := r.points[(start+i)%len(r.points)].member
+		if !slices.Contains(owners, member) {
+			if owners = append(owners, member); len(owners) == count {
+				break
+			}
+		}
+	}
+	return owners
+}
+
+// Migrations lists the queues owned by another member in target than in
+// this ring, in the order of queues.
+func (r *Ring) Migrations(target *Ring, queues []QueueKey) []Migration {
+	migrations := make([]Migration, 0)
+	for _, key := range queues {
+		from, _ := r.Owner(key)
+		to, _ := target.Owner(key)
+		if from != to {
+			migrations = append(migrations, Migration{Queue: key, From: from, To: to})
+		}
+	}
+	return migrations
+}
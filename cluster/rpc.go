@@ -0,0 +1,217 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type RequestVoteRequest struct {
+	Term         uint64
+	Candidate    string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RequestVoteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+type AppendEntriesRequest struct {
+	Term         uint64
+	Leader       string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry // empty for heartbeats
+	LeaderCommit uint64
+}
+
+type AppendEntriesResponse struct {
+	Term    uint64
+	Success bool
+	// Last entry the follower may share with the leader, where the leader
+	// resumes after a failed consistency check.
+	LastIndex uint64
+}
+
+// InstallSnapshotRequest carries a whole namespace archive, replacing the
+// state of a follower missing entries the leader compacted.
+type InstallSnapshotRequest struct {
+	Term              uint64
+	Leader            string
+	LastIncludedIndex uint64
+	LastIncludedTerm  uint64
+	Data              []byte
+}
+
+type InstallSnapshotResponse struct {
+	Term uint64
+}
+
+func (n *Node) HandleRequestVote(req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil, ErrNodeClosed
+	}
+	if req.Term > n.term {
+		if err := n.stepDown(req.Term); err != nil {
+			return nil, err
+		}
+	}
+	resp := &RequestVoteResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp, nil
+	}
+	upToDate := req.LastLogTerm > n.log.lastTerm() || (req.LastLogTerm == n.log.lastTerm() && req.LastLogIndex >= n.log.lastIndex())
+	if (n.votedFor == "" || n.votedFor == req.Candidate) && upToDate {
+		n.votedFor = req.Candidate
+		if err := n.persistState(); err != nil {
+			return nil, err
+		}
+		n.resetElectionTimer()
+		resp.Granted = true
+	}
+	return resp, nil
+}
+
+func (n *Node) HandleAppendEntries(req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil, ErrNodeClosed
+	}
+	resp := &AppendEntriesResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp, nil
+	}
+	if err := n.stepDown(req.Term); err != nil {
+		return nil, err
+	}
+	resp.Term = n.term
+	n.leader = req.Leader
+	n.resetElectionTimer()
+
+	// Entries up to the snapshot are committed, so they match the leader's
+	prevIndex, prevTerm, entries := req.PrevLogIndex, req.PrevLogTerm, req.Entries
+	if first := n.log.firstIndex(); prevIndex < first {
+		skip := min(uint64(len(entries)), first-prevIndex)
+		prevIndex, entries = first, entries[skip:]
+		prevTerm, _ = n.log.term(first)
+	}
+	if term, ok := n.log.term(prevIndex); !ok {
+		resp.LastIndex = n.log.lastIndex()
+		return resp, nil
+	} else if term != prevTerm {
+		// Skip every entry of the conflicting term at once
+		index := prevIndex
+		for index > n.log.firstIndex() {
+			if t, _ := n.log.term(index - 1); t != term {
+				break
+			}
+			index--
+		}
+		resp.LastIndex = index - 1
+		return resp, nil
+	}
+
+	for i, entry := range entries {
+		if term, ok := n.log.term(entry.Index); ok {
+			if term == entry.Term {
+				continue
+			}
+			if err := n.truncateLog(entry.Index); err != nil {
+				return nil, err
+			}
+		}
+		if err := n.log.append(entries[i:]...); err != nil {
+			return nil, err
+		}
+		break
+	}
+	resp.Success = true
+	resp.LastIndex = prevIndex + uint64(len(entries))
+	if req.LeaderCommit > n.commitIndex {
+		n.commitIndex = max(n.commitIndex, min(req.LeaderCommit, resp.LastIndex))
+		n.applyCond.Broadcast()
+	}
+	return resp, nil
+}
+
+// Drop uncommitted entries from index on, failing the operations proposed
+// in them. Callers hold mu.
+func (n *Node) truncateLog(index uint64) error {
+	if index <= n.commitIndex {
+		return fmt.Errorf("entry %d is committed and cannot be replaced", index)
+	}
+	if err := n.log.truncate(index); err != nil {
+		return err
+	}
+	for i, p := range n.proposals {
+		if i >= index {
+			p.done <- applyResult{err: ErrLeadershipLost}
+			delete(n.proposals, i)
+		}
+	}
+	return nil
+}
+
+func (n *Node) HandleInstallSnapshot(req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil, ErrNodeClosed
+	}
+	resp := &InstallSnapshotResponse{Term: n.term}
+	if req.Term < n.term {
+		n.mu.Unlock()
+		return resp, nil
+	}
+	if err := n.stepDown(req.Term); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	resp.Term = n.term
+	n.leader = req.Leader
+	n.resetElectionTimer()
+	applied := n.lastApplied
+	n.mu.Unlock()
+	if req.LastIncludedIndex <= applied {
+		return resp, nil
+	}
+
+	// The namespace is replaced while applyMu keeps entries from being applied
+	snapshots := filepath.Join(n.config.Dir, snapshotsDirectory)
+	path := snapshotPath(snapshots, req.LastIncludedIndex, req.LastIncludedTerm)
+	if err := writeFileAtomic(path, req.Data); err != nil {
+		return nil, err
+	}
+	if err := n.restoreNamespace(path); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.log.compact(req.LastIncludedIndex, req.LastIncludedTerm); err != nil {
+		return nil, err
+	}
+	n.snapshot = path
+	n.lastApplied = req.LastIncludedIndex
+	n.commitIndex = max(n.commitIndex, req.LastIncludedIndex)
+	n.lastContact = time.Now()
+	for i, p := range n.proposals {
+		if i <= req.LastIncludedIndex {
+			p.done <- applyResult{err: fmt.Errorf("operation of entry %d was applied through a snapshot, its result is unknown", i)}
+			delete(n.proposals, i)
+		}
+	}
+	if err := pruneSnapshots(snapshots, path); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,306 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kokaq/core/utils/murmur"
+)
+
+// Entry of the replicated log. Index and Term identify it across nodes.
+type Entry struct {
+	Index   uint64 `json:"index"`
+	Term    uint64 `json:"term"`
+	Command []byte `json:"command,omitempty"` // nil for the entry a new leader appends
+}
+
+// Term and vote of a node, which must survive restarts.
+type persistentState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+func loadState(path string) (persistentState, error) {
+	state := persistentState{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read raft state %s: %w", path, err)
+	}
+	if err = json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to decode raft state %s: %w", path, err)
+	}
+	return state, nil
+}
+
+func saveState(path string, state persistentState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode raft state: %w", err)
+	}
+	return writeFileAtomic(path, data)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to move %s to %s: %w", tmp, path, err)
+	}
+	return nil
+}
+
+// Entries of the log are stored as records of:
+//
+//	length u32 | murmur3 u32 | JSON entry
+//
+// A record torn by a crash ends the log when it is opened.
+const logRecordHeaderSize = 8
+
+// logStore holds the entries after the last snapshot, in memory and in
+// the log file. entries[0] stands for the last entry of the snapshot.
+type logStore struct {
+	path    string
+	file    *os.File
+	entries []Entry
+	offsets []int64 // file offset of entries[i], offsets[0] is unused
+	size    int64
+}
+
+func openLogStore(path string, snapshotIndex uint64, snapshotTerm uint64) (*logStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raft log %s: %w", path, err)
+	}
+	l := &logStore{path: path, file: file, entries: []Entry{{Index: snapshotIndex, Term: snapshotTerm}}, offsets: []int64{0}}
+	if err = l.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *logStore) load() error {
+	data, err := io.ReadAll(l.file)
+	if err != nil {
+		return fmt.Errorf("failed to read raft log %s: %w", l.path, err)
+	}
+	offset := int64(0)
+	for int64(len(data))-offset >= logRecordHeaderSize {
+		length := int64(binary.LittleEndian.Uint32(data[offset:]))
+		checksum := binary.LittleEndian.Uint32(data[offset+4:])
+		end := offset + logRecordHeaderSize + length
+		if end > int64(len(data)) || murmur.Sum32(data[offset+logRecordHeaderSize:end]) != checksum {
+			break
+		}
+		entry := Entry{}
+		if err = json.Unmarshal(data[offset+logRecordHeaderSize:end], &entry); err != nil {
+			return fmt.Errorf("failed to decode raft log entry at offset %d of %s: %w", offset, l.path, err)
+		}
+		// Entries covered by the snapshot are dropped at the next compaction
+		if entry.Index > l.lastIndex() {
+			if entry.Index != l.lastIndex()+1 {
+				return fmt.Errorf("raft log %s holds entry %d after entry %d", l.path, entry.Index, l.lastIndex())
+			}
+			l.entries = append(l.entries, entry)
+			l.offsets = append(l.offsets, offset)
+		}
+		offset = end
+	}
+	if offset != int64(len(data)) {
+		if err = l.file.Truncate(offset); err != nil {
+			return fmt.Errorf("failed to truncate raft log %s: %w", l.path, err)
+		}
+	}
+	l.size = offset
+	return nil
+}
+
+func (l *logStore) firstIndex() uint64 {
+	return l.entries[0].Index
+}
+
+func (l *logStore) lastIndex() uint64 {
+	return l.entries[len(l.entries)-1].Index
+}
+
+func (l *logStore) lastTerm() uint64 {
+	return l.entries[len(l.entries)-1].Term
+}
+
+// Term of the entry at index, known for the snapshot's last entry onwards.
+func (l *logStore) term(index uint64) (uint64, bool) {
+	if index < l.firstIndex() || index > l.lastIndex() {
+		return 0, false
+	}
+	return l.entries[index-l.firstIndex()].Term, true
+}
+
+// Copy of the entries from index on, at most max of them.
+func (l *logStore) slice(from uint64, max int) []Entry {
+	if from <= l.firstIndex() || from > l.lastIndex() {
+		return nil
+	}
+	entries := l.entries[from-l.firstIndex():]
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	return append([]Entry(nil), entries...)
+}
+
+func (l *logStore) append(entries ...Entry) error {
+	buffer := make([]byte, 0)
+	offsets := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode raft log entry %d: %w", entry.Index, err)
+		}
+		offsets = append(offsets, l.size+int64(len(buffer)))
+		buffer = binary.LittleEndian.AppendUint32(buffer, uint32(len(data)))
+		buffer = binary.LittleEndian.AppendUint32(buffer, murmur.Sum32(data))
+		buffer = append(buffer, data...)
+	}
+	if _, err := l.file.WriteAt(buffer, l.size); err != nil {
+		return fmt.Errorf("failed to append to raft log %s: %w", l.path, err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync raft log %s: %w", l.path, err)
+	}
+	l.entries = append(l.entries, entries...)
+	l.offsets = append(l.offsets, offsets...)
+	l.size += int64(len(buffer))
+	return nil
+}
+
+// Drop the entries from index on.
+func (l *logStore) truncate(from uint64) error {
+	if from <= l.firstIndex() || from > l.lastIndex() {
+		return nil
+	}
+	position := from - l.firstIndex()
+	if err := l.file.Truncate(l.offsets[position]); err != nil {
+		return fmt.Errorf("failed to truncate raft log %s: %w", l.path, err)
+	}
+	l.size = l.offsets[position]
+	l.entries = l.entries[:position]
+	l.offsets = l.offsets[:position]
+	return nil
+}
+
+// Drop the entries up to a snapshot's last entry, rewriting the file with
+// the rest. Entries after it are kept only if they follow it in the log.
+func (l *logStore) compact(index uint64, term uint64) error {
+	kept := []Entry(nil)
+	if t, ok := l.term(index); ok && t == term {
+		kept = l.entries[index-l.firstIndex()+1:]
+	}
+	tmp := l.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+	compacted := &logStore{path: l.path, file: file, entries: []Entry{{Index: index, Term: term}}, offsets: []int64{0}}
+	if len(kept) > 0 {
+		err = compacted.append(kept...)
+	} else {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, l.path); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to replace raft log %s: %w", l.path, err)
+	}
+	l.file.Close()
+	*l = *compacted
+	return nil
+}
+
+func (l *logStore) close() error {
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("failed to close raft log %s: %w", l.path, err)
+	}
+	return nil
+}
+
+// Snapshots are namespace archives named after their last entry.
+type snapshotInfo struct {
+	index uint64
+	term  uint64
+	path  string
+}
+
+func snapshotPath(dir string, index uint64, term uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%d-%d.tar", index, term))
+}
+
+// Snapshots in dir, the most recent first.
+func listSnapshots(dir string) ([]snapshotInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot directory %s: %w", dir, err)
+	}
+	snapshots := make([]snapshotInfo, 0)
+	for _, entry := range entries {
+		name, found := strings.CutSuffix(entry.Name(), ".tar")
+		index, term, valid := strings.Cut(name, "-")
+		if !found || !valid {
+			continue // temporary files of snapshots being written
+		}
+		info := snapshotInfo{path: filepath.Join(dir, entry.Name())}
+		if info.index, err = strconv.ParseUint(index, 10, 64); err != nil {
+			continue
+		}
+		if info.term, err = strconv.ParseUint(term, 10, 64); err != nil {
+			continue
+		}
+		snapshots = append(snapshots, info)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].index > snapshots[j].index })
+	return snapshots, nil
+}
+
+// Remove every snapshot and leftover temporary file but the latest snapshot.
+func pruneSnapshots(dir string, latest string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot directory %s: %w", dir, err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if path == latest {
+			continue
+		}
+		if err = os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove snapshot %s: %w", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrUnreachable is returned by a transport when the target node cannot be reached.
+var ErrUnreachable = errors.New("node is unreachable")
+
+// Handler serves the RPCs addressed to a node. Node implements it.
+type Handler interface {
+	HandleRequestVote(req *RequestVoteRequest) (*RequestVoteResponse, error)
+	HandleAppendEntries(req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	HandleInstallSnapshot(req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+}
+
+// Transport carries the RPCs of one node to its peers. Implementations
+// must be safe for concurrent use; requests and responses may be shared
+// with the receiving node and must not be modified after sending.
+type Transport interface {
+	// Serve routes requests addressed to this node to handler until Close.
+	Serve(handler Handler) error
+	RequestVote(ctx context.Context, target string, req *RequestVoteRequest) (*RequestVoteResponse, error)
+	AppendEntries(ctx context.Context, target string, req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	InstallSnapshot(ctx context.Context, target string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+	Close() error
+}
+
+// MemoryNetwork connects nodes running in the same process. Nodes can be
+// isolated from the others to simulate failures and partitions.
+type MemoryNetwork struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+	isolated map[string]bool
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{handlers: make(map[string]Handler), isolated: make(map[string]bool)}
+}
+
+// Transport of the node id on the network.
+func (m *MemoryNetwork) Transport(id string) Transport {
+	return &memoryTransport{network: m, id: id}
+}
+
+// Isolate cuts every connection from and to the node id.
+func (m *MemoryNetwork) Isolate(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.isolated[id] = true
+}
+
+// Heal restores the connections of a node isolated before.
+func (m *MemoryNetwork) Heal(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.isolated, id)
+}
+
+func (m *MemoryNetwork) route(ctx context.Context, from string, to string) (Handler, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	handler, exists := m.handlers[to]
+	if !exists || m.isolated[from] || m.isolated[to] {
+		return nil, fmt.Errorf("%s from %s: %w", to, from, ErrUnreachable)
+	}
+	return handler, nil
+}
+
+type memoryTransport struct {
+	network *MemoryNetwork
+	id      string
+}
+
+func (t *memoryTransport) Serve(handler Handler) error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	if _, exists := t.network.handlers[t.id]; exists {
+		return fmt.Errorf("node %s is already served", t.id)
+	}
+	t.network.handlers[t.id] = handler
+	return nil
+}
+
+func (t *memoryTransport) RequestVote(ctx context.Context, target string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	handler, err := t.network.route(ctx, t.id, target)
+	if err != nil {
+		return nil, err
+	}
+	return handler.HandleRequestVote(req)
+}
+
+func (t *memoryTransport) AppendEntries(ctx context.Context, target string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	handler, err := t.network.route(ctx, t.id, target)
+	if err != nil {
+		return nil, err
+	}
+	return handler.HandleAppendEntries(req)
+}
+
+func (t *memoryTransport) InstallSnapshot(ctx context.Context, target string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	handler, err := t.network.route(ctx, t.id, target)
+	if err != nil {
+		return nil, err
+	}
+	return handler.HandleInstallSnapshot(req)
+}
+
+func (t *memoryTransport) Close() error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	delete(t.network.handlers, t.id)
+	return nil
+}
@@ -0,0 +1,128 @@
+// kokaq-queue exports and imports the messages of a queue that is not in use.
+//
+//	kokaq-queue export [--format json|binary] [--out file] <namespace directory> <queue id>
+//	kokaq-queue import [--dlq] [--invisible] [--in file] <namespace directory> <queue id>
+//
+// Exports are written to stdout and imports read from stdin unless a file is
+// given. The import format is detected from the data.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/kokaq/core/queue"
+	"github.com/kokaq/core/utils"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = runExport(os.Args[2:])
+	case "import":
+		err = runImport(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s export|import [flags] <namespace directory> <queue id>\n", filepath.Base(os.Args[0]))
+	os.Exit(2)
+}
+
+// Open a queue, enabling the heaps it already has on disk or was asked for.
+func openQueue(namespaceDir string, id string, enableDLQ bool, enableInvisible bool) (*queue.Queue, error) {
+	queueId, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid queue id %q: %w", id, err)
+	}
+	rootDir := filepath.Join(namespaceDir, id)
+	return queue.NewQueue(namespaceDir, queue.QueueConfiguration{
+		QueueName:       id,
+		QueueId:         uint32(queueId),
+		EnableDLQ:       enableDLQ || utils.DirectoryExists(filepath.Join(rootDir, "dlq")),
+		EnableInvisible: enableInvisible || utils.DirectoryExists(filepath.Join(rootDir, "invisible")),
+	})
+}
+
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "json", "export format, json or binary")
+	out := flags.String("out", "", "file to write, stdout if empty")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		usage()
+	}
+	formats := map[string]queue.ExportFormat{"json": queue.ExportJSON, "binary": queue.ExportBinary}
+	exportFormat, exists := formats[*format]
+	if !exists {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if !utils.DirectoryExists(filepath.Join(flags.Arg(0), flags.Arg(1))) {
+		return fmt.Errorf("queue %s not found in %s", flags.Arg(1), flags.Arg(0))
+	}
+	q, err := openQueue(flags.Arg(0), flags.Arg(1), false, false)
+	if err != nil {
+		return fmt.Errorf("failed to open queue: %w", err)
+	}
+	defer q.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", *out, err)
+		}
+		defer file.Close()
+		w = file
+	}
+	if err = q.ExportWithFormat(w, exportFormat); err != nil {
+		return fmt.Errorf("export failed: %w", err)
+	}
+	return nil
+}
+
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	enableDLQ := flags.Bool("dlq", false, "create the dlq heap of a new queue")
+	enableInvisible := flags.Bool("invisible", false, "create the invisible heap of a new queue")
+	in := flags.String("in", "", "file to read, stdin if empty")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		usage()
+	}
+	q, err := openQueue(flags.Arg(0), flags.Arg(1), *enableDLQ, *enableInvisible)
+	if err != nil {
+		return fmt.Errorf("failed to open queue: %w", err)
+	}
+	defer q.Close()
+
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		file, err := os.Open(*in)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", *in, err)
+		}
+		defer file.Close()
+		r = file
+	}
+	imported, err := q.Import(r)
+	fmt.Fprintf(os.Stderr, "%d messages imported\n", imported)
+	if err != nil {
+		return fmt.Errorf("import failed: %w", err)
+	}
+	return nil
+}
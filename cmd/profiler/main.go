@@ -15,12 +15,17 @@ func main() {
 		BlockProfilePath:  "block.prof",
 		GoroutineDumpPath: "goroutines.prof",
 		TracePath:         "trace.out",
+		MetricsPath:       "metrics.prom",
 	})
 	defer stop()
-	ns := queue.NewNamespace("C://code/kokaq/bin", queue.NamespaceConfig{
+	ns, err := queue.NewNamespace("C://code/kokaq/bin", queue.NamespaceConfig{
 		NamespaceName: "data-db",
 		NamespaceId:   1,
 	})
+	if err != nil {
+		fmt.Println("Error creating namespace:", err)
+		return
+	}
 
 	fmt.Println("Namespace created: #", ns.Id, ": ", ns.Name)
 
@@ -31,7 +36,6 @@ func main() {
 		EnableInvisible: true,
 	}
 	var q *queue.Queue
-	var err error
 
 	if q, err = ns.AddQueue(&qConfig); err != nil {
 		fmt.Println("Error adding queue:", err)
@@ -7,10 +7,13 @@ import (
 
 func main() {
 
-	ns := queue.NewNamespace("C://code/kokaq/bin", queue.NamespaceConfig{
+	ns, err := queue.NewNamespace("C://code/kokaq/bin", queue.NamespaceConfig{
 		NamespaceName: "data-db",
 		NamespaceId:   1,
 	})
+	if err != nil {
+		panic(err)
+	}
 	qConfig := queue.QueueConfiguration{
 		QueueName:       "test-queue",
 		QueueId:         1,
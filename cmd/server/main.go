@@ -1,20 +1,35 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net"
+	"net/http"
 
+	"github.com/kokaq/core/internals/metrics"
 	"google.golang.org/grpc"
 	// pb "github.com/kokaq/core/proto"
 )
 
 func main() {
-	lis, err := net.Listen("tcp", ":50051")
+	grpcAddr := flag.String("grpc-addr", ":50051", "address the gRPC server listens on")
+	metricsAddr := flag.String("metrics-addr", ":9090", "address the metrics server listens on")
+	flag.Parse()
+
+	lis, err := net.Listen("tcp", *grpcAddr)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
+	go func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler(metrics.Default))
+		log.Printf("metrics server started on %s", *metricsAddr)
+		if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+			log.Printf("metrics server stopped: %v", err)
+		}
+	}()
 	grpcServer := grpc.NewServer()
 	// pb.RegisterNamespaceServiceServer(grpcServer, NewNamespaceServer())
-	log.Println("gRPC server started on :50051")
+	log.Printf("gRPC server started on %s", *grpcAddr)
 	grpcServer.Serve(lis)
 }
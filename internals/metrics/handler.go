@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"log"
+	"net/http"
+	"os"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler serves the registry in the text exposition format, ready to be
+// mounted on /metrics.
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		if err := r.Write(w); err != nil {
+			log.Printf("failed to write metrics: %v", err)
+		}
+	})
+}
+
+// WriteFile dumps the current state of the registry to path.
+func WriteFile(r *Registry, path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		log.Printf("failed to create metrics file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if err := r.Write(f); err != nil {
+		log.Printf("failed to write metrics file: %v", err)
+	}
+}
@@ -1,11 +1,14 @@
 package profiler
 
+import "github.com/kokaq/core/internals/metrics"
+
 type Config struct {
 	CPUProfilePath    string
 	MemProfilePath    string
 	BlockProfilePath  string
 	TracePath         string
 	GoroutineDumpPath string
+	MetricsPath       string
 }
 
 func Start(cfg Config) func() {
@@ -37,5 +40,9 @@ func Start(cfg Config) func() {
 		if cfg.GoroutineDumpPath != "" {
 			writeGoroutines(cfg.GoroutineDumpPath)
 		}
+
+		if cfg.MetricsPath != "" {
+			metrics.WriteFile(metrics.Default, cfg.MetricsPath)
+		}
 	}
 }
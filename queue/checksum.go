@@ -0,0 +1,142 @@
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/utils/murmur"
+)
+
+// Every page ends with the murmur3 sum of its nodes, and every index record
+// is a message id followed by the murmur3 sum of the id. A page that is
+// entirely zero, checksum included, has never been written and is valid.
+const checksumSize = 4
+
+// ErrCorrupted reports data that failed its checksum.
+type ErrCorrupted struct {
+	File   string
+	Offset int64
+	Reason string
+}
+
+func (e *ErrCorrupted) Error() string {
+	return fmt.Sprintf("corrupted data in %s at offset %d: %s", e.File, e.Offset, e.Reason)
+}
+
+func sealPage(data []byte) {
+	body := len(data) - checksumSize
+	binary.LittleEndian.PutUint32(data[body:], murmur.Sum32(data[:body]))
+}
+
+func verifyPage(data []byte, path string, offset int64) error {
+	body := len(data) - checksumSize
+	stored := binary.LittleEndian.Uint32(data[body:])
+	if stored == murmur.Sum32(data[:body]) {
+		return nil
+	}
+	if stored == 0 && isZero(data[:body]) {
+		return nil
+	}
+	return &ErrCorrupted{File: path, Offset: offset, Reason: "page checksum mismatch"}
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeIndexRecord(messageId uuid.UUID) []byte {
+	record := make([]byte, len(messageId)+checksumSize)
+	copy(record, messageId[:])
+	binary.LittleEndian.PutUint32(record[len(messageId):], murmur.Sum32(messageId[:]))
+	return record
+}
+
+// Decode the index record of recordSize bytes at the start of data, read
+// from offset in path.
+func decodeIndexRecord(data []byte, recordSize int, path string, offset int64) (uuid.UUID, error) {
+	if len(data) < recordSize {
+		return uuid.Nil, &ErrCorrupted{File: path, Offset: offset, Reason: "truncated index record"}
+	}
+	id := data[:recordSize-checksumSize]
+	if binary.LittleEndian.Uint32(data[recordSize-checksumSize:recordSize]) != murmur.Sum32(id) {
+		return uuid.Nil, &ErrCorrupted{File: path, Offset: offset, Reason: "index record checksum mismatch"}
+	}
+	messageId, err := uuid.FromBytes(id)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to convert bytes to UUID: %w", err)
+	}
+	return messageId, nil
+}
+
+// A heap records the version of its on-disk format in its format file.
+// Version 1, before pages and index records were checksummed, had no such
+// file: a heap without one is opened only if it passes the checksums of the
+// current version, which it is then marked with.
+const (
+	heapFormatName    = "format"
+	heapFormatVersion = 2
+)
+
+// ErrUnsupportedFormat is returned when opening a heap written in another
+// format. There is no upgrade path from version 1: its pages and index
+// records have other sizes, and the releases that wrote it cannot export
+// them, so such heaps have to be recreated.
+var ErrUnsupportedFormat = errors.New("unsupported heap format")
+
+// Format version of the heap in dir, zero if it has no format file.
+func readHeapFormat(dir string) (int, error) {
+	path := filepath.Join(dir, heapFormatName)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read heap format %s: %w", path, err)
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, &ErrCorrupted{File: path, Reason: "invalid heap format"}
+	}
+	return version, nil
+}
+
+func writeHeapFormat(dir string, sync bool) error {
+	path := filepath.Join(dir, heapFormatName)
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create heap format %s: %w", path, err)
+	}
+	defer file.Close()
+	if _, err = fmt.Fprintln(file, heapFormatVersion); err != nil {
+		return fmt.Errorf("failed to write heap format %s: %w", path, err)
+	}
+	if sync {
+		if err = file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync heap format %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// Check the format of the heap in dir, returning whether it has a format file.
+func checkHeapFormat(dir string) (bool, error) {
+	version, err := readHeapFormat(dir)
+	if err != nil {
+		return false, err
+	}
+	if version != 0 && version != heapFormatVersion {
+		return false, fmt.Errorf("heap %s has format %d, expected %d: %w", dir, version, heapFormatVersion, ErrUnsupportedFormat)
+	}
+	return version != 0, nil
+}
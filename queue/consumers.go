@@ -0,0 +1,382 @@
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/kokaq/core/utils/murmur"
+)
+
+const consumersLogName = "consumers.log"
+
+// Consumer groups each see every message of the main heap, while the
+// consumers of a group compete for its messages. A group tracks, for every
+// priority, the offset in the index file of the next message it has not
+// consumed. Messages stay in the main heap until every group consumed them,
+// so the shared index files serve all groups; once the highest-priority
+// message has been consumed by every group, it is dequeued.
+//
+// Dequeue and PeekLock take messages from the main heap directly, and groups
+// that had not consumed them skip them.
+//
+// The groups and their offsets are persisted as a log of their changes,
+// compacted when the queue opens, so consuming a message appends a record.
+type consumerGroups struct {
+	path    string
+	file    *os.File                     // nil until a record is appended
+	sync    bool                         // fsync every append
+	durable bool                         // fsync compactions
+	Offsets map[string]map[uint64]uint64 // by group, then priority
+}
+
+type consumerOp uint8
+
+const (
+	consumerCreate consumerOp = iota + 1 // a group was created
+	consumerDelete                       // a group was deleted
+	consumerOffset                       // a group consumed up to offset in a priority
+	consumerForget                       // the offsets of every group in a priority were forgotten
+)
+
+// Records of the consumers log are
+//
+//	length u32 | op u8 | priority u64 | offset u64 | group name | murmur3 u32
+//
+// where length counts the bytes after itself.
+const consumerRecordHeaderSize = 1 + 8 + 8
+
+type consumerRecord struct {
+	op       consumerOp
+	group    string
+	priority uint64
+	offset   uint64
+}
+
+func (r *consumerRecord) encode() []byte {
+	length := consumerRecordHeaderSize + len(r.group) + checksumSize
+	data := make([]byte, 4+length)
+	binary.LittleEndian.PutUint32(data, uint32(length))
+	data[4] = byte(r.op)
+	binary.LittleEndian.PutUint64(data[5:], r.priority)
+	binary.LittleEndian.PutUint64(data[13:], r.offset)
+	copy(data[21:], r.group)
+	body := len(data) - checksumSize
+	binary.LittleEndian.PutUint32(data[body:], murmur.Sum32(data[4:body]))
+	return data
+}
+
+// Decode the record at the start of data, returning its size. A record
+// torn by a crash returns a size of zero.
+func decodeConsumerRecord(data []byte, path string, offset int64) (*consumerRecord, int, error) {
+	if len(data) < 4 {
+		return nil, 0, nil
+	}
+	length := int(binary.LittleEndian.Uint32(data))
+	if length < consumerRecordHeaderSize+checksumSize {
+		return nil, 0, &ErrCorrupted{File: path, Offset: offset, Reason: "invalid consumer record length"}
+	}
+	if len(data) < 4+length {
+		return nil, 0, nil
+	}
+	record := data[4 : 4+length]
+	body := length - checksumSize
+	if binary.LittleEndian.Uint32(record[body:]) != murmur.Sum32(record[:body]) {
+		return nil, 0, &ErrCorrupted{File: path, Offset: offset, Reason: "consumer record checksum mismatch"}
+	}
+	r := &consumerRecord{op: consumerOp(record[0])}
+	r.priority = binary.LittleEndian.Uint64(record[1:])
+	r.offset = binary.LittleEndian.Uint64(record[9:])
+	r.group = string(record[17:body])
+	return r, 4 + length, nil
+}
+
+func loadConsumerGroups(path string, durability DurabilityMode) (*consumerGroups, error) {
+	c := &consumerGroups{
+		path:    path,
+		sync:    durability == DurabilitySync,
+		durable: durability != DurabilityNone,
+		Offsets: make(map[string]map[uint64]uint64),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read consumers log %s: %w", path, err)
+	}
+	for offset := 0; offset < len(data); {
+		record, size, err := decodeConsumerRecord(data[offset:], path, int64(offset))
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			// An append torn by a crash was never acknowledged
+			break
+		}
+		c.replay(record)
+		offset += size
+	}
+	if err = c.compact(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *consumerGroups) replay(r *consumerRecord) {
+	switch r.op {
+	case consumerCreate:
+		c.Offsets[r.group] = make(map[uint64]uint64)
+	case consumerDelete:
+		delete(c.Offsets, r.group)
+	case consumerOffset:
+		if offsets, exists := c.Offsets[r.group]; exists {
+			offsets[r.priority] = r.offset
+		}
+	case consumerForget:
+		for _, offsets := range c.Offsets {
+			delete(offsets, r.priority)
+		}
+	}
+}
+
+// Rewrite the log with only the records describing the current state.
+func (c *consumerGroups) compact() error {
+	var data []byte
+	for _, group := range slices.Sorted(maps.Keys(c.Offsets)) {
+		data = append(data, (&consumerRecord{op: consumerCreate, group: group}).encode()...)
+		offsets := c.Offsets[group]
+		for _, priority := range slices.Sorted(maps.Keys(offsets)) {
+			data = append(data, (&consumerRecord{op: consumerOffset, group: group, priority: priority, offset: offsets[priority]}).encode()...)
+		}
+	}
+	if err := replaceFile(c.path, data, c.durable); err != nil {
+		return fmt.Errorf("failed to compact consumers log: %w", err)
+	}
+	return nil
+}
+
+func (c *consumerGroups) append(r *consumerRecord) error {
+	if c.file == nil {
+		file, err := os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open consumers log %s: %w", c.path, err)
+		}
+		c.file = file
+	}
+	if _, err := c.file.Write(r.encode()); err != nil {
+		return fmt.Errorf("failed to append to consumers log %s: %w", c.path, err)
+	}
+	if c.sync {
+		if err := c.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync consumers log %s: %w", c.path, err)
+		}
+	}
+	c.replay(r)
+	return nil
+}
+
+func (c *consumerGroups) flush() error {
+	if c.file == nil {
+		return nil
+	}
+	if err := c.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync consumers log %s: %w", c.path, err)
+	}
+	return nil
+}
+
+func (c *consumerGroups) close() error {
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to close consumers log %s: %w", c.path, err)
+	}
+	return nil
+}
+
+// Offset of the next message of priority the group has to consume.
+func (c *consumerGroups) offset(group string, state *priorityState, priority uint64) uint64 {
+	return max(c.Offsets[group][priority], state.head)
+}
+
+// Forget the offsets of priorities whose index files were removed, as
+// their records start over from zero if they are enqueued again.
+func (c *consumerGroups) forget(priorities func(priority uint64) bool) error {
+	forgotten := make(map[uint64]bool)
+	for _, offsets := range c.Offsets {
+		for priority := range offsets {
+			if priorities(priority) {
+				forgotten[priority] = true
+			}
+		}
+	}
+	for _, priority := range slices.Sorted(maps.Keys(forgotten)) {
+		if err := c.append(&consumerRecord{op: consumerForget, priority: priority}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read the message at a record offset of the index file of a priority.
+func (h *Heap) readRecord(priority uint64, offset uint64) (*QueueItem, error) {
+	if h.closed {
+		return nil, ErrHeapClosed
+	}
+	path := h.getIndexFilePath(priority)
+	position := int64(offset) * int64(h.config.indexRecordSize)
+	data, err := h.files.ReadAt(path, position, h.config.indexRecordSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index file of priority %d: %w", priority, err)
+	}
+	messageId, err := decodeIndexRecord(data, h.config.indexRecordSize, path, position)
+	if err != nil {
+		return nil, err
+	}
+	return &QueueItem{MessageId: messageId, Priority: priority}, nil
+}
+
+// Create a consumer group, which starts with every message in the queue.
+func (q *Queue) CreateConsumerGroup(name string) error {
+	if name == "" {
+		return errors.New("consumer group name cannot be empty")
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, exists := q.consumers.Offsets[name]; exists {
+		return fmt.Errorf("consumer group %s already exists", name)
+	}
+	return q.consumers.append(&consumerRecord{op: consumerCreate, group: name})
+}
+
+// Delete a consumer group, dequeuing the messages only it had yet to consume.
+func (q *Queue) DeleteConsumerGroup(name string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, exists := q.consumers.Offsets[name]; !exists {
+		return fmt.Errorf("consumer group %s not found", name)
+	}
+	if err := q.consumers.append(&consumerRecord{op: consumerDelete, group: name}); err != nil {
+		return err
+	}
+	return q.trimConsumed()
+}
+
+// Names of the consumer groups of the queue, sorted.
+func (q *Queue) ConsumerGroups() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return slices.Sorted(maps.Keys(q.consumers.Offsets))
+}
+
+// Consume the highest-priority message the group has not consumed yet.
+// Each message is returned to a single consumer of the group.
+func (q *Queue) Consume(group string) (*QueueItem, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, exists := q.consumers.Offsets[group]; !exists {
+		return nil, fmt.Errorf("consumer group %s not found", group)
+	}
+	if q.mainHeap == nil {
+		return nil, fmt.Errorf("main heap is not initialized for queue %s", q.Name)
+	}
+	if err := q.promoteDue(); err != nil {
+		return nil, err
+	}
+	var next uint64
+	var found bool
+	for priority, state := range q.mainHeap.priorities {
+		if q.consumers.offset(group, state, priority) < state.head+state.messages && (!found || outranks(priority, next)) {
+			next, found = priority, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no message left for consumer group %s", group)
+	}
+	offset := q.consumers.offset(group, q.mainHeap.priorities[next], next)
+	item, err := q.mainHeap.readRecord(next, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume for group %s: %w", group, err)
+	}
+	if err = q.consumers.append(&consumerRecord{op: consumerOffset, group: group, priority: next, offset: offset + 1}); err != nil {
+		return nil, err
+	}
+	item.GroupKey = q.groups.groupOf(item.MessageId)
+	if err = q.trimConsumed(); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// Messages of the main heap the group has yet to consume.
+func (q *Queue) ConsumerGroupLag(group string) (uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, exists := q.consumers.Offsets[group]; !exists {
+		return 0, fmt.Errorf("consumer group %s not found", group)
+	}
+	return q.consumerGroupLag(group), nil
+}
+
+// Callers hold q.mu.
+func (q *Queue) consumerGroupLag(group string) uint64 {
+	var lag uint64
+	if q.mainHeap == nil {
+		return lag
+	}
+	for priority, state := range q.mainHeap.priorities {
+		lag += state.head + state.messages - min(q.consumers.offset(group, state, priority), state.head+state.messages)
+	}
+	return lag
+}
+
+// Dequeue the highest-priority messages every group has consumed.
+// Callers hold q.mu.
+func (q *Queue) trimConsumed() error {
+	if len(q.consumers.Offsets) == 0 || q.mainHeap == nil {
+		return nil
+	}
+	for q.mainHeap.totalNodes > 0 {
+		root, err := q.mainHeap.readNode(1)
+		if err != nil {
+			return fmt.Errorf("failed to read root node: %w", err)
+		}
+		state := q.mainHeap.priorities[root.priority]
+		if state == nil {
+			return nil
+		}
+		for group := range q.consumers.Offsets {
+			if q.consumers.offset(group, state, root.priority) <= state.head {
+				return nil
+			}
+		}
+		item, err := q.take()
+		if err != nil {
+			return fmt.Errorf("failed to dequeue consumed message: %w", err)
+		}
+		if err = q.release(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Forget the offsets of the priorities the main heap no longer holds.
+// Callers hold q.mu.
+func (q *Queue) forgetDrainedOffsets() error {
+	if len(q.consumers.Offsets) == 0 || q.mainHeap == nil {
+		return nil
+	}
+	drained := func(priority uint64) bool {
+		_, exists := q.mainHeap.priorities[priority]
+		return !exists
+	}
+	return q.consumers.forget(drained)
+}
@@ -0,0 +1,225 @@
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/kokaq/core/utils"
+	"github.com/kokaq/core/utils/murmur"
+)
+
+// ErrDuplicateMessage is returned by enqueues ignored because their message
+// id or dedup key was already enqueued within the dedup window, if the queue
+// rejects duplicates.
+var ErrDuplicateMessage = errors.New("message is a duplicate within the dedup window")
+
+const (
+	dedupDirectoryName = "dedup"
+	dedupBuckets       = 10 // buckets a window is split into
+	fingerprintSize    = 16
+)
+
+type fingerprint [fingerprintSize]byte
+
+func newFingerprint(key []byte) fingerprint {
+	var f fingerprint
+	h1, h2 := murmur.Sum128(key)
+	binary.LittleEndian.PutUint64(f[:], h1)
+	binary.LittleEndian.PutUint64(f[8:], h2)
+	return f
+}
+
+// dedupSet remembers the fingerprints of the keys enqueued within a window.
+// Time is split in buckets of a tenth of the window, each stored in
+// <queue>/dedup/<bucket start in unix ns> as appended fingerprints. A key
+// is remembered from its enqueue until its bucket has entirely left the
+// window, when the bucket file is removed.
+type dedupSet struct {
+	dir     string
+	window  time.Duration
+	width   time.Duration
+	sync    bool // fsync every append
+	seen    map[fingerprint]int64
+	buckets map[int64][]fingerprint
+	paths   map[int64][]string // files of every bucket
+	current int64
+	file    *os.File // file of the current bucket, nil until a key is added
+}
+
+func openDedupSet(dir string, window time.Duration, syncAppends bool, now time.Time) (*dedupSet, error) {
+	if err := utils.EnsureDirectoryCreated(dir); err != nil {
+		return nil, err
+	}
+	d := &dedupSet{
+		dir:     dir,
+		window:  window,
+		width:   max(window/dedupBuckets, time.Millisecond),
+		sync:    syncAppends,
+		seen:    make(map[fingerprint]int64),
+		buckets: make(map[int64][]fingerprint),
+		paths:   make(map[int64][]string),
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dedup directory %s: %w", dir, err)
+	}
+	for _, entry := range entries {
+		start, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dedup bucket %s: %w", path, err)
+		}
+		if torn := len(data) % fingerprintSize; torn != 0 {
+			// An append torn by a crash, later appends must stay aligned
+			data = data[:len(data)-torn]
+			if err = os.Truncate(path, int64(len(data))); err != nil {
+				return nil, fmt.Errorf("failed to truncate dedup bucket %s: %w", path, err)
+			}
+		}
+		// The window may have changed since the bucket was written
+		bucket := start / int64(d.width)
+		d.paths[bucket] = append(d.paths[bucket], path)
+		for offset := 0; offset < len(data); offset += fingerprintSize {
+			d.remember(fingerprint(data[offset:offset+fingerprintSize]), bucket)
+		}
+	}
+	if err = d.prune(now); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *dedupSet) bucket(t time.Time) int64 {
+	return t.UnixNano() / int64(d.width)
+}
+
+func (d *dedupSet) bucketPath(bucket int64) string {
+	return filepath.Join(d.dir, fmt.Sprint(bucket*int64(d.width)))
+}
+
+func (d *dedupSet) remember(key fingerprint, bucket int64) {
+	if previous, exists := d.seen[key]; !exists || previous < bucket {
+		d.seen[key] = bucket
+	}
+	d.buckets[bucket] = append(d.buckets[bucket], key)
+}
+
+// Whether key was added within the window before now.
+func (d *dedupSet) contains(key fingerprint, now time.Time) bool {
+	bucket, exists := d.seen[key]
+	return exists && bucket >= d.bucket(now.Add(-d.window))
+}
+
+func (d *dedupSet) add(key fingerprint, now time.Time) error {
+	if err := d.prune(now); err != nil {
+		return err
+	}
+	bucket := d.bucket(now)
+	if d.file == nil || bucket != d.current {
+		if d.file != nil {
+			d.file.Close()
+		}
+		path := d.bucketPath(bucket)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			d.file = nil
+			return fmt.Errorf("failed to open dedup bucket: %w", err)
+		}
+		d.file, d.current = file, bucket
+		if !slices.Contains(d.paths[bucket], path) {
+			d.paths[bucket] = append(d.paths[bucket], path)
+		}
+	}
+	if _, err := d.file.Write(key[:]); err != nil {
+		return fmt.Errorf("failed to write dedup bucket %s: %w", d.file.Name(), err)
+	}
+	if d.sync {
+		if err := d.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync dedup bucket %s: %w", d.file.Name(), err)
+		}
+	}
+	d.remember(key, bucket)
+	return nil
+}
+
+// Take back the key just added, whose message could not be enqueued.
+func (d *dedupSet) discard(key fingerprint) error {
+	keys := d.buckets[d.current]
+	if d.file == nil || len(keys) == 0 || keys[len(keys)-1] != key {
+		return fmt.Errorf("dedup key was not the last one added")
+	}
+	info, err := d.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat dedup bucket %s: %w", d.file.Name(), err)
+	}
+	if err = d.file.Truncate(info.Size() - fingerprintSize); err != nil {
+		return fmt.Errorf("failed to truncate dedup bucket %s: %w", d.file.Name(), err)
+	}
+	d.buckets[d.current] = keys[:len(keys)-1]
+	delete(d.seen, key)
+	for bucket, keys := range d.buckets {
+		if previous, exists := d.seen[key]; (!exists || previous < bucket) && slices.Contains(keys, key) {
+			d.seen[key] = bucket
+		}
+	}
+	return nil
+}
+
+// Forget the buckets that left the window and remove their files.
+func (d *dedupSet) prune(now time.Time) error {
+	oldest := d.bucket(now.Add(-d.window))
+	for bucket, paths := range d.paths {
+		if bucket >= oldest {
+			continue
+		}
+		if d.file != nil && bucket == d.current {
+			d.file.Close()
+			d.file = nil
+		}
+		for _, path := range paths {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to remove dedup bucket %s: %w", path, err)
+			}
+		}
+		for _, key := range d.buckets[bucket] {
+			if d.seen[key] == bucket {
+				delete(d.seen, key)
+			}
+		}
+		delete(d.buckets, bucket)
+		delete(d.paths, bucket)
+	}
+	return nil
+}
+
+func (d *dedupSet) flush() error {
+	if d.file == nil {
+		return nil
+	}
+	if err := d.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync dedup bucket %s: %w", d.file.Name(), err)
+	}
+	return nil
+}
+
+func (d *dedupSet) close() error {
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to close dedup bucket: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package queue
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type DurabilityMode uint8
+
+const (
+	// Nothing is fsynced, and heap pages are written back only when evicted
+	// from the page cache or flushed. A crash can leave the pages and index
+	// files inconsistent; check and repair them with kokaq-fsck.
+	DurabilityNone DurabilityMode = iota
+	// Every enqueue, dequeue and clear writes back its pages and fsyncs the
+	// pages, index and times files, and the directories whose entries
+	// changed, before returning. An operation that returned is durable.
+	DurabilitySync
+	// Operations are committed as in DurabilitySync once GroupCommitOps
+	// operations are pending or GroupCommitInterval has elapsed since the
+	// last commit, and on Flush and Close. At most that many operations, or
+	// that much time, of acknowledged writes can be lost.
+	DurabilityGroupCommit
+)
+
+type Durability struct {
+	Mode                DurabilityMode
+	GroupCommitInterval time.Duration // 0 commits on operation count only
+	GroupCommitOps      int           // 0 commits on interval only
+}
+
+func (d Durability) validate() error {
+	if d.Mode > DurabilityGroupCommit {
+		return fmt.Errorf("unknown durability mode %d", d.Mode)
+	}
+	if d.Mode == DurabilityGroupCommit && d.GroupCommitInterval <= 0 && d.GroupCommitOps <= 0 {
+		return fmt.Errorf("group commit needs an interval or an operation count")
+	}
+	return nil
+}
+
+// Commit a completed operation according to the durability mode.
+func (h *Heap) commit() error {
+	switch h.durability.Mode {
+	case DurabilitySync:
+		return h.Flush()
+	case DurabilityGroupCommit:
+		h.pendingOps++
+		if h.durability.GroupCommitOps > 0 && h.pendingOps >= h.durability.GroupCommitOps {
+			return h.Flush()
+		}
+		if h.durability.GroupCommitInterval > 0 && time.Since(h.lastCommit) >= h.durability.GroupCommitInterval {
+			return h.Flush()
+		}
+	}
+	return nil
+}
+
+// Commit operations left pending by group commit, for the interval timer.
+func (h *Heap) commitPending() error {
+	if h.closed || h.pendingOps == 0 {
+		return nil
+	}
+	return h.Flush()
+}
+
+// Replace the file at path with data through a temporary file, so a crash
+// leaves either the old or the new contents. With sync, the data and the
+// rename are durable before returning.
+func replaceFile(path string, data []byte, sync bool) error {
+	temporary := path + ".tmp"
+	file, err := os.Create(temporary)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", temporary, err)
+	}
+	if _, err = file.Write(data); err == nil && sync {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temporary)
+		return fmt.Errorf("failed to write %s: %w", temporary, err)
+	}
+	if err = os.Rename(temporary, path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	if !sync {
+		return nil
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("failed to open directory of %s: %w", path, err)
+	}
+	defer dir.Close()
+	if err = dir.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory of %s: %w", path, err)
+	}
+	return nil
+}
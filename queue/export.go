@@ -0,0 +1,381 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/google/uuid"
+)
+
+// Queue contents are exported as one record per message: visible messages
+// first in dequeue order, then locked ones, delayed ones in due order,
+// messages waiting behind the active message of their group, and dead
+// letters. Importing the records in that order restores the message groups.
+//
+// The JSON format has one object per line, starting with a header line:
+//
+//	{"format":"kokaq-export","version":2,"queue_id":1,"queue_name":"orders"}
+//	{"message_id":"6f1c...","priority":7,"state":"visible","group_key":"order-1"}
+//	{"message_id":"0b9e...","priority":3,"state":"dlq","attempts":5}
+//
+// The binary format starts with the magic bytes "KKQX" and a version byte,
+// followed by records of: state byte, uvarint priority, 16 byte message id,
+// uvarint attempts, uvarint length prefixed group key, uvarint payload
+// length and payload, uvarint header count and, per header, uvarint length
+// prefixed key and value. Version 1 exports, without group keys, are still
+// imported.
+//
+// Attempts count the deliveries of messages locked, delayed or visible
+// again after a nack, and are restored on import; dead letters carry none.
+// Payloads and headers are part of the formats for exports from queues that
+// store them. Queues do not store them yet, so importing records carrying
+// them fails rather than dropping them.
+type ExportFormat uint8
+
+const (
+	ExportJSON ExportFormat = iota
+	ExportBinary
+)
+
+const (
+	exportVersion    = 2
+	exportFormatName = "kokaq-export"
+	exportMagic      = "KKQX"
+)
+
+type MessageState string
+
+const (
+	MessageVisible MessageState = "visible"
+	MessageLocked  MessageState = "locked"
+	MessageDLQ     MessageState = "dlq"
+	MessageDelayed MessageState = "delayed" // nacked, waiting for its retry
+	MessageWaiting MessageState = "waiting" // waiting behind the active message of its group
+)
+
+var messageStateCodes = []MessageState{MessageVisible, MessageLocked, MessageDLQ, MessageDelayed, MessageWaiting}
+
+type ExportRecord struct {
+	MessageId uuid.UUID         `json:"message_id"`
+	Priority  uint64            `json:"priority"`
+	State     MessageState      `json:"state"`
+	GroupKey  string            `json:"group_key,omitempty"`
+	Attempts  uint64            `json:"attempts,omitempty"`
+	Payload   []byte            `json:"payload,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+}
+
+type exportHeader struct {
+	Format    string `json:"format"`
+	Version   int    `json:"version"`
+	QueueId   uint32 `json:"queue_id"`
+	QueueName string `json:"queue_name"`
+}
+
+// Export writes every message of the queue as line-delimited JSON.
+func (q *Queue) Export(w io.Writer) error {
+	return q.ExportWithFormat(w, ExportJSON)
+}
+
+// ExportWithFormat writes every message of the queue in the given format.
+// The queue is locked for the duration of the export.
+func (q *Queue) ExportWithFormat(w io.Writer, format ExportFormat) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := bufio.NewWriter(w)
+	var write func(*ExportRecord) error
+	switch format {
+	case ExportJSON:
+		encoder := json.NewEncoder(out)
+		if err := encoder.Encode(exportHeader{Format: exportFormatName, Version: exportVersion, QueueId: q.Id, QueueName: q.Name}); err != nil {
+			return fmt.Errorf("failed to write export header: %w", err)
+		}
+		write = func(record *ExportRecord) error { return encoder.Encode(record) }
+	case ExportBinary:
+		if _, err := out.WriteString(exportMagic); err != nil {
+			return fmt.Errorf("failed to write export header: %w", err)
+		}
+		if err := out.WriteByte(exportVersion); err != nil {
+			return fmt.Errorf("failed to write export header: %w", err)
+		}
+		write = func(record *ExportRecord) error { return writeBinaryRecord(out, record) }
+	default:
+		return fmt.Errorf("unknown export format %d", format)
+	}
+	export := func(item *QueueItem, state MessageState, attempts uint32) error {
+		if err := write(&ExportRecord{MessageId: item.MessageId, Priority: item.Priority, State: state, GroupKey: item.GroupKey, Attempts: uint64(attempts)}); err != nil {
+			return fmt.Errorf("failed to write message %s: %w", item.MessageId, err)
+		}
+		return nil
+	}
+
+	if err := q.exportHeap(q.mainHeap, MessageVisible, export); err != nil {
+		return err
+	}
+	for _, lockId := range q.groups.sortedLocks() {
+		lock := q.groups.locks[lockId]
+		if err := export(&lock.item, MessageLocked, lock.attempts); err != nil {
+			return err
+		}
+	}
+	if err := q.exportHeap(q.invisibileHeap, MessageLocked, export); err != nil {
+		return err
+	}
+	for _, delayed := range q.groups.delayedByDue() {
+		if err := export(&delayed.item, MessageDelayed, delayed.attempts); err != nil {
+			return err
+		}
+	}
+	for _, item := range q.groups.waiting() {
+		if err := export(item, MessageWaiting, 0); err != nil {
+			return err
+		}
+	}
+	if err := q.exportHeap(q.dlqHeap, MessageDLQ, export); err != nil {
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+	return nil
+}
+
+// Callers hold q.mu.
+func (q *Queue) exportHeap(heap *Heap, state MessageState, export func(*QueueItem, MessageState, uint32) error) error {
+	if heap == nil {
+		return nil
+	}
+	options := ListOptions{PageSize: 1000}
+	for {
+		items, token, err := heap.List(options)
+		if err != nil {
+			return fmt.Errorf("failed to list %s messages: %w", state, err)
+		}
+		for _, item := range items {
+			var attempts uint32
+			if heap == q.mainHeap {
+				item.GroupKey = q.groups.groupOf(item.MessageId)
+				if redelivered, exists := q.groups.redelivered[item.MessageId]; exists {
+					attempts = redelivered.attempts
+				}
+			}
+			if err = export(item, state, attempts); err != nil {
+				return err
+			}
+		}
+		if token == "" {
+			return nil
+		}
+		options.ContinuationToken = token
+	}
+}
+
+// Import enqueues every message of an export, in either format, into the
+// heap matching its state. Messages imported before an error are kept.
+func (q *Queue) Import(r io.Reader) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	in := bufio.NewReader(r)
+	magic, err := in.Peek(len(exportMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, fmt.Errorf("failed to read export header: %w", err)
+	}
+	var read func() (*ExportRecord, error)
+	if bytes.Equal(magic, []byte(exportMagic)) {
+		in.Discard(len(exportMagic))
+		version, err := in.ReadByte()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read export header: %w", err)
+		}
+		if version == 0 || version > exportVersion {
+			return 0, fmt.Errorf("unsupported export version %d", version)
+		}
+		read = func() (*ExportRecord, error) { return readBinaryRecord(in, version) }
+	} else {
+		decoder := json.NewDecoder(in)
+		header := exportHeader{}
+		if err := decoder.Decode(&header); err != nil {
+			return 0, fmt.Errorf("failed to read export header: %w", err)
+		}
+		if header.Format != exportFormatName || header.Version < 1 || header.Version > exportVersion {
+			return 0, fmt.Errorf("unsupported export %q version %d", header.Format, header.Version)
+		}
+		read = func() (*ExportRecord, error) {
+			record := &ExportRecord{}
+			if err := decoder.Decode(record); err != nil {
+				return nil, err
+			}
+			return record, nil
+		}
+	}
+
+	imported := 0
+	for {
+		record, err := read()
+		if errors.Is(err, io.EOF) {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, fmt.Errorf("failed to read record %d: %w", imported+1, err)
+		}
+		if err = q.importRecord(record); err != nil {
+			return imported, fmt.Errorf("failed to import message %s: %w", record.MessageId, err)
+		}
+		imported++
+	}
+}
+
+// Import a record as a message in its state. Visible and waiting messages
+// are enqueued, so a waiting one waits again behind the active message of
+// its group. Locked and delayed messages become the active message of their
+// group; nobody holds the lock of an imported message, which expires after
+// the visibility timeout or, without one, is returned to the queue when it
+// reopens like every lock, and a delayed one is due right away. Callers hold q.mu.
+func (q *Queue) importRecord(record *ExportRecord) error {
+	if len(record.Payload) > 0 || len(record.Headers) > 0 {
+		return fmt.Errorf("queue %s does not store payloads or headers", q.Name)
+	}
+	item := &QueueItem{MessageId: record.MessageId, Priority: record.Priority, GroupKey: record.GroupKey}
+	attempts := uint32(min(record.Attempts, math.MaxUint32))
+	switch record.State {
+	case MessageVisible, MessageWaiting:
+		if err := q.enqueue(item); err != nil || attempts == 0 {
+			return err
+		}
+		return q.record(&groupRecord{op: groupDue, item: *item, attempts: attempts})
+	case MessageLocked, MessageDelayed:
+		return q.importHeld(item, record.State, attempts)
+	case MessageDLQ:
+		if q.dlqHeap == nil {
+			return fmt.Errorf("queue %s has no heap for %s messages", q.Name, record.State)
+		}
+		_, err := q.mutate(&logEntry{op: logEnqueue, targets: ClearTargetDLQ, messageId: record.MessageId, priority: record.Priority})
+		return err
+	}
+	return fmt.Errorf("unknown message state %q", record.State)
+}
+
+// Import a locked or delayed message into the groups table. Callers hold q.mu.
+func (q *Queue) importHeld(item *QueueItem, state MessageState, attempts uint32) (err error) {
+	if err = q.admit(item); err != nil {
+		return err
+	}
+	defer q.unreserveOnError(&err)
+	if item.GroupKey != "" {
+		if q.groups.busy(item) {
+			return fmt.Errorf("group %s already has an active message", item.GroupKey)
+		}
+		if err = q.record(&groupRecord{op: groupActivate, item: *item}); err != nil {
+			return err
+		}
+	}
+	if state == MessageLocked {
+		return q.record(&groupRecord{op: groupLock, item: *item, lockId: uuid.New(), attempts: max(attempts, 1), due: q.lockDue()})
+	}
+	return q.record(&groupRecord{op: groupDelay, item: *item, attempts: attempts, due: q.clock.Now().UnixNano()})
+}
+
+func writeBinaryRecord(w *bufio.Writer, record *ExportRecord) error {
+	state := -1
+	for code, s := range messageStateCodes {
+		if s == record.State {
+			state = code
+		}
+	}
+	if state < 0 {
+		return fmt.Errorf("unknown message state %q", record.State)
+	}
+	buffer := make([]byte, 0, 64)
+	buffer = append(buffer, byte(state))
+	buffer = binary.AppendUvarint(buffer, record.Priority)
+	buffer = append(buffer, record.MessageId[:]...)
+	buffer = binary.AppendUvarint(buffer, record.Attempts)
+	buffer = binary.AppendUvarint(buffer, uint64(len(record.GroupKey)))
+	buffer = append(buffer, record.GroupKey...)
+	buffer = binary.AppendUvarint(buffer, uint64(len(record.Payload)))
+	buffer = append(buffer, record.Payload...)
+	buffer = binary.AppendUvarint(buffer, uint64(len(record.Headers)))
+	for key, value := range record.Headers {
+		buffer = binary.AppendUvarint(buffer, uint64(len(key)))
+		buffer = append(buffer, key...)
+		buffer = binary.AppendUvarint(buffer, uint64(len(value)))
+		buffer = append(buffer, value...)
+	}
+	_, err := w.Write(buffer)
+	return err
+}
+
+func readBinaryRecord(r *bufio.Reader, version byte) (*ExportRecord, error) {
+	state, err := r.ReadByte()
+	if err != nil {
+		return nil, err // io.EOF between records ends the export
+	}
+	if int(state) >= len(messageStateCodes) {
+		return nil, fmt.Errorf("unknown message state %d", state)
+	}
+	record := &ExportRecord{State: messageStateCodes[state]}
+	fail := func(err error) (*ExportRecord, error) {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if record.Priority, err = binary.ReadUvarint(r); err != nil {
+		return fail(err)
+	}
+	if _, err = io.ReadFull(r, record.MessageId[:]); err != nil {
+		return fail(err)
+	}
+	if record.Attempts, err = binary.ReadUvarint(r); err != nil {
+		return fail(err)
+	}
+	readBytes := func() ([]byte, error) {
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if length > 1<<30 {
+			return nil, fmt.Errorf("field of %d bytes is too large", length)
+		}
+		data := make([]byte, length)
+		_, err = io.ReadFull(r, data)
+		return data, err
+	}
+	if version >= 2 {
+		groupKey, err := readBytes()
+		if err != nil {
+			return fail(err)
+		}
+		record.GroupKey = string(groupKey)
+	}
+	if payload, err := readBytes(); err != nil {
+		return fail(err)
+	} else if len(payload) > 0 {
+		record.Payload = payload
+	}
+	headers, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fail(err)
+	}
+	for range headers {
+		key, err := readBytes()
+		if err != nil {
+			return fail(err)
+		}
+		value, err := readBytes()
+		if err != nil {
+			return fail(err)
+		}
+		if record.Headers == nil {
+			record.Headers = make(map[string]string)
+		}
+		record.Headers[string(key)] = string(value)
+	}
+	return record, nil
+}
@@ -0,0 +1,342 @@
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/kokaq/core/utils"
+)
+
+type FsckIssueKind string
+
+const (
+	FsckCorrupted       FsckIssueKind = "corrupted"        // page or index record failing its checksum
+	FsckTruncated       FsckIssueKind = "truncated"        // file ending in the middle of a page or record
+	FsckHeapProperty    FsckIssueKind = "heap-property"    // node ordered before a lower priority parent
+	FsckNodeCount       FsckIssueKind = "node-count"       // nodes not stored contiguously from the root
+	FsckDuplicateNode   FsckIssueKind = "duplicate-node"   // priority with more than one node
+	FsckStaleLocalRoot  FsckIssueKind = "stale-local-root" // page root differing from its parent node
+	FsckMissingIndex    FsckIssueKind = "missing-index"    // node without its index file
+	FsckExhaustedIndex  FsckIssueKind = "exhausted-index"  // node pointing past the end of its index file
+	FsckOrphanedIndex   FsckIssueKind = "orphaned-index"   // index file without a node
+	FsckOrphanedTimes   FsckIssueKind = "orphaned-times"   // times file without an index file
+	FsckUnexpectedFile  FsckIssueKind = "unexpected-file"  // file whose name is not a priority
+	FsckUnreadableHeads FsckIssueKind = "unreadable-heads" // heads lost with a corrupted page
+)
+
+type FsckIssue struct {
+	Heap   string
+	Kind   FsckIssueKind
+	Path   string
+	Offset int64
+	Detail string
+}
+
+func (i FsckIssue) String() string {
+	return fmt.Sprintf("%s: %s at %s:%d: %s", i.Heap, i.Kind, i.Path, i.Offset, i.Detail)
+}
+
+type FsckReport struct {
+	Heaps      int
+	Issues     []FsckIssue
+	Repairs    []string
+	Unrepaired []FsckIssue // issues found again after repairing, such as corrupted index records
+}
+
+func (r *FsckReport) Healthy() bool {
+	return len(r.Issues) == 0
+}
+
+// FsckNamespace checks every queue heap under a namespace directory, which
+// must not be open. With repair, the pages of each damaged heap are rebuilt
+// from its index files.
+func FsckNamespace(dir string, repair bool) (*FsckReport, error) {
+	queues, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read namespace directory %s: %w", dir, err)
+	}
+	report := &FsckReport{}
+	for _, queue := range queues {
+		if !queue.IsDir() {
+			continue
+		}
+		for _, name := range queueHeapNames {
+			heapDir := filepath.Join(dir, queue.Name(), name)
+			if !utils.DirectoryExists(heapDir) {
+				continue
+			}
+			if err = FsckHeap(heapDir, queueHeapMaxSize, queuePrioritySize, queueIndexSize, queueMessageIdSize, repair, report); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// FsckHeap checks a single heap directory, which must not be open, adding
+// what it finds to the report. With repair, a damaged heap is checked again
+// once repaired and the issues left are reported as unrepaired. Heaps
+// without a format file, possibly written before checksums, are not repaired.
+func FsckHeap(dir string, heapMaxSize int, prioritySize int, indexSize int, messageIdSize int, repair bool, report *FsckReport) error {
+	if heapMaxSize < 2 {
+		return fmt.Errorf("heap max size must be at least 2, got %d", heapMaxSize)
+	}
+	marked, err := checkHeapFormat(dir)
+	if err != nil {
+		return err
+	}
+	c := &fsckHeap{
+		heap:   &Heap{config: newHeapConfig(dir, heapMaxSize, prioritySize, indexSize, messageIdSize)},
+		dir:    dir,
+		report: report,
+		heads:  make(map[uint64]uint64),
+	}
+	report.Heaps++
+	issues := len(report.Issues)
+	if err := c.checkPages(); err != nil {
+		return err
+	}
+	if err := c.checkFiles(); err != nil {
+		return err
+	}
+	if !repair || len(report.Issues) == issues {
+		return nil
+	}
+	if !marked {
+		// Rebuilding pages from index files of another format would lose them
+		return fmt.Errorf("heap %s has no format file, not repairing it: %w", dir, ErrUnsupportedFormat)
+	}
+	if err := c.repair(); err != nil {
+		return err
+	}
+	recheck := &FsckReport{}
+	if err := FsckHeap(dir, heapMaxSize, prioritySize, indexSize, messageIdSize, false, recheck); err != nil {
+		return err
+	}
+	report.Unrepaired = append(report.Unrepaired, recheck.Issues...)
+	return nil
+}
+
+type fsckHeap struct {
+	heap   *Heap // only its geometry is used
+	dir    string
+	report *FsckReport
+
+	pages       []byte
+	nodes       int
+	heads       map[uint64]uint64 // head record of every priority with a readable node
+	lostHeads   bool              // a corrupted page may have held heads
+	indexes     map[uint64]int64  // index file sizes by priority
+	unreadable  map[int]bool      // corrupted pages
+	staleTimes  []string
+	staleFiles  []string
+	tornIndexes map[uint64]int64 // priority to size of whole records
+}
+
+func (c *fsckHeap) issue(kind FsckIssueKind, path string, offset int64, format string, args ...any) {
+	c.report.Issues = append(c.report.Issues, FsckIssue{Heap: c.dir, Kind: kind, Path: path, Offset: offset, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (c *fsckHeap) nodeOffset(index int) (int, int) {
+	pageNumber, localIndex, _ := c.heap.getLocalHeapDetailsForNode(index)
+	return pageNumber, (pageNumber-1)*c.heap.config.pageSize + (localIndex-1)*c.heap.config.nodeSize
+}
+
+func (c *fsckHeap) node(index int) (heapNode, bool) {
+	pageNumber, start := c.nodeOffset(index)
+	if c.unreadable[pageNumber] || start+c.heap.config.nodeSize > len(c.pages) {
+		return heapNode{}, false
+	}
+	page := &Page{data: c.pages[start : start+c.heap.config.nodeSize]}
+	return c.heap.getNode(page, 1), true
+}
+
+func (c *fsckHeap) checkPages() error {
+	config := c.heap.config
+	c.unreadable = make(map[int]bool)
+	data, err := os.ReadFile(config.PagesPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read pages file %s: %w", config.PagesPath, err)
+	}
+	if rest := len(data) % config.pageSize; rest != 0 {
+		c.issue(FsckTruncated, config.PagesPath, int64(len(data)-rest), "partial page of %d bytes", rest)
+		data = append(data, make([]byte, config.pageSize-rest)...)
+	}
+	c.pages = data
+	totalPages := len(data) / config.pageSize
+	for p := 1; p <= totalPages; p++ {
+		offset := int64(p-1) * int64(config.pageSize)
+		if err := verifyPage(data[offset:offset+int64(config.pageSize)], config.PagesPath, offset); err != nil {
+			c.issue(FsckCorrupted, config.PagesPath, offset, "page %d checksum mismatch", p)
+			c.unreadable[p] = true
+			c.lostHeads = true
+			continue
+		}
+		for i := 1; i <= config.subheapNodes; i++ {
+			if i == 1 && p != 1 {
+				continue
+			}
+			start := int(offset) + (i-1)*config.nodeSize
+			if binary.LittleEndian.Uint64(data[start:start+config.prioritySize]) != 0 {
+				c.nodes++
+			}
+		}
+	}
+
+	localRoot := func(pageNumber int) (heapNode, bool) {
+		start := (pageNumber - 1) * config.pageSize
+		if c.unreadable[pageNumber] || start+config.nodeSize > len(c.pages) {
+			return heapNode{}, false
+		}
+		return c.heap.getNode(&Page{data: c.pages[start:]}, 1), true
+	}
+	violations, heads := verifyNodes(c.heap, c.nodes, c.node, localRoot)
+	for _, violation := range violations {
+		_, offset := c.nodeOffset(violation.Node)
+		if violation.Kind == ViolationStaleLocalRoot {
+			offset = (violation.Page - 1) * config.pageSize
+		}
+		c.issue(fsckKinds[violation.Kind], config.PagesPath, int64(offset), "%s", violation.Detail)
+	}
+	for priority, head := range heads {
+		c.heads[priority] = head.index
+	}
+	return nil
+}
+
+var fsckKinds = map[ViolationKind]FsckIssueKind{
+	ViolationEmptyNode:         FsckNodeCount,
+	ViolationDuplicatePriority: FsckDuplicateNode,
+	ViolationHeapProperty:      FsckHeapProperty,
+	ViolationStaleLocalRoot:    FsckStaleLocalRoot,
+}
+
+func (c *fsckHeap) checkFiles() error {
+	config := c.heap.config
+	c.indexes = make(map[uint64]int64)
+	c.tornIndexes = make(map[uint64]int64)
+	entries, err := os.ReadDir(config.IndexPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read index directory %s: %w", config.IndexPath, err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(config.IndexPath, entry.Name())
+		priority, err := strconv.ParseUint(entry.Name(), 10, 64)
+		if err != nil || priority == 0 {
+			c.issue(FsckUnexpectedFile, path, 0, "not an index file")
+			c.staleFiles = append(c.staleFiles, path)
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read index file %s: %w", path, err)
+		}
+		whole := len(data) - len(data)%config.indexRecordSize
+		if whole != len(data) {
+			c.issue(FsckTruncated, path, int64(whole), "partial record of %d bytes", len(data)-whole)
+			c.tornIndexes[priority] = int64(whole)
+		}
+		for offset := 0; offset < whole; offset += config.indexRecordSize {
+			if _, err := decodeIndexRecord(data[offset:], config.indexRecordSize, path, int64(offset)); err != nil {
+				c.issue(FsckCorrupted, path, int64(offset), "index record checksum mismatch")
+			}
+		}
+		c.indexes[priority] = int64(whole)
+		head, exists := c.heads[priority]
+		if !exists {
+			c.issue(FsckOrphanedIndex, path, 0, "no node for priority %d", priority)
+		} else if int64(head)*int64(config.indexRecordSize) >= int64(whole) {
+			c.issue(FsckExhaustedIndex, path, int64(head)*int64(config.indexRecordSize), "head record %d is past the %d records", head, whole/config.indexRecordSize)
+		}
+	}
+	priorities := make([]uint64, 0, len(c.heads))
+	for priority := range c.heads {
+		priorities = append(priorities, priority)
+	}
+	sort.Slice(priorities, func(i, j int) bool { return priorities[i] < priorities[j] })
+	for _, priority := range priorities {
+		if _, exists := c.indexes[priority]; !exists {
+			c.issue(FsckMissingIndex, filepath.Join(config.IndexPath, fmt.Sprint(priority)), 0, "node for priority %d has no index file", priority)
+		}
+	}
+
+	times, err := os.ReadDir(config.TimesPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read times directory %s: %w", config.TimesPath, err)
+	}
+	for _, entry := range times {
+		path := filepath.Join(config.TimesPath, entry.Name())
+		priority, err := strconv.ParseUint(entry.Name(), 10, 64)
+		if _, exists := c.indexes[priority]; err != nil || !exists {
+			c.issue(FsckOrphanedTimes, path, 0, "no index file for these timestamps")
+			c.staleTimes = append(c.staleTimes, path)
+		}
+	}
+	if c.lostHeads {
+		c.issue(FsckUnreadableHeads, config.PagesPath, 0, "priorities without a readable node will be replayed from their first record on repair")
+	}
+	return nil
+}
+
+// Rebuild the pages from the index files, keeping the head of every
+// priority whose node could be read.
+func (c *fsckHeap) repair() error {
+	config := c.heap.config
+	repaired := func(format string, args ...any) {
+		c.report.Repairs = append(c.report.Repairs, c.dir+": "+fmt.Sprintf(format, args...))
+	}
+	for _, path := range append(c.staleFiles, c.staleTimes...) {
+		if err := utils.EnsureFileDeleted(path); err != nil {
+			return err
+		}
+		repaired("removed %s", path)
+	}
+	for priority, size := range c.tornIndexes {
+		path := filepath.Join(config.IndexPath, fmt.Sprint(priority))
+		if err := utils.TruncateFile(path, size); err != nil {
+			return err
+		}
+		repaired("dropped the partial record of %s", path)
+	}
+
+	nodes := make([]heapNode, 0, len(c.indexes))
+	for priority, size := range c.indexes {
+		head := c.heads[priority]
+		if int64(head)*int64(config.indexRecordSize) >= size {
+			// Every message was dequeued, only the files were left behind
+			for _, path := range []string{filepath.Join(config.IndexPath, fmt.Sprint(priority)), filepath.Join(config.TimesPath, fmt.Sprint(priority))} {
+				if err := utils.EnsureFileDeleted(path); err != nil {
+					return err
+				}
+			}
+			repaired("removed the exhausted files of priority %d", priority)
+			continue
+		}
+		nodes = append(nodes, heapNode{priority: priority, index: head})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return outranks(nodes[i].priority, nodes[j].priority) })
+
+	if err := utils.EnsureFileDeleted(config.PagesPath); err != nil {
+		return err
+	}
+	h, err := NewHeap(c.dir, config.heapMaxSize, config.prioritySize, config.indexSize, config.messageIdSize)
+	if err != nil {
+		return fmt.Errorf("failed to recreate heap %s: %w", c.dir, err)
+	}
+	for _, node := range nodes {
+		if err = h.insertNode(node.priority, node.index); err != nil {
+			h.Close()
+			return fmt.Errorf("failed to insert priority %d: %w", node.priority, err)
+		}
+	}
+	if err = h.Close(); err != nil {
+		return fmt.Errorf("failed to write rebuilt heap %s: %w", c.dir, err)
+	}
+	repaired("rebuilt the pages from %d index files", len(nodes))
+	return nil
+}
@@ -0,0 +1,550 @@
+package queue
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"slices"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/utils/murmur"
+)
+
+// ErrLockNotFound is returned for lock ids that are not, or no longer, held.
+var ErrLockNotFound = errors.New("lock not found")
+
+const groupsLogName = "groups.log"
+
+// MaxGroupKeyLength is the longest group key, in bytes, a message can have.
+const MaxGroupKeyLength = math.MaxUint16
+
+type groupOp uint8
+
+const (
+	groupWait     groupOp = iota + 1 // a message waits behind its group's active message
+	groupActivate                    // a message becomes the active one of its group
+	groupRelease                     // the active message of a group was processed
+	groupLock                        // a message was locked
+	groupUnlock                      // a lock was acked or cleared
+	groupDrop                        // a waiting message was cleared
+	groupReturn                      // a locked message went back to the main heap
+	groupDelay                       // a locked message was nacked until its due time
+	groupDue                         // a delayed message went back to the main heap
+	groupForget                      // a redelivered or delayed message was processed or cleared
+	groupExtend                      // the expiry of a lock moved
+)
+
+// Records of the groups log are
+//
+//	length u32 | op u8 | priority u64 | message id [16] | lock id [16] | attempts u32 | due i64 | group key | murmur3 u32
+//
+// where length counts the bytes after itself, attempts the deliveries of
+// the message and due, in unix nanoseconds, when a delayed message is due
+// or a lock expires, zero for a lock that does not.
+const groupRecordHeaderSize = 1 + 8 + 16 + 16 + 4 + 8
+
+type groupRecord struct {
+	op       groupOp
+	item     QueueItem
+	lockId   uuid.UUID
+	attempts uint32
+	due      int64
+}
+
+func (r *groupRecord) encode() []byte {
+	length := groupRecordHeaderSize + len(r.item.GroupKey) + checksumSize
+	data := make([]byte, 4+length)
+	binary.LittleEndian.PutUint32(data, uint32(length))
+	data[4] = byte(r.op)
+	binary.LittleEndian.PutUint64(data[5:], r.item.Priority)
+	copy(data[13:29], r.item.MessageId[:])
+	copy(data[29:45], r.lockId[:])
+	binary.LittleEndian.PutUint32(data[45:], r.attempts)
+	binary.LittleEndian.PutUint64(data[49:], uint64(r.due))
+	copy(data[57:], r.item.GroupKey)
+	body := len(data) - checksumSize
+	binary.LittleEndian.PutUint32(data[body:], murmur.Sum32(data[4:body]))
+	return data
+}
+
+// Decode the record at the start of data, returning its size. A record
+// torn by a crash returns a size of zero.
+func decodeGroupRecord(data []byte, path string, offset int64) (*groupRecord, int, error) {
+	if len(data) < 4 {
+		return nil, 0, nil
+	}
+	length := int(binary.LittleEndian.Uint32(data))
+	if length < groupRecordHeaderSize+checksumSize {
+		return nil, 0, &ErrCorrupted{File: path, Offset: offset, Reason: "invalid group record length"}
+	}
+	if len(data) < 4+length {
+		return nil, 0, nil
+	}
+	record := data[4 : 4+length]
+	body := length - checksumSize
+	if binary.LittleEndian.Uint32(record[body:]) != murmur.Sum32(record[:body]) {
+		return nil, 0, &ErrCorrupted{File: path, Offset: offset, Reason: "group record checksum mismatch"}
+	}
+	r := &groupRecord{op: groupOp(record[0])}
+	r.item.Priority = binary.LittleEndian.Uint64(record[1:])
+	copy(r.item.MessageId[:], record[9:25])
+	copy(r.lockId[:], record[25:41])
+	r.attempts = binary.LittleEndian.Uint32(record[41:])
+	r.due = int64(binary.LittleEndian.Uint64(record[45:]))
+	r.item.GroupKey = string(record[53:body])
+	return r, 4 + length, nil
+}
+
+// A message out of the main heap, or back in it after being delivered.
+type trackedMessage struct {
+	item     QueueItem
+	attempts uint32 // deliveries so far
+	due      int64  // when a delayed message is due or a lock expires, in unix nanoseconds
+}
+
+type messageGroup struct {
+	active  *QueueItem   // in the main heap or locked, nil when the group is idle
+	backlog []*QueueItem // waiting for active to be processed, in enqueue order
+}
+
+// groupTable holds the locked messages of a queue and the state of its
+// message groups. Only the active message of a group is in the main heap
+// or locked; the next one is enqueued once the active one is acked or
+// dequeued, so a group is processed in order, one message at a time, while
+// groups compete by priority. Nacked messages are held out of the main heap
+// until their retry is due, locks expire after the visibility timeout of the
+// queue, and delivery attempts are counted for messages nacked or locked again. The table is persisted as a log of its changes,
+// compacted when the queue opens.
+type groupTable struct {
+	path        string
+	file        *os.File // nil until a record is appended
+	sync        bool     // fsync every append
+	durable     bool     // fsync compactions
+	groups      map[string]*messageGroup
+	active      map[uuid.UUID]string // group of every active message
+	locks       map[uuid.UUID]*trackedMessage
+	delayed     map[uuid.UUID]*trackedMessage // by message id
+	redelivered map[uuid.UUID]*trackedMessage // back in the main heap, by message id
+	onChange    func()                        // called after every appended record
+}
+
+func openGroupTable(path string, durability DurabilityMode) (*groupTable, error) {
+	t := &groupTable{
+		path:        path,
+		sync:        durability == DurabilitySync,
+		durable:     durability != DurabilityNone,
+		groups:      make(map[string]*messageGroup),
+		active:      make(map[uuid.UUID]string),
+		locks:       make(map[uuid.UUID]*trackedMessage),
+		delayed:     make(map[uuid.UUID]*trackedMessage),
+		redelivered: make(map[uuid.UUID]*trackedMessage),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read groups log %s: %w", path, err)
+	}
+	for offset := 0; offset < len(data); {
+		record, size, err := decodeGroupRecord(data[offset:], path, int64(offset))
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			// An append torn by a crash was never acknowledged
+			break
+		}
+		t.replay(record)
+		offset += size
+	}
+	if err = t.compact(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *groupTable) replay(r *groupRecord) {
+	item := r.item
+	switch r.op {
+	case groupWait:
+		group := t.group(item.GroupKey)
+		group.backlog = append(group.backlog, &item)
+	case groupActivate:
+		group := t.group(item.GroupKey)
+		if len(group.backlog) > 0 && group.backlog[0].MessageId == item.MessageId {
+			group.backlog = group.backlog[1:]
+		}
+		if group.active != nil {
+			delete(t.active, group.active.MessageId)
+		}
+		group.active = &item
+		t.active[item.MessageId] = item.GroupKey
+	case groupRelease:
+		group := t.group(item.GroupKey)
+		if group.active != nil {
+			delete(t.active, group.active.MessageId)
+			group.active = nil
+		}
+		if len(group.backlog) == 0 {
+			delete(t.groups, item.GroupKey)
+		}
+	case groupDrop:
+		group := t.group(item.GroupKey)
+		group.backlog = slices.DeleteFunc(group.backlog, func(waiting *QueueItem) bool { return waiting.MessageId == item.MessageId })
+	case groupLock:
+		t.locks[r.lockId] = &trackedMessage{item: item, attempts: r.attempts, due: r.due}
+		delete(t.redelivered, item.MessageId)
+	case groupExtend:
+		if lock, exists := t.locks[r.lockId]; exists {
+			lock.due = r.due
+		}
+	case groupUnlock:
+		delete(t.locks, r.lockId)
+	case groupReturn:
+		delete(t.locks, r.lockId)
+		t.redelivered[item.MessageId] = &trackedMessage{item: item, attempts: r.attempts}
+	case groupDelay:
+		delete(t.locks, r.lockId)
+		t.delayed[item.MessageId] = &trackedMessage{item: item, attempts: r.attempts, due: r.due}
+	case groupDue:
+		delete(t.delayed, item.MessageId)
+		t.redelivered[item.MessageId] = &trackedMessage{item: item, attempts: r.attempts}
+	case groupForget:
+		delete(t.delayed, item.MessageId)
+		delete(t.redelivered, item.MessageId)
+	}
+}
+
+func (t *groupTable) group(key string) *messageGroup {
+	group, exists := t.groups[key]
+	if !exists {
+		group = &messageGroup{}
+		t.groups[key] = group
+	}
+	return group
+}
+
+// Rewrite the log with only the records describing the current state.
+func (t *groupTable) compact() error {
+	keys := make([]string, 0, len(t.groups))
+	for key := range t.groups {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	var data []byte
+	for _, key := range keys {
+		group := t.groups[key]
+		if group.active != nil {
+			data = append(data, (&groupRecord{op: groupActivate, item: *group.active}).encode()...)
+		}
+		for _, item := range group.backlog {
+			data = append(data, (&groupRecord{op: groupWait, item: *item}).encode()...)
+		}
+	}
+	for _, lockId := range sortedIds(t.locks) {
+		lock := t.locks[lockId]
+		data = append(data, (&groupRecord{op: groupLock, item: lock.item, lockId: lockId, attempts: lock.attempts, due: lock.due}).encode()...)
+	}
+	for _, messageId := range sortedIds(t.delayed) {
+		delayed := t.delayed[messageId]
+		data = append(data, (&groupRecord{op: groupDelay, item: delayed.item, attempts: delayed.attempts, due: delayed.due}).encode()...)
+	}
+	for _, messageId := range sortedIds(t.redelivered) {
+		redelivered := t.redelivered[messageId]
+		data = append(data, (&groupRecord{op: groupDue, item: redelivered.item, attempts: redelivered.attempts}).encode()...)
+	}
+	if err := replaceFile(t.path, data, t.durable); err != nil {
+		return fmt.Errorf("failed to compact groups log: %w", err)
+	}
+	return nil
+}
+
+func sortedIds(messages map[uuid.UUID]*trackedMessage) []uuid.UUID {
+	ids := make([]uuid.UUID, 0, len(messages))
+	for id := range messages {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, func(a, b uuid.UUID) int { return bytes.Compare(a[:], b[:]) })
+	return ids
+}
+
+// Lock ids in the order their messages were dequeued in, then by id.
+func (t *groupTable) sortedLocks() []uuid.UUID {
+	ids := sortedIds(t.locks)
+	slices.SortStableFunc(ids, func(a, b uuid.UUID) int {
+		return comparePriorities(t.locks[a].item.Priority, t.locks[b].item.Priority)
+	})
+	return ids
+}
+
+// Delayed messages in due order.
+func (t *groupTable) delayedByDue() []*trackedMessage {
+	delayed := make([]*trackedMessage, 0, len(t.delayed))
+	for _, messageId := range sortedIds(t.delayed) {
+		delayed = append(delayed, t.delayed[messageId])
+	}
+	slices.SortStableFunc(delayed, func(a, b *trackedMessage) int { return cmp.Compare(a.due, b.due) })
+	return delayed
+}
+
+// Messages waiting behind the active message of their group, by group key
+// then in enqueue order.
+func (t *groupTable) waiting() []*QueueItem {
+	keys := slices.Sorted(maps.Keys(t.groups))
+	var waiting []*QueueItem
+	for _, key := range keys {
+		waiting = append(waiting, t.groups[key].backlog...)
+	}
+	return waiting
+}
+
+func (t *groupTable) append(r *groupRecord) error {
+	if len(r.item.GroupKey) > MaxGroupKeyLength {
+		return fmt.Errorf("group key of message %s is longer than %d bytes", r.item.MessageId, MaxGroupKeyLength)
+	}
+	if t.file == nil {
+		file, err := os.OpenFile(t.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open groups log %s: %w", t.path, err)
+		}
+		t.file = file
+	}
+	if _, err := t.file.Write(r.encode()); err != nil {
+		return fmt.Errorf("failed to append to groups log %s: %w", t.path, err)
+	}
+	if t.sync {
+		if err := t.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync groups log %s: %w", t.path, err)
+		}
+	}
+	t.replay(r)
+	if t.onChange != nil {
+		t.onChange()
+	}
+	return nil
+}
+
+// Whether the group of item has an active message item must wait behind.
+func (t *groupTable) busy(item *QueueItem) bool {
+	group, exists := t.groups[item.GroupKey]
+	return exists && group.active != nil
+}
+
+// Group key of a message taken from the main heap, empty if it has none.
+func (t *groupTable) groupOf(messageId uuid.UUID) string {
+	return t.active[messageId]
+}
+
+func (t *groupTable) flush() error {
+	if t.file == nil {
+		return nil
+	}
+	if err := t.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync groups log %s: %w", t.path, err)
+	}
+	return nil
+}
+
+func (t *groupTable) close() error {
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to close groups log %s: %w", t.path, err)
+	}
+	return nil
+}
+
+// Log a change of the groups table for followers, then change it. Callers
+// hold q.mu.
+func (q *Queue) record(r *groupRecord) error {
+	if q.replica == ReplicaFollower {
+		return ErrReadOnlyReplica
+	}
+	if q.log == nil {
+		return q.groups.append(r)
+	}
+	if err := q.log.append(&logEntry{op: logGroup, priority: r.item.Priority, messageId: r.item.MessageId, group: r}); err != nil {
+		return fmt.Errorf("failed to log mutation: %w", err)
+	}
+	if err := q.groups.append(r); err != nil {
+		return q.rollbackLog(err)
+	}
+	q.commitLog()
+	return nil
+}
+
+// Enqueue a message in the main heap, or in the backlog of its group when
+// the group already has an active message. Callers hold q.mu.
+func (q *Queue) enqueue(item *QueueItem) (err error) {
+	if len(item.GroupKey) > MaxGroupKeyLength {
+		return fmt.Errorf("group key of message %s is longer than %d bytes", item.MessageId, MaxGroupKeyLength)
+	}
+	if err = q.admit(item); err != nil {
+		return err
+	}
+	defer q.unreserveOnError(&err)
+	if item.GroupKey != "" && q.groups.busy(item) {
+		return q.record(&groupRecord{op: groupWait, item: *item})
+	}
+	if _, err := q.mutate(&logEntry{op: logEnqueue, targets: ClearTargetMain, messageId: item.MessageId, priority: item.Priority}); err != nil {
+		return err
+	}
+	if item.GroupKey == "" {
+		return nil
+	}
+	return q.record(&groupRecord{op: groupActivate, item: *item})
+}
+
+// Take the highest-priority message from the main heap, with its group key.
+// Callers hold q.mu.
+func (q *Queue) take() (*QueueItem, error) {
+	item, err := q.mutate(&logEntry{op: logDequeue, targets: ClearTargetMain})
+	if err != nil {
+		return nil, err
+	}
+	item.GroupKey = q.groups.groupOf(item.MessageId)
+	if err = q.forgetDrainedOffsets(); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// Mark the active message of a group processed and enqueue the next message
+// of the group. Callers hold q.mu.
+func (q *Queue) release(item *QueueItem) error {
+	if _, exists := q.groups.redelivered[item.MessageId]; exists {
+		if err := q.record(&groupRecord{op: groupForget, item: *item}); err != nil {
+			return err
+		}
+	}
+	if item.GroupKey == "" {
+		return nil
+	}
+	group, exists := q.groups.groups[item.GroupKey]
+	if !exists || group.active == nil || group.active.MessageId != item.MessageId {
+		return nil
+	}
+	if len(group.backlog) == 0 {
+		return q.record(&groupRecord{op: groupRelease, item: *item})
+	}
+	next := group.backlog[0]
+	if _, err := q.mutate(&logEntry{op: logEnqueue, targets: ClearTargetMain, messageId: next.MessageId, priority: next.Priority}); err != nil {
+		return fmt.Errorf("failed to enqueue next message of group %s: %w", item.GroupKey, err)
+	}
+	return q.record(&groupRecord{op: groupActivate, item: *next})
+}
+
+// Return a locked message to the main heap, at the head of its group.
+// Callers hold q.mu.
+func (q *Queue) unlock(lockId uuid.UUID) error {
+	lock := q.groups.locks[lockId]
+	if _, err := q.mutate(&logEntry{op: logEnqueue, targets: ClearTargetMain, messageId: lock.item.MessageId, priority: lock.item.Priority}); err != nil {
+		return fmt.Errorf("failed to return locked message %s: %w", lock.item.MessageId, err)
+	}
+	return q.record(&groupRecord{op: groupReturn, item: lock.item, lockId: lockId, attempts: lock.attempts})
+}
+
+// Locks do not survive the queue, their messages are visible again once it
+// reopens. Callers hold q.mu.
+func (q *Queue) restoreLocks() error {
+	if q.replica == ReplicaFollower {
+		return nil
+	}
+	for _, lockId := range sortedIds(q.groups.locks) {
+		if err := q.unlock(lockId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the messages of expired locks to the main heap. Callers hold q.mu.
+func (q *Queue) expireLocks() error {
+	if len(q.groups.locks) == 0 || q.replica == ReplicaFollower {
+		return nil
+	}
+	now := q.clock.Now().UnixNano()
+	for _, lockId := range q.groups.sortedLocks() {
+		if lock := q.groups.locks[lockId]; lock.due != 0 && lock.due <= now {
+			if err := q.unlock(lockId); err != nil {
+				return fmt.Errorf("failed to expire lock %s: %w", lockId, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Drop the waiting, delayed and locked messages in the cleared heaps and
+// priorities, moving on to the next message of groups whose active message
+// was cleared. Delayed messages belong to the main heap. Callers hold q.mu.
+func (q *Queue) clearGroups(targets ClearTarget, priorities PriorityRange) error {
+	var cleared []*QueueItem
+	held := make(map[uuid.UUID]bool) // active messages kept out of the main heap
+	for _, lockId := range sortedIds(q.groups.locks) {
+		item := q.groups.locks[lockId].item
+		if targets&ClearTargetInvisible == 0 || !priorities.Contains(item.Priority) {
+			held[item.MessageId] = true
+			continue
+		}
+		if err := q.record(&groupRecord{op: groupUnlock, item: item, lockId: lockId}); err != nil {
+			return err
+		}
+		cleared = append(cleared, &item)
+	}
+	for _, messageId := range sortedIds(q.groups.delayed) {
+		item := q.groups.delayed[messageId].item
+		if targets&ClearTargetMain == 0 || !priorities.Contains(item.Priority) {
+			held[item.MessageId] = true
+			continue
+		}
+		if err := q.record(&groupRecord{op: groupForget, item: item}); err != nil {
+			return err
+		}
+		cleared = append(cleared, &item)
+	}
+	if targets&ClearTargetMain != 0 {
+		for _, messageId := range sortedIds(q.groups.redelivered) {
+			item := q.groups.redelivered[messageId].item
+			if !priorities.Contains(item.Priority) {
+				continue
+			}
+			if err := q.record(&groupRecord{op: groupForget, item: item}); err != nil {
+				return err
+			}
+		}
+		keys := make([]string, 0, len(q.groups.groups))
+		for key := range q.groups.groups {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			group := q.groups.groups[key]
+			for _, item := range slices.Clone(group.backlog) {
+				if !priorities.Contains(item.Priority) {
+					continue
+				}
+				if err := q.record(&groupRecord{op: groupDrop, item: *item}); err != nil {
+					return err
+				}
+			}
+			if active := group.active; active != nil && !held[active.MessageId] && priorities.Contains(active.Priority) {
+				cleared = append(cleared, active)
+			}
+		}
+	}
+	for _, item := range cleared {
+		if err := q.release(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,17 +2,28 @@ package queue
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/bits"
+	"math/rand/v2"
 	"path/filepath"
+	"sort"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/kokaq/core/utils"
 )
 
+// ErrHeapClosed is returned by operations on a heap after Close.
+var ErrHeapClosed = errors.New("heap is closed")
+
+// ErrHeapEmpty is returned when taking or peeking a message of an empty heap.
+var ErrHeapEmpty = errors.New("heap is empty")
+
 type HeapConfig struct {
 	PagesPath    string
 	IndexPath    string
+	TimesPath    string
 	heapMaxSize  int
 	prioritySize int
 	indexSize    int
@@ -22,96 +33,209 @@ type HeapConfig struct {
 	subheapLastLayerNodes int
 	subheapNodes          int
 	messageIdSize         int
+	pageSize              int // subheapSize and the page checksum
+	indexRecordSize       int // messageIdSize and the record checksum
 }
 
 type Heap struct {
 	totalNodes  int
 	totalPages  int
 	config      HeapConfig
-	currentPage *Page
+	pages       *pageCache
+	store       pageStore
+	files       *utils.FileManager
+	closed      bool
+	metrics     *heapMetrics
+	priorities  map[uint64]*priorityState
+	generations uint64
+	instanceId  uint64
+	durability  Durability
+	pendingOps  int
+	lastCommit  time.Time
+	clock       Clock
 }
 
 func NewHeap(parentDirectory string, heapMaxSize int, prioritySize int, indexSize int, messageIdSize int) (*Heap, error) {
+	return NewHeapWithOptions(parentDirectory, heapMaxSize, prioritySize, indexSize, messageIdSize, HeapOptions{})
+}
+
+func NewHeapWithOptions(parentDirectory string, heapMaxSize int, prioritySize int, indexSize int, messageIdSize int, options HeapOptions) (*Heap, error) {
 	var err error
-	var subheapNodes = (1 << heapMaxSize) - 1
-	indexpath := filepath.Join(parentDirectory, "indexes") // directory
-	pagesPath := filepath.Join(parentDirectory, "pages")   // file
+	if heapMaxSize < 2 {
+		return nil, fmt.Errorf("heap max size must be at least 2, got %d", heapMaxSize)
+	}
+	if messageIdSize != len(uuid.UUID{}) {
+		return nil, fmt.Errorf("message id size must be %d, got %d", len(uuid.UUID{}), messageIdSize)
+	}
+	if err = options.Durability.validate(); err != nil {
+		return nil, fmt.Errorf("invalid durability: %w", err)
+	}
+	marked, err := checkHeapFormat(parentDirectory)
+	if err != nil {
+		return nil, err
+	}
+	h := &Heap{
+		totalNodes: 0,
+		totalPages: 0,
+		files: utils.NewFileManagerWithOptions(utils.FileManagerOptions{
+			MaxOpenFiles: options.MaxOpenFiles,
+			FileSystem:   options.FileSystem,
+			TrackSync:    options.Durability.Mode != DurabilityNone,
+		}),
+		durability: options.Durability,
+		lastCommit: time.Now(),
+		metrics:    newHeapMetrics(parentDirectory),
+		priorities: make(map[uint64]*priorityState),
+		instanceId: rand.Uint64(),
+		clock:      options.Clock,
+		config:     newHeapConfig(parentDirectory, heapMaxSize, prioritySize, indexSize, messageIdSize),
+	}
+	if h.clock == nil {
+		h.clock = systemClock{}
+	}
+	indexpath, timesPath, pagesPath := h.config.IndexPath, h.config.TimesPath, h.config.PagesPath
 	if err = utils.EnsureDirectoryCreated(indexpath); err != nil {
+		h.discard()
 		return nil, fmt.Errorf("failed to create index directory %s: %w", indexpath, err)
 	}
-	if !utils.FileExists(pagesPath) {
+	if err = utils.EnsureDirectoryCreated(timesPath); err != nil {
+		h.discard()
+		return nil, fmt.Errorf("failed to create times directory %s: %w", timesPath, err)
+	}
+	existing := utils.FileExists(pagesPath)
+	if !existing {
 		if err = utils.EnsureFileCreated(pagesPath); err != nil {
+			h.discard()
 			return nil, fmt.Errorf("failed to create file %s: %w", pagesPath, err)
 		}
-		return &Heap{
-			totalNodes:  0,
-			totalPages:  0,
-			currentPage: NewPage(),
-			config: HeapConfig{
-				PagesPath:             pagesPath,
-				IndexPath:             indexpath,
-				messageIdSize:         messageIdSize,
-				heapMaxSize:           heapMaxSize,
-				prioritySize:          prioritySize,
-				indexSize:             indexSize,
-				nodeSize:              prioritySize + indexSize,
-				subheapSize:           (prioritySize + indexSize) * subheapNodes,
-				subheapLastLayerNodes: (1 << (heapMaxSize - 1)),
-				subheapNodes:          subheapNodes,
-			},
-		}, nil
-	} else {
-		cnt := 1
-		nodes := 0
-		pages := 0
-
-		for {
-			currPage, err := utils.ReadBytesFromFile(pagesPath, int64((cnt-1)*(prioritySize+indexSize)*subheapNodes), (prioritySize+indexSize)*subheapNodes)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read file %s: %w", pagesPath, err)
+	}
+	if h.store, err = newPageStore(options.PageStore, pagesPath, h.config.pageSize, h.files); err != nil {
+		h.discard()
+		return nil, fmt.Errorf("failed to open page store: %w", err)
+	}
+	h.pages = newPageCache(options, pagesPath, h.config.pageSize, h.store, h.metrics)
+	if !existing {
+		if err = writeHeapFormat(parentDirectory, h.durability.Mode != DurabilityNone); err != nil {
+			h.discard()
+			return nil, err
+		}
+		if h.durability.Mode != DurabilityNone {
+			// Make the entries of the new heap directories durable up to the namespace
+			for _, dir := range []string{parentDirectory, filepath.Dir(parentDirectory), filepath.Dir(filepath.Dir(parentDirectory))} {
+				if err = h.files.SyncDirectory(dir); err != nil {
+					h.discard()
+					return nil, err
+				}
 			}
-			if len(currPage) == 0 {
+		}
+		h.metrics.load(h.priorities)
+		return h, nil
+	}
+
+	cnt := 1
+	for {
+		currPage, err := h.store.readPage(cnt)
+		if err != nil {
+			h.discard()
+			return nil, fmt.Errorf("failed to read file %s: %w", pagesPath, err)
+		}
+		if len(currPage) == 0 {
+			break
+		}
+		if len(currPage) < h.config.pageSize {
+			currPage = append(currPage, make([]byte, h.config.pageSize-len(currPage))...)
+		}
+		if err = verifyPage(currPage, pagesPath, int64(cnt-1)*int64(h.config.pageSize)); err != nil {
+			h.discard()
+			return nil, unmarkedFormat(parentDirectory, marked, err)
+		}
+		nodesInPage := 0
+		for i := 1; i <= h.config.subheapNodes; i++ {
+			startIndex := (i - 1) * h.config.nodeSize
+			if startIndex+h.config.nodeSize > len(currPage) {
 				break
 			}
-			nodesInPage := 0
-			for i := 1; i <= subheapNodes; i++ {
-				startIndex := (i - 1) * (prioritySize + indexSize)
-				length := (prioritySize + indexSize)
-				priority := int(binary.LittleEndian.Uint64(currPage[startIndex:length][:prioritySize]))
-				if priority == 0 || (i == 1 && cnt != 1) {
-					continue
-				}
-				nodesInPage++
+			// Local root of every page but the first duplicates a node of its parent page
+			if i == 1 && cnt != 1 {
+				continue
+			}
+			priority := binary.LittleEndian.Uint64(currPage[startIndex : startIndex+prioritySize])
+			if priority == 0 {
+				continue
 			}
-			nodes += nodesInPage
-			if nodesInPage > 0 {
-				pages++
+			indexPos := binary.LittleEndian.Uint64(currPage[startIndex+prioritySize : startIndex+h.config.nodeSize])
+			if err = h.loadPriorityState(priority, indexPos); err != nil {
+				h.discard()
+				return nil, fmt.Errorf("failed to load state of priority %d: %w", priority, err)
 			}
-			cnt++
+			nodesInPage++
+		}
+		h.totalNodes += nodesInPage
+		if nodesInPage > 0 {
+			h.totalPages++
+		}
+		cnt++
+	}
+	if !marked {
+		// Pages pass their checksums, so must the next record of every priority
+		for priority, state := range h.priorities {
+			if _, err = h.readRecord(priority, state.head); err != nil {
+				h.discard()
+				return nil, unmarkedFormat(parentDirectory, marked, err)
+			}
+		}
+		if err = writeHeapFormat(parentDirectory, h.durability.Mode != DurabilityNone); err != nil {
+			h.discard()
+			return nil, err
 		}
+	}
+	h.metrics.load(h.priorities)
+	return h, nil
+}
+
+// Release a heap that failed to open.
+func (h *Heap) discard() {
+	if h.store != nil {
+		h.store.close()
+	}
+	h.metrics.close(h.priorities)
+}
 
-		return &Heap{
-			totalNodes:  nodes,
-			totalPages:  pages,
-			currentPage: NewPage(),
-			config: HeapConfig{
-				PagesPath:             pagesPath,
-				IndexPath:             indexpath,
-				heapMaxSize:           heapMaxSize,
-				prioritySize:          prioritySize,
-				indexSize:             indexSize,
-				nodeSize:              prioritySize + indexSize,
-				subheapSize:           (prioritySize + indexSize) * subheapNodes,
-				subheapLastLayerNodes: (1 << (heapMaxSize - 1)),
-				subheapNodes:          subheapNodes,
-			},
-		}, nil
+// A heap without a format file failing its checksums was most likely
+// written in format 1, before checksums.
+func unmarkedFormat(dir string, marked bool, err error) error {
+	var corrupted *ErrCorrupted
+	if marked || !errors.As(err, &corrupted) {
+		return err
+	}
+	return fmt.Errorf("heap %s has no format file and fails the checksums of format %d (%w): %w", dir, heapFormatVersion, err, ErrUnsupportedFormat)
+}
+
+func newHeapConfig(parentDirectory string, heapMaxSize int, prioritySize int, indexSize int, messageIdSize int) HeapConfig {
+	subheapNodes := (1 << heapMaxSize) - 1
+	return HeapConfig{
+		PagesPath:             filepath.Join(parentDirectory, "pages"),   // file
+		IndexPath:             filepath.Join(parentDirectory, "indexes"), // directory
+		TimesPath:             filepath.Join(parentDirectory, "times"),   // directory
+		messageIdSize:         messageIdSize,
+		heapMaxSize:           heapMaxSize,
+		prioritySize:          prioritySize,
+		indexSize:             indexSize,
+		nodeSize:              prioritySize + indexSize,
+		subheapSize:           (prioritySize + indexSize) * subheapNodes,
+		subheapLastLayerNodes: (1 << (heapMaxSize - 1)),
+		subheapNodes:          subheapNodes,
+		pageSize:              (prioritySize+indexSize)*subheapNodes + checksumSize,
+		indexRecordSize:       messageIdSize + checksumSize,
 	}
 }
 
 // Public Methods
 
 func (h *Heap) Enqueue(queueItem *QueueItem) error {
+	if h.closed {
+		return ErrHeapClosed
+	}
 	if queueItem.Priority == 0 {
 		return fmt.Errorf("priority cannot be zero")
 	}
@@ -121,166 +245,120 @@ func (h *Heap) Enqueue(queueItem *QueueItem) error {
 		// if this is a new priority
 		// - add priority node to heap
 		// - heapify up
-		if h.totalNodes == 0 {
-			h.loadPage(0)
-			newPage := make([]byte, h.config.subheapSize)
-			binary.LittleEndian.PutUint64(newPage[0:], uint64(queueItem.Priority))
-			binary.LittleEndian.PutUint64(newPage[h.config.prioritySize:], uint64(0))
-			h.currentPage.SetData(1, newPage)
-			h.totalPages += 1
-		} else {
-			if h.totalNodes >= h.config.subheapLastLayerNodes {
-				return fmt.Errorf("heap is full, cannot enqueue more nodes")
-			}
-			h.heapifyUp(h.totalNodes+1, queueItem.Priority, 0)
+		if err := h.insertNode(queueItem.Priority, 0); err != nil {
+			return err
 		}
-		h.totalNodes++
 	}
-	byteArray := queueItem.MessageId[:]
-	utils.AppendBytesToFile(indexPath, byteArray)
+	if err := h.files.Append(indexPath, encodeIndexRecord(queueItem.MessageId)); err != nil {
+		return fmt.Errorf("failed to append message id to index file: %w", err)
+	}
+	if err := h.trackEnqueue(queueItem.Priority); err != nil {
+		return fmt.Errorf("failed to track enqueue: %w", err)
+	}
+	if err := h.commit(); err != nil {
+		return fmt.Errorf("failed to commit enqueue: %w", err)
+	}
 	return nil
 }
 
 func (h *Heap) Dequeue() (*QueueItem, error) {
-	if err := h.loadPage(1); err != nil {
-		return nil, fmt.Errorf("failed to load page 1: %w", err)
-	}
-	if len(h.currentPage.data) < (h.config.prioritySize + h.config.indexSize) {
-		return nil, fmt.Errorf("heap is empty")
+	if h.closed {
+		return nil, ErrHeapClosed
 	}
-	priority := binary.LittleEndian.Uint64(h.currentPage.data[:h.config.prioritySize])
-	indexPos := binary.LittleEndian.Uint64(h.currentPage.data[h.config.prioritySize:])
-	indexPath := h.getIndexFilePath(priority)
-	offset := int64(indexPos) * int64(h.config.messageIdSize)
-	data, err := utils.ReadBytesFromFile(indexPath, offset, 2*h.config.messageIdSize)
+	item, err := h.dequeue()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read message id from index file: %w", err)
+		return nil, err
 	}
-	if itemId, err := uuid.FromBytes(data[:h.config.messageIdSize]); err != nil {
-		return nil, fmt.Errorf("failed to convert bytes to UUID: %w", err)
-	} else {
-		if itemId == uuid.Nil {
-			return nil, fmt.Errorf("no item found for the given priority")
-		}
-		nextItemId, err := uuid.FromBytes(data[h.config.messageIdSize:])
-		if err != nil && nextItemId == uuid.Nil {
-			if err := utils.EnsureFileDeleted(indexPath); err != nil {
-				return nil, fmt.Errorf("failed to delete index file %s: %w", indexPath, err)
-			}
-			// core
-			if h.totalNodes == 0 {
-				return nil, fmt.Errorf("no items in the heap")
-			}
-			if h.totalNodes == 1 {
-				if err = h.loadPage(1); err != nil {
-					return nil, fmt.Errorf("failed to load page 1: %w", err)
-				}
-				// priority1 := binary.LittleEndian.Uint64(h.currentPage.data[:h.config.prioritySize])
-				// indexPos1 := binary.LittleEndian.Uint64(h.currentPage.data[h.config.prioritySize:])
-				copy(h.currentPage.data[:h.config.nodeSize], make([]byte, h.config.nodeSize))
-				h.totalNodes -= 1
-				h.totalPages -= 1
-			} else {
-				if err := h.loadPage(1); err != nil {
-					return nil, fmt.Errorf("failed to load page 1: %w", err)
-				}
-				priority = binary.LittleEndian.Uint64(h.currentPage.data[:h.config.prioritySize])
-				indexPos = binary.LittleEndian.Uint64(h.currentPage.data[h.config.prioritySize:])
-
-				pageNumber, localIndex, _ := h.getLocalHeapDetailsForNode(h.totalNodes)
-				if err = h.loadPage(pageNumber); err != nil {
-					return nil, fmt.Errorf("failed to load page %d: %w", pageNumber, err)
-				}
-
-				startIndex := (localIndex - 1) * h.config.nodeSize
-				lpriority := binary.LittleEndian.Uint64(h.currentPage.data[startIndex : startIndex+h.config.prioritySize])
-				lindexPos := binary.LittleEndian.Uint64(h.currentPage.data[startIndex+h.config.prioritySize : startIndex+h.config.nodeSize])
-				copy(h.currentPage.data[startIndex:], make([]byte, h.config.nodeSize))
-				h.totalNodes -= 1
-				if localIndex == 2 && pageNumber != 1 {
-					h.totalPages -= 1
-					copy(h.currentPage.data[:h.config.nodeSize], make([]byte, h.config.nodeSize))
-				}
-				if err = h.heapifyDown(lpriority, lindexPos); err != nil {
-					return nil, fmt.Errorf("failed to heapify down after dequeue: %w", err)
-				}
-
-				return &QueueItem{
-					MessageId: itemId,
-					Priority:  priority,
-				}, nil
-			}
-		} else {
-			if err = h.setIndexOfPeekElement(int(indexPos + 1)); err != nil {
-				return nil, fmt.Errorf("failed to set index of peek element: %w", err)
-			}
-		}
-
-		return &QueueItem{
-			MessageId: itemId,
-			Priority:  priority,
-		}, nil
+	if err = h.trackDequeue(item.Priority); err != nil {
+		return nil, fmt.Errorf("failed to track dequeue: %w", err)
 	}
+	if err = h.commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit dequeue: %w", err)
+	}
+	return item, nil
 }
 
-func (h *Heap) IsEmpty() (bool, error) {
-	if err := h.loadPage(1); err != nil {
-		return true, nil
+func (h *Heap) dequeue() (*QueueItem, error) {
+	if h.totalNodes == 0 {
+		return nil, ErrHeapEmpty
 	}
-	var priority uint64 = 0
-	var indexPos uint64 = 0
-
-	indexPath := h.getIndexFilePath(priority)
-	loadedPageEmpty := len(h.currentPage.data) == 0
-	priorityDoesNotExists := !utils.FileExists(indexPath)
-
-	if loadedPageEmpty {
-		if priorityDoesNotExists {
-			return true, nil
-		}
+	root, err := h.readNode(1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read root node: %w", err)
 	}
-	priority = binary.LittleEndian.Uint64(h.currentPage.data[:h.config.prioritySize])
-	indexPos = binary.LittleEndian.Uint64(h.currentPage.data[h.config.prioritySize:])
-	var offset = int64(indexPos) * int64(h.config.messageIdSize)
-	data, err := utils.ReadBytesFromFile(indexPath, offset, h.config.messageIdSize)
+	indexPath := h.getIndexFilePath(root.priority)
+	recordSize := h.config.indexRecordSize
+	offset := int64(root.index) * int64(recordSize)
+	data, err := h.files.ReadAt(indexPath, offset, 2*recordSize)
 	if err != nil {
-		return false, fmt.Errorf("error reading indexfile")
+		return nil, fmt.Errorf("failed to read message id from index file: %w", err)
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("no item found for the given priority")
 	}
-	itemId, err := uuid.FromBytes(data)
+	itemId, err := decodeIndexRecord(data, recordSize, indexPath, offset)
 	if err != nil {
-		return false, fmt.Errorf("messageid is not valid")
+		return nil, err
 	}
 	if itemId == uuid.Nil {
-		return true, nil
+		return nil, fmt.Errorf("no item found for the given priority")
+	}
+	if len(data) > recordSize {
+		// A torn record after this one must not be dropped silently with the index file
+		if _, err = decodeIndexRecord(data[recordSize:], recordSize, indexPath, offset+int64(recordSize)); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(data) < 2*recordSize {
+		// Last message of this priority, drop its node
+		if err := h.files.Remove(indexPath); err != nil {
+			return nil, fmt.Errorf("failed to delete index file %s: %w", indexPath, err)
+		}
+		if err = h.removeRoot(); err != nil {
+			return nil, fmt.Errorf("failed to remove root node: %w", err)
+		}
+	} else {
+		if err = h.setIndexOfPeekElement(int(root.index + 1)); err != nil {
+			return nil, fmt.Errorf("failed to set index of peek element: %w", err)
+		}
 	}
-	return false, nil
+	return &QueueItem{
+		MessageId: itemId,
+		Priority:  root.priority,
+	}, nil
+}
+
+func (h *Heap) IsEmpty() (bool, error) {
+	return h.totalNodes == 0, nil
 }
 
 func (h *Heap) Peek() (*QueueItem, error) {
-	if err := h.loadPage(1); err != nil {
-		return nil, fmt.Errorf("failed to load page 1: %w", err)
-	}
-	if len(h.currentPage.data) < (h.config.prioritySize + h.config.indexSize) {
-		return nil, fmt.Errorf("heap is empty")
-	}
-	var priority uint64 = 0
-	var indexPos uint64 = 0
-	priority = binary.LittleEndian.Uint64(h.currentPage.data[:h.config.prioritySize])
-	indexPos = binary.LittleEndian.Uint64(h.currentPage.data[h.config.prioritySize:])
-	indexPath := h.getIndexFilePath(priority)
-	data, err := utils.ReadBytesFromFile(indexPath, int64(indexPos)*int64(h.config.messageIdSize), h.config.messageIdSize)
+	if h.closed {
+		return nil, ErrHeapClosed
+	}
+	if h.totalNodes == 0 {
+		return nil, ErrHeapEmpty
+	}
+	root, err := h.readNode(1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read root node: %w", err)
+	}
+	indexPath := h.getIndexFilePath(root.priority)
+	offset := int64(root.index) * int64(h.config.indexRecordSize)
+	data, err := h.files.ReadAt(indexPath, offset, h.config.indexRecordSize)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read message id from index file: %w", err)
 	}
-	if itemId, err := uuid.FromBytes(data); err != nil {
-		return nil, fmt.Errorf("failed to convert bytes to UUID: %w", err)
+	if itemId, err := decodeIndexRecord(data, h.config.indexRecordSize, indexPath, offset); err != nil {
+		return nil, err
 	} else {
 		if itemId == uuid.Nil {
 			return nil, fmt.Errorf("no item found for the given priority")
 		}
 		queueItem := &QueueItem{
 			MessageId: itemId,
-			Priority:  priority,
+			Priority:  root.priority,
 		}
 		return queueItem, nil
 	}
@@ -290,239 +368,323 @@ func (h *Heap) GetConfig() HeapConfig {
 	return h.config
 }
 
+// Clear removes every message whose priority is in the range, deleting their
+// index files and rebuilding the pages of the remaining priorities.
+func (h *Heap) Clear(priorities PriorityRange) error {
+	if h.closed {
+		return ErrHeapClosed
+	}
+	remaining := make([]heapNode, 0, len(h.priorities))
+	for priority, state := range h.priorities {
+		if !priorities.Contains(priority) {
+			remaining = append(remaining, heapNode{priority: priority, index: state.head})
+			continue
+		}
+		if err := h.files.Remove(h.getIndexFilePath(priority)); err != nil {
+			return fmt.Errorf("failed to delete index file of priority %d: %w", priority, err)
+		}
+		if err := h.files.Remove(h.getTimesFilePath(priority)); err != nil {
+			return fmt.Errorf("failed to delete times file of priority %d: %w", priority, err)
+		}
+		h.untrackPriority(priority)
+	}
+	// Reinsert in priority order so the resulting pages do not depend on map order
+	sort.Slice(remaining, func(i, j int) bool { return remaining[i].priority < remaining[j].priority })
+	if err := h.rebuild(remaining); err != nil {
+		return fmt.Errorf("failed to rebuild heap: %w", err)
+	}
+	if err := h.commit(); err != nil {
+		return fmt.Errorf("failed to commit clear: %w", err)
+	}
+	return nil
+}
+
+// Write every modified page back to the pages file and, unless durability
+// is DurabilityNone, fsync the files and directories changed since the last flush.
+func (h *Heap) Flush() error {
+	if h.closed {
+		return ErrHeapClosed
+	}
+	if err := h.pages.flush(); err != nil {
+		return fmt.Errorf("failed to flush pages: %w", err)
+	}
+	if err := h.store.sync(); err != nil {
+		return fmt.Errorf("failed to sync pages: %w", err)
+	}
+	if err := h.files.Sync(); err != nil {
+		return fmt.Errorf("failed to sync files: %w", err)
+	}
+	h.pendingOps = 0
+	h.lastCommit = time.Now()
+	return nil
+}
+
+// Flush the heap and release its file handles. The heap cannot be used afterwards.
+func (h *Heap) Close() error {
+	if h.closed {
+		return nil
+	}
+	flushErr := h.Flush()
+	h.closed = true
+	h.pages.reset()
+	h.metrics.close(h.priorities)
+	var errs = []error{flushErr}
+	if err := h.store.close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close page store: %w", err))
+	}
+	if err := h.files.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close files: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
 // Internal Methods
 
 func (h *Heap) setIndexOfPeekElement(index int) error {
-	if err := h.loadPage(1); err != nil {
-		return fmt.Errorf("failed to load page 1: %w", err)
+	root, err := h.readNode(1)
+	if err != nil {
+		return fmt.Errorf("failed to read root node: %w", err)
 	}
-	binary.LittleEndian.PutUint64(h.currentPage.data[h.config.prioritySize:], uint64(index))
-	return nil
+	root.index = uint64(index)
+	return h.writeNode(1, root)
 }
 
-func (h *Heap) getIndexFilePath(priority uint64) string {
-	return filepath.Join(h.config.IndexPath, fmt.Sprint(priority))
+type heapNode struct {
+	priority uint64
+	index    uint64
 }
 
-func (h *Heap) loadPage(pageNumber int) error {
-	if pageNumber < 0 {
-		return fmt.Errorf("invalid page number: %d", pageNumber)
+// Append a node after the last one and move it up to its place.
+func (h *Heap) insertNode(priority uint64, index uint64) error {
+	heapIndex := h.totalNodes + 1
+	pageNumber, localIndex, _ := h.getLocalHeapDetailsForNode(heapIndex)
+	if heapIndex == 1 || (localIndex == 2 && pageNumber != 1) {
+		// This is the first node of a new page, the local root
+		// duplicates its parent from the last layer of the parent page
+		page, err := h.pages.create(pageNumber)
+		if err != nil {
+			return fmt.Errorf("failed to create page %d: %w", pageNumber, err)
+		}
+		if heapIndex != 1 {
+			parent, err := h.readNode(heapIndex / 2)
+			if err != nil {
+				return fmt.Errorf("failed to read parent node: %w", err)
+			}
+			if page, err = h.loadPage(pageNumber); err != nil {
+				return fmt.Errorf("failed to load page %d: %w", pageNumber, err)
+			}
+			h.putNode(page, 1, parent)
+		}
+		h.totalPages += 1
 	}
-	if pageNumber != h.currentPage.index {
-		h.commitCurrentPage()
-		return h.loadIntoCurrentPage(pageNumber)
+	h.totalNodes++
+	if err := h.writeNode(heapIndex, heapNode{priority: priority, index: index}); err != nil {
+		return err
 	}
-	return nil
+	return h.heapifyUp(heapIndex)
 }
 
-func (h *Heap) loadIntoCurrentPage(pageNumber int) error {
-	if pageNumber != 0 {
-		startIndex := (pageNumber - 1) * (h.config.subheapSize)
-		var err error
-		if h.currentPage.data, err = utils.ReadBytesFromFile(h.config.PagesPath, int64(startIndex), h.config.subheapSize); err != nil {
-			return fmt.Errorf("failed to read page %d: %w", pageNumber, err)
-		}
-		h.currentPage.index = pageNumber
+// Replace the root with the last node and move it down to its place.
+func (h *Heap) removeRoot() error {
+	return h.removeNode(1)
+}
+
+// Replace a node with the last one and move that one to its place.
+func (h *Heap) removeNode(heapIndex int) error {
+	lastIndex := h.totalNodes
+	last, err := h.readNode(lastIndex)
+	if err != nil {
+		return fmt.Errorf("failed to read last node: %w", err)
+	}
+	pageNumber, localIndex, _ := h.getLocalHeapDetailsForNode(lastIndex)
+	page, err := h.loadPage(pageNumber)
+	if err != nil {
+		return fmt.Errorf("failed to load page %d: %w", pageNumber, err)
+	}
+	if lastIndex == 1 || (localIndex == 2 && pageNumber != 1) {
+		// The page becomes empty, including its duplicated root
+		h.pages.modify(page)
+		clear(page.data)
+		h.totalPages -= 1
 	} else {
-		h.currentPage.data = nil
-		h.currentPage.index = 0
+		h.putNode(page, localIndex, heapNode{})
 	}
-	return nil
+	h.totalNodes -= 1
+	if heapIndex == lastIndex {
+		return nil
+	}
+	if err = h.writeNode(heapIndex, last); err != nil {
+		return err
+	}
+	if err = h.heapifyUp(heapIndex); err != nil {
+		return err
+	}
+	return h.heapifyDown(heapIndex)
 }
 
-func (h *Heap) commitCurrentPage() error {
-	if h.currentPage.index != 0 {
-		startIndex := (h.currentPage.index - 1) * (h.config.subheapSize)
-		if err := utils.WriteBytesToFile(h.config.PagesPath, int64(startIndex), h.currentPage.data); err != nil {
-			return fmt.Errorf("failed to commit page %d: %w", h.currentPage.index, err)
+// Discard the pages and lay out the given nodes again from scratch.
+func (h *Heap) rebuild(nodes []heapNode) error {
+	h.pages.reset()
+	if err := h.store.truncate(); err != nil {
+		return fmt.Errorf("failed to truncate pages file: %w", err)
+	}
+	h.totalNodes = 0
+	h.totalPages = 0
+	for _, node := range nodes {
+		if err := h.insertNode(node.priority, node.index); err != nil {
+			return fmt.Errorf("failed to insert priority %d: %w", node.priority, err)
 		}
 	}
 	return nil
 }
 
-func (h *Heap) heapifyUp(heapIndex int, priority uint64, index uint64) error {
-	pageNumber, localIndex, _ := h.getLocalHeapDetailsForNode(heapIndex)
-	if localIndex == 2 && pageNumber != 1 {
-		// This is the first element in the new page,
-		// root node will be there in the parent page,
-		// load it and then move forward
-		parentIndex := heapIndex / 2
-		pageOfParent, localIndexOfParent, _ := h.getLocalHeapDetailsForNode(parentIndex)
-		if err := h.loadPage(pageOfParent); err != nil {
-			return fmt.Errorf("failed to load parent page %d: %w", pageOfParent, err)
-		}
-		rootNode := h.currentPage.data[(localIndexOfParent-1)*(h.config.nodeSize) : (localIndexOfParent)*(h.config.nodeSize)]
-		if err := h.loadPage(0); err != nil {
-			return fmt.Errorf("failed to load current page %d: %w", 0, err)
-		}
-		newPage := make([]byte, h.config.subheapSize)
-		copy(newPage[:h.config.nodeSize], rootNode)
-		h.currentPage.SetData(pageNumber, newPage)
-	}
-
-	//Fake conditions to perform first executions irrespective of anything
-	needToGoUp := true
-	previousPage := 0
-	for needToGoUp {
-		pageNumber, localIndex, localLevel := h.getLocalHeapDetailsForNode(heapIndex)
-		if err := h.loadPage(pageNumber); err != nil {
-			return fmt.Errorf("failed to load page %d: %w", pageNumber, err)
-		}
-		startIndex := (localIndex - 1) * h.config.nodeSize
-
-		newPage := make([]byte, h.config.nodeSize)
-		binary.LittleEndian.PutUint64(newPage[0:], uint64(priority))
-		binary.LittleEndian.PutUint64(newPage[h.config.prioritySize:], uint64(index))
-		copy(h.currentPage.data[startIndex:], newPage)
-
-		needToGoUp = h.localHeapifyUp(localIndex)
-
-		if previousPage != 0 {
-			offset := int64((previousPage - 1) * (h.config.subheapSize))
-			_data := h.currentPage.data[startIndex : startIndex+h.config.nodeSize]
-			utils.WriteBytesToFile(h.config.PagesPath, offset, _data)
-		}
-		if pageNumber == 1 {
-			// If first sub heap no need to go up
-			break
-		}
-		//Change parametes for next iterations
-		heapIndex = heapIndex >> localLevel
-		previousPage = pageNumber
+func (h *Heap) getIndexFilePath(priority uint64) string {
+	return filepath.Join(h.config.IndexPath, fmt.Sprint(priority))
+}
+
+func (h *Heap) getTimesFilePath(priority uint64) string {
+	return filepath.Join(h.config.TimesPath, fmt.Sprint(priority))
+}
+
+func (h *Heap) loadPage(pageNumber int) (*Page, error) {
+	if pageNumber <= 0 {
+		return nil, fmt.Errorf("invalid page number: %d", pageNumber)
 	}
-	return nil
+	return h.pages.get(pageNumber)
 }
 
-func (h *Heap) localHeapifyUp(index int) bool {
-	indexChild := index
-	for indexChild > 1 {
-		startPointChild := (indexChild - 1) * (h.config.nodeSize)
-		bytesChild := h.currentPage.data[startPointChild : startPointChild+h.config.nodeSize]
-		priorityChild := binary.LittleEndian.Uint64(bytesChild[:h.config.prioritySize])
+func (h *Heap) getNode(page *Page, localIndex int) heapNode {
+	startIndex := (localIndex - 1) * h.config.nodeSize
+	return heapNode{
+		priority: binary.LittleEndian.Uint64(page.data[startIndex : startIndex+h.config.prioritySize]),
+		index:    binary.LittleEndian.Uint64(page.data[startIndex+h.config.prioritySize : startIndex+h.config.nodeSize]),
+	}
+}
 
-		indexParent := indexChild / 2
+func (h *Heap) putNode(page *Page, localIndex int, node heapNode) {
+	h.pages.modify(page)
+	startIndex := (localIndex - 1) * h.config.nodeSize
+	binary.LittleEndian.PutUint64(page.data[startIndex:], node.priority)
+	binary.LittleEndian.PutUint64(page.data[startIndex+h.config.prioritySize:], node.index)
+}
 
-		startPointParent := (indexParent - 1) * (h.config.nodeSize)
-		bytesParent := h.currentPage.data[startPointParent : startPointParent+h.config.nodeSize]
-		priorityParent := binary.LittleEndian.Uint64(bytesParent[:h.config.prioritySize])
+func (h *Heap) readNode(heapIndex int) (heapNode, error) {
+	pageNumber, localIndex, _ := h.getLocalHeapDetailsForNode(heapIndex)
+	page, err := h.loadPage(pageNumber)
+	if err != nil {
+		return heapNode{}, fmt.Errorf("failed to load page %d: %w", pageNumber, err)
+	}
+	return h.getNode(page, localIndex), nil
+}
 
-		// TODO: Priority comparison should be configurable
-		if priorityChild > priorityParent {
-			tempByteParents := make([]byte, len(bytesParent))
-			copy(tempByteParents, bytesParent)
-			copy(h.currentPage.data[startPointParent:], bytesChild)
-			copy(h.currentPage.data[startPointChild:], tempByteParents)
-		} else {
-			return false
+// Nodes in the last layer of a page are also the local root of their child
+// page, so both copies are updated together.
+func (h *Heap) writeNode(heapIndex int, node heapNode) error {
+	pageNumber, localIndex, localLevel := h.getLocalHeapDetailsForNode(heapIndex)
+	page, err := h.loadPage(pageNumber)
+	if err != nil {
+		return fmt.Errorf("failed to load page %d: %w", pageNumber, err)
+	}
+	h.putNode(page, localIndex, node)
+	if localLevel == h.config.heapMaxSize-1 && 2*heapIndex <= h.totalNodes {
+		childPageNumber, _, _ := h.getLocalHeapDetailsForNode(2 * heapIndex)
+		childPage, err := h.loadPage(childPageNumber)
+		if err != nil {
+			return fmt.Errorf("failed to load page %d: %w", childPageNumber, err)
 		}
-		indexChild = indexChild / 2
+		h.putNode(childPage, 1, node)
 	}
-	return true
+	return nil
 }
 
-func (h *Heap) heapifyDown(priority uint64, index uint64) error {
-	needToGoDown := true
-	pageNumber := 1
-	previousPage := 0
-	previousIndex := 0
-	lastLayerIndex := 0
-	for needToGoDown {
-		var err error
-		if err = h.loadPage(pageNumber); err != nil {
-			return fmt.Errorf("failed to load page %d: %w", pageNumber, err)
-		}
+func (h *Heap) swapNodes(first int, second int) error {
+	firstNode, err := h.readNode(first)
+	if err != nil {
+		return err
+	}
+	secondNode, err := h.readNode(second)
+	if err != nil {
+		return err
+	}
+	if err = h.writeNode(first, secondNode); err != nil {
+		return err
+	}
+	return h.writeNode(second, firstNode)
+}
 
-		binary.LittleEndian.PutUint64(h.currentPage.data[:h.config.prioritySize], priority)
-		binary.LittleEndian.PutUint64(h.currentPage.data[h.config.prioritySize:], index)
-		if needToGoDown, lastLayerIndex, err = h.localHeapifyDown(); err != nil {
-			return fmt.Errorf("failed to heapify down: %w", err)
-		}
+// Whether a message of priority a is dequeued before one of priority b.
+func outranks(a uint64, b uint64) bool {
+	// TODO: Priority comparison should be configurable
+	return a > b
+}
 
-		//If second iteration change the last layer node of previous page
-		//------Anti-pattern code------
-		// Here we are directly going to previous page and changing the last layer node,
-		// every operation should be done by loading page
-		// Here, we are sure that page is synced in meomry,
-		//  to reduce disk I/O this has been done
+// Order of priorities in dequeue order, for sorting.
+func comparePriorities(a uint64, b uint64) int {
+	switch {
+	case outranks(a, b):
+		return -1
+	case outranks(b, a):
+		return 1
+	}
+	return 0
+}
 
-		if previousPage != 0 {
-			var offset = int64((previousPage-1)*(h.config.subheapSize) + (previousIndex-1)*(h.config.nodeSize))
-			utils.WriteBytesToFile(h.config.PagesPath, offset, h.currentPage.data[:h.config.nodeSize])
+func (h *Heap) heapifyUp(heapIndex int) error {
+	for heapIndex > 1 {
+		child, err := h.readNode(heapIndex)
+		if err != nil {
+			return fmt.Errorf("failed to read node %d: %w", heapIndex, err)
 		}
-		previousPage = pageNumber
-		previousIndex = lastLayerIndex
-
-		pageNumber = (h.config.subheapLastLayerNodes)*(pageNumber-1) + (lastLayerIndex - h.config.subheapLastLayerNodes + 1) + 1
-
-		if pageNumber > h.totalPages {
-			break
+		parent, err := h.readNode(heapIndex / 2)
+		if err != nil {
+			return fmt.Errorf("failed to read node %d: %w", heapIndex/2, err)
+		}
+		if !outranks(child.priority, parent.priority) {
+			return nil
+		}
+		if err = h.swapNodes(heapIndex, heapIndex/2); err != nil {
+			return fmt.Errorf("failed to swap node %d with its parent: %w", heapIndex, err)
 		}
+		heapIndex = heapIndex / 2
 	}
 	return nil
 }
 
-func (h *Heap) localHeapifyDown() (bool, int, error) {
-	indexParent := 1
-
-	for indexParent < h.config.subheapLastLayerNodes {
-		parentBytes := h.currentPage.data[(indexParent-1)*(h.config.nodeSize) : (indexParent)*(h.config.nodeSize)]
-		priorityParent := binary.LittleEndian.Uint64(parentBytes[:h.config.prioritySize])
-		indexLeftChild := indexParent * 2
-		indexRightChild := indexLeftChild + 1
-		leftChildBytes := h.currentPage.data[(indexLeftChild-1)*(h.config.nodeSize) : (indexLeftChild)*(h.config.nodeSize)]
-		rightChildBytes := h.currentPage.data[(indexRightChild-1)*(h.config.nodeSize) : (indexRightChild)*(h.config.nodeSize)]
-		priorityLeftChild := binary.LittleEndian.Uint64(leftChildBytes[:h.config.prioritySize])
-		priorityRightChild := binary.LittleEndian.Uint64(rightChildBytes[:h.config.prioritySize])
-
-		//None of the childern exist, so no need to go further
-		if priorityLeftChild == 0 && priorityRightChild == 0 {
-			return false, indexParent, nil
-		}
-
-		//Right child does not exist
-		if priorityRightChild == 0 {
-			//Parent wins, no need to go further
-			// TODO: Priority comparison should be configurable
-			if priorityParent > priorityLeftChild {
-				return false, indexParent, nil
-				//Left child wins still no need to go further
-			} else {
-				tempByteParents := make([]byte, len(parentBytes))
-				copy(tempByteParents, parentBytes)
-				copy(h.currentPage.data[(indexParent-1)*(h.config.nodeSize):], leftChildBytes)
-				copy(h.currentPage.data[(indexLeftChild-1)*(h.config.nodeSize):], tempByteParents)
-				return false, indexLeftChild, nil
+func (h *Heap) heapifyDown(heapIndex int) error {
+	for {
+		largest := heapIndex
+		largestNode, err := h.readNode(heapIndex)
+		if err != nil {
+			return fmt.Errorf("failed to read node %d: %w", heapIndex, err)
+		}
+		for _, child := range []int{2 * heapIndex, 2*heapIndex + 1} {
+			if child > h.totalNodes {
+				break
 			}
-		} else {
-			//Both children exist
-			// TODO: Priority comparison should be configurable
-			if priorityParent > priorityLeftChild && priorityParent > priorityRightChild {
-				//parent wins, no need to go further
-				return false, indexParent, nil
-			} else {
-				//Left child wins
-				// TODO: Priority comparison should be configurable
-				if priorityLeftChild > priorityRightChild {
-					tempByteParents := make([]byte, len(parentBytes))
-					copy(tempByteParents, parentBytes)
-					copy(h.currentPage.data[(indexParent-1)*(h.config.nodeSize):], leftChildBytes)
-					copy(h.currentPage.data[(indexLeftChild-1)*(h.config.nodeSize):], tempByteParents)
-					indexParent = indexLeftChild
-				} else {
-					//Right child wins
-					tempByteParents := make([]byte, len(parentBytes))
-					copy(tempByteParents, parentBytes)
-					copy(h.currentPage.data[(indexParent-1)*(h.config.nodeSize):], rightChildBytes)
-					copy(h.currentPage.data[(indexRightChild-1)*(h.config.nodeSize):], tempByteParents)
-					indexParent = indexRightChild
-				}
+			childNode, err := h.readNode(child)
+			if err != nil {
+				return fmt.Errorf("failed to read node %d: %w", child, err)
+			}
+			if outranks(childNode.priority, largestNode.priority) {
+				largest = child
+				largestNode = childNode
 			}
 		}
+		if largest == heapIndex {
+			return nil
+		}
+		if err = h.swapNodes(heapIndex, largest); err != nil {
+			return fmt.Errorf("failed to swap node %d with its child: %w", heapIndex, err)
+		}
+		heapIndex = largest
 	}
-	return true, indexParent, nil
 }
 
 func (h *Heap) getLocalHeapDetailsForNode(index int) (int, int, int) {
+	if index == 1 {
+		// The global root is the only node on level 0
+		return 1, 1, 0
+	}
 	globalLevel := bits.Len(uint(index)) - 1
 	nodesInGloablLevel := 1 << globalLevel
 	subHeapLevel := (globalLevel - 1) / (h.config.heapMaxSize - 1)
@@ -0,0 +1,290 @@
+package queue
+
+import (
+	"fmt"
+	"sync"
+)
+
+// What an enqueue exceeding a limit of its queue does.
+type OverflowPolicy uint8
+
+const (
+	OverflowReject     OverflowPolicy = iota // fail with ErrQueueFull
+	OverflowDropLowest                       // drop messages of the lowest priority, unless the new one is lower
+	OverflowDropOldest                       // drop the oldest visible messages
+)
+
+// Limits of the messages a queue holds, visible, locked, delayed or waiting
+// behind their group. Dead letters are not counted. Zero leaves a limit unset.
+type QueueLimits struct {
+	MaxMessages   uint64
+	MaxPriorities int // distinct priorities of the visible messages
+	Overflow      OverflowPolicy
+}
+
+// Quotas of a namespace, across its queues. Enqueues exceeding them fail
+// with ErrQueueFull whatever the overflow policy of the queue.
+type NamespaceQuotas struct {
+	MaxMessages uint64
+}
+
+// Limit names reported by ErrQueueFull.
+const (
+	LimitMessages   = "messages"
+	LimitPriorities = "priorities"
+)
+
+// ErrQueueFull is returned by enqueues exceeding a limit of their queue, or
+// a quota of its namespace, that the overflow policy could not make room for.
+type ErrQueueFull struct {
+	Queue     string
+	Limit     string
+	Max       uint64
+	Namespace bool // a namespace quota was exceeded
+}
+
+func (e *ErrQueueFull) Error() string {
+	if e.Namespace {
+		return fmt.Sprintf("queue %s is full: namespace quota of %d %s reached", e.Queue, e.Max, e.Limit)
+	}
+	return fmt.Sprintf("queue %s is full: limit of %d %s reached", e.Queue, e.Max, e.Limit)
+}
+
+// Usage of a queue or of a namespace.
+type Usage struct {
+	Messages uint64
+}
+
+func (u Usage) add(other Usage) Usage {
+	return Usage{Messages: u.Messages + other.Messages}
+}
+
+// namespaceQuota sums the usage its queues publish after every change, so
+// an enqueue checks the quotas without locking the other queues.
+type namespaceQuota struct {
+	mu     sync.Mutex
+	quotas NamespaceQuotas
+	usage  map[*Queue]Usage
+}
+
+func newNamespaceQuota(quotas NamespaceQuotas) *namespaceQuota {
+	return &namespaceQuota{quotas: quotas, usage: make(map[*Queue]Usage)}
+}
+
+func (n *namespaceQuota) total() Usage {
+	var total Usage
+	for _, usage := range n.usage {
+		total = total.add(usage)
+	}
+	return total
+}
+
+func (n *namespaceQuota) publish(q *Queue, usage Usage) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.usage[q] = usage
+}
+
+func (n *namespaceQuota) remove(q *Queue) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.usage, q)
+}
+
+// Reserve the usage of one more message of q, failing if it exceeds a quota.
+func (n *namespaceQuota) reserve(q *Queue, message Usage) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	total := n.total().add(message)
+	if n.quotas.MaxMessages > 0 && total.Messages > n.quotas.MaxMessages {
+		return &ErrQueueFull{Queue: q.Name, Limit: LimitMessages, Max: n.quotas.MaxMessages, Namespace: true}
+	}
+	n.usage[q] = n.usage[q].add(message)
+	return nil
+}
+
+// Usage of the queues of the namespace.
+func (n *Namespace) Usage() Usage {
+	n.quota.mu.Lock()
+	defer n.quota.mu.Unlock()
+	return n.quota.total()
+}
+
+// Usage of a single message.
+func (q *Queue) messageUsage() Usage {
+	return Usage{Messages: 1}
+}
+
+// Callers hold q.mu.
+func (q *Queue) usage() Usage {
+	var messages uint64
+	if q.mainHeap != nil {
+		for _, state := range q.mainHeap.priorities {
+			messages += state.messages
+		}
+	}
+	if q.groups != nil {
+		messages += uint64(len(q.groups.locks) + len(q.groups.delayed) + len(q.groups.waiting()))
+	}
+	return Usage{Messages: messages}
+}
+
+// Publish the usage of the queue to its namespace. Callers hold q.mu.
+func (q *Queue) publishUsage() {
+	if q.quota != nil && q.mainHeap != nil {
+		q.quota.publish(q, q.usage())
+	}
+}
+
+// Give back the reservation of an enqueue that failed after admit, by
+// publishing the usage the queue really has. Callers hold q.mu.
+func (q *Queue) unreserveOnError(err *error) {
+	if *err != nil {
+		q.publishUsage()
+	}
+}
+
+// Attach the queue to the quotas of its namespace.
+func (q *Queue) attachQuota(quota *namespaceQuota) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.quota = quota
+	q.publishUsage()
+}
+
+// Make room for item within the limits of the queue, dropping messages as
+// the overflow policy allows, then reserve it in the namespace quotas.
+// Callers hold q.mu.
+func (q *Queue) admit(item *QueueItem) error {
+	if q.mainHeap == nil {
+		return fmt.Errorf("main heap is not initialized for queue %s", q.Name)
+	}
+	for {
+		full := q.exceededLimit(item)
+		if full == nil {
+			break
+		}
+		if q.limits.Overflow == OverflowReject {
+			return full
+		}
+		dropped, err := q.dropFor(item, full.Limit == LimitPriorities)
+		if err != nil {
+			return err
+		}
+		if !dropped {
+			return full
+		}
+	}
+	if q.quota != nil {
+		return q.quota.reserve(q, q.messageUsage())
+	}
+	return nil
+}
+
+// The limit enqueuing item would exceed, nil if none. Callers hold q.mu.
+func (q *Queue) exceededLimit(item *QueueItem) *ErrQueueFull {
+	limits := q.limits
+	if limits.MaxMessages == 0 && limits.MaxPriorities == 0 {
+		return nil
+	}
+	usage := q.usage().add(q.messageUsage())
+	if limits.MaxMessages > 0 && usage.Messages > limits.MaxMessages {
+		return &ErrQueueFull{Queue: q.Name, Limit: LimitMessages, Max: limits.MaxMessages}
+	}
+	if _, exists := q.mainHeap.priorities[item.Priority]; limits.MaxPriorities > 0 && !exists && len(q.mainHeap.priorities) >= limits.MaxPriorities {
+		return &ErrQueueFull{Queue: q.Name, Limit: LimitPriorities, Max: uint64(limits.MaxPriorities)}
+	}
+	return nil
+}
+
+// Drop a visible message, or every message of a priority, to make room for
+// item. Returns false when the policy has nothing to drop. Callers hold q.mu.
+func (q *Queue) dropFor(item *QueueItem, wholePriority bool) (bool, error) {
+	var victim uint64
+	var found bool
+	var oldest int64
+	for priority, state := range q.mainHeap.priorities {
+		switch q.limits.Overflow {
+		case OverflowDropLowest:
+			if !found || outranks(victim, priority) {
+				victim, found = priority, true
+			}
+		case OverflowDropOldest:
+			if !found || state.headTime < oldest || (state.headTime == oldest && outranks(victim, priority)) {
+				victim, oldest, found = priority, state.headTime, true
+			}
+		}
+	}
+	if !found || (q.limits.Overflow == OverflowDropLowest && outranks(victim, item.Priority)) {
+		return false, nil
+	}
+	for {
+		if err := q.drop(victim); err != nil {
+			return false, err
+		}
+		if _, exists := q.mainHeap.priorities[victim]; !wholePriority || !exists {
+			return true, nil
+		}
+	}
+}
+
+// Drop the oldest message of a priority. Callers hold q.mu.
+func (q *Queue) drop(priority uint64) error {
+	item, err := q.mutate(&logEntry{op: logDrop, targets: ClearTargetMain, priority: priority})
+	if err != nil {
+		return fmt.Errorf("failed to drop message of priority %d: %w", priority, err)
+	}
+	item.GroupKey = q.groups.groupOf(item.MessageId)
+	if err = q.forgetDrainedOffsets(); err != nil {
+		return err
+	}
+	return q.release(item)
+}
+
+// Remove the oldest message of a priority, wherever its node is in the heap.
+func (h *Heap) dropHead(priority uint64) (*QueueItem, error) {
+	if h.closed {
+		return nil, ErrHeapClosed
+	}
+	state, exists := h.priorities[priority]
+	if !exists {
+		return nil, fmt.Errorf("no message of priority %d", priority)
+	}
+	heapIndex := 0
+	var node heapNode
+	for i := 1; i <= h.totalNodes && heapIndex == 0; i++ {
+		current, err := h.readNode(i)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read node %d: %w", i, err)
+		}
+		if current.priority == priority {
+			heapIndex, node = i, current
+		}
+	}
+	if heapIndex == 0 {
+		return nil, fmt.Errorf("no node for priority %d", priority)
+	}
+	item, err := h.readRecord(priority, node.index)
+	if err != nil {
+		return nil, err
+	}
+	if state.messages > 1 {
+		if err = h.writeNode(heapIndex, heapNode{priority: priority, index: node.index + 1}); err != nil {
+			return nil, err
+		}
+	} else {
+		if err = h.files.Remove(h.getIndexFilePath(priority)); err != nil {
+			return nil, fmt.Errorf("failed to delete index file of priority %d: %w", priority, err)
+		}
+		if err = h.removeNode(heapIndex); err != nil {
+			return nil, fmt.Errorf("failed to remove node of priority %d: %w", priority, err)
+		}
+	}
+	if err = h.trackDequeue(priority); err != nil {
+		return nil, fmt.Errorf("failed to track drop: %w", err)
+	}
+	if err = h.commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit drop: %w", err)
+	}
+	return item, nil
+}
@@ -0,0 +1,216 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+const defaultListPageSize = 100
+
+// PriorityRange selects priorities between Min and Max inclusive.
+// A zero Max leaves the range unbounded above.
+type PriorityRange struct {
+	Min uint64
+	Max uint64
+}
+
+func (r PriorityRange) Contains(priority uint64) bool {
+	return priority >= r.Min && (r.Max == 0 || priority <= r.Max)
+}
+
+type ListOptions struct {
+	PageSize          int    // defaults to 100
+	ContinuationToken string // returned by the previous call, empty to start a listing
+	Priorities        PriorityRange
+}
+
+// A listing cursor pins the messages present when the listing started: for
+// every priority the end of its index file and the generation of its state.
+// Messages dequeued meanwhile are dropped, messages enqueued later are not
+// listed, and a priority drained and re-created is recognised by its
+// generation, so a listing never repeats or skips entries.
+type listCursor struct {
+	Heap     uint64      `json:"h"`
+	Position int         `json:"p"`
+	Offset   uint64      `json:"o"`
+	Ranges   []listRange `json:"r"`
+}
+
+type listRange struct {
+	Priority   uint64 `json:"p"`
+	Generation uint64 `json:"g"`
+	End        uint64 `json:"e"`
+}
+
+func encodeListCursor(cursor any) (string, error) {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode continuation token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeListCursor(token string, cursor any) error {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return fmt.Errorf("invalid continuation token: %w", err)
+	}
+	if err = json.Unmarshal(data, cursor); err != nil {
+		return fmt.Errorf("invalid continuation token: %w", err)
+	}
+	return nil
+}
+
+func (h *Heap) newListCursor(priorities PriorityRange) *listCursor {
+	cursor := &listCursor{Heap: h.instanceId}
+	for priority, state := range h.priorities {
+		if !priorities.Contains(priority) {
+			continue
+		}
+		cursor.Ranges = append(cursor.Ranges, listRange{
+			Priority:   priority,
+			Generation: state.generation,
+			End:        state.head + state.messages,
+		})
+	}
+	sort.Slice(cursor.Ranges, func(i, j int) bool { return outranks(cursor.Ranges[i].Priority, cursor.Ranges[j].Priority) })
+	return cursor
+}
+
+// List returns up to PageSize messages in dequeue order and the token to
+// fetch the next page, which is empty once the listing is complete.
+func (h *Heap) List(options ListOptions) ([]*QueueItem, string, error) {
+	if h.closed {
+		return nil, "", ErrHeapClosed
+	}
+	pageSize := options.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultListPageSize
+	}
+	var cursor *listCursor
+	var err error
+	if options.ContinuationToken == "" {
+		cursor = h.newListCursor(options.Priorities)
+	} else {
+		cursor = &listCursor{}
+		if err = decodeListCursor(options.ContinuationToken, cursor); err != nil {
+			return nil, "", err
+		}
+		if cursor.Heap != h.instanceId {
+			return nil, "", fmt.Errorf("continuation token was issued by another heap instance")
+		}
+	}
+
+	items := make([]*QueueItem, 0)
+	for ; cursor.Position < len(cursor.Ranges); cursor.Position, cursor.Offset = cursor.Position+1, 0 {
+		r := cursor.Ranges[cursor.Position]
+		state, exists := h.priorities[r.Priority]
+		if !exists || state.generation != r.Generation {
+			// Every message of this priority has been dequeued since the listing started
+			continue
+		}
+		start := max(cursor.Offset, state.head)
+		count := min(r.End-min(start, r.End), uint64(pageSize-len(items)))
+		if count > 0 {
+			path := h.getIndexFilePath(r.Priority)
+			recordSize := h.config.indexRecordSize
+			data, err := h.files.ReadAt(path, int64(start)*int64(recordSize), int(count)*recordSize)
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to read index file of priority %d: %w", r.Priority, err)
+			}
+			for i := 0; i < len(data); i += recordSize {
+				messageId, err := decodeIndexRecord(data[i:], recordSize, path, int64(start)*int64(recordSize)+int64(i))
+				if err != nil {
+					return nil, "", err
+				}
+				items = append(items, &QueueItem{MessageId: messageId, Priority: r.Priority})
+			}
+		}
+		if len(items) == pageSize {
+			cursor.Offset = start + count
+			if cursor.Offset < r.End || cursor.Position+1 < len(cursor.Ranges) {
+				token, err := encodeListCursor(cursor)
+				return items, token, err
+			}
+			return items, "", nil
+		}
+	}
+	return items, "", nil
+}
+
+// A listing of locked messages pages through the locks, in the order of
+// sortedLocks, then through the invisible heap. Locks taken meanwhile are
+// listed if they sort after the last lock listed.
+type lockListCursor struct {
+	Priority uint64    `json:"p"`
+	LockId   uuid.UUID `json:"l"`           // last lock listed, nil before the first
+	Heap     *string   `json:"h,omitempty"` // token of the invisible heap listing, once every lock is listed
+}
+
+// Callers hold q.mu.
+func (q *Queue) listLocks(options ListOptions) ([]*QueueItem, string, error) {
+	pageSize := options.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultListPageSize
+	}
+	cursor := &lockListCursor{}
+	if options.ContinuationToken != "" {
+		if err := decodeListCursor(options.ContinuationToken, cursor); err != nil {
+			return nil, "", err
+		}
+	}
+	items := make([]*QueueItem, 0)
+	next := func() ([]*QueueItem, string, error) {
+		token, err := encodeListCursor(cursor)
+		return items, token, err
+	}
+	if cursor.Heap == nil {
+		for _, lockId := range q.groups.sortedLocks() {
+			item := q.groups.locks[lockId].item
+			if !options.Priorities.Contains(item.Priority) || !cursor.before(item.Priority, lockId) {
+				continue
+			}
+			if len(items) == pageSize {
+				return next()
+			}
+			items = append(items, &item)
+			cursor.Priority, cursor.LockId = item.Priority, lockId
+		}
+		cursor.Heap = new(string)
+	}
+	if q.invisibileHeap == nil {
+		return items, "", nil
+	}
+	if len(items) == pageSize {
+		if empty, _ := q.invisibileHeap.IsEmpty(); empty {
+			return items, "", nil
+		}
+		return next()
+	}
+	locked, token, err := q.listHeap(q.invisibileHeap, "invisible", ListOptions{PageSize: pageSize - len(items), ContinuationToken: *cursor.Heap, Priorities: options.Priorities})
+	if err != nil {
+		return nil, "", err
+	}
+	items = append(items, locked...)
+	if token == "" {
+		return items, "", nil
+	}
+	cursor.Heap = &token
+	return next()
+}
+
+// Whether the lock sorts after the last lock listed.
+func (c *lockListCursor) before(priority uint64, lockId uuid.UUID) bool {
+	if c.LockId == uuid.Nil {
+		return true
+	}
+	if order := comparePriorities(c.Priority, priority); order != 0 {
+		return order < 0
+	}
+	return bytes.Compare(c.LockId[:], lockId[:]) < 0
+}
@@ -0,0 +1,126 @@
+package queue
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/kokaq/core/internals/metrics"
+)
+
+var (
+	heapMessages         = metrics.Default.Gauge("kokaq_heap_messages", "Messages stored in a queue heap (main is the visible depth, dlq the dead letters). Messages locked by PeekLock are reported by kokaq_queue_held_messages.", "namespace", "queue", "dir", "heap")
+	heapPriorityMessages = metrics.Default.Gauge("kokaq_heap_priority_messages", "Messages stored in a queue heap per priority.", "namespace", "queue", "dir", "heap", "priority")
+	heapEnqueued         = metrics.Default.Counter("kokaq_heap_enqueued_total", "Messages enqueued into a queue heap.", "namespace", "queue", "dir", "heap")
+	heapDequeued         = metrics.Default.Counter("kokaq_heap_dequeued_total", "Messages dequeued from a queue heap.", "namespace", "queue", "dir", "heap")
+	heapPageLoads        = metrics.Default.Counter("kokaq_heap_page_loads_total", "Heap pages read from the pages file.", "namespace", "queue", "dir", "heap")
+	heapPageCommits      = metrics.Default.Counter("kokaq_heap_page_commits_total", "Heap pages written back to the pages file.", "namespace", "queue", "dir", "heap")
+	heapPageCacheHits    = metrics.Default.Counter("kokaq_heap_page_cache_hits_total", "Heap page lookups served from the page cache.", "namespace", "queue", "dir", "heap")
+	heapPageCacheMisses  = metrics.Default.Counter("kokaq_heap_page_cache_misses_total", "Heap page lookups that had to read the pages file.", "namespace", "queue", "dir", "heap")
+	queueDuplicates      = metrics.Default.Counter("kokaq_queue_duplicates_total", "Enqueues of a queue ignored as duplicates within its dedup window.", "namespace", "queue", "dir")
+	queueHeldMessages    = metrics.Default.Gauge("kokaq_queue_held_messages", "Messages of a queue held out of its main heap: locked, delayed until their retry, or waiting behind their group.", "namespace", "queue", "dir", "state")
+)
+
+type heapMetrics struct {
+	labels      []string
+	messages    *metrics.Gauge
+	enqueued    *metrics.Counter
+	dequeued    *metrics.Counter
+	pageLoads   *metrics.Counter
+	pageCommits *metrics.Counter
+	cacheHits   *metrics.Counter
+	cacheMisses *metrics.Counter
+}
+
+// Heaps live in <namespace>/<queue>/<heap>, so the labels are taken from the
+// directory layout rather than threaded through every constructor. Names can
+// repeat under other data directories, the absolute queue directory cannot.
+func newHeapMetrics(parentDirectory string) *heapMetrics {
+	labels := append(queueLabels(filepath.Dir(parentDirectory)), filepath.Base(parentDirectory))
+	return &heapMetrics{
+		labels:      labels,
+		messages:    heapMessages.With(labels...),
+		enqueued:    heapEnqueued.With(labels...),
+		dequeued:    heapDequeued.With(labels...),
+		pageLoads:   heapPageLoads.With(labels...),
+		pageCommits: heapPageCommits.With(labels...),
+		cacheHits:   heapPageCacheHits.With(labels...),
+		cacheMisses: heapPageCacheMisses.With(labels...),
+	}
+}
+
+func queueLabels(queueDir string) []string {
+	dir, err := filepath.Abs(queueDir)
+	if err != nil {
+		dir = filepath.Clean(queueDir)
+	}
+	return []string{filepath.Base(filepath.Dir(queueDir)), filepath.Base(queueDir), dir}
+}
+
+func (m *heapMetrics) priority(priority uint64) *metrics.Gauge {
+	return heapPriorityMessages.With(append(m.labels, fmt.Sprint(priority))...)
+}
+
+func (m *heapMetrics) onEnqueue(priority uint64) {
+	m.enqueued.Inc()
+	m.messages.Inc()
+	m.priority(priority).Inc()
+}
+
+func (m *heapMetrics) onDequeue(priority uint64) {
+	m.dequeued.Inc()
+	m.messages.Dec()
+	if gauge := m.priority(priority); gauge.Value() > 1 {
+		gauge.Dec()
+	} else {
+		heapPriorityMessages.Delete(append(m.labels, fmt.Sprint(priority))...)
+	}
+}
+
+func (m *heapMetrics) onClear(priority uint64, messages uint64) {
+	m.messages.Add(-float64(messages))
+	heapPriorityMessages.Delete(append(m.labels, fmt.Sprint(priority))...)
+}
+
+// Report the messages of a heap just opened.
+func (m *heapMetrics) load(priorities map[uint64]*priorityState) {
+	var messages uint64
+	for priority, state := range priorities {
+		messages += state.messages
+		m.priority(priority).Set(float64(state.messages))
+	}
+	m.messages.Set(float64(messages))
+}
+
+// Remove the series of a closed heap, so a heap opened again in the same
+// directory starts from its own state.
+func (m *heapMetrics) close(priorities map[uint64]*priorityState) {
+	for priority := range priorities {
+		heapPriorityMessages.Delete(append(m.labels, fmt.Sprint(priority))...)
+	}
+	heapMessages.Delete(m.labels...)
+	for _, counter := range []*metrics.CounterVec{heapEnqueued, heapDequeued, heapPageLoads, heapPageCommits, heapPageCacheHits, heapPageCacheMisses} {
+		counter.Delete(m.labels...)
+	}
+}
+
+// Labels of the queue, like those of its heaps.
+func (q *Queue) metricLabels() []string {
+	return queueLabels(q.RootDir)
+}
+
+// Report the messages held by the groups table. Callers hold q.mu.
+func (q *Queue) publishHeld() {
+	labels := q.metricLabels()
+	queueHeldMessages.With(append(labels, "locked")...).Set(float64(len(q.groups.locks)))
+	queueHeldMessages.With(append(labels, "delayed")...).Set(float64(len(q.groups.delayed)))
+	queueHeldMessages.With(append(labels, "waiting")...).Set(float64(len(q.groups.waiting())))
+}
+
+// Remove the series of a closed queue. Callers hold q.mu.
+func (q *Queue) deleteMetrics() {
+	labels := q.metricLabels()
+	for _, state := range []string{"locked", "delayed", "waiting"} {
+		queueHeldMessages.Delete(append(labels, state)...)
+	}
+	queueDuplicates.Delete(labels...)
+}
@@ -1,8 +1,10 @@
 package queue
 
 import (
+	"errors"
 	"fmt"
 	"path/filepath"
+	"sync"
 
 	"github.com/kokaq/core/utils"
 )
@@ -10,6 +12,7 @@ import (
 type NamespaceConfig struct {
 	NamespaceName string
 	NamespaceId   uint32
+	Quotas        NamespaceQuotas
 }
 
 type Namespace struct {
@@ -17,19 +20,35 @@ type Namespace struct {
 	Id      uint32
 	RootDir string
 	Queues  map[uint32]*Queue
+
+	policyMu sync.RWMutex
+	policy   *Policy
+
+	catalogMu sync.RWMutex
+	catalog   *catalog
+
+	quota *namespaceQuota
 }
 
-func NewNamespace(parentDirectory string, config NamespaceConfig) *Namespace {
+func NewNamespace(parentDirectory string, config NamespaceConfig) (*Namespace, error) {
 	n := &Namespace{
 		Name:    config.NamespaceName,
 		Queues:  make(map[uint32]*Queue, 0),
 		Id:      config.NamespaceId,
+		quota:   newNamespaceQuota(config.Quotas),
 		RootDir: filepath.Join(parentDirectory, fmt.Sprintf("%s-%d", config.NamespaceName, config.NamespaceId)),
 	}
 	if err := utils.EnsureDirectoryCreated(n.RootDir); err != nil {
-		panic(fmt.Errorf("failed to create root directory for namespace %s: %w", n.Name, err))
+		return nil, fmt.Errorf("failed to create root directory for namespace %s: %w", n.Name, err)
+	}
+	var err error
+	if n.policy, err = loadPolicy(n.policyPath()); err != nil {
+		return nil, fmt.Errorf("failed to load policy for namespace %s: %w", n.Name, err)
+	}
+	if n.catalog, err = loadCatalog(n.catalogPath()); err != nil {
+		return nil, fmt.Errorf("failed to load catalog for namespace %s: %w", n.Name, err)
 	}
-	return n
+	return n, nil
 }
 
 func (n *Namespace) GetQueue(queueId uint32) (*Queue, error) {
@@ -44,6 +63,7 @@ func (n *Namespace) AddQueue(q *QueueConfiguration) (*Queue, error) {
 	if n.Queues[q.QueueId], err = NewQueue(n.RootDir, *q); err != nil {
 		return nil, fmt.Errorf("failed to add queue %s: %w", q.QueueName, err)
 	}
+	n.Queues[q.QueueId].attachQuota(n.quota)
 	return n.Queues[q.QueueId], nil
 }
 
@@ -64,14 +84,64 @@ func (n *Namespace) ClearQueue(queueId uint32) error {
 }
 
 func (n *Namespace) DeleteQueue(queueId uint32) error {
-	if _, exists := n.Queues[queueId]; exists {
-		n.Queues[queueId].Delete()
+	if q, exists := n.Queues[queueId]; exists && q != nil {
+		q.Delete()
+		n.quota.remove(q)
 		n.Queues[queueId] = nil
 	}
 	rootDir := filepath.Join(n.RootDir, fmt.Sprint(queueId))
 	if err := utils.EnsureDirectoryDeleted(rootDir); err != nil {
 		return fmt.Errorf("failed to delete queue directory %s: %w", rootDir, err)
 	}
+	n.catalogMu.Lock()
+	defer n.catalogMu.Unlock()
+	if err := n.unsubscribeQueue(queueId); err != nil {
+		return fmt.Errorf("failed to unsubscribe queue %d: %w", queueId, err)
+	}
+	return nil
+}
 
+// Close every loaded queue of the namespace, releasing their file handles.
+func (n *Namespace) Close() error {
+	var errs []error
+	for queueId, q := range n.Queues {
+		if q == nil {
+			continue
+		}
+		if err := q.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close queue %d: %w", queueId, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Replace the authorization policy of the namespace and persist it.
+// A nil policy disables authorization checks.
+func (n *Namespace) SetPolicy(policy *Policy) error {
+	n.policyMu.Lock()
+	defer n.policyMu.Unlock()
+	if err := savePolicy(n.policyPath(), policy); err != nil {
+		return fmt.Errorf("failed to save policy for namespace %s: %w", n.Name, err)
+	}
+	n.policy = policy.clone()
 	return nil
 }
+
+// GetPolicy returns a copy of the authorization policy; changing it has no
+// effect until it is set again.
+func (n *Namespace) GetPolicy() *Policy {
+	n.policyMu.RLock()
+	defer n.policyMu.RUnlock()
+	return n.policy.clone()
+}
+
+// Check whether principal may perform an operation needing permission on a queue.
+// Namespaces without a policy allow everything.
+func (n *Namespace) Authorize(principal string, queueId uint32, permission Permission) error {
+	n.policyMu.RLock()
+	defer n.policyMu.RUnlock()
+	if n.policy == nil || n.policy.IsAllowed(principal, queueId, permission) {
+		return nil
+	}
+	return fmt.Errorf("%s on queue %d for principal %q: %w", permission, queueId, principal, ErrAccessDenied)
+}
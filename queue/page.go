@@ -1,8 +1,10 @@
 package queue
 
 type Page struct {
-	index int
-	data  []byte
+	index  int
+	data   []byte
+	dirty  bool // modified in memory since it was last written to disk
+	shared bool // data is a view of the page store, copied before it is modified
 }
 
 func NewPage() *Page {
@@ -23,4 +25,10 @@ func (p *Page) GetData() []byte {
 func (p *Page) SetData(index int, data []byte) {
 	p.index = index
 	p.data = data
+	p.dirty = true
+	p.shared = false
+}
+
+func (p *Page) IsDirty() bool {
+	return p.dirty
 }
@@ -0,0 +1,163 @@
+package queue
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"sort"
+
+	"github.com/kokaq/core/utils"
+)
+
+const defaultPageCachePages = 16
+
+type HeapOptions struct {
+	PageCachePages int // pages kept in memory, defaults to 16
+	PageCacheBytes int // upper bound on cached page bytes, 0 for no bound
+	MaxOpenFiles   int // descriptors kept open for pages and index files, defaults to 64
+	PageStore      PageStoreKind
+	Durability     Durability
+	FileSystem     utils.FileSystem // defaults to the operating system, not used to map pages
+	Clock          Clock            // stamps enqueues, defaults to the system clock
+}
+
+// pageCache keeps the most recently used heap pages in memory. Modified
+// pages are marked dirty and written back when evicted or flushed.
+type pageCache struct {
+	maxPages int
+	path     string
+	pageSize int
+	entries  map[int]*list.Element
+	lru      *list.List
+	hits     uint64
+	misses   uint64
+	reads    uint64
+	writes   uint64
+	store    pageStore
+	metrics  *heapMetrics
+}
+
+func newPageCache(options HeapOptions, path string, pageSize int, store pageStore, metrics *heapMetrics) *pageCache {
+	maxPages := options.PageCachePages
+	if maxPages <= 0 {
+		maxPages = defaultPageCachePages
+	}
+	if options.PageCacheBytes > 0 {
+		maxPages = min(maxPages, options.PageCacheBytes/pageSize)
+	}
+	return &pageCache{
+		maxPages: max(maxPages, 1),
+		path:     path,
+		pageSize: pageSize,
+		entries:  make(map[int]*list.Element),
+		lru:      list.New(),
+		store:    store,
+		metrics:  metrics,
+	}
+}
+
+// Get a page, reading it from disk on a miss. The returned page stays valid
+// until the next call loading another page.
+func (c *pageCache) get(pageNumber int) (*Page, error) {
+	if element, exists := c.entries[pageNumber]; exists {
+		c.hits++
+		c.metrics.cacheHits.Inc()
+		c.lru.MoveToFront(element)
+		return element.Value.(*Page), nil
+	}
+	c.misses++
+	c.metrics.cacheMisses.Inc()
+	data, err := c.store.readPage(pageNumber)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read page %d: %w", pageNumber, err)
+	}
+	c.reads++
+	c.metrics.pageLoads.Inc()
+	if len(data) < c.pageSize {
+		// Pages past the end of the file read as empty
+		data = append(data, make([]byte, c.pageSize-len(data))...)
+	}
+	if err = verifyPage(data, c.path, int64(pageNumber-1)*int64(c.pageSize)); err != nil {
+		return nil, err
+	}
+	page := &Page{index: pageNumber, data: data, shared: c.store.shared()}
+	if err = c.insert(page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Create an empty dirty page, replacing whatever was stored at pageNumber.
+func (c *pageCache) create(pageNumber int) (*Page, error) {
+	if element, exists := c.entries[pageNumber]; exists {
+		c.lru.Remove(element)
+		delete(c.entries, pageNumber)
+	}
+	page := &Page{index: pageNumber, data: make([]byte, c.pageSize), dirty: true}
+	if err := c.insert(page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Mark a page as about to be modified. A page sharing its data with the
+// store is copied first, so nothing changes on disk until it is sealed and
+// written back.
+func (c *pageCache) modify(page *Page) {
+	if page.shared {
+		page.data = bytes.Clone(page.data)
+		page.shared = false
+	}
+	page.dirty = true
+}
+
+func (c *pageCache) insert(page *Page) error {
+	c.entries[page.index] = c.lru.PushFront(page)
+	for c.lru.Len() > c.maxPages {
+		oldest := c.lru.Back()
+		evicted := oldest.Value.(*Page)
+		if err := c.writeBack(evicted); err != nil {
+			return err
+		}
+		c.lru.Remove(oldest)
+		delete(c.entries, evicted.index)
+	}
+	return nil
+}
+
+func (c *pageCache) writeBack(page *Page) error {
+	if !page.dirty {
+		return nil
+	}
+	sealPage(page.data)
+	if err := c.store.writePage(page.index, page.data); err != nil {
+		return fmt.Errorf("failed to write back page %d: %w", page.index, err)
+	}
+	c.writes++
+	c.metrics.pageCommits.Inc()
+	page.dirty = false
+	return nil
+}
+
+// Write every dirty page back, in page order.
+func (c *pageCache) flush() error {
+	dirty := make([]*Page, 0)
+	for element := c.lru.Front(); element != nil; element = element.Next() {
+		if page := element.Value.(*Page); page.dirty {
+			dirty = append(dirty, page)
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i].index < dirty[j].index })
+	for _, page := range dirty {
+		if err := c.writeBack(page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Drop every cached page without writing anything back.
+func (c *pageCache) reset() {
+	c.entries = make(map[int]*list.Element)
+	c.lru.Init()
+}
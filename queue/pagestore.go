@@ -0,0 +1,69 @@
+package queue
+
+import (
+	"fmt"
+
+	"github.com/kokaq/core/utils"
+)
+
+type PageStoreKind uint8
+
+const (
+	// Pages are read into and written from memory buffers through the file handle manager.
+	PageStoreFile PageStoreKind = iota
+	// Pages are views of a shared memory mapping of the pages file.
+	PageStoreMmap
+)
+
+// pageStore is where the page cache reads pages from and writes them back to.
+type pageStore interface {
+	// Read a page, returning fewer bytes (possibly none) past the end of the store.
+	readPage(pageNumber int) ([]byte, error)
+	writePage(pageNumber int, data []byte) error
+	// Whether pages read are views of the store rather than copies.
+	shared() bool
+	truncate() error
+	sync() error
+	close() error
+}
+
+func newPageStore(kind PageStoreKind, path string, pageSize int, files *utils.FileManager) (pageStore, error) {
+	switch kind {
+	case PageStoreFile:
+		return &filePageStore{path: path, pageSize: pageSize, files: files}, nil
+	case PageStoreMmap:
+		return newMmapPageStore(path, pageSize)
+	}
+	return nil, fmt.Errorf("unknown page store kind %d", kind)
+}
+
+type filePageStore struct {
+	path     string
+	pageSize int
+	files    *utils.FileManager
+}
+
+func (s *filePageStore) readPage(pageNumber int) ([]byte, error) {
+	return s.files.ReadAt(s.path, int64(pageNumber-1)*int64(s.pageSize), s.pageSize)
+}
+
+func (s *filePageStore) writePage(pageNumber int, data []byte) error {
+	return s.files.WriteAt(s.path, int64(pageNumber-1)*int64(s.pageSize), data)
+}
+
+func (s *filePageStore) shared() bool {
+	return false
+}
+
+func (s *filePageStore) truncate() error {
+	return s.files.Truncate(s.path, 0)
+}
+
+func (s *filePageStore) sync() error {
+	return nil
+}
+
+// The file handle manager is owned and closed by the heap.
+func (s *filePageStore) close() error {
+	return nil
+}
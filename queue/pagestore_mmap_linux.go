@@ -0,0 +1,143 @@
+//go:build linux
+
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// mmapPageStore maps the pages file into memory and hands out pages as views
+// of the mapping, so nothing is copied until a page is modified. Modified
+// pages are private copies until written back sealed, so a crash never leaves
+// a page in the file that does not match its checksum.
+//
+// Growing the file remaps it at the new size. Previous mappings are kept
+// until close because cached pages may still point into them; they share the
+// file's pages with the current mapping, so writes through them stay visible.
+type mmapPageStore struct {
+	path     string
+	pageSize int
+	file     *os.File
+	data     []byte
+	retired  [][]byte
+}
+
+func newMmapPageStore(path string, pageSize int) (pageStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat file %s: %w", path, err)
+	}
+	s := &mmapPageStore{path: path, pageSize: pageSize, file: file}
+	if size := info.Size() - info.Size()%int64(pageSize); size > 0 {
+		if err = s.remap(int(size)); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *mmapPageStore) remap(size int) error {
+	data, err := syscall.Mmap(int(s.file.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("failed to map file %s: %w", s.path, err)
+	}
+	if s.data != nil {
+		s.retired = append(s.retired, s.data)
+	}
+	s.data = data
+	return nil
+}
+
+// View of a page, growing the file and the mapping if needed and allowed.
+func (s *mmapPageStore) view(pageNumber int, grow bool) ([]byte, error) {
+	start := (pageNumber - 1) * s.pageSize
+	end := start + s.pageSize
+	if end > len(s.data) {
+		if !grow {
+			return nil, nil
+		}
+		// Grow geometrically to keep the number of mappings small
+		size := max(end, 2*len(s.data))
+		if err := s.file.Truncate(int64(size)); err != nil {
+			return nil, fmt.Errorf("failed to grow file %s: %w", s.path, err)
+		}
+		if err := s.remap(size); err != nil {
+			return nil, err
+		}
+	}
+	return s.data[start:end:end], nil
+}
+
+func (s *mmapPageStore) readPage(pageNumber int) ([]byte, error) {
+	return s.view(pageNumber, false)
+}
+
+func (s *mmapPageStore) writePage(pageNumber int, data []byte) error {
+	page, err := s.view(pageNumber, true)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 && &page[0] != &data[0] {
+		copy(page, data)
+	}
+	return nil
+}
+
+func (s *mmapPageStore) shared() bool {
+	return true
+}
+
+// Callers must drop every page handed out before truncating.
+func (s *mmapPageStore) truncate() error {
+	if err := s.unmapAll(); err != nil {
+		return err
+	}
+	if err := s.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate file %s: %w", s.path, err)
+	}
+	return nil
+}
+
+func (s *mmapPageStore) sync() error {
+	if len(s.data) == 0 {
+		return nil
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&s.data[0])), uintptr(len(s.data)), syscall.MS_SYNC)
+	if errno != 0 {
+		return fmt.Errorf("failed to msync file %s: %w", s.path, errno)
+	}
+	return nil
+}
+
+func (s *mmapPageStore) unmapAll() error {
+	var errs []error
+	for _, data := range append(s.retired, s.data) {
+		if data == nil {
+			continue
+		}
+		if err := syscall.Munmap(data); err != nil {
+			errs = append(errs, fmt.Errorf("failed to unmap file %s: %w", s.path, err))
+		}
+	}
+	s.data = nil
+	s.retired = nil
+	return errors.Join(errs...)
+}
+
+func (s *mmapPageStore) close() error {
+	unmapErr := s.unmapAll()
+	if err := s.file.Close(); err != nil {
+		return errors.Join(unmapErr, fmt.Errorf("failed to close file %s: %w", s.path, err))
+	}
+	return unmapErr
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package queue
+
+import "fmt"
+
+func newMmapPageStore(path string, pageSize int) (pageStore, error) {
+	return nil, fmt.Errorf("mmap page store is only supported on linux")
+}
@@ -0,0 +1,206 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/kokaq/core/utils"
+	"github.com/kokaq/core/utils/murmur"
+)
+
+type PartitionedQueueConfiguration struct {
+	QueueName       string
+	QueueId         uint32
+	Partitions      int
+	EnableDLQ       bool
+	EnableInvisible bool
+	HeapOptions     HeapOptions
+}
+
+// PartitionedQueue spreads its messages across queues, so partitions can
+// be enqueued to concurrently. A message goes to the partition selected by
+// the murmur3 hash of its partition key, its message id by default.
+// Dequeue merges the heads of the partitions to keep the global priority
+// order. Partition i is stored as a queue in <queue>/<i>.
+type PartitionedQueue struct {
+	Id         uint32
+	Name       string
+	RootDir    string
+	partitions []*Queue
+
+	mu   sync.Mutex // serializes merged dequeues
+	next int        // partition preferred on ties, rotated for fairness
+}
+
+func NewPartitionedQueue(parentDirectory string, config PartitionedQueueConfiguration) (*PartitionedQueue, error) {
+	if config.Partitions < 1 {
+		return nil, fmt.Errorf("partitioned queue %s needs at least one partition, got %d", config.QueueName, config.Partitions)
+	}
+	rootDir := filepath.Join(parentDirectory, fmt.Sprint(config.QueueId))
+	if err := utils.EnsureDirectoryCreated(rootDir); err != nil {
+		return nil, fmt.Errorf("failed to create directory for queue %s: %w", config.QueueName, err)
+	}
+	// Keys map to other partitions when their count changes
+	existing, err := countPartitions(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	if existing > 0 && existing != config.Partitions {
+		return nil, fmt.Errorf("queue %s has %d partitions, not %d", config.QueueName, existing, config.Partitions)
+	}
+
+	pq := &PartitionedQueue{Id: config.QueueId, Name: config.QueueName, RootDir: rootDir}
+	for i := range config.Partitions {
+		partition, err := NewQueue(rootDir, QueueConfiguration{
+			QueueName:       fmt.Sprintf("%s/%d", config.QueueName, i),
+			QueueId:         uint32(i),
+			EnableDLQ:       config.EnableDLQ,
+			EnableInvisible: config.EnableInvisible,
+			HeapOptions:     config.HeapOptions,
+		})
+		if err != nil {
+			pq.Close()
+			return nil, fmt.Errorf("failed to create partition %d of queue %s: %w", i, config.QueueName, err)
+		}
+		pq.partitions = append(pq.partitions, partition)
+	}
+	return pq, nil
+}
+
+func countPartitions(rootDir string) (int, error) {
+	entries, err := os.ReadDir(rootDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read queue directory %s: %w", rootDir, err)
+	}
+	count := 0
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (pq *PartitionedQueue) Partitions() int {
+	return len(pq.partitions)
+}
+
+// Partition a key is assigned to.
+func (pq *PartitionedQueue) PartitionFor(key []byte) int {
+	return int(murmur.Sum32(key) % uint32(len(pq.partitions)))
+}
+
+// Enqueue a message in the partition of its message id.
+func (pq *PartitionedQueue) Enqueue(item *QueueItem) error {
+	return pq.EnqueueWithKey(item, item.MessageId[:])
+}
+
+// Enqueue a message in the partition of key. Messages sharing a key are
+// dequeued in priority order relative to each other.
+func (pq *PartitionedQueue) EnqueueWithKey(item *QueueItem, key []byte) error {
+	partition := pq.PartitionFor(key)
+	if err := pq.partitions[partition].Enqueue(item); err != nil {
+		return fmt.Errorf("failed to enqueue in partition %d: %w", partition, err)
+	}
+	return nil
+}
+
+// Dequeue the highest-priority message across partitions. Ties between
+// partitions are broken round-robin.
+func (pq *PartitionedQueue) Dequeue() (*QueueItem, error) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	partition, _, err := pq.head()
+	if err != nil {
+		return nil, err
+	}
+	item, err := pq.partitions[partition].Dequeue()
+	if err != nil {
+		return nil, fmt.Errorf("failed to dequeue from partition %d: %w", partition, err)
+	}
+	pq.next = (partition + 1) % len(pq.partitions)
+	return item, nil
+}
+
+// Peek at the message Dequeue would return.
+func (pq *PartitionedQueue) Peek() (*QueueItem, error) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	_, item, err := pq.head()
+	return item, err
+}
+
+// Partition holding the highest-priority head, and that head. Callers hold pq.mu.
+func (pq *PartitionedQueue) head() (int, *QueueItem, error) {
+	best, bestItem := -1, (*QueueItem)(nil)
+	for offset := range pq.partitions {
+		partition := (pq.next + offset) % len(pq.partitions)
+		empty, err := pq.partitions[partition].IsEmpty()
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to check partition %d: %w", partition, err)
+		}
+		if empty {
+			continue
+		}
+		item, err := pq.partitions[partition].Peek()
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to peek partition %d: %w", partition, err)
+		}
+		if bestItem == nil || outranks(item.Priority, bestItem.Priority) {
+			best, bestItem = partition, item
+		}
+	}
+	if bestItem == nil {
+		return 0, nil, fmt.Errorf("queue %s is empty", pq.Name)
+	}
+	return best, bestItem, nil
+}
+
+func (pq *PartitionedQueue) IsEmpty() (bool, error) {
+	for i, partition := range pq.partitions {
+		empty, err := partition.IsEmpty()
+		if err != nil {
+			return false, fmt.Errorf("failed to check partition %d: %w", i, err)
+		}
+		if !empty {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Stats of every partition, indexed by partition.
+func (pq *PartitionedQueue) PartitionStats() ([]map[string]uint64, error) {
+	stats := make([]map[string]uint64, 0, len(pq.partitions))
+	for i, partition := range pq.partitions {
+		partitionStats, err := partition.GetStats()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get stats of partition %d: %w", i, err)
+		}
+		stats = append(stats, partitionStats)
+	}
+	return stats, nil
+}
+
+func (pq *PartitionedQueue) Flush() error {
+	for i, partition := range pq.partitions {
+		if err := partition.Flush(); err != nil {
+			return fmt.Errorf("failed to flush partition %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (pq *PartitionedQueue) Close() error {
+	var errs []error
+	for i, partition := range pq.partitions {
+		if err := partition.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close partition %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,195 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/kokaq/core/utils"
+)
+
+// ErrAccessDenied is returned by authorization checks when a principal is not
+// allowed to perform an operation on a queue.
+var ErrAccessDenied = errors.New("access denied")
+
+type Permission uint8
+
+const (
+	PermissionEnqueue Permission = 1 << iota
+	PermissionConsume
+	PermissionAdmin
+
+	// Admin implies every other permission.
+	PermissionAll = PermissionEnqueue | PermissionConsume | PermissionAdmin
+)
+
+func (p Permission) String() string {
+	switch p {
+	case PermissionEnqueue:
+		return "enqueue"
+	case PermissionConsume:
+		return "consume"
+	case PermissionAdmin:
+		return "admin"
+	}
+	return fmt.Sprintf("permission(%d)", uint8(p))
+}
+
+type Effect uint8
+
+const (
+	EffectAllow Effect = iota
+	EffectDeny
+)
+
+// AnyPrincipal matches every principal in a role binding.
+const AnyPrincipal = "*"
+
+const policyFileName = "policy.json"
+
+type Role struct {
+	Name        string
+	Permissions Permission
+}
+
+// Built-in roles, available in every policy unless overridden by name.
+var (
+	RoleProducer = Role{Name: "producer", Permissions: PermissionEnqueue}
+	RoleConsumer = Role{Name: "consumer", Permissions: PermissionConsume}
+	RoleAdmin    = Role{Name: "admin", Permissions: PermissionAll}
+)
+
+type RoleBinding struct {
+	Principal string
+	Role      string
+	Queues    []uint32 // empty applies to every queue in the namespace
+	Effect    Effect
+}
+
+type Policy struct {
+	Roles    map[string]Role
+	Bindings []RoleBinding
+}
+
+func NewPolicy() *Policy {
+	return &Policy{
+		Roles:    make(map[string]Role),
+		Bindings: make([]RoleBinding, 0),
+	}
+}
+
+// Deep copy of the policy, nil for a nil policy.
+func (p *Policy) clone() *Policy {
+	if p == nil {
+		return nil
+	}
+	clone := &Policy{Roles: maps.Clone(p.Roles), Bindings: slices.Clone(p.Bindings)}
+	for i := range clone.Bindings {
+		clone.Bindings[i].Queues = slices.Clone(clone.Bindings[i].Queues)
+	}
+	return clone
+}
+
+// Register a custom role, replacing any role with the same name.
+func (p *Policy) AddRole(role Role) {
+	if p.Roles == nil {
+		p.Roles = make(map[string]Role)
+	}
+	p.Roles[role.Name] = role
+}
+
+// Allow binds principal to role on the given queues (all queues if none).
+func (p *Policy) Allow(principal string, role string, queues ...uint32) {
+	p.Bindings = append(p.Bindings, RoleBinding{Principal: principal, Role: role, Queues: queues, Effect: EffectAllow})
+}
+
+// Deny revokes the permissions of role from principal on the given queues (all queues if none).
+func (p *Policy) Deny(principal string, role string, queues ...uint32) {
+	p.Bindings = append(p.Bindings, RoleBinding{Principal: principal, Role: role, Queues: queues, Effect: EffectDeny})
+}
+
+func (p *Policy) getRole(name string) (Role, bool) {
+	if role, exists := p.Roles[name]; exists {
+		return role, true
+	}
+	for _, role := range []Role{RoleProducer, RoleConsumer, RoleAdmin} {
+		if role.Name == name {
+			return role, true
+		}
+	}
+	return Role{}, false
+}
+
+// IsAllowed evaluates every binding matching principal and queueId.
+// A deny revoking any of the permissions wins over a matching allow, and
+// anything not explicitly allowed is denied.
+func (p *Policy) IsAllowed(principal string, queueId uint32, permission Permission) bool {
+	allowed := false
+	for _, binding := range p.Bindings {
+		if binding.Principal != principal && binding.Principal != AnyPrincipal {
+			continue
+		}
+		if len(binding.Queues) > 0 && !slices.Contains(binding.Queues, queueId) {
+			continue
+		}
+		role, exists := p.getRole(binding.Role)
+		if !exists {
+			continue
+		}
+		granted := role.Permissions
+		if granted&PermissionAdmin != 0 {
+			granted = PermissionAll
+		}
+		if binding.Effect == EffectDeny {
+			if granted&permission != 0 {
+				return false
+			}
+			continue
+		}
+		if granted&permission == permission {
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+func loadPolicy(path string) (*Policy, error) {
+	if !utils.FileExists(path) {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file %s: %w", path, err)
+	}
+	policy := NewPolicy()
+	if err = json.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file %s: %w", path, err)
+	}
+	return policy, nil
+}
+
+func savePolicy(path string, policy *Policy) error {
+	if policy == nil {
+		return utils.EnsureFileDeleted(path)
+	}
+	data, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode policy: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	if err = os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write policy file %s: %w", tmpPath, err)
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace policy file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (n *Namespace) policyPath() string {
+	return filepath.Join(n.RootDir, policyFileName)
+}
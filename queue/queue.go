@@ -1,19 +1,49 @@
 package queue
 
 import (
+	"errors"
 	"fmt"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/kokaq/core/internals/logger"
 	"github.com/kokaq/core/utils"
 )
 
+// Geometry of the heaps of every queue
+const (
+	queueHeapMaxSize   = 5
+	queuePrioritySize  = 8
+	queueIndexSize     = 8
+	queueMessageIdSize = 16
+)
+
+// Heaps of a queue, in <queue>/<name>
+var queueHeapNames = []string{"main", "invisible", "dlq"}
+
 type QueueConfiguration struct {
 	QueueName       string
 	QueueId         uint32
 	EnableDLQ       bool
 	EnableInvisible bool
+	HeapOptions     HeapOptions
+	Replica         ReplicaRole
+	// Entries of the replication log kept past those every connected
+	// follower applied, for followers resuming. Defaults to 4096.
+	ReplicationRetention uint64
+	// Enqueues of a message id or dedup key already enqueued within the
+	// window succeed without effect. Zero disables deduplication.
+	DedupWindow time.Duration
+	// Duplicates fail with ErrDuplicateMessage instead of being ignored.
+	RejectDuplicates bool
+	Retry            RetryPolicy
+	// Locked messages are visible again once their lock is held for this
+	// long. Zero keeps them locked until acked or the queue reopens.
+	VisibilityTimeout time.Duration
+	Clock             Clock // defaults to the system clock
+	Limits            QueueLimits
 }
 
 type Queue struct {
@@ -25,11 +55,36 @@ type Queue struct {
 	dlqHeap         *Heap
 	EnableDLQ       bool
 	EnableInvisible bool
+
+	mu         sync.Mutex
+	stopCommit func() // stops the group commit timer, nil without one
+
+	replica      ReplicaRole
+	log          *replicationLog // nil unless replicated
+	unlogged     bool            // a follower may have applied an entry it did not log
+	logRetention uint64          // entries kept past those every follower applied
+	followersMu  sync.Mutex
+	followers    map[string]*followerState
+
+	dedup            *dedupSet // nil without a dedup window
+	rejectDuplicates bool
+	duplicates       uint64 // enqueues ignored as duplicates since the queue opened
+	groups           *groupTable
+	consumers        *consumerGroups
+	retry            RetryPolicy
+	lockTimeout      time.Duration // visibility timeout of new locks, zero if they do not expire
+	clock            Clock
+	limits           QueueLimits
+	quota            *namespaceQuota // nil unless the queue belongs to a namespace
 }
 
 type QueueItem struct {
 	MessageId uuid.UUID
 	Priority  uint64
+	// Messages sharing a group key are delivered in enqueue order, one at
+	// a time: the next one is available once the previous one is acked.
+	// Messages without a group key are independent.
+	GroupKey string
 }
 
 func NewQueue(parentDirectory string, config QueueConfiguration) (*Queue, error) {
@@ -47,31 +102,139 @@ func NewQueue(parentDirectory string, config QueueConfiguration) (*Queue, error)
 		RootDir:         rootDir,
 		EnableDLQ:       config.EnableDLQ,
 		EnableInvisible: config.EnableInvisible,
+		retry:           config.Retry,
+		lockTimeout:     config.VisibilityTimeout,
+		clock:           config.Clock,
+		limits:          config.Limits,
+
+		rejectDuplicates: config.RejectDuplicates,
+	}
+	if q.clock == nil {
+		q.clock = systemClock{}
+	}
+	if config.VisibilityTimeout < 0 {
+		return nil, fmt.Errorf("visibility timeout of queue %s must not be negative, got %s", q.Name, config.VisibilityTimeout)
+	}
+	if config.HeapOptions.Clock == nil {
+		config.HeapOptions.Clock = q.clock
 	}
 
-	q.mainHeap, err = NewHeap(filepath.Join(q.RootDir, "main"), 5, 8, 8, 16)
+	q.mainHeap, err = NewHeapWithOptions(filepath.Join(q.RootDir, "main"), queueHeapMaxSize, queuePrioritySize, queueIndexSize, queueMessageIdSize, config.HeapOptions)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create main heap for queue %s: %w", q.Name, err)
 	}
 
 	if q.EnableInvisible {
-		q.invisibileHeap, err = NewHeap(filepath.Join(q.RootDir, "invisible"), 5, 8, 8, 16)
+		q.invisibileHeap, err = NewHeapWithOptions(filepath.Join(q.RootDir, "invisible"), queueHeapMaxSize, queuePrioritySize, queueIndexSize, queueMessageIdSize, config.HeapOptions)
 		if err != nil {
+			q.closeHeaps()
 			return nil, fmt.Errorf("failed to create invisible heap for queue %s: %w", q.Name, err)
 		}
 	}
 	if q.EnableDLQ {
-		q.dlqHeap, err = NewHeap(filepath.Join(q.RootDir, "dlq"), 5, 8, 8, 16)
+		q.dlqHeap, err = NewHeapWithOptions(filepath.Join(q.RootDir, "dlq"), queueHeapMaxSize, queuePrioritySize, queueIndexSize, queueMessageIdSize, config.HeapOptions)
 		if err != nil {
+			q.closeHeaps()
 			return nil, fmt.Errorf("failed to create dlq heap for queue %s: %w", q.Name, err)
 		}
 	}
+	if config.Replica != ReplicaNone {
+		q.replica = config.Replica
+		q.unlogged = config.Replica == ReplicaFollower
+		q.followers = make(map[string]*followerState)
+		q.logRetention = config.ReplicationRetention
+		if q.logRetention == 0 {
+			q.logRetention = defaultReplicationRetention
+		}
+		if q.log, err = openReplicationLog(filepath.Join(q.RootDir, replicationLogName), config.HeapOptions.Durability.Mode == DurabilitySync); err != nil {
+			q.closeHeaps()
+			return nil, fmt.Errorf("failed to open replication log of queue %s: %w", q.Name, err)
+		}
+	}
+	if config.DedupWindow > 0 {
+		if q.dedup, err = openDedupSet(filepath.Join(q.RootDir, dedupDirectoryName), config.DedupWindow, config.HeapOptions.Durability.Mode == DurabilitySync, q.clock.Now()); err != nil {
+			q.closeHeaps()
+			return nil, fmt.Errorf("failed to open dedup window of queue %s: %w", q.Name, err)
+		}
+	}
+	if q.groups, err = openGroupTable(filepath.Join(q.RootDir, groupsLogName), config.HeapOptions.Durability.Mode); err != nil {
+		q.closeHeaps()
+		return nil, fmt.Errorf("failed to open message groups of queue %s: %w", q.Name, err)
+	}
+	q.groups.onChange = func() {
+		q.publishUsage()
+		q.publishHeld()
+	}
+	q.publishHeld()
+	if q.consumers, err = loadConsumerGroups(filepath.Join(q.RootDir, consumersLogName), config.HeapOptions.Durability.Mode); err != nil {
+		q.closeHeaps()
+		return nil, fmt.Errorf("failed to load consumer groups of queue %s: %w", q.Name, err)
+	}
+	if q.replica == ReplicaPrimary {
+		if err = q.redoLogged(); err != nil {
+			q.closeHeaps()
+			return nil, fmt.Errorf("failed to redo the last mutation of queue %s: %w", q.Name, err)
+		}
+	}
+	if err = q.restoreLocks(); err != nil {
+		q.closeHeaps()
+		return nil, fmt.Errorf("failed to restore locked messages of queue %s: %w", q.Name, err)
+	}
+	if durability := config.HeapOptions.Durability; durability.Mode == DurabilityGroupCommit && durability.GroupCommitInterval > 0 {
+		q.startGroupCommit(durability.GroupCommitInterval)
+	}
 
 	return q, nil
 }
 
+// Commit pending operations every interval, so an idle queue does not hold
+// acknowledged writes longer than promised.
+func (q *Queue) startGroupCommit(interval time.Duration) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	q.stopCommit = sync.OnceFunc(func() {
+		close(stop)
+		<-done
+	})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				q.mu.Lock()
+				for name, heap := range map[string]*Heap{"main": q.mainHeap, "invisible": q.invisibileHeap, "dlq": q.dlqHeap} {
+					if heap == nil {
+						continue
+					}
+					// A failed commit stays pending and is retried by the next operation or tick
+					if err := heap.commitPending(); err != nil {
+						logger.ConsoleLog("ERROR", "failed to commit %s heap of queue %s: %v", name, q.Name, err)
+					}
+				}
+				if err := q.flushLogs(); err != nil {
+					logger.ConsoleLog("ERROR", "failed to commit logs of queue %s: %v", q.Name, err)
+				}
+				q.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// Must be called without holding q.mu.
+func (q *Queue) stopGroupCommit() {
+	if q.stopCommit != nil {
+		q.stopCommit()
+	}
+}
+
 // Check if the queue is empty by attempting to peek at the highest-priority item.
 func (q *Queue) IsEmpty() (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
 	if q.mainHeap == nil {
 		return true, fmt.Errorf("main heap is not initialized for queue %s", q.Name)
 	}
@@ -82,8 +245,86 @@ func (q *Queue) IsEmpty() (bool, error) {
 	return false, nil // If Peek succeeds, the heap is not empty
 }
 
+// Write every modified heap page of the queue to disk.
+func (q *Queue) Flush() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for name, heap := range map[string]*Heap{"main": q.mainHeap, "invisible": q.invisibileHeap, "dlq": q.dlqHeap} {
+		if heap == nil {
+			continue
+		}
+		if err := heap.Flush(); err != nil {
+			return fmt.Errorf("failed to flush %s heap of queue %s: %w", name, q.Name, err)
+		}
+	}
+	return q.flushLogs()
+}
+
+// Sync the logs the queue appends to. Callers hold q.mu.
+func (q *Queue) flushLogs() error {
+	if q.dedup != nil {
+		if err := q.dedup.flush(); err != nil {
+			return err
+		}
+	}
+	if q.groups != nil {
+		if err := q.groups.flush(); err != nil {
+			return err
+		}
+	}
+	if q.consumers != nil {
+		if err := q.consumers.flush(); err != nil {
+			return err
+		}
+	}
+	if q.log != nil {
+		return q.log.flush()
+	}
+	return nil
+}
+
+// Flush the heaps of the queue and release their file handles.
+// The queue cannot be used afterwards.
+func (q *Queue) Close() error {
+	q.stopGroupCommit()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closeHeaps()
+}
+
+func (q *Queue) closeHeaps() error {
+	var errs []error
+	for name, heap := range map[string]*Heap{"main": q.mainHeap, "invisible": q.invisibileHeap, "dlq": q.dlqHeap} {
+		if heap == nil {
+			continue
+		}
+		if err := heap.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close %s heap of queue %s: %w", name, q.Name, err))
+		}
+	}
+	if q.log != nil {
+		errs = append(errs, q.log.close())
+	}
+	if q.dedup != nil {
+		errs = append(errs, q.dedup.close())
+	}
+	if q.groups != nil {
+		errs = append(errs, q.groups.close())
+	}
+	if q.consumers != nil {
+		errs = append(errs, q.consumers.close())
+	}
+	q.deleteMetrics()
+	return errors.Join(errs...)
+}
+
 // Delete the queue and its associated resources.
 func (q *Queue) Delete() error {
+	q.stopGroupCommit()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// Pages are discarded with the directory, failing to flush them does not matter
+	_ = q.closeHeaps()
 	if err := utils.EnsureDirectoryDeleted(q.RootDir); err != nil {
 		return fmt.Errorf("failed to delete queue directory %s: %w", q.RootDir, err)
 	}
@@ -93,91 +334,239 @@ func (q *Queue) Delete() error {
 	return nil
 }
 
-// Add a message to the queue with a given priority.
+// Add a message to the queue with a given priority. With a dedup window,
+// its message id is the dedup key.
 func (q *Queue) Enqueue(item *QueueItem) error {
-	if q.mainHeap == nil {
-		return fmt.Errorf("main heap is not initialized for queue %s", q.Name)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.dedup == nil {
+		return q.enqueue(item)
 	}
-	if err := q.mainHeap.Enqueue(item); err != nil {
-		return fmt.Errorf("failed to enqueue item in main heap: %w", err)
+	return q.enqueueOnce(item, item.MessageId[:])
+}
+
+// Add a message unless a message with the same dedup key was enqueued
+// within the dedup window.
+func (q *Queue) EnqueueWithDedupKey(item *QueueItem, key string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.dedup == nil {
+		return fmt.Errorf("queue %s has no dedup window", q.Name)
+	}
+	return q.enqueueOnce(item, []byte(key))
+}
+
+// Callers hold q.mu.
+func (q *Queue) enqueueOnce(item *QueueItem, key []byte) error {
+	now := q.clock.Now()
+	fingerprint := newFingerprint(key)
+	if q.dedup.contains(fingerprint, now) {
+		q.duplicates++
+		queueDuplicates.With(q.metricLabels()...).Inc()
+		if q.rejectDuplicates {
+			return fmt.Errorf("message %s: %w", item.MessageId, ErrDuplicateMessage)
+		}
+		return nil
+	}
+	// The key is recorded first, so a message is never enqueued without it
+	if err := q.dedup.add(fingerprint, now); err != nil {
+		return fmt.Errorf("failed to record dedup key of message %s: %w", item.MessageId, err)
+	}
+	if err := q.enqueue(item); err != nil {
+		if discardErr := q.dedup.discard(fingerprint); discardErr != nil {
+			return errors.Join(err, fmt.Errorf("failed to discard dedup key of message %s: %w", item.MessageId, discardErr))
+		}
+		return err
 	}
 	return nil
 }
 
 // Remove and return the highest-priority visible message.
 func (q *Queue) Dequeue() (*QueueItem, error) {
-	if q.mainHeap == nil {
-		return nil, fmt.Errorf("main heap is not initialized for queue %s", q.Name)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.promoteDue(); err != nil {
+		return nil, err
 	}
-	item, err := q.mainHeap.Dequeue()
+	item, err := q.take()
 	if err != nil {
-		return nil, fmt.Errorf("failed to dequeue item from main heap: %w", err)
+		return nil, err
+	}
+	if err = q.release(item); err != nil {
+		return nil, err
 	}
 	return item, nil
 }
 
 // View the highest-priority message without removing it.
 func (q *Queue) Peek() (*QueueItem, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
 	if q.mainHeap == nil {
 		return nil, fmt.Errorf("main heap is not initialized for queue %s", q.Name)
 	}
+	if err := q.promoteDue(); err != nil {
+		return nil, err
+	}
 	item, err := q.mainHeap.Peek()
 	if err != nil {
 		return nil, fmt.Errorf("failed to peek item from main heap: %w", err)
 	}
+	item.GroupKey = q.groups.groupOf(item.MessageId)
 	return item, nil
 }
 
 // Lock the highest-priority message temporarily (invisible to others).
+// Only the oldest message of a group can be locked, and the next one of
+// the group stays unavailable until the lock is acked.
 func (q *Queue) PeekLock() (*QueueItem, string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
 	if q.mainHeap == nil {
 		return nil, "", fmt.Errorf("main heap is not initialized for queue %s", q.Name)
 	}
-	item, err := q.mainHeap.Peek()
+	if err := q.promoteDue(); err != nil {
+		return nil, "", err
+	}
+	item, err := q.take()
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to peek lock item from main heap: %w", err)
+		return nil, "", fmt.Errorf("failed to peek lock item: %w", err)
+	}
+	attempts := uint32(1)
+	if redelivered, exists := q.groups.redelivered[item.MessageId]; exists {
+		attempts += redelivered.attempts
+	}
+	lockId := uuid.New()
+	if err = q.record(&groupRecord{op: groupLock, item: *item, lockId: lockId, attempts: attempts, due: q.lockDue()}); err != nil {
+		return nil, "", fmt.Errorf("failed to lock message %s: %w", item.MessageId, err)
 	}
-	return item, "", nil
+	return item, lockId.String(), nil
 }
 
 // Acknowledge and permanently remove the locked message.
 func (q *Queue) Ack(lockId string) error {
-	return nil
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	id, lock, err := q.lockedMessage(lockId)
+	if err != nil {
+		return err
+	}
+	if err = q.record(&groupRecord{op: groupUnlock, item: lock.item, lockId: id}); err != nil {
+		return fmt.Errorf("failed to ack message %s: %w", lock.item.MessageId, err)
+	}
+	return q.release(&lock.item)
 }
 
-// Negative acknowledgment – return the locked message to the queue or send to DLQ.
-func (q *Queue) Nack(lockId string) error {
-	return nil
+// Lock held, after returning expired locks to the main heap. Callers hold q.mu.
+func (q *Queue) lockedMessage(lockId string) (uuid.UUID, *trackedMessage, error) {
+	if err := q.expireLocks(); err != nil {
+		return uuid.Nil, nil, err
+	}
+	return q.findLock(lockId)
+}
+
+// Callers hold q.mu.
+func (q *Queue) findLock(lockId string) (uuid.UUID, *trackedMessage, error) {
+	id, err := uuid.Parse(lockId)
+	if err != nil {
+		return uuid.Nil, nil, fmt.Errorf("lock %q: %w", lockId, ErrLockNotFound)
+	}
+	lock, exists := q.groups.locks[id]
+	if !exists {
+		return uuid.Nil, nil, fmt.Errorf("lock %q: %w", lockId, ErrLockNotFound)
+	}
+	return id, lock, nil
+}
+
+// Expiry of a lock taken now, zero if locks do not expire. Callers hold q.mu.
+func (q *Queue) lockDue() int64 {
+	if q.lockTimeout == 0 {
+		return 0
+	}
+	return addDelay(q.clock.Now().UnixNano(), q.lockTimeout)
 }
 
-// Extend the invisibility timeout for a locked message.
+// Extend the invisibility timeout for a locked message by duration. A lock
+// that does not expire is left as is.
 func (q *Queue) Extend(lockId string, duration time.Duration) error {
-	return nil
+	if duration <= 0 {
+		return fmt.Errorf("lock extension must be positive, got %s", duration)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	id, lock, err := q.lockedMessage(lockId)
+	if err != nil || lock.due == 0 {
+		return err
+	}
+	return q.moveExpiry(id, lock, addDelay(lock.due, duration))
 }
 
-// Configure how long a locked message stays hidden.
+// Configure how long a locked message stays hidden, for the locks taken
+// from now on until the queue closes. Zero keeps them until acked.
 func (q *Queue) SetVisibilityTimeout(duration time.Duration) error {
+	if duration < 0 {
+		return fmt.Errorf("visibility timeout must not be negative, got %s", duration)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.lockTimeout = duration
 	return nil
 }
 
-// Refresh visibility timeout on a locked message.
+// Refresh visibility timeout on a locked message: it expires a whole
+// timeout from now.
 func (q *Queue) RefreshVisibilityTimeout(lockId string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	id, lock, err := q.lockedMessage(lockId)
+	if err != nil {
+		return err
+	}
+	return q.moveExpiry(id, lock, q.lockDue())
+}
+
+// Callers hold q.mu.
+func (q *Queue) moveExpiry(lockId uuid.UUID, lock *trackedMessage, due int64) error {
+	if err := q.record(&groupRecord{op: groupExtend, item: lock.item, lockId: lockId, attempts: lock.attempts, due: due}); err != nil {
+		return fmt.Errorf("failed to extend lock of message %s: %w", lock.item.MessageId, err)
+	}
 	return nil
 }
 
 // Manually release the lock and make the message visible again.
 func (q *Queue) ReleaseLock(lockId string) error {
-	return nil
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	id, _, err := q.lockedMessage(lockId)
+	if err != nil {
+		return err
+	}
+	return q.unlock(id)
 }
 
-// Check if a message’s invisibility timeout has expired.
+// Check if a message’s invisibility timeout has expired. Its message is
+// returned to the queue by the next operation reading or using a lock,
+// after which the lock is not found.
 func (q *Queue) IsExpired(lockId string) (bool, error) {
-	return false, nil // If Peek succeeds, the message is still invisible
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, lock, err := q.findLock(lockId)
+	if err != nil {
+		return false, err
+	}
+	return lock.due != 0 && lock.due <= q.clock.Now().UnixNano(), nil
 }
 
 // Retrieve currently locked messages for inspection/debugging.
 func (q *Queue) GetLockedMessages() ([]*QueueItem, error) {
-	return nil, nil
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := make([]*QueueItem, 0, len(q.groups.locks))
+	for _, lockId := range sortedIds(q.groups.locks) {
+		item := q.groups.locks[lockId].item
+		items = append(items, &item)
+	}
+	return items, nil
 }
 
 // Move a message to the Dead-Letter Queue (manual or policy-based).
@@ -207,31 +596,149 @@ func (q *Queue) MoveFromDLQ(messageId uuid.UUID) error {
 
 // Clear all messages in the DLQ.
 func (q *Queue) ClearDLQ() error {
-	return nil
+	return q.ClearWithOptions(ClearOptions{Targets: ClearTargetDLQ})
 }
 
+// Keys reported by GetStats. Per-priority counts of visible messages are
+// reported as StatPriorityPrefix followed by the priority, e.g. "priority.5".
+const (
+	StatVisible            = "visible"
+	StatLocked             = "locked"
+	StatDLQ                = "dlq"
+	StatPriorities         = "priorities"
+	StatOldestMessageAgeMs = "oldest_message_age_ms"
+	StatPageBytes          = "page_bytes"
+	StatIndexBytes         = "index_bytes"
+	StatPriorityPrefix     = "priority."
+	StatWaiting            = "waiting" // messages waiting behind the active message of their group
+	StatDelayed            = "delayed" // nacked messages waiting for their retry
+	StatConsumerLagPrefix  = "consumer_lag."
+	StatUsageMessages      = "usage_messages" // messages counted against the limits
+	StatDuplicates         = "duplicates"     // enqueues ignored as duplicates since the queue opened
+)
+
 // Get stats like message count, locked messages, DLQ size, etc.
 func (q *Queue) GetStats() (map[string]uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
 	stats := make(map[string]uint64)
+	if q.mainHeap == nil {
+		return nil, fmt.Errorf("main heap is not initialized for queue %s", q.Name)
+	}
+	mainStats, err := q.mainHeap.Stats()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stats of main heap: %w", err)
+	}
+	stats[StatVisible] = mainStats.Messages
+	stats[StatPriorities] = uint64(len(mainStats.Priorities))
+	for priority, messages := range mainStats.Priorities {
+		stats[fmt.Sprint(StatPriorityPrefix, priority)] = messages
+	}
+	if !mainStats.OldestEnqueuedAt.IsZero() {
+		stats[StatOldestMessageAgeMs] = uint64(max(q.clock.Now().Sub(mainStats.OldestEnqueuedAt).Milliseconds(), 0))
+	}
+	stats[StatPageBytes] = uint64(mainStats.PageBytes)
+	stats[StatIndexBytes] = uint64(mainStats.IndexBytes)
+	stats[StatLocked] = uint64(len(q.groups.locks))
+	stats[StatDLQ] = 0
+	stats[StatWaiting] = uint64(len(q.groups.waiting()))
+	stats[StatDelayed] = uint64(len(q.groups.delayed))
+	usage := q.usage()
+	stats[StatUsageMessages] = usage.Messages
+	stats[StatDuplicates] = q.duplicates
+	for group := range q.consumers.Offsets {
+		stats[StatConsumerLagPrefix+group] = q.consumerGroupLag(group)
+	}
+
+	for key, heap := range map[string]*Heap{StatLocked: q.invisibileHeap, StatDLQ: q.dlqHeap} {
+		if heap == nil {
+			continue
+		}
+		heapStats, err := heap.Stats()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %s stats: %w", key, err)
+		}
+		stats[key] += heapStats.Messages
+		stats[StatPageBytes] += uint64(heapStats.PageBytes)
+		stats[StatIndexBytes] += uint64(heapStats.IndexBytes)
+	}
 	return stats, nil
 }
 
+type ClearTarget uint8
+
+const (
+	ClearTargetMain ClearTarget = 1 << iota
+	ClearTargetInvisible
+	ClearTargetDLQ
+
+	ClearTargetAll = ClearTargetMain | ClearTargetInvisible | ClearTargetDLQ
+)
+
+type ClearOptions struct {
+	Targets    ClearTarget // heaps to purge, all of them if zero
+	Priorities PriorityRange
+}
+
 // Delete all messages in the queue.
 func (q *Queue) Clear() error {
-	return nil
+	return q.ClearWithOptions(ClearOptions{})
 }
 
-// List all visible (pending) messages.
-func (q *Queue) ListMessages() ([]*QueueItem, error) {
-	return nil, nil
+// Delete the messages of the selected heaps and priorities, reclaiming their disk space.
+func (q *Queue) ClearWithOptions(options ClearOptions) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.mainHeap == nil {
+		return fmt.Errorf("main heap is not initialized for queue %s", q.Name)
+	}
+	targets := options.Targets
+	if targets == 0 {
+		targets = ClearTargetAll
+	}
+	if _, err := q.mutate(&logEntry{op: logClear, targets: targets, priorities: options.Priorities}); err != nil {
+		return err
+	}
+	if err := q.forgetDrainedOffsets(); err != nil {
+		return err
+	}
+	return q.clearGroups(targets, options.Priorities)
 }
 
-// List all currently locked/invisible messages.
-func (q *Queue) ListLockedMessages() ([]*QueueItem, error) {
-	return nil, nil
+// List visible (pending) messages in priority order, one page at a time.
+func (q *Queue) ListMessages(options ListOptions) ([]*QueueItem, string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items, token, err := q.listHeap(q.mainHeap, "main", options)
+	for _, item := range items {
+		item.GroupKey = q.groups.groupOf(item.MessageId)
+	}
+	return items, token, err
 }
 
-// List all messages currently in the DLQ.
-func (q *Queue) ListDLQMessages() ([]*QueueItem, error) {
-	return nil, nil
+// List currently locked messages, one page at a time: the messages locked
+// by PeekLock in priority order, then those of the invisible heap.
+func (q *Queue) ListLockedMessages(options ListOptions) ([]*QueueItem, string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.listLocks(options)
+}
+
+// List messages currently in the DLQ, one page at a time.
+func (q *Queue) ListDLQMessages(options ListOptions) ([]*QueueItem, string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.listHeap(q.dlqHeap, "dlq", options)
+}
+
+// Callers hold q.mu.
+func (q *Queue) listHeap(heap *Heap, name string, options ListOptions) ([]*QueueItem, string, error) {
+	if heap == nil {
+		return make([]*QueueItem, 0), "", nil
+	}
+	items, token, err := heap.List(options)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list %s heap: %w", name, err)
+	}
+	return items, token, nil
 }
@@ -0,0 +1,470 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/kokaq/core/internals/logger"
+)
+
+// A replicated queue records every mutation in its replication log. The
+// primary ships the log to followers, which apply each entry to their own
+// heaps. Heaps lay out pages deterministically, so a follower's pages and
+// index files stay byte for byte equal to the primary's; only the enqueue
+// timestamps differ, as followers stamp messages when applying them.
+type ReplicaRole uint8
+
+const (
+	ReplicaNone ReplicaRole = iota // not replicated, no log is kept
+	ReplicaPrimary
+	ReplicaFollower
+)
+
+func (r ReplicaRole) String() string {
+	switch r {
+	case ReplicaPrimary:
+		return "primary"
+	case ReplicaFollower:
+		return "follower"
+	}
+	return "none"
+}
+
+var (
+	// ErrReadOnlyReplica is returned by mutations of a follower.
+	ErrReadOnlyReplica = errors.New("queue is a read-only follower")
+	// ErrReplicationDiverged is returned when a follower's state does not match the primary's.
+	ErrReplicationDiverged = errors.New("replica diverged from the primary")
+	// ErrPromoted is returned by Follow once the follower has been promoted.
+	ErrPromoted = errors.New("follower was promoted to primary")
+	// ErrLogTruncated is returned when a follower resumes from an entry the
+	// primary trimmed from its log. It has to be restored from a snapshot of
+	// the primary's namespace and reopened as a follower.
+	ErrLogTruncated = errors.New("replication log no longer holds the entry")
+)
+
+const (
+	replicationLogName = "replication.log"
+	shipBatchEntries   = 256
+
+	defaultReplicationRetention = 4096
+)
+
+type FollowerStatus struct {
+	Id       string
+	AckedSeq uint64 // last entry the follower applied
+	Lag      uint64 // entries the follower has yet to apply
+	LastAck  time.Time
+}
+
+type ReplicationStatus struct {
+	Role      ReplicaRole
+	LastSeq   uint64 // last entry logged or, on a follower, applied
+	Followers []FollowerStatus
+}
+
+type followerState struct {
+	acked   uint64
+	lastAck time.Time
+}
+
+// Heap of a single target, with its name for errors.
+func (q *Queue) heapFor(target ClearTarget) (*Heap, string) {
+	switch target {
+	case ClearTargetMain:
+		return q.mainHeap, "main"
+	case ClearTargetInvisible:
+		return q.invisibileHeap, "invisible"
+	case ClearTargetDLQ:
+		return q.dlqHeap, "dlq"
+	}
+	return nil, fmt.Sprintf("target %d", target)
+}
+
+// Log a client mutation, then apply it. The entry is shipped to followers
+// once applied and dropped from the log if it fails. Callers hold q.mu.
+func (q *Queue) mutate(entry *logEntry) (*QueueItem, error) {
+	if q.replica == ReplicaFollower {
+		return nil, ErrReadOnlyReplica
+	}
+	defer q.publishUsage()
+	if q.log == nil {
+		return q.apply(entry)
+	}
+	if err := q.resolve(entry); err != nil {
+		return nil, err
+	}
+	if err := q.log.append(entry); err != nil {
+		return nil, fmt.Errorf("failed to log mutation: %w", err)
+	}
+	item, err := q.apply(entry)
+	if err != nil {
+		return nil, q.rollbackLog(err)
+	}
+	q.commitLog()
+	return item, nil
+}
+
+// Record the message a dequeue or drop is about to remove in its entry,
+// so followers detect divergence. Callers hold q.mu.
+func (q *Queue) resolve(entry *logEntry) error {
+	if entry.op != logDequeue && entry.op != logDrop {
+		return nil
+	}
+	heap, name := q.heapFor(entry.targets)
+	if heap == nil {
+		return fmt.Errorf("%s heap is not initialized for queue %s", name, q.Name)
+	}
+	var item *QueueItem
+	var err error
+	if entry.op == logDequeue {
+		if item, err = heap.Peek(); err != nil {
+			return fmt.Errorf("failed to dequeue item from %s heap: %w", name, err)
+		}
+	} else {
+		state, exists := heap.priorities[entry.priority]
+		if !exists {
+			return fmt.Errorf("failed to drop item from %s heap: no message of priority %d", name, entry.priority)
+		}
+		if item, err = heap.readRecord(entry.priority, state.head); err != nil {
+			return fmt.Errorf("failed to drop item from %s heap: %w", name, err)
+		}
+	}
+	entry.messageId, entry.priority = item.MessageId, item.Priority
+	return nil
+}
+
+// Drop the entry logged ahead of a mutation that failed. Callers hold q.mu.
+func (q *Queue) rollbackLog(err error) error {
+	if rollbackErr := q.log.rollback(); rollbackErr != nil {
+		return errors.Join(err, rollbackErr)
+	}
+	return err
+}
+
+// Ship the entry of a mutation applied. Callers hold q.mu.
+func (q *Queue) commitLog() {
+	q.log.commit()
+	q.trimLog(q.log)
+}
+
+// Trim the entries of log every connected follower applied, keeping the
+// last retention ones for followers resuming.
+func (q *Queue) trimLog(log *replicationLog) {
+	last := log.last()
+	upTo := last - min(last, q.logRetention)
+	q.followersMu.Lock()
+	for _, state := range q.followers {
+		upTo = min(upTo, state.acked)
+	}
+	q.followersMu.Unlock()
+	// Trimming is retried with the next entry or ack, it never loses one
+	if err := log.trim(upTo, q.logRetention); err != nil {
+		logger.ConsoleLog("ERROR", "failed to trim replication log of queue %s: %v", q.Name, err)
+	}
+}
+
+// Apply the last entry of the log again unless the heaps and groups reflect
+// it, as after a crash between logging and applying it. Callers hold q.mu.
+func (q *Queue) redoLogged() error {
+	entry, err := q.log.lastEntry()
+	if err != nil || entry == nil {
+		return err
+	}
+	applied, err := q.applied(entry)
+	if err != nil {
+		return fmt.Errorf("failed to check entry %d: %w", entry.seq, err)
+	}
+	if applied {
+		return nil
+	}
+	if _, err = q.apply(entry); err != nil {
+		return fmt.Errorf("failed to apply entry %d: %w", entry.seq, err)
+	}
+	return nil
+}
+
+// Apply a mutation to the heaps. Callers hold q.mu.
+func (q *Queue) apply(entry *logEntry) (*QueueItem, error) {
+	switch entry.op {
+	case logEnqueue:
+		heap, name := q.heapFor(entry.targets)
+		if heap == nil {
+			return nil, fmt.Errorf("%s heap is not initialized for queue %s", name, q.Name)
+		}
+		item := &QueueItem{MessageId: entry.messageId, Priority: entry.priority}
+		if err := heap.Enqueue(item); err != nil {
+			return nil, fmt.Errorf("failed to enqueue item in %s heap: %w", name, err)
+		}
+		return item, nil
+	case logDequeue:
+		heap, name := q.heapFor(entry.targets)
+		if heap == nil {
+			return nil, fmt.Errorf("%s heap is not initialized for queue %s", name, q.Name)
+		}
+		item, err := heap.Dequeue()
+		if err != nil {
+			return nil, fmt.Errorf("failed to dequeue item from %s heap: %w", name, err)
+		}
+		return item, nil
+	case logDrop:
+		heap, name := q.heapFor(entry.targets)
+		if heap == nil {
+			return nil, fmt.Errorf("%s heap is not initialized for queue %s", name, q.Name)
+		}
+		item, err := heap.dropHead(entry.priority)
+		if err != nil {
+			return nil, fmt.Errorf("failed to drop item from %s heap: %w", name, err)
+		}
+		return item, nil
+	case logClear:
+		for _, target := range []ClearTarget{ClearTargetMain, ClearTargetInvisible, ClearTargetDLQ} {
+			heap, name := q.heapFor(target)
+			if entry.targets&target == 0 || heap == nil {
+				continue
+			}
+			if err := heap.Clear(entry.priorities); err != nil {
+				return nil, fmt.Errorf("failed to clear %s heap of queue %s: %w", name, q.Name, err)
+			}
+		}
+		return nil, nil
+	case logGroup:
+		return nil, q.groups.append(entry.group)
+	}
+	return nil, fmt.Errorf("unknown log operation %d", entry.op)
+}
+
+// ServeFollower ships the replication log to a follower connected through
+// conn until the connection fails or the queue is closed. The follower
+// first sends the last sequence it applied, then acknowledges every entry
+// it applies; acknowledgements drive the lag reported for id.
+func (q *Queue) ServeFollower(id string, conn io.ReadWriter) error {
+	q.mu.Lock()
+	log := q.log
+	role := q.replica
+	q.mu.Unlock()
+	if role != ReplicaPrimary {
+		return fmt.Errorf("queue %s is not a primary", q.Name)
+	}
+	handshake := make([]byte, 8)
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		return fmt.Errorf("failed to read follower handshake: %w", err)
+	}
+	applied := binary.LittleEndian.Uint64(handshake)
+	if applied > log.last() {
+		return fmt.Errorf("follower %s applied entry %d past the last entry %d: %w", id, applied, log.last(), ErrReplicationDiverged)
+	}
+	if applied+1 < log.start() {
+		return fmt.Errorf("follower %s needs entry %d, the log starts at entry %d: %w", id, applied+1, log.start(), ErrLogTruncated)
+	}
+
+	q.followersMu.Lock()
+	state := &followerState{acked: applied, lastAck: time.Now()}
+	q.followers[id] = state
+	q.followersMu.Unlock()
+	defer func() {
+		q.followersMu.Lock()
+		if q.followers[id] == state {
+			delete(q.followers, id)
+		}
+		q.followersMu.Unlock()
+	}()
+
+	acks := make(chan error, 1)
+	var disconnected atomic.Bool
+	go func() {
+		ack := make([]byte, 8)
+		for {
+			if _, err := io.ReadFull(conn, ack); err != nil {
+				acks <- err
+				disconnected.Store(true)
+				log.wake()
+				return
+			}
+			q.followersMu.Lock()
+			state.acked = binary.LittleEndian.Uint64(ack)
+			state.lastAck = time.Now()
+			q.followersMu.Unlock()
+			q.trimLog(log)
+		}
+	}()
+
+	next := applied + 1
+	for {
+		select {
+		case err := <-acks:
+			return fmt.Errorf("follower %s disconnected: %w", id, err)
+		default:
+		}
+		data, count, err := log.waitEntries(next, shipBatchEntries, disconnected.Load)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+		if _, err = conn.Write(data); err != nil {
+			return fmt.Errorf("failed to ship log to follower %s: %w", id, err)
+		}
+		next += uint64(count)
+	}
+}
+
+// Follow applies the log shipped by a primary through conn until the
+// connection ends, returning nil on a clean end of stream. It returns
+// ErrPromoted when an entry arrives after the follower was promoted.
+func (q *Queue) Follow(conn io.ReadWriter) error {
+	q.mu.Lock()
+	if q.replica != ReplicaFollower {
+		q.mu.Unlock()
+		return fmt.Errorf("queue %s is not a follower", q.Name)
+	}
+	log := q.log
+	q.mu.Unlock()
+	handshake := make([]byte, 8)
+	binary.LittleEndian.PutUint64(handshake, log.last())
+	if _, err := conn.Write(handshake); err != nil {
+		return fmt.Errorf("failed to send handshake: %w", err)
+	}
+
+	in := bufio.NewReader(conn)
+	ack := make([]byte, 8)
+	for offset := int64(0); ; {
+		entry, size, err := readLogEntry(in, "replication stream", offset)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read log entry: %w", err)
+		}
+		offset += int64(size)
+		if err = q.applyShipped(entry); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(ack, entry.seq)
+		if _, err = conn.Write(ack); err != nil {
+			return fmt.Errorf("failed to acknowledge entry %d: %w", entry.seq, err)
+		}
+	}
+}
+
+// Apply an entry shipped by the primary and append it to the local log. A
+// follower crashing between the two is shipped the entry again when it
+// resumes, so the first entry after opening the queue, or after a failure
+// to log, is applied only if the heaps and groups do not reflect it yet.
+func (q *Queue) applyShipped(entry *logEntry) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.replica != ReplicaFollower {
+		return ErrPromoted
+	}
+	if last := q.log.last(); entry.seq != last+1 {
+		return fmt.Errorf("received entry %d after entry %d: %w", entry.seq, last, ErrReplicationDiverged)
+	}
+	applied := false
+	if q.unlogged {
+		var err error
+		if applied, err = q.applied(entry); err != nil {
+			return fmt.Errorf("failed to check entry %d: %w", entry.seq, err)
+		}
+	}
+	if !applied {
+		q.unlogged = true
+		item, err := q.apply(entry)
+		if err != nil {
+			return fmt.Errorf("failed to apply entry %d: %w", entry.seq, err)
+		}
+		if (entry.op == logDequeue || entry.op == logDrop) && item.MessageId != entry.messageId {
+			return fmt.Errorf("entry %d dequeued %s, the primary dequeued %s: %w", entry.seq, item.MessageId, entry.messageId, ErrReplicationDiverged)
+		}
+	}
+	if err := q.log.append(entry); err != nil {
+		return err
+	}
+	q.commitLog()
+	q.unlogged = false
+	return nil
+}
+
+// Whether the heaps and groups already reflect the last entry applied.
+// Clearing and the changes of the groups table other than a message
+// waiting are idempotent, so they are always applied again.
+// Callers hold q.mu.
+func (q *Queue) applied(entry *logEntry) (bool, error) {
+	switch entry.op {
+	case logEnqueue, logDequeue, logDrop:
+		heap, _ := q.heapFor(entry.targets)
+		if heap == nil {
+			return false, nil
+		}
+		state, exists := heap.priorities[entry.priority]
+		if entry.op != logEnqueue {
+			// Dequeued unless still the oldest message of its priority
+			if !exists {
+				return true, nil
+			}
+			head, err := heap.readRecord(entry.priority, state.head)
+			if err != nil {
+				return false, err
+			}
+			return head.MessageId != entry.messageId, nil
+		}
+		if !exists {
+			return false, nil
+		}
+		last, err := heap.readRecord(entry.priority, state.head+state.messages-1)
+		if err != nil {
+			return false, err
+		}
+		return last.MessageId == entry.messageId, nil
+	case logGroup:
+		if entry.group.op != groupWait {
+			return false, nil
+		}
+		group, exists := q.groups.groups[entry.group.item.GroupKey]
+		return exists && len(group.backlog) > 0 && group.backlog[len(group.backlog)-1].MessageId == entry.group.item.MessageId, nil
+	}
+	return false, nil
+}
+
+// Promote turns a follower into a primary accepting mutations, which are
+// logged after the entries it applied so it can serve followers in turn.
+// Messages locked on the former primary stay locked, so their consumers
+// can still ack them.
+// The connection to the former primary should be closed by the caller.
+func (q *Queue) Promote() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.replica != ReplicaFollower {
+		return fmt.Errorf("queue %s is not a follower", q.Name)
+	}
+	q.replica = ReplicaPrimary
+	return nil
+}
+
+func (q *Queue) ReplicationStatus() ReplicationStatus {
+	q.mu.Lock()
+	status := ReplicationStatus{Role: q.replica}
+	if q.log != nil {
+		status.LastSeq = q.log.last()
+	}
+	q.mu.Unlock()
+	q.followersMu.Lock()
+	defer q.followersMu.Unlock()
+	for id, state := range q.followers {
+		status.Followers = append(status.Followers, FollowerStatus{
+			Id:       id,
+			AckedSeq: state.acked,
+			Lag:      status.LastSeq - min(state.acked, status.LastSeq),
+			LastAck:  state.lastAck,
+		})
+	}
+	sort.Slice(status.Followers, func(i, j int) bool { return status.Followers[i].Id < status.Followers[j].Id })
+	return status
+}
@@ -0,0 +1,374 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/utils/murmur"
+)
+
+type logOp uint8
+
+const (
+	logEnqueue logOp = iota + 1
+	logDequeue
+	logClear
+	logDrop
+	logGroup
+)
+
+// Every mutation of a replicated queue is an entry of the replication log:
+//
+//	seq u64 | op u8 | targets u8 | priority u64 | message id [16] | min u64 | max u64 | murmur3 u32
+//
+// Enqueue and dequeue target a single heap; a dequeue records the message
+// it removed so followers detect divergence. Clear records its options. A
+// drop removes the oldest message of a priority, recorded like a dequeue.
+// A change of the groups table records its message and is followed by the
+// record of the groups log, so entries are located through their offsets.
+const logEntrySize = 8 + 1 + 1 + 8 + 16 + 8 + 8 + checksumSize
+
+type logEntry struct {
+	seq        uint64
+	op         logOp
+	targets    ClearTarget
+	priority   uint64
+	messageId  uuid.UUID
+	priorities PriorityRange
+	group      *groupRecord // the change of a group entry
+}
+
+func (e *logEntry) encode() []byte {
+	data := make([]byte, logEntrySize)
+	binary.LittleEndian.PutUint64(data[0:], e.seq)
+	data[8] = byte(e.op)
+	data[9] = byte(e.targets)
+	binary.LittleEndian.PutUint64(data[10:], e.priority)
+	copy(data[18:34], e.messageId[:])
+	binary.LittleEndian.PutUint64(data[34:], e.priorities.Min)
+	binary.LittleEndian.PutUint64(data[42:], e.priorities.Max)
+	binary.LittleEndian.PutUint32(data[50:], murmur.Sum32(data[:50]))
+	if e.op == logGroup {
+		data = append(data, e.group.encode()...)
+	}
+	return data
+}
+
+func decodeLogEntry(data []byte, path string, offset int64) (*logEntry, error) {
+	if len(data) < logEntrySize {
+		return nil, &ErrCorrupted{File: path, Offset: offset, Reason: "truncated log entry"}
+	}
+	if binary.LittleEndian.Uint32(data[50:]) != murmur.Sum32(data[:50]) {
+		return nil, &ErrCorrupted{File: path, Offset: offset, Reason: "log entry checksum mismatch"}
+	}
+	e := &logEntry{
+		seq:        binary.LittleEndian.Uint64(data[0:]),
+		op:         logOp(data[8]),
+		targets:    ClearTarget(data[9]),
+		priority:   binary.LittleEndian.Uint64(data[10:]),
+		priorities: PriorityRange{Min: binary.LittleEndian.Uint64(data[34:]), Max: binary.LittleEndian.Uint64(data[42:])},
+	}
+	copy(e.messageId[:], data[18:34])
+	return e, nil
+}
+
+// Read the next entry of r, returning its size. Returns io.EOF if r ends
+// before the entry and io.ErrUnexpectedEOF if it ends within it.
+func readLogEntry(r io.Reader, path string, offset int64) (*logEntry, int, error) {
+	data := make([]byte, logEntrySize)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, 0, err
+	}
+	entry, err := decodeLogEntry(data, path, offset)
+	if err != nil || entry.op != logGroup {
+		return entry, logEntrySize, err
+	}
+	record := make([]byte, 4)
+	if _, err = io.ReadFull(r, record); err != nil {
+		return nil, 0, unexpectedEOF(err)
+	}
+	length := binary.LittleEndian.Uint32(record)
+	if length > groupRecordHeaderSize+MaxGroupKeyLength+checksumSize {
+		return nil, 0, &ErrCorrupted{File: path, Offset: offset + logEntrySize, Reason: "invalid group record length"}
+	}
+	record = append(record, make([]byte, length)...)
+	if _, err = io.ReadFull(r, record[4:]); err != nil {
+		return nil, 0, unexpectedEOF(err)
+	}
+	if entry.group, _, err = decodeGroupRecord(record, path, offset+logEntrySize); err != nil {
+		return nil, 0, err
+	}
+	return entry, logEntrySize + len(record), nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// replicationLog is the append-only file of a queue's mutations. Entries are
+// appended ahead of their mutation and shipped once committed; readers
+// shipping them to followers wait for new entries on cond. Entries every
+// follower applied are trimmed from the start of the file.
+type replicationLog struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	path      string
+	file      *os.File
+	first     uint64  // sequence of the first entry in the file
+	lastSeq   uint64  // last entry appended
+	committed uint64  // last entry shipped, entries after it are being applied
+	offsets   []int64 // of every entry in the file, entry first+n at offsets[n]
+	end       int64   // offset the next entry is appended at
+	sync      bool    // fsync every append
+	closed    bool
+	failed    error // set when an entry could not be rolled back
+}
+
+var errLogClosed = errors.New("replication log is closed")
+
+func openReplicationLog(path string, syncAppends bool) (*replicationLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open replication log %s: %w", path, err)
+	}
+	l := &replicationLog{path: path, file: file, first: 1, sync: syncAppends}
+	l.cond = sync.NewCond(&l.mu)
+	in := bufio.NewReader(file)
+	for {
+		entry, size, err := readLogEntry(in, path, l.end)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// An append torn by a crash was never acknowledged
+			if err = file.Truncate(l.end); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("failed to truncate replication log %s: %w", path, err)
+			}
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if len(l.offsets) == 0 {
+			// Entries before the first one were trimmed
+			l.first = entry.seq
+		}
+		if seq := l.first + uint64(len(l.offsets)); entry.seq != seq {
+			file.Close()
+			return nil, &ErrCorrupted{File: path, Offset: l.end, Reason: fmt.Sprintf("entry %d has sequence %d", seq, entry.seq)}
+		}
+		l.offsets = append(l.offsets, l.end)
+		l.end += int64(size)
+	}
+	l.lastSeq = l.first + uint64(len(l.offsets)) - 1
+	l.committed = l.lastSeq
+	return l, nil
+}
+
+// Last committed entry.
+func (l *replicationLog) last() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.committed
+}
+
+// Append an entry, assigning it the next sequence number unless it has
+// one. Readers see it once committed.
+func (l *replicationLog) append(entry *logEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return errLogClosed
+	}
+	if l.failed != nil {
+		return l.failed
+	}
+	if entry.seq == 0 {
+		entry.seq = l.lastSeq + 1
+	} else if entry.seq != l.lastSeq+1 {
+		return fmt.Errorf("log entry %d does not follow entry %d", entry.seq, l.lastSeq)
+	}
+	data := entry.encode()
+	if _, err := l.file.WriteAt(data, l.end); err != nil {
+		return fmt.Errorf("failed to append to replication log %s: %w", l.path, err)
+	}
+	if l.sync {
+		if err := l.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync replication log %s: %w", l.path, err)
+		}
+	}
+	l.offsets = append(l.offsets, l.end)
+	l.end += int64(len(data))
+	l.lastSeq = entry.seq
+	return nil
+}
+
+// Ship the entries appended since the last commit.
+func (l *replicationLog) commit() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.committed = l.lastSeq
+	l.cond.Broadcast()
+}
+
+// Drop the entries appended since the last commit.
+func (l *replicationLog) rollback() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kept := l.committed - l.first + 1
+	if kept == uint64(len(l.offsets)) {
+		return nil
+	}
+	l.end = l.offsets[kept]
+	l.offsets = l.offsets[:kept]
+	l.lastSeq = l.committed
+	if err := l.file.Truncate(l.end); err != nil {
+		l.failed = fmt.Errorf("failed to roll back replication log %s: %w", l.path, err)
+		return l.failed
+	}
+	return nil
+}
+
+// Drop the committed entries up to upTo from the start of the file, once
+// there are at least batch of them so the file is rewritten seldom.
+func (l *replicationLog) trim(upTo uint64, batch uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	upTo = min(upTo, l.committed)
+	if l.closed || upTo < l.first || upTo-l.first+1 < batch {
+		return nil
+	}
+	start := l.offsets[upTo-l.first+1]
+	data := make([]byte, l.end-start)
+	if _, err := l.file.ReadAt(data, start); err != nil {
+		return fmt.Errorf("failed to read replication log %s: %w", l.path, err)
+	}
+	temporary := l.path + ".tmp"
+	file, err := os.OpenFile(temporary, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", temporary, err)
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(temporary, l.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(temporary)
+		return fmt.Errorf("failed to trim replication log %s: %w", l.path, err)
+	}
+	// The renamed file holds the log from now on
+	l.file.Close()
+	l.file = file
+	l.offsets = l.offsets[upTo-l.first+1:]
+	for i := range l.offsets {
+		l.offsets[i] -= start
+	}
+	l.end -= start
+	l.first = upTo + 1
+	dir, err := os.Open(filepath.Dir(l.path))
+	if err != nil {
+		return fmt.Errorf("failed to open directory of %s: %w", l.path, err)
+	}
+	defer dir.Close()
+	if err = dir.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory of %s: %w", l.path, err)
+	}
+	return nil
+}
+
+// Last entry appended, nil if the log is empty.
+func (l *replicationLog) lastEntry() (*logEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.offsets) == 0 {
+		return nil, nil
+	}
+	offset := l.offsets[len(l.offsets)-1]
+	entry, _, err := readLogEntry(io.NewSectionReader(l.file, offset, l.end-offset), l.path, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replication log %s: %w", l.path, err)
+	}
+	return entry, nil
+}
+
+// Raw committed entries from seq on, at most max of them, and their count,
+// waiting for seq to be committed. Returns no entries if stopped returns
+// true while waiting, and ErrLogTruncated if seq was trimmed.
+func (l *replicationLog) waitEntries(seq uint64, max int, stopped func() bool) ([]byte, int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.committed < seq && !l.closed {
+		if stopped() {
+			return nil, 0, nil
+		}
+		l.cond.Wait()
+	}
+	if l.closed {
+		return nil, 0, errLogClosed
+	}
+	if seq < l.first {
+		return nil, 0, fmt.Errorf("entry %d is before the first entry %d: %w", seq, l.first, ErrLogTruncated)
+	}
+	count := min(l.committed-seq+1, uint64(max))
+	start, end := l.offsets[seq-l.first], l.end
+	if next := seq - l.first + count; next < uint64(len(l.offsets)) {
+		end = l.offsets[next]
+	}
+	// Read under the lock, trimming replaces the file
+	data := make([]byte, end-start)
+	if _, err := l.file.ReadAt(data, start); err != nil {
+		return nil, 0, fmt.Errorf("failed to read replication log %s: %w", l.path, err)
+	}
+	return data, int(count), nil
+}
+
+// Sequence of the first entry in the file.
+func (l *replicationLog) start() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.first
+}
+
+// Wake waiting readers so they check whether they were stopped.
+func (l *replicationLog) wake() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+func (l *replicationLog) flush() error {
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync replication log %s: %w", l.path, err)
+	}
+	return nil
+}
+
+// Close the file, waking readers waiting for entries.
+func (l *replicationLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	l.cond.Broadcast()
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("failed to close replication log %s: %w", l.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package queue
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Clock tells queues the time. Tests inject a clock they control.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// RetryPolicy spaces the redeliveries of nacked messages. The delay after
+// attempt n is BaseDelay * Multiplier^(n-1), capped at MaxDelay, minus up
+// to Jitter of it at random so failing consumers do not retry in lockstep.
+// A zero policy makes nacked messages visible again immediately.
+type RetryPolicy struct {
+	BaseDelay  time.Duration
+	Multiplier float64       // below 1 keeps the delay constant
+	Jitter     float64       // fraction of the delay, between 0 and 1
+	MaxDelay   time.Duration // zero leaves the delay unbounded
+}
+
+// Delay before redelivering a message nacked after its attempts-th delivery.
+func (p RetryPolicy) Delay(attempts uint32) time.Duration {
+	if p.BaseDelay <= 0 {
+		return 0
+	}
+	delay := float64(p.BaseDelay) * math.Pow(max(p.Multiplier, 1), float64(max(attempts, 1)-1))
+	if p.MaxDelay > 0 {
+		delay = min(delay, float64(p.MaxDelay))
+	}
+	// MaxInt64 rounds up to 2^63 as a float, which overflows a duration
+	delay = min(delay, maxDelay)
+	delay -= delay * min(max(p.Jitter, 0), 1) * rand.Float64()
+	return time.Duration(delay)
+}
+
+// Longest delay, the largest float64 below math.MaxInt64.
+var maxDelay = math.Nextafter(math.MaxInt64, 0)
+
+// Negative acknowledgment – return the locked message to the queue once
+// the delay of the retry policy for its delivery attempts has elapsed.
+func (q *Queue) Nack(lockId string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	id, lock, err := q.lockedMessage(lockId)
+	if err != nil {
+		return err
+	}
+	return q.nack(id, lock, q.retry.Delay(lock.attempts))
+}
+
+// Nack overriding the retry policy: the message is visible again after delay.
+func (q *Queue) NackWithDelay(lockId string, delay time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	id, lock, err := q.lockedMessage(lockId)
+	if err != nil {
+		return err
+	}
+	return q.nack(id, lock, delay)
+}
+
+// Callers hold q.mu.
+func (q *Queue) nack(lockId uuid.UUID, lock *trackedMessage, delay time.Duration) error {
+	if delay <= 0 {
+		return q.unlock(lockId)
+	}
+	due := addDelay(q.clock.Now().UnixNano(), delay)
+	if err := q.record(&groupRecord{op: groupDelay, item: lock.item, lockId: lockId, attempts: lock.attempts, due: due}); err != nil {
+		return fmt.Errorf("failed to nack message %s: %w", lock.item.MessageId, err)
+	}
+	return nil
+}
+
+// Unix nanoseconds delay after from, saturated past the range of unix nanoseconds.
+func addDelay(from int64, delay time.Duration) int64 {
+	due := from + int64(delay)
+	if due < from {
+		return math.MaxInt64
+	}
+	return due
+}
+
+// Return the messages of expired locks, then the delayed messages that are
+// due, to the main heap, in due order. Callers hold q.mu.
+func (q *Queue) promoteDue() error {
+	if err := q.expireLocks(); err != nil {
+		return err
+	}
+	if len(q.groups.delayed) == 0 || q.replica == ReplicaFollower {
+		return nil
+	}
+	now := q.clock.Now().UnixNano()
+	for _, delayed := range q.groups.delayedByDue() {
+		if delayed.due > now {
+			break
+		}
+		item := delayed.item
+		if _, err := q.mutate(&logEntry{op: logEnqueue, targets: ClearTargetMain, messageId: item.MessageId, priority: item.Priority}); err != nil {
+			return fmt.Errorf("failed to redeliver message %s: %w", item.MessageId, err)
+		}
+		if err := q.record(&groupRecord{op: groupDue, item: item, attempts: delayed.attempts}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,353 @@
+package queue
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kokaq/core/utils"
+	"github.com/kokaq/core/utils/murmur"
+)
+
+const (
+	snapshotVersion      = 1
+	snapshotManifestName = "manifest.json"
+	snapshotDataPrefix   = "data/"
+)
+
+// SnapshotManifest describes a namespace archive. It is the last entry of
+// the archive, after the files it lists under data/.
+type SnapshotManifest struct {
+	Version   int             `json:"version"`
+	CreatedAt time.Time       `json:"created_at"`
+	Namespace NamespaceConfig `json:"namespace"`
+	Queues    []SnapshotQueue `json:"queues"`
+	Files     []SnapshotFile  `json:"files"`
+}
+
+type SnapshotQueue struct {
+	Id                uint32        `json:"id"`
+	Name              string        `json:"name"`
+	EnableDLQ         bool          `json:"enable_dlq"`
+	EnableInvisible   bool          `json:"enable_invisible"`
+	Limits            QueueLimits   `json:"limits"`
+	Retry             RetryPolicy   `json:"retry"`
+	DedupWindow       time.Duration `json:"dedup_window,omitempty"`
+	RejectDuplicates  bool          `json:"reject_duplicates,omitempty"`
+	VisibilityTimeout time.Duration `json:"visibility_timeout,omitempty"`
+}
+
+type SnapshotFile struct {
+	Path     string `json:"path"` // relative to the namespace directory, slash separated
+	Size     int64  `json:"size"`
+	Checksum uint32 `json:"checksum"` // murmur3 of the contents
+}
+
+// A file captured while the queues were locked. Files rewritten in place
+// are held in memory; append-only index and times files are kept open and
+// read up to their size then, so later appends or removals do not matter.
+type snapshotSource struct {
+	path string
+	size int64
+	data []byte
+	file *os.File
+}
+
+func (s *snapshotSource) reader() io.Reader {
+	if s.file != nil {
+		return io.NewSectionReader(s.file, 0, s.size)
+	}
+	return bytes.NewReader(s.data)
+}
+
+// Snapshot writes a point-in-time archive of the namespace to dest: its
+// policy, its catalog of topics and the heaps of every loaded queue. Queues are paused only while
+// their files are captured, not while the archive is written.
+func (n *Namespace) Snapshot(dest string) (err error) {
+	manifest := &SnapshotManifest{
+		Version:   snapshotVersion,
+		CreatedAt: time.Now().UTC(),
+		Namespace: NamespaceConfig{NamespaceName: n.Name, NamespaceId: n.Id, Quotas: n.quota.quotas},
+	}
+	sources, err := n.captureSnapshot(manifest)
+	defer func() {
+		for _, source := range sources {
+			if source.file != nil {
+				source.file.Close()
+			}
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	tmp := fmt.Sprintf("%s.tmp-%d", dest, rand.Uint64())
+	out, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot %s: %w", dest, err)
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(tmp)
+		}
+	}()
+	archive := tar.NewWriter(out)
+	for _, source := range sources {
+		header := &tar.Header{Name: snapshotDataPrefix + source.path, Mode: 0644, Size: source.size, ModTime: manifest.CreatedAt}
+		if err = archive.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write snapshot entry %s: %w", source.path, err)
+		}
+		digest := murmur.New32()
+		if _, err = io.Copy(io.MultiWriter(archive, digest), source.reader()); err != nil {
+			return fmt.Errorf("failed to write snapshot entry %s: %w", source.path, err)
+		}
+		manifest.Files = append(manifest.Files, SnapshotFile{Path: source.path, Size: source.size, Checksum: digest.Sum32()})
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot manifest: %w", err)
+	}
+	if err = archive.WriteHeader(&tar.Header{Name: snapshotManifestName, Mode: 0644, Size: int64(len(data)), ModTime: manifest.CreatedAt}); err != nil {
+		return fmt.Errorf("failed to write snapshot manifest: %w", err)
+	}
+	if _, err = archive.Write(data); err != nil {
+		return fmt.Errorf("failed to write snapshot manifest: %w", err)
+	}
+	if err = archive.Close(); err != nil {
+		return fmt.Errorf("failed to finish snapshot %s: %w", dest, err)
+	}
+	if err = out.Sync(); err != nil {
+		return fmt.Errorf("failed to sync snapshot %s: %w", dest, err)
+	}
+	if err = out.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot %s: %w", dest, err)
+	}
+	if err = os.Rename(tmp, dest); err != nil {
+		return fmt.Errorf("failed to move snapshot to %s: %w", dest, err)
+	}
+	return nil
+}
+
+// Lock every loaded queue, flush it and capture its files, so the snapshot
+// reflects a single point in time across the namespace. The policy and
+// catalog are locked before the queues, never after.
+func (n *Namespace) captureSnapshot(manifest *SnapshotManifest) ([]*snapshotSource, error) {
+	n.policyMu.RLock()
+	defer n.policyMu.RUnlock()
+	n.catalogMu.RLock()
+	defer n.catalogMu.RUnlock()
+	queues := make([]*Queue, 0, len(n.Queues))
+	for _, q := range n.Queues {
+		if q != nil {
+			queues = append(queues, q)
+		}
+	}
+	sort.Slice(queues, func(i, j int) bool { return queues[i].Id < queues[j].Id })
+	for _, q := range queues {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+	}
+
+	sources := make([]*snapshotSource, 0)
+	for _, path := range []string{n.policyPath(), n.catalogPath()} {
+		if !utils.FileExists(path) {
+			continue
+		}
+		source, err := captureFile(n.RootDir, path, false)
+		if err != nil {
+			return sources, err
+		}
+		sources = append(sources, source)
+	}
+	for _, q := range queues {
+		snapshotQueue := SnapshotQueue{Id: q.Id, Name: q.Name, EnableDLQ: q.EnableDLQ, EnableInvisible: q.EnableInvisible, Limits: q.limits, Retry: q.retry, RejectDuplicates: q.rejectDuplicates, VisibilityTimeout: q.lockTimeout}
+		if q.dedup != nil {
+			snapshotQueue.DedupWindow = q.dedup.window
+		}
+		manifest.Queues = append(manifest.Queues, snapshotQueue)
+		for name, heap := range map[string]*Heap{"main": q.mainHeap, "invisible": q.invisibileHeap, "dlq": q.dlqHeap} {
+			if heap == nil {
+				continue
+			}
+			if err := heap.Flush(); err != nil {
+				return sources, fmt.Errorf("failed to flush %s heap of queue %s: %w", name, q.Name, err)
+			}
+		}
+		err := filepath.WalkDir(q.RootDir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			source, err := captureFile(n.RootDir, path, entry.Name() != "pages")
+			if err != nil {
+				return err
+			}
+			sources = append(sources, source)
+			return nil
+		})
+		if err != nil {
+			return sources, fmt.Errorf("failed to capture queue %s: %w", q.Name, err)
+		}
+	}
+	return sources, nil
+}
+
+func captureFile(root string, path string, appendOnly bool) (*snapshotSource, error) {
+	relative, err := filepath.Rel(root, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate %s in %s: %w", path, root, err)
+	}
+	source := &snapshotSource{path: filepath.ToSlash(relative)}
+	if !appendOnly {
+		if source.data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		source.size = int64(len(source.data))
+		return source, nil
+	}
+	if source.file, err = os.Open(path); err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	info, err := source.file.Stat()
+	if err != nil {
+		source.file.Close()
+		return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	source.size = info.Size()
+	return source, nil
+}
+
+// RestoreNamespace validates a snapshot archive and restores it as a new
+// namespace under parentDirectory, returning it with its queues loaded.
+// Nothing is written to the namespace directory unless the whole archive
+// is valid, and an existing namespace directory is never overwritten.
+func RestoreNamespace(archive string, parentDirectory string) (*Namespace, error) {
+	in, err := os.Open(archive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot %s: %w", archive, err)
+	}
+	defer in.Close()
+	if err = utils.EnsureDirectoryCreated(parentDirectory); err != nil {
+		return nil, err
+	}
+	staging, err := os.MkdirTemp(parentDirectory, ".restore-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	manifest, files, err := extractSnapshot(tar.NewReader(in), staging)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %w", archive, err)
+	}
+	if err = manifest.validate(files); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %w", archive, err)
+	}
+
+	config := manifest.Namespace
+	rootDir := filepath.Join(parentDirectory, fmt.Sprintf("%s-%d", config.NamespaceName, config.NamespaceId))
+	if _, err = os.Stat(rootDir); !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("namespace directory %s already exists", rootDir)
+	}
+	if err = os.Rename(staging, rootDir); err != nil {
+		return nil, fmt.Errorf("failed to move restored namespace to %s: %w", rootDir, err)
+	}
+	n, err := NewNamespace(parentDirectory, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open restored namespace: %w", err)
+	}
+	for _, q := range manifest.Queues {
+		queueConfig := &QueueConfiguration{
+			QueueName:         q.Name,
+			QueueId:           q.Id,
+			EnableDLQ:         q.EnableDLQ,
+			EnableInvisible:   q.EnableInvisible,
+			Limits:            q.Limits,
+			Retry:             q.Retry,
+			DedupWindow:       q.DedupWindow,
+			RejectDuplicates:  q.RejectDuplicates,
+			VisibilityTimeout: q.VisibilityTimeout,
+		}
+		if _, err = n.LoadQueue(queueConfig); err != nil {
+			n.Close()
+			return nil, fmt.Errorf("failed to load restored queue %s: %w", q.Name, err)
+		}
+	}
+	return n, nil
+}
+
+// Extract the data entries into dir, returning the manifest and the size
+// and checksum of every extracted file.
+func extractSnapshot(archive *tar.Reader, dir string) (*SnapshotManifest, map[string]SnapshotFile, error) {
+	var manifest *SnapshotManifest
+	files := make(map[string]SnapshotFile)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		if header.Name == snapshotManifestName {
+			manifest = &SnapshotManifest{}
+			if err = json.NewDecoder(archive).Decode(manifest); err != nil {
+				return nil, nil, fmt.Errorf("failed to decode manifest: %w", err)
+			}
+			continue
+		}
+		relative, found := strings.CutPrefix(header.Name, snapshotDataPrefix)
+		if !found || header.Typeflag != tar.TypeReg || !filepath.IsLocal(relative) || path.Clean(relative) != relative {
+			return nil, nil, fmt.Errorf("unexpected entry %q", header.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(relative))
+		if err = utils.EnsureDirectoryCreated(filepath.Dir(target)); err != nil {
+			return nil, nil, err
+		}
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create %s: %w", target, err)
+		}
+		digest := murmur.New32()
+		size, err := io.Copy(io.MultiWriter(out, digest), archive)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to extract %s: %w", relative, err)
+		}
+		files[relative] = SnapshotFile{Path: relative, Size: size, Checksum: digest.Sum32()}
+	}
+	if manifest == nil {
+		return nil, nil, fmt.Errorf("missing %s", snapshotManifestName)
+	}
+	return manifest, files, nil
+}
+
+func (m *SnapshotManifest) validate(files map[string]SnapshotFile) error {
+	if m.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", m.Version)
+	}
+	if len(files) != len(m.Files) {
+		return fmt.Errorf("archive holds %d files, manifest lists %d", len(files), len(m.Files))
+	}
+	for _, expected := range m.Files {
+		if actual, exists := files[expected.Path]; !exists {
+			return fmt.Errorf("missing file %s", expected.Path)
+		} else if actual != expected {
+			return &ErrCorrupted{File: expected.Path, Offset: 0, Reason: "size or checksum differs from the manifest"}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package queue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kokaq/core/utils"
+)
+
+// Every index record has a matching enqueue timestamp (unix nanoseconds)
+// at the same record offset in the times file of its priority.
+const timestampSize = 8
+
+type priorityState struct {
+	messages uint64 // messages not yet dequeued
+	head     uint64 // record offset of the next message to dequeue
+	headTime int64  // enqueue time of the next message, 0 if unknown
+
+	generation uint64 // distinguishes a priority re-created after being drained
+}
+
+type HeapStats struct {
+	Messages         uint64
+	Priorities       map[uint64]uint64
+	OldestEnqueuedAt time.Time // zero if the heap is empty
+	PageBytes        int64
+	IndexBytes       int64
+
+	PageCacheHits   uint64
+	PageCacheMisses uint64
+	PageReads       uint64
+	PageWrites      uint64
+}
+
+// Stats is computed from counters maintained on enqueue and dequeue;
+// only the pages file is stat'ed.
+func (h *Heap) Stats() (HeapStats, error) {
+	stats := HeapStats{
+		Priorities:      make(map[uint64]uint64, len(h.priorities)),
+		PageCacheHits:   h.pages.hits,
+		PageCacheMisses: h.pages.misses,
+		PageReads:       h.pages.reads,
+		PageWrites:      h.pages.writes,
+	}
+	var oldest int64 = 0
+	for priority, state := range h.priorities {
+		stats.Messages += state.messages
+		stats.Priorities[priority] = state.messages
+		stats.IndexBytes += int64(state.head+state.messages) * int64(h.config.indexRecordSize+timestampSize)
+		if state.headTime != 0 && (oldest == 0 || state.headTime < oldest) {
+			oldest = state.headTime
+		}
+	}
+	if oldest != 0 {
+		stats.OldestEnqueuedAt = time.Unix(0, oldest)
+	}
+	info, err := os.Stat(h.config.PagesPath)
+	if err != nil {
+		return stats, fmt.Errorf("failed to stat pages file %s: %w", h.config.PagesPath, err)
+	}
+	stats.PageBytes = info.Size()
+	return stats, nil
+}
+
+func (h *Heap) loadPriorityState(priority uint64, head uint64) error {
+	info, err := os.Stat(h.getIndexFilePath(priority))
+	if err != nil {
+		return fmt.Errorf("failed to stat index file of priority %d: %w", priority, err)
+	}
+	records := uint64(info.Size()) / uint64(h.config.indexRecordSize)
+	if records <= head {
+		return nil
+	}
+	h.generations++
+	state := &priorityState{messages: records - head, head: head, generation: h.generations}
+	if state.headTime, err = h.readTimestamp(priority, head); err != nil {
+		return err
+	}
+	h.priorities[priority] = state
+	return nil
+}
+
+func (h *Heap) trackEnqueue(priority uint64) error {
+	now := h.clock.Now().UnixNano()
+	timestamp := make([]byte, timestampSize)
+	binary.LittleEndian.PutUint64(timestamp, uint64(now))
+	if err := h.files.Append(h.getTimesFilePath(priority), timestamp); err != nil {
+		return fmt.Errorf("failed to append timestamp for priority %d: %w", priority, err)
+	}
+	state, exists := h.priorities[priority]
+	if !exists {
+		h.generations++
+		state = &priorityState{headTime: now, generation: h.generations}
+		h.priorities[priority] = state
+	}
+	state.messages++
+	h.metrics.onEnqueue(priority)
+	return nil
+}
+
+func (h *Heap) trackDequeue(priority uint64) error {
+	h.metrics.onDequeue(priority)
+	state, exists := h.priorities[priority]
+	if !exists {
+		return nil
+	}
+	state.messages--
+	state.head++
+	if state.messages == 0 {
+		delete(h.priorities, priority)
+		return h.files.Remove(h.getTimesFilePath(priority))
+	}
+	var err error
+	state.headTime, err = h.readTimestamp(priority, state.head)
+	return err
+}
+
+func (h *Heap) untrackPriority(priority uint64) {
+	state, exists := h.priorities[priority]
+	if !exists {
+		return
+	}
+	delete(h.priorities, priority)
+	h.metrics.onClear(priority, state.messages)
+}
+
+func (h *Heap) readTimestamp(priority uint64, record uint64) (int64, error) {
+	path := h.getTimesFilePath(priority)
+	if !utils.FileExists(path) {
+		return 0, nil
+	}
+	data, err := h.files.ReadAt(path, int64(record)*timestampSize, timestampSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read timestamp of priority %d: %w", priority, err)
+	}
+	if len(data) < timestampSize {
+		return 0, nil
+	}
+	return int64(binary.LittleEndian.Uint64(data)), nil
+}
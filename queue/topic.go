@@ -0,0 +1,252 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/kokaq/core/utils"
+)
+
+const catalogFileName = "catalog.json"
+
+// A topic fans every published message out to the queues subscribed to it.
+// Each matching subscription gets the same message id enqueued in its queue.
+type Topic struct {
+	Name          string
+	Subscriptions []Subscription
+}
+
+type Subscription struct {
+	Name       string
+	QueueId    uint32
+	Priorities PriorityRange     // zero matches every priority
+	Headers    map[string]string // published headers must hold every one, empty matches every message
+}
+
+// Whether a message published with headers is delivered to the subscription.
+func (s *Subscription) Matches(item *QueueItem, headers map[string]string) bool {
+	if !s.Priorities.Contains(item.Priority) {
+		return false
+	}
+	for key, value := range s.Headers {
+		if published, exists := headers[key]; !exists || published != value {
+			return false
+		}
+	}
+	return true
+}
+
+// The persisted definitions of a namespace beyond its queues.
+type catalog struct {
+	Topics map[string]*Topic
+}
+
+func newCatalog() *catalog {
+	return &catalog{Topics: make(map[string]*Topic)}
+}
+
+func loadCatalog(path string) (*catalog, error) {
+	c := newCatalog()
+	if !utils.FileExists(path) {
+		return c, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalog file %s: %w", path, err)
+	}
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("failed to parse catalog file %s: %w", path, err)
+	}
+	return c, nil
+}
+
+func saveCatalog(path string, c *catalog) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode catalog: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	if err = os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write catalog file %s: %w", tmpPath, err)
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace catalog file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (n *Namespace) catalogPath() string {
+	return filepath.Join(n.RootDir, catalogFileName)
+}
+
+// Apply change to a copy of the catalog, persist it, then make it current.
+// Callers hold n.catalogMu.
+func (n *Namespace) updateCatalog(change func(c *catalog) error) error {
+	updated := newCatalog()
+	for name, topic := range n.catalog.Topics {
+		updated.Topics[name] = cloneTopic(topic)
+	}
+	if err := change(updated); err != nil {
+		return err
+	}
+	if err := saveCatalog(n.catalogPath(), updated); err != nil {
+		return fmt.Errorf("failed to save catalog for namespace %s: %w", n.Name, err)
+	}
+	n.catalog = updated
+	return nil
+}
+
+func cloneTopic(topic *Topic) *Topic {
+	clone := &Topic{Name: topic.Name, Subscriptions: slices.Clone(topic.Subscriptions)}
+	for i := range clone.Subscriptions {
+		clone.Subscriptions[i].Headers = maps.Clone(clone.Subscriptions[i].Headers)
+	}
+	return clone
+}
+
+func (n *Namespace) CreateTopic(name string) error {
+	if name == "" {
+		return errors.New("topic name cannot be empty")
+	}
+	n.catalogMu.Lock()
+	defer n.catalogMu.Unlock()
+	return n.updateCatalog(func(c *catalog) error {
+		if _, exists := c.Topics[name]; exists {
+			return fmt.Errorf("topic %s already exists", name)
+		}
+		c.Topics[name] = &Topic{Name: name, Subscriptions: make([]Subscription, 0)}
+		return nil
+	})
+}
+
+// Delete a topic and its subscriptions; the subscribed queues are kept.
+func (n *Namespace) DeleteTopic(name string) error {
+	n.catalogMu.Lock()
+	defer n.catalogMu.Unlock()
+	return n.updateCatalog(func(c *catalog) error {
+		if _, exists := c.Topics[name]; !exists {
+			return fmt.Errorf("topic %s not found", name)
+		}
+		delete(c.Topics, name)
+		return nil
+	})
+}
+
+func (n *Namespace) GetTopic(name string) (*Topic, error) {
+	n.catalogMu.RLock()
+	defer n.catalogMu.RUnlock()
+	topic, exists := n.catalog.Topics[name]
+	if !exists {
+		return nil, fmt.Errorf("topic %s not found", name)
+	}
+	return cloneTopic(topic), nil
+}
+
+// Names of the topics of the namespace, sorted.
+func (n *Namespace) Topics() []string {
+	n.catalogMu.RLock()
+	defer n.catalogMu.RUnlock()
+	return slices.Sorted(maps.Keys(n.catalog.Topics))
+}
+
+// Subscribe a queue of the namespace to a topic. Messages published from
+// then on that match the subscription are enqueued in the queue.
+func (n *Namespace) Subscribe(topicName string, subscription Subscription) error {
+	if subscription.Name == "" {
+		return errors.New("subscription name cannot be empty")
+	}
+	if q := n.Queues[subscription.QueueId]; q == nil {
+		return fmt.Errorf("queue with id %d not found", subscription.QueueId)
+	}
+	n.catalogMu.Lock()
+	defer n.catalogMu.Unlock()
+	return n.updateCatalog(func(c *catalog) error {
+		topic, exists := c.Topics[topicName]
+		if !exists {
+			return fmt.Errorf("topic %s not found", topicName)
+		}
+		if slices.ContainsFunc(topic.Subscriptions, func(s Subscription) bool { return s.Name == subscription.Name }) {
+			return fmt.Errorf("subscription %s of topic %s already exists", subscription.Name, topicName)
+		}
+		subscription.Headers = maps.Clone(subscription.Headers)
+		topic.Subscriptions = append(topic.Subscriptions, subscription)
+		return nil
+	})
+}
+
+func (n *Namespace) Unsubscribe(topicName string, subscriptionName string) error {
+	n.catalogMu.Lock()
+	defer n.catalogMu.Unlock()
+	return n.updateCatalog(func(c *catalog) error {
+		topic, exists := c.Topics[topicName]
+		if !exists {
+			return fmt.Errorf("topic %s not found", topicName)
+		}
+		count := len(topic.Subscriptions)
+		topic.Subscriptions = slices.DeleteFunc(topic.Subscriptions, func(s Subscription) bool { return s.Name == subscriptionName })
+		if len(topic.Subscriptions) == count {
+			return fmt.Errorf("subscription %s of topic %s not found", subscriptionName, topicName)
+		}
+		return nil
+	})
+}
+
+// Drop the subscriptions of a deleted queue. Callers hold n.catalogMu.
+func (n *Namespace) unsubscribeQueue(queueId uint32) error {
+	subscribed := false
+	for _, topic := range n.catalog.Topics {
+		subscribed = subscribed || slices.ContainsFunc(topic.Subscriptions, func(s Subscription) bool { return s.QueueId == queueId })
+	}
+	if !subscribed {
+		return nil
+	}
+	return n.updateCatalog(func(c *catalog) error {
+		for _, topic := range c.Topics {
+			topic.Subscriptions = slices.DeleteFunc(topic.Subscriptions, func(s Subscription) bool { return s.QueueId == queueId })
+		}
+		return nil
+	})
+}
+
+// Publish enqueues the message in the queue of every subscription of the
+// topic it matches, in subscription order, and returns the ids of those
+// queues. Every subscription is attempted even if some fail, in which case
+// the returned ids are those of the queues the message reached. Headers
+// are only matched against subscription filters, they are not stored.
+func (n *Namespace) Publish(topicName string, item *QueueItem, headers map[string]string) ([]uint32, error) {
+	// Queues are locked after the catalog by snapshots, so the catalog is
+	// released before enqueueing
+	n.catalogMu.RLock()
+	topic, exists := n.catalog.Topics[topicName]
+	if !exists {
+		n.catalogMu.RUnlock()
+		return nil, fmt.Errorf("topic %s not found", topicName)
+	}
+	subscriptions := slices.Clone(topic.Subscriptions)
+	n.catalogMu.RUnlock()
+
+	delivered := make([]uint32, 0, len(subscriptions))
+	var errs []error
+	for _, subscription := range subscriptions {
+		if !subscription.Matches(item, headers) {
+			continue
+		}
+		q := n.Queues[subscription.QueueId]
+		if q == nil {
+			errs = append(errs, fmt.Errorf("subscription %s: queue with id %d not loaded", subscription.Name, subscription.QueueId))
+			continue
+		}
+		message := *item
+		if err := q.Enqueue(&message); err != nil {
+			errs = append(errs, fmt.Errorf("failed to deliver to subscription %s: %w", subscription.Name, err))
+			continue
+		}
+		delivered = append(delivered, subscription.QueueId)
+	}
+	return delivered, errors.Join(errs...)
+}
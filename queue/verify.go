@@ -0,0 +1,160 @@
+package queue
+
+import (
+	"fmt"
+	"os"
+)
+
+type ViolationKind string
+
+const (
+	ViolationEmptyNode         ViolationKind = "empty-node"         // node within totalNodes without a priority
+	ViolationDuplicatePriority ViolationKind = "duplicate-priority" // priority with more than one node
+	ViolationHeapProperty      ViolationKind = "heap-property"      // node ordered before a lower priority parent
+	ViolationStaleLocalRoot    ViolationKind = "stale-local-root"   // page root differing from its parent node
+	ViolationNodeCount         ViolationKind = "node-count"         // nodes in the pages differing from totalNodes
+	ViolationPageCount         ViolationKind = "page-count"         // pages holding nodes differing from totalPages
+	ViolationPriorityState     ViolationKind = "priority-state"     // node and tracked state of a priority disagreeing
+	ViolationMissingIndex      ViolationKind = "missing-index"      // node whose head record is not in its index file
+)
+
+type HeapViolation struct {
+	Kind   ViolationKind
+	Node   int // global node index, 0 when not about a node
+	Page   int // 0 when not about a page
+	Detail string
+}
+
+func (v HeapViolation) String() string {
+	return fmt.Sprintf("%s (node %d, page %d): %s", v.Kind, v.Node, v.Page, v.Detail)
+}
+
+// Verify walks every page of the heap and reports the violations of its
+// invariants. The page cache and index files are read as they are, so
+// modifications not yet flushed are taken into account.
+func (h *Heap) Verify() ([]HeapViolation, error) {
+	if h.closed {
+		return nil, ErrHeapClosed
+	}
+	var loadErr error
+	node := func(i int) (heapNode, bool) {
+		if loadErr != nil {
+			return heapNode{}, false
+		}
+		var n heapNode
+		n, loadErr = h.readNode(i)
+		return n, loadErr == nil
+	}
+	localRoot := func(pageNumber int) (heapNode, bool) {
+		if loadErr != nil {
+			return heapNode{}, false
+		}
+		var page *Page
+		if page, loadErr = h.loadPage(pageNumber); loadErr != nil {
+			return heapNode{}, false
+		}
+		return h.getNode(page, 1), true
+	}
+	violations, heads := verifyNodes(h, h.totalNodes, node, localRoot)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+
+	// Count what the pages hold, up to the last page on disk or in use
+	info, err := os.Stat(h.config.PagesPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat pages file %s: %w", h.config.PagesPath, err)
+	}
+	lastPage := int((info.Size() + int64(h.config.pageSize) - 1) / int64(h.config.pageSize))
+	if h.totalNodes > 0 {
+		pageNumber, _, _ := h.getLocalHeapDetailsForNode(h.totalNodes)
+		lastPage = max(lastPage, pageNumber)
+	}
+	nodes, pages := 0, 0
+	for p := 1; p <= lastPage; p++ {
+		page, err := h.loadPage(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load page %d: %w", p, err)
+		}
+		inPage := 0
+		for i := 1; i <= h.config.subheapNodes; i++ {
+			if i == 1 && p != 1 {
+				continue
+			}
+			if h.getNode(page, i).priority != 0 {
+				inPage++
+			}
+		}
+		nodes += inPage
+		if inPage > 0 {
+			pages++
+		}
+	}
+	if nodes != h.totalNodes {
+		violations = append(violations, HeapViolation{Kind: ViolationNodeCount, Detail: fmt.Sprintf("pages hold %d nodes, totalNodes is %d", nodes, h.totalNodes)})
+	}
+	if pages != h.totalPages {
+		violations = append(violations, HeapViolation{Kind: ViolationPageCount, Detail: fmt.Sprintf("%d pages hold nodes, totalPages is %d", pages, h.totalPages)})
+	}
+
+	for priority, at := range heads {
+		state, exists := h.priorities[priority]
+		if !exists {
+			violations = append(violations, HeapViolation{Kind: ViolationPriorityState, Node: at.node, Detail: fmt.Sprintf("priority %d is not tracked", priority)})
+		} else if state.head != at.index {
+			violations = append(violations, HeapViolation{Kind: ViolationPriorityState, Node: at.node, Detail: fmt.Sprintf("priority %d has head %d, its state head %d", priority, at.index, state.head)})
+		}
+		offset := int64(at.index) * int64(h.config.indexRecordSize)
+		data, err := h.files.ReadAt(h.getIndexFilePath(priority), offset, h.config.indexRecordSize)
+		if err != nil || len(data) < h.config.indexRecordSize {
+			violations = append(violations, HeapViolation{Kind: ViolationMissingIndex, Node: at.node, Detail: fmt.Sprintf("no record %d for priority %d", at.index, priority)})
+		}
+	}
+	for priority := range h.priorities {
+		if _, exists := heads[priority]; !exists {
+			violations = append(violations, HeapViolation{Kind: ViolationPriorityState, Detail: fmt.Sprintf("tracked priority %d has no node", priority)})
+		}
+	}
+	return violations, nil
+}
+
+type nodeHead struct {
+	node  int
+	index uint64
+}
+
+// Check the first count nodes of a heap, read through node, and the local
+// roots of the pages below them, read through localRoot. Nodes that cannot
+// be read are skipped. Returns the violations and the head of every priority.
+func verifyNodes(h *Heap, count int, node func(int) (heapNode, bool), localRoot func(int) (heapNode, bool)) ([]HeapViolation, map[uint64]nodeHead) {
+	violations := make([]HeapViolation, 0)
+	heads := make(map[uint64]nodeHead)
+	for i := 1; i <= count; i++ {
+		n, ok := node(i)
+		if !ok {
+			continue
+		}
+		pageNumber, _, localLevel := h.getLocalHeapDetailsForNode(i)
+		if n.priority == 0 {
+			violations = append(violations, HeapViolation{Kind: ViolationEmptyNode, Node: i, Page: pageNumber, Detail: fmt.Sprintf("node %d of %d is empty", i, count)})
+			continue
+		}
+		if previous, exists := heads[n.priority]; exists {
+			violations = append(violations, HeapViolation{Kind: ViolationDuplicatePriority, Node: i, Page: pageNumber, Detail: fmt.Sprintf("priority %d is also at node %d", n.priority, previous.node)})
+		}
+		heads[n.priority] = nodeHead{node: i, index: n.index}
+		if i == 1 {
+			continue
+		}
+		if parent, ok := node(i / 2); ok && outranks(n.priority, parent.priority) {
+			violations = append(violations, HeapViolation{Kind: ViolationHeapProperty, Node: i, Page: pageNumber, Detail: fmt.Sprintf("priority %d is below its parent with priority %d", n.priority, parent.priority)})
+		}
+		if localLevel == h.config.heapMaxSize-1 && 2*i <= count {
+			childPage, _, _ := h.getLocalHeapDetailsForNode(2 * i)
+			if root, ok := localRoot(childPage); ok && root != n {
+				violations = append(violations, HeapViolation{Kind: ViolationStaleLocalRoot, Node: i, Page: childPage, Detail: fmt.Sprintf("page root is %+v, node is %+v", root, n)})
+			}
+		}
+	}
+	return violations, heads
+}
@@ -0,0 +1,157 @@
+package tests
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/queue"
+	"github.com/kokaq/core/utils/murmur"
+	"github.com/stretchr/testify/assert"
+)
+
+const indexRecordSize = 16 + 4
+
+func fillHeap(t *testing.T, dir string, priorities uint64, messages int) {
+	heap, err := queue.NewHeap(dir, 3, 8, 8, 16)
+	if err != nil {
+		t.Fatalf("Failed to initialize heap: %v", err)
+	}
+	for priority := uint64(1); priority <= priorities; priority++ {
+		for range messages {
+			if err := heap.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: priority}); err != nil {
+				t.Fatalf("Enqueue failed: %v", err)
+			}
+		}
+	}
+	if err := heap.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+func flipByte(t *testing.T, path string, offset int64) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	data[offset] ^= 0xff
+	if err = os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func TestChecksumCorruptedPage(t *testing.T) {
+	dir := t.TempDir()
+	fillHeap(t, dir, 20, 1)
+	// Page 2 starts after the 7 nodes and checksum of page 1
+	pageSize := int64(7*16 + 4)
+	flipByte(t, filepath.Join(dir, "pages"), pageSize+20)
+
+	_, err := queue.NewHeap(dir, 3, 8, 8, 16)
+	var corrupted *queue.ErrCorrupted
+	if !errors.As(err, &corrupted) {
+		t.Fatalf("expected ErrCorrupted, got %v", err)
+	}
+	assert.Equal(t, filepath.Join(dir, "pages"), corrupted.File)
+	assert.Equal(t, pageSize, corrupted.Offset)
+}
+
+func TestChecksumCorruptedIndexRecord(t *testing.T) {
+	dir := t.TempDir()
+	fillHeap(t, dir, 1, 3)
+	index := filepath.Join(dir, "indexes", "1")
+	flipByte(t, index, indexRecordSize+3)
+
+	heap, err := queue.NewHeap(dir, 3, 8, 8, 16)
+	if err != nil {
+		t.Fatalf("Failed to reopen heap: %v", err)
+	}
+	defer heap.Close()
+	_, err = heap.Peek()
+	assert.NoError(t, err)
+	// Dequeue checks the record that becomes the head
+	_, err = heap.Dequeue()
+	var corrupted *queue.ErrCorrupted
+	if assert.ErrorAs(t, err, &corrupted) {
+		assert.Equal(t, index, corrupted.File)
+		assert.Equal(t, int64(indexRecordSize), corrupted.Offset)
+	}
+	_, _, err = heap.List(queue.ListOptions{})
+	assert.ErrorAs(t, err, &corrupted)
+}
+
+func TestChecksumTornAppend(t *testing.T) {
+	dir := t.TempDir()
+	fillHeap(t, dir, 1, 1)
+	index := filepath.Join(dir, "indexes", "1")
+	file, err := os.OpenFile(index, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", index, err)
+	}
+	file.Write(make([]byte, 7))
+	file.Close()
+
+	heap, err := queue.NewHeap(dir, 3, 8, 8, 16)
+	if err != nil {
+		t.Fatalf("Failed to reopen heap: %v", err)
+	}
+	defer heap.Close()
+	// The torn record is reported rather than dropped with the index file
+	_, err = heap.Dequeue()
+	var corrupted *queue.ErrCorrupted
+	if assert.ErrorAs(t, err, &corrupted) {
+		assert.Equal(t, int64(indexRecordSize), corrupted.Offset)
+	}
+}
+
+func TestMurmurSum32(t *testing.T) {
+	data := []byte("kokaq checksums")
+	digest := murmur.New32()
+	digest.Write(data)
+	assert.Equal(t, digest.Sum32(), murmur.Sum32(data))
+	assert.NotEqual(t, murmur.Sum32(data), murmur.SeedSum32(1, data))
+}
+
+func TestHeapFormat(t *testing.T) {
+	dir := t.TempDir()
+	fillHeap(t, dir, 5, 2)
+	format := filepath.Join(dir, "format")
+	assert.FileExists(t, format)
+
+	// A heap that predates the format file is marked once its checksums pass
+	assert.NoError(t, os.Remove(format))
+	heap, err := queue.NewHeap(dir, 3, 8, 8, 16)
+	assert.NoError(t, err)
+	assert.NoError(t, heap.Close())
+	assert.FileExists(t, format)
+
+	assert.NoError(t, os.WriteFile(format, []byte("3\n"), 0644))
+	_, err = queue.NewHeap(dir, 3, 8, 8, 16)
+	assert.ErrorIs(t, err, queue.ErrUnsupportedFormat)
+
+	_, err = queue.NewHeap(t.TempDir(), 3, 8, 8, 8)
+	assert.Error(t, err, "message ids are 16 byte uuids")
+}
+
+func TestHeapFormatRefusesUncheckedHeap(t *testing.T) {
+	// A heap of format 1: a page of 7 nodes and index records without checksums
+	dir := t.TempDir()
+	page := make([]byte, 7*16)
+	binary.LittleEndian.PutUint64(page, 4)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "pages"), page, 0644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "indexes"), 0755))
+	id := uuid.New()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "indexes", "4"), id[:], 0644))
+
+	_, err := queue.NewHeap(dir, 3, 8, 8, 16)
+	assert.ErrorIs(t, err, queue.ErrUnsupportedFormat)
+	assert.NoFileExists(t, filepath.Join(dir, "format"))
+	report := &queue.FsckReport{}
+	assert.ErrorIs(t, queue.FsckHeap(dir, 3, 8, 8, 16, true, report), queue.ErrUnsupportedFormat)
+	data, err := os.ReadFile(filepath.Join(dir, "pages"))
+	assert.NoError(t, err)
+	assert.Equal(t, page, data, "fsck leaves the heap alone")
+}
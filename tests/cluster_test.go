@@ -0,0 +1,336 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/cluster"
+	"github.com/kokaq/core/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCluster struct {
+	t         *testing.T
+	network   *cluster.MemoryNetwork
+	root      string
+	peers     []string
+	threshold uint64
+	nodes     map[string]*cluster.Node
+}
+
+func newTestCluster(t *testing.T, size int, threshold uint64) *testCluster {
+	c := &testCluster{t: t, network: cluster.NewMemoryNetwork(), root: t.TempDir(), threshold: threshold, nodes: make(map[string]*cluster.Node)}
+	for i := range size {
+		c.peers = append(c.peers, fmt.Sprint("node-", i+1))
+	}
+	for _, id := range c.peers {
+		c.start(id)
+	}
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			node.Close()
+		}
+	})
+	return c
+}
+
+func (c *testCluster) start(id string) *cluster.Node {
+	node, err := cluster.NewNode(cluster.Config{
+		Id:                id,
+		Peers:             c.peers,
+		Dir:               filepath.Join(c.root, id),
+		Namespace:         queue.NamespaceConfig{NamespaceName: "cluster", NamespaceId: 20},
+		Transport:         c.network.Transport(id),
+		ElectionTimeout:   60 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+		SnapshotThreshold: c.threshold,
+	})
+	if err != nil {
+		c.t.Fatalf("Failed to start node %s: %v", id, err)
+	}
+	c.nodes[id] = node
+	return node
+}
+
+// Wait for a single leader among the nodes not excluded, which all follow it.
+func (c *testCluster) leader(excluded ...string) *cluster.Node {
+	var leader *cluster.Node
+	assert.Eventually(c.t, func() bool {
+		leader = nil
+		leaders := make(map[string]bool)
+		for id, node := range c.nodes {
+			if slices.Contains(excluded, id) {
+				continue
+			}
+			status := node.Status()
+			if status.State == cluster.Leader {
+				leader = node
+			}
+			leaders[status.Leader] = true
+		}
+		return leader != nil && len(leaders) == 1
+	}, 5*time.Second, 5*time.Millisecond)
+	if leader == nil {
+		c.t.Fatalf("No leader elected")
+	}
+	return leader
+}
+
+// Wait for the leader to apply its whole log, and every node not excluded
+// to apply as much.
+func (c *testCluster) converge(leader *cluster.Node, excluded ...string) {
+	assert.Eventually(c.t, func() bool {
+		status := leader.Status()
+		if status.LastApplied < status.LastIndex {
+			return false
+		}
+		for id, node := range c.nodes {
+			if !slices.Contains(excluded, id) && node.Status().LastApplied < status.LastApplied {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 5*time.Millisecond)
+}
+
+func messagesOf(t *testing.T, node *cluster.Node, queueId uint32) []*queue.QueueItem {
+	var items []*queue.QueueItem
+	err := node.View(func(namespace *queue.Namespace) error {
+		q, err := namespace.GetQueue(queueId)
+		if err != nil {
+			return err
+		}
+		items, _, err = q.ListMessages(queue.ListOptions{PageSize: 1000})
+		return err
+	})
+	assert.NoError(t, err)
+	return items
+}
+
+func enqueueMany(t *testing.T, node *cluster.Node, queueId uint32, count int) {
+	for i := range count {
+		assert.NoError(t, node.Enqueue(context.Background(), queueId, &queue.QueueItem{MessageId: uuid.New(), Priority: uint64(i%5 + 1)}))
+	}
+}
+
+func TestClusterReplicatesOperations(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+	ctx := context.Background()
+	assert.NoError(t, leader.AddQueue(ctx, queue.QueueConfiguration{QueueName: "orders", QueueId: 1, EnableDLQ: true}))
+	assert.Error(t, leader.AddQueue(ctx, queue.QueueConfiguration{QueueName: "orders", QueueId: 1}))
+	enqueueMany(t, leader, 1, 20)
+	item, err := leader.Dequeue(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), item.Priority)
+	peeked, err := leader.Peek(ctx, 1)
+	assert.NoError(t, err)
+
+	c.converge(leader)
+	expected := messagesOf(t, leader, 1)
+	assert.Len(t, expected, 19)
+	assert.Equal(t, peeked, expected[0])
+	for _, node := range c.nodes {
+		assert.Equal(t, expected, messagesOf(t, node, 1))
+	}
+
+	// Writes are only accepted by the leader
+	for _, node := range c.nodes {
+		if node != leader {
+			err := node.Enqueue(ctx, 1, &queue.QueueItem{MessageId: uuid.New(), Priority: 1})
+			assert.ErrorIs(t, err, cluster.ErrNotLeader)
+			assert.ErrorContains(t, err, leader.Status().Id)
+		}
+	}
+
+	assert.NoError(t, leader.DeleteQueue(ctx, 1))
+	_, err = leader.Dequeue(ctx, 1)
+	assert.ErrorContains(t, err, "not found")
+}
+
+func TestClusterReplicatesGroups(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+	ctx := context.Background()
+	assert.NoError(t, leader.AddQueue(ctx, queue.QueueConfiguration{QueueName: "orders", QueueId: 1}))
+	first := &queue.QueueItem{MessageId: uuid.New(), Priority: 1, GroupKey: "order-1"}
+	second := &queue.QueueItem{MessageId: uuid.New(), Priority: 9, GroupKey: "order-1"}
+	assert.NoError(t, leader.Enqueue(ctx, 1, first))
+	assert.NoError(t, leader.Enqueue(ctx, 1, second))
+
+	// Every node holds the second message back behind the first
+	c.converge(leader)
+	for _, node := range c.nodes {
+		assert.Equal(t, []*queue.QueueItem{first}, messagesOf(t, node, 1))
+	}
+	item, err := leader.Dequeue(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, first.MessageId, item.MessageId)
+}
+
+func TestClusterDequeuesAreLinearizable(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+	ctx := context.Background()
+	assert.NoError(t, leader.AddQueue(ctx, queue.QueueConfiguration{QueueName: "jobs", QueueId: 1}))
+	enqueueMany(t, leader, 1, 60)
+
+	var mu sync.Mutex
+	seen := make(map[uuid.UUID]int)
+	var wg sync.WaitGroup
+	for range 6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				item, err := leader.Dequeue(ctx, 1)
+				if !assert.NoError(t, err) {
+					return
+				}
+				mu.Lock()
+				seen[item.MessageId]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, seen, 60)
+	for id, count := range seen {
+		assert.Equal(t, 1, count, "message %s dequeued %d times", id, count)
+	}
+	c.converge(leader)
+	for _, node := range c.nodes {
+		assert.Empty(t, messagesOf(t, node, 1))
+	}
+}
+
+func TestClusterLeaderFailover(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	ctx := context.Background()
+	old := c.leader()
+	assert.NoError(t, old.AddQueue(ctx, queue.QueueConfiguration{QueueName: "jobs", QueueId: 1}))
+	enqueueMany(t, old, 1, 10)
+
+	oldId := old.Status().Id
+	c.network.Isolate(oldId)
+	leader := c.leader(oldId)
+	assert.NotEqual(t, oldId, leader.Status().Id)
+	enqueueMany(t, leader, 1, 10)
+
+	// The isolated leader cannot commit and steps down
+	timeout, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	err := old.Enqueue(timeout, 1, &queue.QueueItem{MessageId: uuid.New(), Priority: 9})
+	assert.True(t, errors.Is(err, cluster.ErrNotLeader) || errors.Is(err, context.DeadlineExceeded), "unexpected error %v", err)
+	assert.Eventually(t, func() bool { return old.Status().State != cluster.Leader }, 5*time.Second, 5*time.Millisecond)
+	assert.ErrorIs(t, old.Enqueue(ctx, 1, &queue.QueueItem{MessageId: uuid.New(), Priority: 9}), cluster.ErrNotLeader)
+
+	c.network.Heal(oldId)
+	assert.NoError(t, leader.Enqueue(ctx, 1, &queue.QueueItem{MessageId: uuid.New(), Priority: 3}))
+	c.converge(leader)
+	expected := messagesOf(t, leader, 1)
+	assert.Len(t, expected, 21)
+	assert.Equal(t, expected, messagesOf(t, old, 1))
+}
+
+func TestClusterSnapshotsTruncateLog(t *testing.T) {
+	c := newTestCluster(t, 3, 16)
+	ctx := context.Background()
+	leader := c.leader()
+	assert.NoError(t, leader.AddQueue(ctx, queue.QueueConfiguration{QueueName: "jobs", QueueId: 1, EnableDLQ: true, EnableInvisible: true}))
+
+	// A follower missing compacted entries is sent a snapshot
+	var lagging string
+	for id := range c.nodes {
+		if id != leader.Status().Id {
+			lagging = id
+			break
+		}
+	}
+	c.network.Isolate(lagging)
+	enqueueMany(t, leader, 1, 100)
+	status := leader.Status()
+	assert.Greater(t, status.SnapshotIndex, uint64(0))
+	assert.LessOrEqual(t, status.LastIndex-status.SnapshotIndex, uint64(16))
+	snapshots, err := os.ReadDir(filepath.Join(c.root, status.Id, "snapshots"))
+	assert.NoError(t, err)
+	assert.Len(t, snapshots, 1)
+
+	c.network.Heal(lagging)
+	c.converge(leader)
+	expected := messagesOf(t, leader, 1)
+	assert.Len(t, expected, 100)
+	assert.Equal(t, expected, messagesOf(t, c.nodes[lagging], 1))
+	assert.Greater(t, c.nodes[lagging].Status().SnapshotIndex, uint64(0))
+
+	// A restarted node recovers from its snapshot and log
+	assert.NoError(t, c.nodes[lagging].Close())
+	restarted := c.start(lagging)
+	enqueueMany(t, c.leader(), 1, 5)
+	c.converge(c.leader())
+	assert.Equal(t, messagesOf(t, c.leader(), 1), messagesOf(t, restarted, 1))
+}
+
+func TestClusterSingleNodeRestart(t *testing.T) {
+	c := newTestCluster(t, 1, 8)
+	ctx := context.Background()
+	node := c.leader()
+	assert.NoError(t, node.AddQueue(ctx, queue.QueueConfiguration{QueueName: "jobs", QueueId: 1}))
+	enqueueMany(t, node, 1, 20)
+	_, err := node.Dequeue(ctx, 1)
+	assert.NoError(t, err)
+	expected := messagesOf(t, node, 1)
+
+	assert.NoError(t, node.Close())
+	assert.ErrorIs(t, node.Enqueue(ctx, 1, &queue.QueueItem{MessageId: uuid.New(), Priority: 1}), cluster.ErrNodeClosed)
+	node = c.start(node.Status().Id)
+	c.leader()
+	c.converge(node)
+	assert.Equal(t, expected, messagesOf(t, node, 1))
+}
+
+func TestClusterNodeFailsOnStorageErrors(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+	ctx := context.Background()
+	assert.NoError(t, leader.AddQueue(ctx, queue.QueueConfiguration{QueueName: "orders", QueueId: 1}))
+	enqueueMany(t, leader, 1, 5)
+	c.converge(leader)
+	var broken *cluster.Node
+	for _, node := range c.nodes {
+		if node != leader {
+			broken = node
+		}
+	}
+
+	// The follower can no longer create index files, the others can
+	var rootDir string
+	assert.NoError(t, broken.View(func(namespace *queue.Namespace) error {
+		q, err := namespace.GetQueue(1)
+		rootDir = q.RootDir
+		return err
+	}))
+	assert.NoError(t, os.RemoveAll(filepath.Join(rootDir, "main", "indexes")))
+	applied := broken.Status().LastApplied
+	assert.NoError(t, leader.Enqueue(ctx, 1, &queue.QueueItem{MessageId: uuid.New(), Priority: 42}))
+	assert.Eventually(t, func() bool { return broken.Status().Failure != nil }, 5*time.Second, 5*time.Millisecond)
+	assert.ErrorIs(t, broken.Status().Failure, cluster.ErrNodeFailed)
+	assert.Equal(t, applied, broken.Status().LastApplied, "the failed entry is not applied")
+	enqueueMany(t, leader, 1, 3)
+	c.converge(leader, broken.Status().Id)
+
+	// Restarting the node rebuilds its namespace from the log
+	assert.NoError(t, broken.Close())
+	broken = c.start(broken.Status().Id)
+	c.converge(leader)
+	assert.Nil(t, broken.Status().Failure)
+	assert.Equal(t, messagesOf(t, leader, 1), messagesOf(t, broken, 1))
+}
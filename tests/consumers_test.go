@@ -0,0 +1,179 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func newConsumerQueue(t *testing.T, dir string) *queue.Queue {
+	return newTestQueue(t, dir, queue.QueueConfiguration{QueueName: "consumers", QueueId: 1})
+}
+
+func consumeAll(t *testing.T, q *queue.Queue, group string) []uuid.UUID {
+	var ids []uuid.UUID
+	for {
+		item, err := q.Consume(group)
+		if err != nil {
+			return ids
+		}
+		ids = append(ids, item.MessageId)
+	}
+}
+
+func TestConsumerGroupsEachSeeEveryMessage(t *testing.T) {
+	q := newConsumerQueue(t, t.TempDir())
+	assert.NoError(t, q.CreateConsumerGroup("billing"))
+	assert.NoError(t, q.CreateConsumerGroup("shipping"))
+	assert.Error(t, q.CreateConsumerGroup("billing"))
+	assert.Equal(t, []string{"billing", "shipping"}, q.ConsumerGroups())
+
+	var ids []uuid.UUID
+	for _, priority := range []uint64{2, 9, 2, 5} {
+		item := &queue.QueueItem{MessageId: uuid.New(), Priority: priority}
+		ids = append(ids, item.MessageId)
+		assert.NoError(t, q.Enqueue(item))
+	}
+	expected := []uuid.UUID{ids[1], ids[3], ids[0], ids[2]}
+	lag, err := q.ConsumerGroupLag("billing")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), lag)
+
+	assert.Equal(t, expected, consumeAll(t, q, "billing"))
+	stats, err := q.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), stats[queue.StatVisible], "messages stay until every group consumed them")
+	assert.Equal(t, uint64(0), stats[queue.StatConsumerLagPrefix+"billing"])
+	assert.Equal(t, uint64(4), stats[queue.StatConsumerLagPrefix+"shipping"])
+
+	item, err := q.Consume("shipping")
+	assert.NoError(t, err)
+	assert.Equal(t, expected[0], item.MessageId)
+	stats, err = q.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), stats[queue.StatVisible])
+
+	// Deleting the lagging group dequeues what only it had left
+	assert.NoError(t, q.DeleteConsumerGroup("shipping"))
+	assert.Error(t, q.DeleteConsumerGroup("shipping"))
+	_, err = q.ConsumerGroupLag("shipping")
+	assert.Error(t, err)
+	empty, err := q.IsEmpty()
+	assert.NoError(t, err)
+	assert.True(t, empty)
+
+	// Priorities drained and enqueued again start over in their index files
+	next := &queue.QueueItem{MessageId: uuid.New(), Priority: 9}
+	assert.NoError(t, q.Enqueue(next))
+	assert.Equal(t, []uuid.UUID{next.MessageId}, consumeAll(t, q, "billing"))
+}
+
+func TestConsumerGroupCompetingConsumers(t *testing.T) {
+	q := newConsumerQueue(t, t.TempDir())
+	assert.NoError(t, q.CreateConsumerGroup("workers"))
+	assert.NoError(t, q.CreateConsumerGroup("audit"))
+	const messages = 200
+	for i := range messages {
+		assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: uint64(i%4 + 1)}))
+	}
+
+	var mu sync.Mutex
+	seen := make(map[uuid.UUID]int)
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, id := range consumeAll(t, q, "workers") {
+				mu.Lock()
+				seen[id]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, seen, messages)
+	for id, count := range seen {
+		assert.Equal(t, 1, count, "message %s", id)
+	}
+	assert.Len(t, consumeAll(t, q, "audit"), messages)
+	empty, err := q.IsEmpty()
+	assert.NoError(t, err)
+	assert.True(t, empty)
+}
+
+func TestConsumerGroupOffsetsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	q := newConsumerQueue(t, dir)
+	assert.NoError(t, q.CreateConsumerGroup("a"))
+	assert.NoError(t, q.CreateConsumerGroup("b"))
+	var ids []uuid.UUID
+	for range 5 {
+		item := &queue.QueueItem{MessageId: uuid.New(), Priority: 3}
+		ids = append(ids, item.MessageId)
+		assert.NoError(t, q.Enqueue(item))
+	}
+	for range 2 {
+		_, err := q.Consume("a")
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, q.Close())
+
+	q = newConsumerQueue(t, dir)
+	assert.Equal(t, []string{"a", "b"}, q.ConsumerGroups())
+	lag, err := q.ConsumerGroupLag("a")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), lag)
+	assert.Equal(t, ids[2:], consumeAll(t, q, "a"))
+	assert.Equal(t, ids, consumeAll(t, q, "b"))
+}
+
+func TestConsumerGroupOffsetsAreLogged(t *testing.T) {
+	dir := t.TempDir()
+	q := newTestQueue(t, dir, queue.QueueConfiguration{QueueName: "consumers", QueueId: 1, HeapOptions: queue.HeapOptions{Durability: queue.Durability{Mode: queue.DurabilitySync}}})
+	assert.NoError(t, q.CreateConsumerGroup("a"))
+	assert.NoError(t, q.CreateConsumerGroup("b"))
+	for range 4 {
+		assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 3}))
+	}
+	path := filepath.Join(q.RootDir, "consumers.log")
+	// Every message consumed appends one record rather than rewriting the offsets
+	var growths []int64
+	size := fileSize(path)
+	for range 3 {
+		_, err := q.Consume("a")
+		assert.NoError(t, err)
+		growths = append(growths, fileSize(path)-size)
+		size += growths[len(growths)-1]
+	}
+	assert.Equal(t, []int64{growths[0], growths[0], growths[0]}, growths)
+	assert.Less(t, growths[0], int64(64))
+	assert.NoError(t, q.Close())
+
+	// An append torn by a crash is dropped
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	_, err = file.Write([]byte{26, 0, 0, 0, 3})
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+	q = newConsumerQueue(t, dir)
+	lag, err := q.ConsumerGroupLag("a")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), lag)
+	lag, err = q.ConsumerGroupLag("b")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), lag)
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
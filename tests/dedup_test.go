@@ -0,0 +1,145 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func newDedupQueue(t *testing.T, dir string, window time.Duration) *queue.Queue {
+	return newTestQueue(t, dir, queue.QueueConfiguration{QueueName: "dedup", QueueId: 1, DedupWindow: window, RejectDuplicates: true})
+}
+
+func visibleCount(t *testing.T, q *queue.Queue) uint64 {
+	stats, err := q.GetStats()
+	assert.NoError(t, err)
+	return stats[queue.StatVisible]
+}
+
+func TestDedupRejectsDuplicateIds(t *testing.T) {
+	q := newDedupQueue(t, t.TempDir(), time.Hour)
+	item := &queue.QueueItem{MessageId: uuid.New(), Priority: 3}
+	assert.NoError(t, q.Enqueue(item))
+	assert.ErrorIs(t, q.Enqueue(item), queue.ErrDuplicateMessage)
+	assert.ErrorIs(t, q.Enqueue(&queue.QueueItem{MessageId: item.MessageId, Priority: 4}), queue.ErrDuplicateMessage)
+	assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 3}))
+	assert.Equal(t, uint64(2), visibleCount(t, q))
+
+	// Dequeued messages stay deduplicated within the window
+	_, err := q.Dequeue()
+	assert.NoError(t, err)
+	assert.ErrorIs(t, q.Enqueue(item), queue.ErrDuplicateMessage)
+}
+
+func TestDedupIgnoresDuplicates(t *testing.T) {
+	q := newTestQueue(t, t.TempDir(), queue.QueueConfiguration{QueueName: "dedup", QueueId: 1, DedupWindow: time.Hour})
+	item := &queue.QueueItem{MessageId: uuid.New(), Priority: 3}
+	assert.NoError(t, q.Enqueue(item))
+	// A retried enqueue succeeds without enqueueing the message again
+	assert.NoError(t, q.Enqueue(item))
+	assert.NoError(t, q.EnqueueWithDedupKey(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}, "order-1"))
+	assert.NoError(t, q.EnqueueWithDedupKey(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}, "order-1"))
+	stats, err := q.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), stats[queue.StatVisible])
+	assert.Equal(t, uint64(2), stats[queue.StatDuplicates])
+}
+
+func TestDedupKeys(t *testing.T) {
+	q := newDedupQueue(t, t.TempDir(), time.Hour)
+	assert.NoError(t, q.EnqueueWithDedupKey(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}, "order-1"))
+	assert.ErrorIs(t, q.EnqueueWithDedupKey(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}, "order-1"), queue.ErrDuplicateMessage)
+	assert.NoError(t, q.EnqueueWithDedupKey(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}, "order-2"))
+	assert.Equal(t, uint64(2), visibleCount(t, q))
+
+	plain := newTestQueue(t, t.TempDir(), queue.QueueConfiguration{QueueName: "plain", QueueId: 2})
+	item := &queue.QueueItem{MessageId: uuid.New(), Priority: 1}
+	assert.NoError(t, plain.Enqueue(item))
+	assert.NoError(t, plain.Enqueue(item), "queues without a window do not deduplicate")
+	assert.Error(t, plain.EnqueueWithDedupKey(item, "order-1"))
+}
+
+func TestDedupWindowExpires(t *testing.T) {
+	dir := t.TempDir()
+	window := 200 * time.Millisecond
+	q := newDedupQueue(t, dir, window)
+	item := &queue.QueueItem{MessageId: uuid.New(), Priority: 1}
+	assert.NoError(t, q.Enqueue(item))
+	buckets, err := os.ReadDir(filepath.Join(q.RootDir, "dedup"))
+	assert.NoError(t, err)
+	assert.Len(t, buckets, 1)
+
+	// A key is forgotten once its bucket, a tenth of the window, left the window
+	time.Sleep(window + window/10 + 10*time.Millisecond)
+	assert.NoError(t, q.Enqueue(item))
+	assert.Equal(t, uint64(2), visibleCount(t, q))
+	remaining, err := os.ReadDir(filepath.Join(q.RootDir, "dedup"))
+	assert.NoError(t, err)
+	assert.Len(t, remaining, 1)
+	assert.NotEqual(t, buckets[0].Name(), remaining[0].Name(), "the expired bucket is removed")
+}
+
+func TestDedupSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	q := newDedupQueue(t, dir, time.Hour)
+	item := &queue.QueueItem{MessageId: uuid.New(), Priority: 1}
+	assert.NoError(t, q.Enqueue(item))
+	assert.NoError(t, q.EnqueueWithDedupKey(&queue.QueueItem{MessageId: uuid.New(), Priority: 2}, "order-1"))
+	assert.NoError(t, q.Close())
+
+	q = newDedupQueue(t, dir, time.Hour)
+	assert.ErrorIs(t, q.Enqueue(item), queue.ErrDuplicateMessage)
+	assert.ErrorIs(t, q.EnqueueWithDedupKey(&queue.QueueItem{MessageId: uuid.New(), Priority: 2}, "order-1"), queue.ErrDuplicateMessage)
+	assert.NoError(t, q.Close())
+
+	// Reopened with a shorter window, keys older than it are forgotten
+	time.Sleep(50 * time.Millisecond)
+	q = newDedupQueue(t, dir, 20*time.Millisecond)
+	assert.NoError(t, q.Enqueue(item))
+	buckets, err := os.ReadDir(filepath.Join(q.RootDir, "dedup"))
+	assert.NoError(t, err)
+	assert.Len(t, buckets, 1)
+}
+
+func TestDedupTruncatesTornKeys(t *testing.T) {
+	dir := t.TempDir()
+	q := newDedupQueue(t, dir, time.Hour)
+	first, second := &queue.QueueItem{MessageId: uuid.New(), Priority: 1}, &queue.QueueItem{MessageId: uuid.New(), Priority: 1}
+	assert.NoError(t, q.Enqueue(first))
+	assert.NoError(t, q.Close())
+	buckets, err := os.ReadDir(filepath.Join(q.RootDir, "dedup"))
+	assert.NoError(t, err)
+	assert.Len(t, buckets, 1)
+	path := filepath.Join(q.RootDir, "dedup", buckets[0].Name())
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	_, err = file.Write([]byte{1, 2, 3, 4, 5})
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	// Keys appended after the torn one are read back
+	q = newDedupQueue(t, dir, time.Hour)
+	assert.NoError(t, q.Enqueue(second))
+	assert.NoError(t, q.Close())
+	q = newDedupQueue(t, dir, time.Hour)
+	assert.ErrorIs(t, q.Enqueue(first), queue.ErrDuplicateMessage)
+	assert.ErrorIs(t, q.Enqueue(second), queue.ErrDuplicateMessage)
+}
+
+func TestDedupForgetsRejectedEnqueues(t *testing.T) {
+	q := newTestQueue(t, t.TempDir(), queue.QueueConfiguration{QueueName: "dedup", QueueId: 1, DedupWindow: time.Hour, RejectDuplicates: true, Limits: queue.QueueLimits{MaxMessages: 1}})
+	assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}))
+	var full *queue.ErrQueueFull
+	assert.ErrorAs(t, q.EnqueueWithDedupKey(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}, "order-1"), &full)
+
+	// The rejected message can be enqueued again once there is room
+	_, err := q.Dequeue()
+	assert.NoError(t, err)
+	assert.NoError(t, q.EnqueueWithDedupKey(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}, "order-1"))
+	assert.ErrorIs(t, q.EnqueueWithDedupKey(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}, "order-1"), queue.ErrDuplicateMessage)
+}
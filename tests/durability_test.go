@@ -0,0 +1,180 @@
+package tests
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/queue"
+	"github.com/kokaq/core/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// faultFS records the files and directories synced and fails syncs on demand.
+type faultFS struct {
+	mu       sync.Mutex
+	syncs    map[string]int
+	failSync error
+}
+
+type faultFile struct {
+	utils.File
+	path string
+	fs   *faultFS
+}
+
+func newFaultFS() *faultFS {
+	return &faultFS{syncs: make(map[string]int)}
+}
+
+func (fs *faultFS) OpenFile(path string, flag int, perm os.FileMode) (utils.File, error) {
+	file, err := utils.OSFileSystem.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, path: path, fs: fs}, nil
+}
+
+func (fs *faultFS) Stat(path string) (os.FileInfo, error) {
+	return utils.OSFileSystem.Stat(path)
+}
+
+func (fs *faultFS) Remove(path string) error {
+	return utils.OSFileSystem.Remove(path)
+}
+
+func (fs *faultFS) count(path string) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.syncs[path]
+}
+
+func (fs *faultFS) total() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	total := 0
+	for _, n := range fs.syncs {
+		total += n
+	}
+	return total
+}
+
+func (fs *faultFS) fail(err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.failSync = err
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.fs.failSync != nil {
+		return f.fs.failSync
+	}
+	f.fs.syncs[f.path]++
+	return f.File.Sync()
+}
+
+func newDurableHeap(t *testing.T, fs *faultFS, durability queue.Durability) (*queue.Heap, string) {
+	dir := filepath.Join(t.TempDir(), "ns", "queue", "main")
+	heap, err := queue.NewHeapWithOptions(dir, 3, 8, 8, 16, queue.HeapOptions{Durability: durability, FileSystem: fs})
+	if err != nil {
+		t.Fatalf("Failed to initialize heap: %v", err)
+	}
+	t.Cleanup(func() { heap.Close() })
+	return heap, dir
+}
+
+func TestDurabilityNoneNeverSyncs(t *testing.T) {
+	fs := newFaultFS()
+	heap, _ := newDurableHeap(t, fs, queue.Durability{})
+	for priority := uint64(1); priority <= 10; priority++ {
+		assert.NoError(t, heap.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: priority}))
+	}
+	_, err := heap.Dequeue()
+	assert.NoError(t, err)
+	assert.NoError(t, heap.Flush())
+	assert.Zero(t, fs.total())
+}
+
+func TestDurabilitySyncPerOperation(t *testing.T) {
+	fs := newFaultFS()
+	heap, dir := newDurableHeap(t, fs, queue.Durability{Mode: queue.DurabilitySync})
+	// Creating the heap makes its directories durable
+	assert.Equal(t, 1, fs.count(dir))
+	assert.Equal(t, 1, fs.count(filepath.Dir(dir)))
+
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, heap.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 7}))
+		assert.Equal(t, i, fs.count(filepath.Join(dir, "indexes", "7")), "index append %d should be synced", i)
+		assert.Equal(t, i, fs.count(filepath.Join(dir, "times", "7")), "timestamp append %d should be synced", i)
+	}
+	// Only the first enqueue of the priority wrote a page and created files
+	assert.Equal(t, 1, fs.count(filepath.Join(dir, "pages")))
+	assert.Equal(t, 1, fs.count(filepath.Join(dir, "indexes")))
+	assert.Equal(t, 1, fs.count(filepath.Join(dir, "times")))
+
+	for range 3 {
+		_, err := heap.Dequeue()
+		assert.NoError(t, err)
+	}
+	// Every dequeue moved the head of the priority in its page, and the
+	// last one removed its files
+	assert.Equal(t, 4, fs.count(filepath.Join(dir, "pages")))
+	assert.Equal(t, 2, fs.count(filepath.Join(dir, "indexes")))
+	assert.Equal(t, 2, fs.count(filepath.Join(dir, "times")))
+}
+
+func TestDurabilityGroupCommitByOperations(t *testing.T) {
+	fs := newFaultFS()
+	heap, dir := newDurableHeap(t, fs, queue.Durability{Mode: queue.DurabilityGroupCommit, GroupCommitOps: 5})
+	index := filepath.Join(dir, "indexes", "3")
+	for i := 1; i <= 12; i++ {
+		assert.NoError(t, heap.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 3}))
+		assert.Equal(t, i/5, fs.count(index), "after %d enqueues", i)
+	}
+	assert.NoError(t, heap.Flush())
+	assert.Equal(t, 3, fs.count(index))
+}
+
+func TestDurabilityGroupCommitByInterval(t *testing.T) {
+	fs := newFaultFS()
+	root := t.TempDir()
+	q := newTestQueue(t, root, queue.QueueConfiguration{
+		QueueName: "durable",
+		QueueId:   1,
+		HeapOptions: queue.HeapOptions{
+			Durability: queue.Durability{Mode: queue.DurabilityGroupCommit, GroupCommitInterval: 10 * time.Millisecond},
+			FileSystem: fs,
+		},
+	})
+	assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}))
+	index := filepath.Join(root, "1", "main", "indexes", "1")
+	// The queue stays idle, the timer has to commit the enqueue
+	assert.Eventually(t, func() bool { return fs.count(index) == 1 }, time.Second, 5*time.Millisecond)
+}
+
+func TestDurabilitySyncFailure(t *testing.T) {
+	fs := newFaultFS()
+	heap, _ := newDurableHeap(t, fs, queue.Durability{Mode: queue.DurabilitySync})
+	injected := errors.New("injected fsync failure")
+	fs.fail(injected)
+	err := heap.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1})
+	assert.ErrorIs(t, err, injected)
+
+	// The write is retried by the next commit once the disk recovers
+	fs.fail(nil)
+	assert.NoError(t, heap.Flush())
+	item, err := heap.Dequeue()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), item.Priority)
+}
+
+func TestDurabilityInvalidGroupCommit(t *testing.T) {
+	_, err := queue.NewHeapWithOptions(t.TempDir(), 3, 8, 8, 16, queue.HeapOptions{Durability: queue.Durability{Mode: queue.DurabilityGroupCommit}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,86 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func newExportQueue(t *testing.T, id uint32) *queue.Queue {
+	return newTestQueue(t, t.TempDir(), queue.QueueConfiguration{QueueName: fmt.Sprint("export-", id), QueueId: id, EnableDLQ: true, EnableInvisible: true})
+}
+
+func listAll(t *testing.T, list func(queue.ListOptions) ([]*queue.QueueItem, string, error)) []*queue.QueueItem {
+	items, token, err := list(queue.ListOptions{PageSize: 1000})
+	assert.NoError(t, err)
+	assert.Empty(t, token)
+	return items
+}
+
+func TestQueueExportImportRoundTrip(t *testing.T) {
+	source := newExportQueue(t, 1)
+	for i := range 30 {
+		assert.NoError(t, source.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: uint64(i%4 + 1)}))
+	}
+	locked, dead := uuid.New(), uuid.New()
+	input := strings.Join([]string{
+		`{"format":"kokaq-export","version":1,"queue_id":9,"queue_name":"elsewhere"}`,
+		fmt.Sprintf(`{"message_id":"%s","priority":2,"state":"locked"}`, locked),
+		fmt.Sprintf(`{"message_id":"%s","priority":5,"state":"dlq","attempts":3}`, dead),
+	}, "\n")
+	imported, err := source.Import(strings.NewReader(input))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, imported)
+
+	for _, format := range []queue.ExportFormat{queue.ExportJSON, queue.ExportBinary} {
+		buffer := &bytes.Buffer{}
+		assert.NoError(t, source.ExportWithFormat(buffer, format))
+		target := newExportQueue(t, 2+uint32(format))
+		imported, err := target.Import(buffer)
+		assert.NoError(t, err)
+		assert.Equal(t, 32, imported)
+
+		assert.Equal(t, listAll(t, source.ListMessages), listAll(t, target.ListMessages))
+		assert.Equal(t, []*queue.QueueItem{{MessageId: locked, Priority: 2}}, listAll(t, target.ListLockedMessages))
+		assert.Equal(t, []*queue.QueueItem{{MessageId: dead, Priority: 5}}, listAll(t, target.ListDLQMessages))
+	}
+}
+
+func TestQueueExportJSONFormat(t *testing.T) {
+	q := newExportQueue(t, 1)
+	id := uuid.New()
+	assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: id, Priority: 7}))
+	buffer := &bytes.Buffer{}
+	assert.NoError(t, q.Export(buffer))
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	assert.Equal(t, []string{
+		`{"format":"kokaq-export","version":2,"queue_id":1,"queue_name":"export-1"}`,
+		fmt.Sprintf(`{"message_id":"%s","priority":7,"state":"visible"}`, id),
+	}, lines)
+}
+
+func TestQueueImportRejectsInvalidRecords(t *testing.T) {
+	q := newExportQueue(t, 1)
+	header := `{"format":"kokaq-export","version":1,"queue_id":1,"queue_name":"x"}` + "\n"
+
+	_, err := q.Import(strings.NewReader(header + fmt.Sprintf(`{"message_id":"%s","priority":1,"state":"visible","payload":"aGk="}`, uuid.New())))
+	assert.ErrorContains(t, err, "payloads")
+	_, err = q.Import(strings.NewReader(header + fmt.Sprintf(`{"message_id":"%s","priority":1,"state":"gone"}`, uuid.New())))
+	assert.ErrorContains(t, err, "unknown message state")
+	_, err = q.Import(strings.NewReader(`{"format":"other","version":1}`))
+	assert.Error(t, err)
+
+	// A binary export cut in the middle of a record
+	buffer := &bytes.Buffer{}
+	assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}))
+	assert.NoError(t, q.ExportWithFormat(buffer, queue.ExportBinary))
+	truncated := buffer.Bytes()[:buffer.Len()-5]
+	imported, err := newExportQueue(t, 2).Import(bytes.NewReader(truncated))
+	assert.Error(t, err)
+	assert.Equal(t, 0, imported)
+}
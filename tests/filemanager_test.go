@@ -0,0 +1,70 @@
+package tests
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kokaq/core/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileManager_ReadWriteAppend(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "file")
+	files := utils.NewFileManager(4)
+	defer files.Close()
+
+	assert.NoError(t, files.Append(path, []byte("foo")))
+	assert.NoError(t, files.Append(path, []byte("bar")))
+	assert.NoError(t, files.WriteAt(path, 1, []byte("XY")))
+
+	data, err := files.ReadAt(path, 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("fXYbar"), data)
+
+	// Appends continue after bytes written past the end
+	assert.NoError(t, files.WriteAt(path, 8, []byte("!")))
+	assert.NoError(t, files.Append(path, []byte("?")))
+	read, _ := os.ReadFile(path)
+	assert.Equal(t, []byte("fXYbar\x00\x00!?"), read)
+
+	_, err = files.ReadAt(filepath.Join(tmpDir, "missing"), 0, 1)
+	assert.Error(t, err)
+}
+
+func TestFileManager_CapsOpenFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := utils.NewFileManager(3)
+	defer files.Close()
+
+	for i := 0; i < 10; i++ {
+		path := filepath.Join(tmpDir, fmt.Sprint(i))
+		assert.NoError(t, files.Append(path, []byte{byte(i)}))
+		assert.LessOrEqual(t, files.OpenFiles(), 3)
+	}
+	// Files closed by the LRU are transparently reopened
+	for i := 0; i < 10; i++ {
+		data, err := files.ReadAt(filepath.Join(tmpDir, fmt.Sprint(i)), 0, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{byte(i)}, data)
+	}
+	assert.Equal(t, 3, files.OpenFiles())
+}
+
+func TestFileManager_RemoveAndClose(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "file")
+	files := utils.NewFileManager(0)
+
+	assert.NoError(t, files.Append(path, []byte("data")))
+	assert.NoError(t, files.Remove(path))
+	assert.False(t, utils.FileExists(path))
+	assert.Equal(t, 0, files.OpenFiles())
+
+	assert.NoError(t, files.Append(path, []byte("data")))
+	assert.NoError(t, files.Close())
+	assert.Equal(t, 0, files.OpenFiles())
+	assert.Error(t, files.Append(path, []byte("more")))
+}
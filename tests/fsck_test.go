@@ -0,0 +1,140 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+// Namespace directory with one queue holding two messages for each of 40
+// priorities, the first of them dequeued.
+func newFsckNamespace(t *testing.T) string {
+	dir := t.TempDir()
+	q := newTestQueue(t, dir, queue.QueueConfiguration{QueueName: "fsck", QueueId: 1, EnableDLQ: true, EnableInvisible: true})
+	for priority := uint64(1); priority <= 40; priority++ {
+		for range 2 {
+			assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: priority}))
+		}
+	}
+	_, err := q.Dequeue()
+	assert.NoError(t, err)
+	assert.NoError(t, q.Close())
+	return dir
+}
+
+func issueKinds(report *queue.FsckReport) []queue.FsckIssueKind {
+	kinds := make([]queue.FsckIssueKind, 0, len(report.Issues))
+	for _, issue := range report.Issues {
+		kinds = append(kinds, issue.Kind)
+	}
+	return kinds
+}
+
+// Reopen the queue and drain it, checking priorities come out in order.
+func drainFsckQueue(t *testing.T, dir string) int {
+	q := newTestQueue(t, dir, queue.QueueConfiguration{QueueName: "fsck", QueueId: 1, EnableDLQ: true, EnableInvisible: true})
+	count := 0
+	last := ^uint64(0)
+	for {
+		if empty, _ := q.IsEmpty(); empty {
+			return count
+		}
+		item, err := q.Dequeue()
+		if err != nil {
+			t.Fatalf("Dequeue failed: %v", err)
+		}
+		assert.LessOrEqual(t, item.Priority, last)
+		last = item.Priority
+		count++
+	}
+}
+
+func TestFsckHealthyNamespace(t *testing.T) {
+	dir := newFsckNamespace(t)
+	report, err := queue.FsckNamespace(dir, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Heaps)
+	assert.True(t, report.Healthy(), "unexpected issues: %v", report.Issues)
+}
+
+func TestFsckCorruptedPageRepair(t *testing.T) {
+	dir := newFsckNamespace(t)
+	pages := filepath.Join(dir, "1", "main", "pages")
+	// Page 2 holds nodes of low priorities that were never dequeued
+	flipByte(t, pages, 31*16+4+40)
+
+	report, err := queue.FsckNamespace(dir, false)
+	assert.NoError(t, err)
+	assert.Contains(t, issueKinds(report), queue.FsckCorrupted)
+	assert.Contains(t, issueKinds(report), queue.FsckOrphanedIndex)
+
+	report, err = queue.FsckNamespace(dir, true)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, report.Repairs)
+	assert.Empty(t, report.Unrepaired)
+
+	report, err = queue.FsckNamespace(dir, false)
+	assert.NoError(t, err)
+	assert.True(t, report.Healthy(), "issues left after repair: %v", report.Issues)
+	// The head of priority 40, on the first page, survived the repair
+	assert.Equal(t, 79, drainFsckQueue(t, dir))
+}
+
+func TestFsckMissingAndOrphanedFiles(t *testing.T) {
+	dir := newFsckNamespace(t)
+	heap := filepath.Join(dir, "1", "main")
+	assert.NoError(t, os.Remove(filepath.Join(heap, "indexes", "7")))
+	assert.NoError(t, os.WriteFile(filepath.Join(heap, "times", "99"), make([]byte, 8), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(heap, "indexes", "junk"), nil, 0644))
+
+	report, err := queue.FsckNamespace(dir, true)
+	assert.NoError(t, err)
+	kinds := issueKinds(report)
+	assert.Contains(t, kinds, queue.FsckMissingIndex)
+	assert.Contains(t, kinds, queue.FsckOrphanedTimes)
+	assert.Contains(t, kinds, queue.FsckUnexpectedFile)
+	assert.NoFileExists(t, filepath.Join(heap, "times", "99"))
+	assert.NoFileExists(t, filepath.Join(heap, "indexes", "junk"))
+
+	report, err = queue.FsckNamespace(dir, false)
+	assert.NoError(t, err)
+	assert.True(t, report.Healthy(), "issues left after repair: %v", report.Issues)
+	assert.Equal(t, 77, drainFsckQueue(t, dir))
+}
+
+func TestFsckTornIndexRecord(t *testing.T) {
+	dir := newFsckNamespace(t)
+	index := filepath.Join(dir, "1", "main", "indexes", "3")
+	file, err := os.OpenFile(index, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", index, err)
+	}
+	file.Write(make([]byte, 5))
+	file.Close()
+
+	report, err := queue.FsckNamespace(dir, true)
+	assert.NoError(t, err)
+	assert.Contains(t, issueKinds(report), queue.FsckTruncated)
+	info, err := os.Stat(index)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2*indexRecordSize), info.Size())
+	assert.Equal(t, 79, drainFsckQueue(t, dir))
+}
+
+func TestFsckCorruptedIndexRecordIsUnrepaired(t *testing.T) {
+	dir := newFsckNamespace(t)
+	flipByte(t, filepath.Join(dir, "1", "main", "indexes", "5"), indexRecordSize+3)
+
+	// The message id of the record is lost, repairing leaves the issue
+	report, err := queue.FsckNamespace(dir, true)
+	assert.NoError(t, err)
+	assert.Contains(t, issueKinds(report), queue.FsckCorrupted)
+	if assert.Len(t, report.Unrepaired, 1) {
+		assert.Equal(t, queue.FsckCorrupted, report.Unrepaired[0].Kind)
+		assert.Equal(t, int64(indexRecordSize), report.Unrepaired[0].Offset)
+	}
+}
@@ -0,0 +1,226 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func newGroupQueue(t *testing.T, dir string) *queue.Queue {
+	return newTestQueue(t, dir, queue.QueueConfiguration{QueueName: "groups", QueueId: 1})
+}
+
+func groupItem(group string, priority uint64) *queue.QueueItem {
+	return &queue.QueueItem{MessageId: uuid.New(), Priority: priority, GroupKey: group}
+}
+
+func peekLock(t *testing.T, q *queue.Queue) (*queue.QueueItem, string) {
+	item, lockId, err := q.PeekLock()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return item, lockId
+}
+
+func TestGroupsLockOneMessageAtATime(t *testing.T) {
+	q := newGroupQueue(t, t.TempDir())
+	first, second := groupItem("customer-a", 1), groupItem("customer-a", 9)
+	other, plain := groupItem("customer-b", 5), groupItem("", 3)
+	for _, item := range []*queue.QueueItem{first, second, other, plain} {
+		assert.NoError(t, q.Enqueue(item))
+	}
+	stats, err := q.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), stats[queue.StatVisible])
+	assert.Equal(t, uint64(1), stats[queue.StatWaiting])
+
+	// Groups compete by priority, but a group's newer message waits for the older one
+	item, otherLock := peekLock(t, q)
+	assert.Equal(t, other.MessageId, item.MessageId)
+	assert.Equal(t, "customer-b", item.GroupKey)
+	item, plainLock := peekLock(t, q)
+	assert.Equal(t, plain.MessageId, item.MessageId)
+	assert.Equal(t, "", item.GroupKey)
+	item, firstLock := peekLock(t, q)
+	assert.Equal(t, first.MessageId, item.MessageId)
+	_, _, err = q.PeekLock()
+	assert.Error(t, err, "the second message of the group is unavailable while the first is locked")
+
+	locked, err := q.GetLockedMessages()
+	assert.NoError(t, err)
+	assert.Len(t, locked, 3)
+	stats, err = q.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), stats[queue.StatLocked])
+
+	assert.NoError(t, q.Ack(firstLock))
+	item, secondLock := peekLock(t, q)
+	assert.Equal(t, second.MessageId, item.MessageId)
+	assert.Equal(t, "customer-a", item.GroupKey)
+
+	for _, lockId := range []string{otherLock, plainLock, secondLock} {
+		assert.NoError(t, q.Ack(lockId))
+	}
+	assert.ErrorIs(t, q.Ack(firstLock), queue.ErrLockNotFound)
+	assert.ErrorIs(t, q.Ack("not-a-lock"), queue.ErrLockNotFound)
+	stats, err = q.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), stats[queue.StatVisible]+stats[queue.StatLocked]+stats[queue.StatWaiting])
+
+	// An idle group's next message is available right away
+	next := groupItem("customer-a", 2)
+	assert.NoError(t, q.Enqueue(next))
+	item, _ = peekLock(t, q)
+	assert.Equal(t, next.MessageId, item.MessageId)
+}
+
+func TestGroupsKeepEnqueueOrder(t *testing.T) {
+	q := newGroupQueue(t, t.TempDir())
+	var ids []uuid.UUID
+	for _, priority := range []uint64{1, 8, 3, 8, 5} {
+		item := groupItem("orders", priority)
+		ids = append(ids, item.MessageId)
+		assert.NoError(t, q.Enqueue(item))
+	}
+	// Dequeue also moves on to the next message of the group
+	for _, id := range ids {
+		item, err := q.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, id, item.MessageId)
+		assert.Equal(t, "orders", item.GroupKey)
+	}
+	empty, err := q.IsEmpty()
+	assert.NoError(t, err)
+	assert.True(t, empty)
+}
+
+func TestGroupsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	q := newGroupQueue(t, dir)
+	first, second, third := groupItem("a", 2), groupItem("a", 2), groupItem("a", 2)
+	for _, item := range []*queue.QueueItem{first, second, third} {
+		assert.NoError(t, q.Enqueue(item))
+	}
+	_, lockId := peekLock(t, q)
+	assert.NoError(t, q.Ack(lockId))
+	_, lockId = peekLock(t, q)
+	assert.NoError(t, q.Close())
+
+	// Locks are lost with the queue and their messages visible again
+	q = newGroupQueue(t, dir)
+	assert.ErrorIs(t, q.Ack(lockId), queue.ErrLockNotFound)
+	item, lockId := peekLock(t, q)
+	assert.Equal(t, second.MessageId, item.MessageId)
+	assert.Equal(t, "a", item.GroupKey)
+	_, _, err := q.PeekLock()
+	assert.Error(t, err)
+	assert.NoError(t, q.Ack(lockId))
+	item, _ = peekLock(t, q)
+	assert.Equal(t, third.MessageId, item.MessageId)
+}
+
+func TestGroupsClear(t *testing.T) {
+	q := newGroupQueue(t, t.TempDir())
+	active, cleared, kept := groupItem("a", 7), groupItem("a", 7), groupItem("a", 2)
+	for _, item := range []*queue.QueueItem{active, cleared, kept} {
+		assert.NoError(t, q.Enqueue(item))
+	}
+	// Clearing the active message and the next one moves on to the first kept one
+	assert.NoError(t, q.ClearWithOptions(queue.ClearOptions{Targets: queue.ClearTargetMain, Priorities: queue.PriorityRange{Min: 5}}))
+	item, lockId := peekLock(t, q)
+	assert.Equal(t, kept.MessageId, item.MessageId)
+
+	// Clearing locked messages releases their group
+	assert.NoError(t, q.Enqueue(groupItem("a", 4)))
+	assert.NoError(t, q.ClearWithOptions(queue.ClearOptions{Targets: queue.ClearTargetInvisible}))
+	assert.ErrorIs(t, q.Ack(lockId), queue.ErrLockNotFound)
+	item, _ = peekLock(t, q)
+	assert.Equal(t, uint64(4), item.Priority)
+
+	assert.NoError(t, q.Enqueue(groupItem("a", 4)))
+	assert.NoError(t, q.Clear())
+	stats, err := q.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), stats[queue.StatVisible]+stats[queue.StatLocked]+stats[queue.StatWaiting])
+}
+
+func TestGroupsListAndExportHeldMessages(t *testing.T) {
+	q := newGroupQueue(t, t.TempDir())
+	locked, delayed := groupItem("a", 9), groupItem("b", 7)
+	waiting, visible, plain := groupItem("a", 5), groupItem("c", 3), groupItem("", 1)
+	for _, item := range []*queue.QueueItem{locked, delayed, waiting, visible, plain} {
+		assert.NoError(t, q.Enqueue(item))
+	}
+	peekLock(t, q)
+	_, delayedLock := peekLock(t, q)
+	assert.NoError(t, q.NackWithDelay(delayedLock, time.Hour))
+	item, _ := peekLock(t, q)
+	assert.Equal(t, visible.MessageId, item.MessageId)
+
+	// Locks are listed page by page, in dequeue order
+	var listed []*queue.QueueItem
+	options := queue.ListOptions{PageSize: 1}
+	for {
+		items, token, err := q.ListLockedMessages(options)
+		assert.NoError(t, err)
+		listed = append(listed, items...)
+		if token == "" {
+			break
+		}
+		options.ContinuationToken = token
+	}
+	assert.Equal(t, []*queue.QueueItem{locked, visible}, listed)
+	assert.Equal(t, []*queue.QueueItem{plain}, listAll(t, q.ListMessages))
+
+	buffer := &bytes.Buffer{}
+	assert.NoError(t, q.Export(buffer))
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	assert.Equal(t, []string{
+		fmt.Sprintf(`{"message_id":"%s","priority":1,"state":"visible"}`, plain.MessageId),
+		fmt.Sprintf(`{"message_id":"%s","priority":9,"state":"locked","group_key":"a","attempts":1}`, locked.MessageId),
+		fmt.Sprintf(`{"message_id":"%s","priority":3,"state":"locked","group_key":"c","attempts":1}`, visible.MessageId),
+		fmt.Sprintf(`{"message_id":"%s","priority":7,"state":"delayed","group_key":"b","attempts":1}`, delayed.MessageId),
+		fmt.Sprintf(`{"message_id":"%s","priority":5,"state":"waiting","group_key":"a"}`, waiting.MessageId),
+	}, lines[1:])
+
+	// The imported queue holds the same messages in the same states
+	target := newGroupQueue(t, t.TempDir())
+	imported, err := target.Import(bytes.NewReader(buffer.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, imported)
+	stats, err := target.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), stats[queue.StatVisible])
+	assert.Equal(t, uint64(2), stats[queue.StatLocked])
+	assert.Equal(t, uint64(1), stats[queue.StatDelayed])
+	assert.Equal(t, uint64(1), stats[queue.StatWaiting])
+	assert.Equal(t, []*queue.QueueItem{locked, visible}, listAll(t, target.ListLockedMessages))
+}
+
+func TestGroupsExportKeepsAttempts(t *testing.T) {
+	q := newGroupQueue(t, t.TempDir())
+	redelivered := groupItem("a", 2)
+	assert.NoError(t, q.Enqueue(redelivered))
+	for range 3 {
+		_, lockId := peekLock(t, q)
+		assert.NoError(t, q.NackWithDelay(lockId, 0))
+	}
+	buffer := &bytes.Buffer{}
+	assert.NoError(t, q.Export(buffer))
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	assert.Equal(t, fmt.Sprintf(`{"message_id":"%s","priority":2,"state":"visible","group_key":"a","attempts":3}`, redelivered.MessageId), lines[1])
+
+	// A message visible again after a nack keeps counting its deliveries
+	target := newGroupQueue(t, t.TempDir())
+	_, err := target.Import(bytes.NewReader(buffer.Bytes()))
+	assert.NoError(t, err)
+	exported := &bytes.Buffer{}
+	assert.NoError(t, target.Export(exported))
+	assert.Equal(t, buffer.String(), exported.String())
+}
@@ -1,6 +1,8 @@
 package tests
 
 import (
+	"fmt"
+	"math/rand"
 	"testing"
 
 	"github.com/google/uuid"
@@ -228,3 +230,119 @@ func TestHeapPeekEmpty(t *testing.T) {
 // 		t.Error("Index file should be deleted after last dequeue")
 // 	}
 // }
+
+func TestHeapMultiPageOrdering(t *testing.T) {
+	for _, cachePages := range []int{1, 2, 64} {
+		heap, err := queue.NewHeapWithOptions(t.TempDir(), 3, 8, 8, 16, queue.HeapOptions{PageCachePages: cachePages})
+		if err != nil {
+			t.Fatalf("Failed to initialize heap: %v", err)
+		}
+		r := rand.New(rand.NewSource(int64(cachePages)))
+		for _, priority := range r.Perm(200) {
+			if err := heap.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: uint64(priority + 1)}); err != nil {
+				t.Fatalf("Enqueue failed: %v", err)
+			}
+		}
+		for want := uint64(200); want > 0; want-- {
+			item, err := heap.Dequeue()
+			if err != nil {
+				t.Fatalf("Dequeue failed: %v", err)
+			}
+			if item.Priority != want {
+				t.Fatalf("cache of %d pages: dequeued priority %d, want %d", cachePages, item.Priority, want)
+			}
+		}
+		if _, err := heap.Dequeue(); err == nil {
+			t.Error("Expected error when dequeuing from empty heap")
+		}
+	}
+}
+
+func TestHeapFlushAndReopen(t *testing.T) {
+	tmpDir := t.TempDir()
+	heap, err := queue.NewHeapWithOptions(tmpDir, 3, 8, 8, 16, queue.HeapOptions{PageCachePages: 2})
+	if err != nil {
+		t.Fatalf("Failed to initialize heap: %v", err)
+	}
+	ids := make(map[uint64]uuid.UUID)
+	for priority := uint64(1); priority <= 50; priority++ {
+		ids[priority] = uuid.New()
+		if err := heap.Enqueue(&queue.QueueItem{MessageId: ids[priority], Priority: priority}); err != nil {
+			t.Fatalf("Enqueue failed: %v", err)
+		}
+	}
+	if err := heap.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	reopened, err := queue.NewHeap(tmpDir, 3, 8, 8, 16)
+	if err != nil {
+		t.Fatalf("Failed to reopen heap: %v", err)
+	}
+	for priority := uint64(50); priority > 0; priority-- {
+		item, err := reopened.Dequeue()
+		if err != nil {
+			t.Fatalf("Dequeue after reopen failed: %v", err)
+		}
+		if item.Priority != priority || item.MessageId != ids[priority] {
+			t.Fatalf("Dequeue after reopen returned %+v, want priority %d", item, priority)
+		}
+	}
+}
+
+func TestHeapPageCacheCounters(t *testing.T) {
+	heap, err := queue.NewHeapWithOptions(t.TempDir(), 2, 8, 8, 16, queue.HeapOptions{PageCachePages: 1})
+	if err != nil {
+		t.Fatalf("Failed to initialize heap: %v", err)
+	}
+	for priority := uint64(1); priority <= 20; priority++ {
+		if err := heap.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: priority}); err != nil {
+			t.Fatalf("Enqueue failed: %v", err)
+		}
+	}
+	stats, err := heap.Stats()
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if stats.PageCacheHits == 0 || stats.PageCacheMisses == 0 || stats.PageWrites == 0 {
+		t.Errorf("expected cache hits, misses and write-backs with a single cached page, got %+v", stats)
+	}
+	if stats.PageReads != stats.PageCacheMisses {
+		t.Errorf("every miss should read a page: %d reads for %d misses", stats.PageReads, stats.PageCacheMisses)
+	}
+}
+
+// Enqueue and drain a heap deep enough to span several page levels,
+// reporting page reads and writes per operation for several cache sizes.
+func BenchmarkHeapPageCache(b *testing.B) {
+	const priorities = 1000
+	for _, cachePages := range []int{1, 4, 64, 512} {
+		b.Run(fmt.Sprintf("pages=%d", cachePages), func(b *testing.B) {
+			var reads, writes uint64
+			r := rand.New(rand.NewSource(1))
+			order := r.Perm(priorities)
+			for i := 0; i < b.N; i++ {
+				heap, err := queue.NewHeapWithOptions(b.TempDir(), 3, 8, 8, 16, queue.HeapOptions{PageCachePages: cachePages})
+				if err != nil {
+					b.Fatalf("Failed to initialize heap: %v", err)
+				}
+				for _, priority := range order {
+					if err := heap.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: uint64(priority + 1)}); err != nil {
+						b.Fatalf("Enqueue failed: %v", err)
+					}
+				}
+				for range priorities {
+					if _, err := heap.Dequeue(); err != nil {
+						b.Fatalf("Dequeue failed: %v", err)
+					}
+				}
+				stats, _ := heap.Stats()
+				reads += stats.PageReads
+				writes += stats.PageWrites
+			}
+			operations := float64(b.N * 2 * priorities)
+			b.ReportMetric(float64(reads)/operations, "page-reads/op")
+			b.ReportMetric(float64(writes)/operations, "page-writes/op")
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func newLimitedQueue(t *testing.T, limits queue.QueueLimits) *queue.Queue {
+	return newTestQueue(t, t.TempDir(), queue.QueueConfiguration{QueueName: "limited", QueueId: 1, EnableInvisible: true, Limits: limits})
+}
+
+func enqueuePriorities(t *testing.T, q *queue.Queue, priorities ...uint64) []uuid.UUID {
+	var ids []uuid.UUID
+	for _, priority := range priorities {
+		item := &queue.QueueItem{MessageId: uuid.New(), Priority: priority}
+		ids = append(ids, item.MessageId)
+		assert.NoError(t, q.Enqueue(item))
+		time.Sleep(time.Millisecond)
+	}
+	return ids
+}
+
+func dequeueAll(t *testing.T, q *queue.Queue) []uuid.UUID {
+	var ids []uuid.UUID
+	for {
+		item, err := q.Dequeue()
+		if err != nil || item == nil {
+			return ids
+		}
+		ids = append(ids, item.MessageId)
+	}
+}
+
+func assertQueueFull(t *testing.T, err error, limit string, namespace bool) {
+	var full *queue.ErrQueueFull
+	if assert.True(t, errors.As(err, &full), "expected ErrQueueFull, got %v", err) {
+		assert.Equal(t, limit, full.Limit)
+		assert.Equal(t, namespace, full.Namespace)
+	}
+}
+
+func TestQueueLimitsReject(t *testing.T) {
+	q := newLimitedQueue(t, queue.QueueLimits{MaxMessages: 2})
+	enqueuePriorities(t, q, 3, 5)
+	assertQueueFull(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 9}), queue.LimitMessages, false)
+
+	// Locked messages count until they are acknowledged
+	_, lockId, err := q.PeekLock()
+	assert.NoError(t, err)
+	assertQueueFull(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 9}), queue.LimitMessages, false)
+	assert.NoError(t, q.Ack(lockId))
+	assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 9}))
+
+	stats, err := q.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), stats[queue.StatUsageMessages])
+
+	priorities := newLimitedQueue(t, queue.QueueLimits{MaxPriorities: 2})
+	enqueuePriorities(t, priorities, 1, 2, 2)
+	assert.NoError(t, priorities.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}))
+	assertQueueFull(t, priorities.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 3}), queue.LimitPriorities, false)
+}
+
+func TestQueueLimitsDropLowest(t *testing.T) {
+	q := newLimitedQueue(t, queue.QueueLimits{MaxMessages: 3, Overflow: queue.OverflowDropLowest})
+	ids := enqueuePriorities(t, q, 5, 2, 2)
+	incoming := enqueuePriorities(t, q, 4)
+	// Lower than every message held, the new one is the one not to keep
+	assertQueueFull(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}), queue.LimitMessages, false)
+	assert.Equal(t, []uuid.UUID{ids[0], incoming[0], ids[2]}, dequeueAll(t, q))
+
+	// A priority limit drops the whole lowest priority
+	priorities := newLimitedQueue(t, queue.QueueLimits{MaxPriorities: 2, Overflow: queue.OverflowDropLowest})
+	ids = enqueuePriorities(t, priorities, 3, 3, 7, 9)
+	assert.Equal(t, []uuid.UUID{ids[3], ids[2]}, dequeueAll(t, priorities))
+}
+
+func TestQueueLimitsDropOldest(t *testing.T) {
+	q := newLimitedQueue(t, queue.QueueLimits{MaxMessages: 2, Overflow: queue.OverflowDropOldest})
+	ids := enqueuePriorities(t, q, 9, 1, 5)
+	assert.Equal(t, []uuid.UUID{ids[2], ids[1]}, dequeueAll(t, q))
+}
+
+func TestQueueLimitsDropPromotesGroup(t *testing.T) {
+	q := newLimitedQueue(t, queue.QueueLimits{MaxMessages: 3, Overflow: queue.OverflowDropOldest})
+	first := &queue.QueueItem{MessageId: uuid.New(), Priority: 2, GroupKey: "order-1"}
+	second := &queue.QueueItem{MessageId: uuid.New(), Priority: 2, GroupKey: "order-1"}
+	assert.NoError(t, q.Enqueue(first))
+	assert.NoError(t, q.Enqueue(second))
+	time.Sleep(time.Millisecond)
+	other := enqueuePriorities(t, q, 6)
+	latest := enqueuePriorities(t, q, 4)
+
+	// Dropping the active message of a group makes the next one visible
+	assert.Equal(t, []uuid.UUID{other[0], latest[0], second.MessageId}, dequeueAll(t, q))
+}
+
+func TestNamespaceQuotas(t *testing.T) {
+	ns := newTestNamespace(t, t.TempDir(), queue.NamespaceConfig{NamespaceName: "quotas", NamespaceId: 50, Quotas: queue.NamespaceQuotas{MaxMessages: 3}})
+	t.Cleanup(func() { ns.Close() })
+	first, err := ns.LoadQueue(&queue.QueueConfiguration{QueueName: "first", QueueId: 1, Limits: queue.QueueLimits{Overflow: queue.OverflowDropOldest}})
+	assert.NoError(t, err)
+	second, err := ns.LoadQueue(&queue.QueueConfiguration{QueueName: "second", QueueId: 2})
+	assert.NoError(t, err)
+
+	enqueuePriorities(t, first, 1, 2)
+	enqueuePriorities(t, second, 1)
+	assert.Equal(t, queue.Usage{Messages: 3}, ns.Usage())
+	// Quotas reject whatever the overflow policy of the queue
+	assertQueueFull(t, first.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 3}), queue.LimitMessages, true)
+	assertQueueFull(t, second.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 3}), queue.LimitMessages, true)
+
+	_, err = first.Dequeue()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), ns.Usage().Messages)
+	assert.NoError(t, second.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 3}))
+
+	// Deleted queues no longer count
+	assert.NoError(t, ns.DeleteQueue(2))
+	assert.Equal(t, uint64(1), ns.Usage().Messages)
+}
+
+func TestNamespaceQuotasReleaseFailedEnqueues(t *testing.T) {
+	ns := newTestNamespace(t, t.TempDir(), queue.NamespaceConfig{NamespaceName: "quotas", NamespaceId: 51, Quotas: queue.NamespaceQuotas{MaxMessages: 2}})
+	t.Cleanup(func() { ns.Close() })
+	q, err := ns.LoadQueue(&queue.QueueConfiguration{QueueName: "groups", QueueId: 1})
+	assert.NoError(t, err)
+	assert.NoError(t, q.Enqueue(groupItem("a", 1)))
+
+	// Importing a lock for a group that has an active message fails after the quota was reserved
+	export := fmt.Sprintf("{\"format\":\"kokaq-export\",\"version\":2}\n{\"message_id\":\"%s\",\"priority\":1,\"state\":\"locked\",\"group_key\":\"a\"}\n", uuid.New())
+	for range 2 {
+		_, err = q.Import(strings.NewReader(export))
+		assert.Error(t, err)
+	}
+	assert.Equal(t, uint64(1), ns.Usage().Messages)
+	assert.NoError(t, q.Enqueue(groupItem("b", 1)))
+}
+
+func TestQueueLimitsDropsReplicate(t *testing.T) {
+	primaryDir, followerDir := t.TempDir(), t.TempDir()
+	primary := newTestQueue(t, primaryDir, queue.QueueConfiguration{QueueName: "replicated", QueueId: 1, EnableDLQ: true, EnableInvisible: true, Replica: queue.ReplicaPrimary,
+		Limits: queue.QueueLimits{MaxMessages: 20, Overflow: queue.OverflowDropOldest}})
+	follower := newReplica(t, followerDir, queue.ReplicaFollower)
+	disconnect := connect(t, primary, follower, "f1")
+	defer disconnect()
+
+	mutate(t, primary, 100)
+	waitCaughtUp(t, primary, "f1")
+
+	assert.NoError(t, primary.Flush())
+	assert.NoError(t, follower.Flush())
+	assert.Equal(t, replicatedFiles(t, primaryDir), replicatedFiles(t, followerDir))
+	assert.Equal(t, listAll(t, primary.ListMessages), listAll(t, follower.ListMessages))
+}
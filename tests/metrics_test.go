@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/internals/metrics"
+	"github.com/kokaq/core/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics_TextExposition(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.Counter("test_requests_total", "Requests served.", "code").With("200").Add(3)
+	registry.Gauge("test_temperature", "Current temperature.").With().Set(-1.5)
+	histogram := registry.Histogram("test_latency_seconds", "Latency.", []float64{0.1, 1}, "op")
+	histogram.With("read").Observe(0.05)
+	histogram.With("read").Observe(0.5)
+
+	var sb strings.Builder
+	assert.NoError(t, registry.Write(&sb))
+	expected := `# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{op="read",le="0.1"} 1
+test_latency_seconds_bucket{op="read",le="1"} 2
+test_latency_seconds_bucket{op="read",le="+Inf"} 2
+test_latency_seconds_sum{op="read"} 0.55
+test_latency_seconds_count{op="read"} 2
+# HELP test_requests_total Requests served.
+# TYPE test_requests_total counter
+test_requests_total{code="200"} 3
+# HELP test_temperature Current temperature.
+# TYPE test_temperature gauge
+test_temperature -1.5
+`
+	assert.Equal(t, expected, sb.String())
+}
+
+func TestMetrics_LabelEscaping(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.Gauge("test_escaped", "Escaped.", "path").With("a\"b\\c\nd").Set(1)
+
+	var sb strings.Builder
+	assert.NoError(t, registry.Write(&sb))
+	assert.Contains(t, sb.String(), `test_escaped{path="a\"b\\c\nd"} 1`)
+}
+
+func TestMetrics_Handler(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.Counter("test_hits_total", "Hits.").With().Inc()
+
+	recorder := httptest.NewRecorder()
+	metrics.Handler(registry).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(recorder.Body)
+	assert.Equal(t, 200, recorder.Code)
+	assert.True(t, strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain"))
+	assert.Contains(t, string(body), "test_hits_total 1\n")
+}
+
+func TestMetrics_QueueInstrumentation(t *testing.T) {
+	dir := setupTestDir(t)
+	defer os.RemoveAll(dir)
+
+	ns := newTestNamespace(t, dir, queue.NamespaceConfig{NamespaceName: "metricsns", NamespaceId: 30})
+	q, err := ns.AddQueue(&queue.QueueConfiguration{QueueId: 1, QueueName: "q1"})
+	assert.NoError(t, err)
+	assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 4}))
+	assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 4}))
+	assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 9}))
+	_, err = q.Dequeue()
+	assert.NoError(t, err)
+
+	var sb strings.Builder
+	assert.NoError(t, metrics.Default.Write(&sb))
+	out := sb.String()
+	queueLabels := fmt.Sprintf(`namespace="metricsns-30",queue="1",dir=%q`, absPath(t, q.RootDir))
+	labels := queueLabels + `,heap="main"`
+	assert.Contains(t, out, "kokaq_heap_messages{"+labels+"} 2\n")
+	assert.Contains(t, out, "kokaq_heap_enqueued_total{"+labels+"} 3\n")
+	assert.Contains(t, out, "kokaq_heap_dequeued_total{"+labels+"} 1\n")
+	assert.Contains(t, out, "kokaq_heap_priority_messages{"+labels+`,priority="4"} 2`+"\n")
+	assert.NotContains(t, out, "kokaq_heap_priority_messages{"+labels+`,priority="9"}`)
+	assert.Contains(t, out, `kokaq_file_io_duration_seconds_count{operation="append"}`)
+
+	// Locked messages are held by the groups table, out of every heap
+	_, _, err = q.PeekLock()
+	assert.NoError(t, err)
+	sb.Reset()
+	assert.NoError(t, metrics.Default.Write(&sb))
+	held := "kokaq_queue_held_messages{" + queueLabels + ",state="
+	assert.Contains(t, sb.String(), held+`"locked"} 1`+"\n")
+	assert.Contains(t, sb.String(), held+`"delayed"} 0`+"\n")
+
+	// Reopening the queue reports its messages once, closing it removes its series
+	assert.NoError(t, ns.Close())
+	sb.Reset()
+	assert.NoError(t, metrics.Default.Write(&sb))
+	assert.NotContains(t, sb.String(), queueLabels)
+	ns = newTestNamespace(t, dir, queue.NamespaceConfig{NamespaceName: "metricsns", NamespaceId: 30})
+	defer ns.Close()
+	_, err = ns.LoadQueue(&queue.QueueConfiguration{QueueId: 1, QueueName: "q1"})
+	assert.NoError(t, err)
+	sb.Reset()
+	assert.NoError(t, metrics.Default.Write(&sb))
+	assert.Contains(t, sb.String(), "kokaq_heap_messages{"+labels+"} 2\n")
+	assert.Contains(t, sb.String(), "kokaq_heap_priority_messages{"+labels+`,priority="4"} 2`+"\n")
+}
+
+func TestMetrics_QueuesUnderOtherDirectories(t *testing.T) {
+	first := newTestQueue(t, t.TempDir(), queue.QueueConfiguration{QueueId: 1, QueueName: "same"})
+	second := newTestQueue(t, t.TempDir(), queue.QueueConfiguration{QueueId: 1, QueueName: "same"})
+	assert.NoError(t, first.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}))
+	assert.NoError(t, second.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}))
+
+	var sb strings.Builder
+	assert.NoError(t, metrics.Default.Write(&sb))
+	for _, q := range []*queue.Queue{first, second} {
+		assert.Contains(t, sb.String(), fmt.Sprintf(`queue="1",dir=%q,heap="main"} 1`, absPath(t, q.RootDir))+"\n")
+	}
+}
+
+func absPath(t *testing.T, path string) string {
+	abs, err := filepath.Abs(path)
+	assert.NoError(t, err)
+	return abs
+}
@@ -0,0 +1,70 @@
+package tests
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/kokaq/core/utils/murmur"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMurmur128ReferenceVectors(t *testing.T) {
+	for _, vector := range []struct {
+		seed   uint32
+		data   string
+		h1, h2 uint64
+	}{
+		{0, "", 0, 0},
+		{1, "", 0x4610abe56eff5cb5, 0x51622daa78f83583},
+		{0, "hello", 0xcbd8a7b341bd9b02, 0x5b1e906a48ae1d19},
+		{0, "hello, world", 0x342fac623a5ebc8e, 0x4cdcbc079642414d},
+		{0, "The quick brown fox jumps over the lazy dog", 0xe34bbc7bbc071b6c, 0x7a433ca9c49a9347},
+	} {
+		h1, h2 := murmur.SeedSum128(vector.seed, []byte(vector.data))
+		assert.Equal(t, vector.h1, h1, "h1 of %q with seed %d", vector.data, vector.seed)
+		assert.Equal(t, vector.h2, h2, "h2 of %q with seed %d", vector.data, vector.seed)
+	}
+}
+
+// The verification of SMHasher: hash keys {0}, {0, 1}, ... {0, ..., 254}
+// with seed 256-length, then hash the concatenated little endian sums.
+func TestMurmur128SMHasherVerification(t *testing.T) {
+	key := make([]byte, 0, 256)
+	sums := make([]byte, 0, 256*16)
+	for i := range 256 {
+		h1, h2 := murmur.SeedSum128(uint32(256-i), key)
+		sums = binary.LittleEndian.AppendUint64(sums, h1)
+		sums = binary.LittleEndian.AppendUint64(sums, h2)
+		key = append(key, byte(i))
+	}
+	h1, _ := murmur.Sum128(sums)
+	assert.Equal(t, uint32(0x6384ba69), uint32(h1))
+}
+
+func TestMurmur128Streaming(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	h1, h2 := murmur.SeedSum128(42, data)
+	expected := binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, h1), h2)
+
+	// Any split of the writes gives the sum of the whole data
+	for _, chunk := range []int{1, 3, 15, 16, 17, 100} {
+		d := murmur.SeedNew128(42)
+		for offset := 0; offset < len(data); offset += chunk {
+			d.Write(data[offset:min(offset+chunk, len(data))])
+		}
+		assert.Equal(t, expected, d.Sum(nil), "chunks of %d", chunk)
+	}
+
+	d := murmur.New128()
+	assert.Equal(t, 16, d.Size())
+	assert.Equal(t, 1, d.BlockSize())
+	d.Write([]byte("discarded"))
+	d.Reset()
+	d.Write([]byte("hello"))
+	h1, h2 = d.Sum128()
+	assert.Equal(t, uint64(0xcbd8a7b341bd9b02), h1)
+	assert.Equal(t, uint64(0x5b1e906a48ae1d19), h2)
+}
@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/google/uuid"
 	"github.com/kokaq/core/queue"
 )
 
@@ -19,12 +20,20 @@ func setupTestDir(t *testing.T) string {
 	return dir
 }
 
+func newTestNamespace(t *testing.T, dir string, config queue.NamespaceConfig) *queue.Namespace {
+	ns, err := queue.NewNamespace(dir, config)
+	if err != nil {
+		t.Fatalf("Failed to create namespace: %v", err)
+	}
+	return ns
+}
+
 func TestNewNamespace_CreatesDirectory(t *testing.T) {
 	dir := setupTestDir(t)
 	defer os.RemoveAll(dir)
 
 	config := queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 1}
-	ns := queue.NewNamespace(dir, config)
+	ns := newTestNamespace(t, dir, config)
 
 	expectedDir := filepath.Join(dir, "testns-1")
 	if _, err := os.Stat(expectedDir); os.IsNotExist(err) {
@@ -40,7 +49,7 @@ func TestNamespace_AddAndGetQueue(t *testing.T) {
 	defer os.RemoveAll(dir)
 
 	config := queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 2}
-	ns := queue.NewNamespace(dir, config)
+	ns := newTestNamespace(t, dir, config)
 
 	qConfig := &queue.QueueConfiguration{QueueId: 42, QueueName: "q42"}
 	q, err := ns.AddQueue(qConfig)
@@ -60,7 +69,7 @@ func TestNamespace_GetQueue_NotFound(t *testing.T) {
 	dir := setupTestDir(t)
 	defer os.RemoveAll(dir)
 
-	ns := queue.NewNamespace(dir, queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 3})
+	ns := newTestNamespace(t, dir, queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 3})
 	_, err := ns.GetQueue(999)
 	if err == nil {
 		t.Errorf("expected error for non-existent queue")
@@ -71,7 +80,7 @@ func TestNamespace_LoadQueue(t *testing.T) {
 	dir := setupTestDir(t)
 	defer os.RemoveAll(dir)
 
-	ns := queue.NewNamespace(dir, queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 4})
+	ns := newTestNamespace(t, dir, queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 4})
 	qConfig := &queue.QueueConfiguration{QueueId: 7, QueueName: "q7"}
 	q1, err := ns.LoadQueue(qConfig)
 	if err != nil {
@@ -90,7 +99,7 @@ func TestNamespace_ClearQueue(t *testing.T) {
 	dir := setupTestDir(t)
 	defer os.RemoveAll(dir)
 
-	ns := queue.NewNamespace(dir, queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 5})
+	ns := newTestNamespace(t, dir, queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 5})
 	qConfig := &queue.QueueConfiguration{QueueId: 8, QueueName: "q8"}
 	q, _ := ns.AddQueue(qConfig)
 	if err := q.Clear(); err != nil {
@@ -102,10 +111,59 @@ func TestNamespace_DeleteQueue(t *testing.T) {
 	dir := setupTestDir(t)
 	defer os.RemoveAll(dir)
 
-	ns := queue.NewNamespace(dir, queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 6})
+	ns := newTestNamespace(t, dir, queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 6})
 	qConfig := &queue.QueueConfiguration{QueueId: 9, QueueName: "q9"}
 	ns.AddQueue(qConfig)
 	if err := ns.DeleteQueue(9); err != nil {
 		t.Errorf("DeleteQueue failed: %v", err)
 	}
 }
+
+func TestNamespace_ClearQueuePurges(t *testing.T) {
+	dir := setupTestDir(t)
+	defer os.RemoveAll(dir)
+
+	ns := newTestNamespace(t, dir, queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 7})
+	q, err := ns.AddQueue(&queue.QueueConfiguration{QueueId: 10, QueueName: "q10"})
+	if err != nil {
+		t.Fatalf("AddQueue failed: %v", err)
+	}
+	if err := q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 3}); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	if err := ns.ClearQueue(10); err != nil {
+		t.Fatalf("ClearQueue failed: %v", err)
+	}
+	if _, err := q.Peek(); err == nil {
+		t.Errorf("expected queue to be empty after ClearQueue")
+	}
+}
+
+func TestNamespace_Close(t *testing.T) {
+	dir := setupTestDir(t)
+	defer os.RemoveAll(dir)
+
+	ns := newTestNamespace(t, dir, queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 8})
+	q, err := ns.AddQueue(&queue.QueueConfiguration{QueueId: 11, QueueName: "q11", EnableDLQ: true, EnableInvisible: true})
+	if err != nil {
+		t.Fatalf("AddQueue failed: %v", err)
+	}
+	if err := q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 3}); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	if err := ns.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := q.Peek(); err == nil {
+		t.Errorf("expected error when using a queue of a closed namespace")
+	}
+
+	reloaded := newTestNamespace(t, dir, queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 8})
+	q, err = reloaded.LoadQueue(&queue.QueueConfiguration{QueueId: 11, QueueName: "q11", EnableDLQ: true, EnableInvisible: true})
+	if err != nil {
+		t.Fatalf("LoadQueue failed: %v", err)
+	}
+	if _, err := q.Peek(); err != nil {
+		t.Errorf("Peek after reload failed: %v", err)
+	}
+}
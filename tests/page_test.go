@@ -58,3 +58,14 @@ func TestSetDataNil(t *testing.T) {
 		t.Errorf("expected data nil, got %v", p.GetData())
 	}
 }
+
+func TestSetDataMarksDirty(t *testing.T) {
+	p := queue.NewPage()
+	if p.IsDirty() {
+		t.Errorf("expected new page to be clean")
+	}
+	p.SetData(1, []byte{1})
+	if !p.IsDirty() {
+		t.Errorf("expected page to be dirty after SetData")
+	}
+}
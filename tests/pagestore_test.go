@@ -0,0 +1,174 @@
+package tests
+
+import (
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/queue"
+)
+
+var pageStores = map[string]queue.PageStoreKind{
+	"file": queue.PageStoreFile,
+	"mmap": queue.PageStoreMmap,
+}
+
+// Run a test against every page store backend.
+func forEachPageStore(t *testing.T, test func(t *testing.T, kind queue.PageStoreKind)) {
+	for name, kind := range pageStores {
+		t.Run(name, func(t *testing.T) {
+			if kind == queue.PageStoreMmap && runtime.GOOS != "linux" {
+				t.Skip("mmap page store is only supported on linux")
+			}
+			test(t, kind)
+		})
+	}
+}
+
+func TestPageStoreOrdering(t *testing.T) {
+	forEachPageStore(t, func(t *testing.T, kind queue.PageStoreKind) {
+		for _, cachePages := range []int{1, 64} {
+			heap, err := queue.NewHeapWithOptions(t.TempDir(), 3, 8, 8, 16, queue.HeapOptions{PageCachePages: cachePages, PageStore: kind})
+			if err != nil {
+				t.Fatalf("Failed to initialize heap: %v", err)
+			}
+			for _, priority := range rand.Perm(200) {
+				if err := heap.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: uint64(priority + 1)}); err != nil {
+					t.Fatalf("Enqueue failed: %v", err)
+				}
+			}
+			for priority := uint64(200); priority > 0; priority-- {
+				item, err := heap.Dequeue()
+				if err != nil {
+					t.Fatalf("Dequeue failed: %v", err)
+				}
+				if item.Priority != priority {
+					t.Fatalf("cache of %d pages: dequeued priority %d, want %d", cachePages, item.Priority, priority)
+				}
+			}
+			if err := heap.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+		}
+	})
+}
+
+// Pages written by one backend are read back by either.
+func TestPageStoreReopen(t *testing.T) {
+	forEachPageStore(t, func(t *testing.T, kind queue.PageStoreKind) {
+		forEachPageStore(t, func(t *testing.T, reopenKind queue.PageStoreKind) {
+			tmpDir := t.TempDir()
+			heap, err := queue.NewHeapWithOptions(tmpDir, 3, 8, 8, 16, queue.HeapOptions{PageCachePages: 2, PageStore: kind})
+			if err != nil {
+				t.Fatalf("Failed to initialize heap: %v", err)
+			}
+			ids := make(map[uint64]uuid.UUID)
+			for priority := uint64(1); priority <= 50; priority++ {
+				ids[priority] = uuid.New()
+				if err := heap.Enqueue(&queue.QueueItem{MessageId: ids[priority], Priority: priority}); err != nil {
+					t.Fatalf("Enqueue failed: %v", err)
+				}
+			}
+			if err := heap.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			reopened, err := queue.NewHeapWithOptions(tmpDir, 3, 8, 8, 16, queue.HeapOptions{PageStore: reopenKind})
+			if err != nil {
+				t.Fatalf("Failed to reopen heap: %v", err)
+			}
+			defer reopened.Close()
+			for priority := uint64(50); priority > 0; priority-- {
+				item, err := reopened.Dequeue()
+				if err != nil {
+					t.Fatalf("Dequeue after reopen failed: %v", err)
+				}
+				if item.Priority != priority || item.MessageId != ids[priority] {
+					t.Fatalf("Dequeue after reopen returned %+v, want priority %d", item, priority)
+				}
+			}
+			if empty, _ := reopened.IsEmpty(); !empty {
+				t.Errorf("heap should be empty after draining")
+			}
+		})
+	})
+}
+
+func TestPageStoreClear(t *testing.T) {
+	forEachPageStore(t, func(t *testing.T, kind queue.PageStoreKind) {
+		heap, err := queue.NewHeapWithOptions(t.TempDir(), 2, 8, 8, 16, queue.HeapOptions{PageCachePages: 1, PageStore: kind})
+		if err != nil {
+			t.Fatalf("Failed to initialize heap: %v", err)
+		}
+		defer heap.Close()
+		for priority := uint64(1); priority <= 40; priority++ {
+			if err := heap.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: priority}); err != nil {
+				t.Fatalf("Enqueue failed: %v", err)
+			}
+		}
+		if err := heap.Clear(queue.PriorityRange{Min: 11}); err != nil {
+			t.Fatalf("Clear failed: %v", err)
+		}
+		stats, err := heap.Stats()
+		if err != nil {
+			t.Fatalf("Stats failed: %v", err)
+		}
+		if stats.Messages != 10 {
+			t.Errorf("expected 10 messages after clear, got %d", stats.Messages)
+		}
+		for priority := uint64(10); priority > 0; priority-- {
+			item, err := heap.Dequeue()
+			if err != nil {
+				t.Fatalf("Dequeue failed: %v", err)
+			}
+			if item.Priority != priority {
+				t.Fatalf("dequeued priority %d, want %d", item.Priority, priority)
+			}
+		}
+	})
+}
+
+// A heap left open without a flush, as after a crash, reopens at its last flush.
+func TestPageStoreCrashWithoutFlush(t *testing.T) {
+	forEachPageStore(t, func(t *testing.T, kind queue.PageStoreKind) {
+		tmpDir := t.TempDir()
+		heap, err := queue.NewHeapWithOptions(tmpDir, 3, 8, 8, 16, queue.HeapOptions{PageCachePages: 64, PageStore: kind})
+		if err != nil {
+			t.Fatalf("Failed to initialize heap: %v", err)
+		}
+		defer heap.Close()
+		for priority := uint64(1); priority <= 30; priority++ {
+			if err := heap.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: priority}); err != nil {
+				t.Fatalf("Enqueue failed: %v", err)
+			}
+		}
+		if err := heap.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+		// Modify every flushed page without flushing them again
+		for priority := uint64(31); priority <= 60; priority++ {
+			if err := heap.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: priority}); err != nil {
+				t.Fatalf("Enqueue failed: %v", err)
+			}
+		}
+		if _, err := heap.Dequeue(); err != nil {
+			t.Fatalf("Dequeue failed: %v", err)
+		}
+
+		reopened, err := queue.NewHeapWithOptions(tmpDir, 3, 8, 8, 16, queue.HeapOptions{PageStore: kind})
+		if err != nil {
+			t.Fatalf("Failed to reopen heap: %v", err)
+		}
+		defer reopened.Close()
+		for priority := uint64(30); priority > 0; priority-- {
+			item, err := reopened.Dequeue()
+			if err != nil {
+				t.Fatalf("Dequeue after reopen failed: %v", err)
+			}
+			if item.Priority != priority {
+				t.Fatalf("dequeued priority %d after reopen, want %d", item.Priority, priority)
+			}
+		}
+	})
+}
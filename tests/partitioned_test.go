@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"math/rand/v2"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func newPartitionedQueue(t *testing.T, dir string, partitions int) *queue.PartitionedQueue {
+	pq, err := queue.NewPartitionedQueue(dir, queue.PartitionedQueueConfiguration{QueueName: "partitioned", QueueId: 1, Partitions: partitions})
+	if err != nil {
+		t.Fatalf("Failed to create partitioned queue: %v", err)
+	}
+	t.Cleanup(func() { pq.Close() })
+	return pq
+}
+
+func TestPartitionedQueueBalancedDistribution(t *testing.T) {
+	pq := newPartitionedQueue(t, t.TempDir(), 8)
+	for i := range 8000 {
+		assert.NoError(t, pq.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: uint64(i%10 + 1)}))
+	}
+	stats, err := pq.PartitionStats()
+	assert.NoError(t, err)
+	assert.Len(t, stats, 8)
+	total := uint64(0)
+	for i, partition := range stats {
+		total += partition[queue.StatVisible]
+		assert.InDelta(t, 1000, partition[queue.StatVisible], 150, "partition %d", i)
+	}
+	assert.Equal(t, uint64(8000), total)
+}
+
+func TestPartitionedQueueGlobalPriorityOrder(t *testing.T) {
+	pq := newPartitionedQueue(t, t.TempDir(), 4)
+	enqueued := make(map[uuid.UUID]uint64)
+	for range 500 {
+		item := &queue.QueueItem{MessageId: uuid.New(), Priority: rand.Uint64N(20) + 1}
+		enqueued[item.MessageId] = item.Priority
+		assert.NoError(t, pq.Enqueue(item))
+	}
+	previous := uint64(21)
+	for range 500 {
+		peeked, err := pq.Peek()
+		assert.NoError(t, err)
+		item, err := pq.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, peeked, item)
+		assert.LessOrEqual(t, item.Priority, previous)
+		assert.Equal(t, enqueued[item.MessageId], item.Priority)
+		delete(enqueued, item.MessageId)
+		previous = item.Priority
+	}
+	assert.Empty(t, enqueued)
+	empty, err := pq.IsEmpty()
+	assert.NoError(t, err)
+	assert.True(t, empty)
+	_, err = pq.Dequeue()
+	assert.ErrorContains(t, err, "empty")
+}
+
+func TestPartitionedQueueKeyAffinity(t *testing.T) {
+	pq := newPartitionedQueue(t, t.TempDir(), 5)
+	key := []byte("customer-42")
+	partition := pq.PartitionFor(key)
+	for i := range 20 {
+		assert.NoError(t, pq.EnqueueWithKey(&queue.QueueItem{MessageId: uuid.New(), Priority: uint64(i + 1)}, key))
+	}
+	stats, err := pq.PartitionStats()
+	assert.NoError(t, err)
+	for i, partitionStats := range stats {
+		if i == partition {
+			assert.Equal(t, uint64(20), partitionStats[queue.StatVisible])
+		} else {
+			assert.Zero(t, partitionStats[queue.StatVisible])
+		}
+	}
+}
+
+func TestPartitionedQueueReopen(t *testing.T) {
+	dir := t.TempDir()
+	pq := newPartitionedQueue(t, dir, 3)
+	id := uuid.New()
+	assert.NoError(t, pq.Enqueue(&queue.QueueItem{MessageId: id, Priority: 7}))
+	assert.NoError(t, pq.Close())
+
+	_, err := queue.NewPartitionedQueue(dir, queue.PartitionedQueueConfiguration{QueueName: "partitioned", QueueId: 1, Partitions: 4})
+	assert.ErrorContains(t, err, "has 3 partitions")
+	_, err = queue.NewPartitionedQueue(dir, queue.PartitionedQueueConfiguration{QueueName: "partitioned", QueueId: 1})
+	assert.Error(t, err)
+
+	pq = newPartitionedQueue(t, dir, 3)
+	item, err := pq.Dequeue()
+	assert.NoError(t, err)
+	assert.Equal(t, &queue.QueueItem{MessageId: id, Priority: 7}, item)
+}
@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kokaq/core/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicy_DefaultDeny(t *testing.T) {
+	policy := queue.NewPolicy()
+	assert.False(t, policy.IsAllowed("alice", 1, queue.PermissionEnqueue))
+}
+
+func TestPolicy_AllowRole(t *testing.T) {
+	policy := queue.NewPolicy()
+	policy.Allow("alice", "producer", 1)
+
+	assert.True(t, policy.IsAllowed("alice", 1, queue.PermissionEnqueue))
+	assert.False(t, policy.IsAllowed("alice", 1, queue.PermissionConsume))
+	assert.False(t, policy.IsAllowed("alice", 2, queue.PermissionEnqueue))
+	assert.False(t, policy.IsAllowed("bob", 1, queue.PermissionEnqueue))
+}
+
+func TestPolicy_AdminImpliesAll(t *testing.T) {
+	policy := queue.NewPolicy()
+	policy.Allow("root", "admin")
+
+	assert.True(t, policy.IsAllowed("root", 5, queue.PermissionEnqueue))
+	assert.True(t, policy.IsAllowed("root", 5, queue.PermissionConsume))
+	assert.True(t, policy.IsAllowed("root", 5, queue.PermissionAdmin))
+}
+
+func TestPolicy_DenyWinsOverAllow(t *testing.T) {
+	policy := queue.NewPolicy()
+	policy.Allow(queue.AnyPrincipal, "consumer")
+	policy.Deny("mallory", "consumer", 3)
+
+	assert.True(t, policy.IsAllowed("mallory", 1, queue.PermissionConsume))
+	assert.False(t, policy.IsAllowed("mallory", 3, queue.PermissionConsume))
+	assert.True(t, policy.IsAllowed("alice", 3, queue.PermissionConsume))
+
+	// Order of bindings does not matter
+	policy = queue.NewPolicy()
+	policy.Deny("mallory", "consumer")
+	policy.Allow("mallory", "admin")
+	assert.False(t, policy.IsAllowed("mallory", 1, queue.PermissionConsume))
+	assert.True(t, policy.IsAllowed("mallory", 1, queue.PermissionEnqueue))
+
+	// A deny covering part of the permissions denies them together
+	assert.False(t, policy.IsAllowed("mallory", 1, queue.PermissionEnqueue|queue.PermissionConsume))
+}
+
+func TestPolicy_CustomRole(t *testing.T) {
+	policy := queue.NewPolicy()
+	policy.AddRole(queue.Role{Name: "worker", Permissions: queue.PermissionEnqueue | queue.PermissionConsume})
+	policy.Allow("svc", "worker")
+	policy.Allow("svc", "unknown-role")
+
+	assert.True(t, policy.IsAllowed("svc", 1, queue.PermissionEnqueue))
+	assert.True(t, policy.IsAllowed("svc", 1, queue.PermissionConsume))
+	assert.False(t, policy.IsAllowed("svc", 1, queue.PermissionAdmin))
+}
+
+func TestNamespace_AuthorizeWithoutPolicy(t *testing.T) {
+	dir := setupTestDir(t)
+	defer os.RemoveAll(dir)
+
+	ns := newTestNamespace(t, dir, queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 20})
+	assert.NoError(t, ns.Authorize("anyone", 1, queue.PermissionAdmin))
+}
+
+func TestNamespace_AuthorizePersisted(t *testing.T) {
+	dir := setupTestDir(t)
+	defer os.RemoveAll(dir)
+
+	config := queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 21}
+	ns := newTestNamespace(t, dir, config)
+	policy := queue.NewPolicy()
+	policy.Allow("alice", "producer", 1)
+	assert.NoError(t, ns.SetPolicy(policy))
+
+	reloaded := newTestNamespace(t, dir, config)
+	assert.NoError(t, reloaded.Authorize("alice", 1, queue.PermissionEnqueue))
+	err := reloaded.Authorize("alice", 1, queue.PermissionConsume)
+	assert.True(t, errors.Is(err, queue.ErrAccessDenied))
+
+	assert.NoError(t, reloaded.SetPolicy(nil))
+	assert.NoError(t, newTestNamespace(t, dir, config).Authorize("alice", 1, queue.PermissionConsume))
+}
+
+func TestNamespace_PolicyIsCopied(t *testing.T) {
+	ns := newTestNamespace(t, t.TempDir(), queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 22})
+	policy := queue.NewPolicy()
+	policy.Allow("alice", "producer", 1)
+	assert.NoError(t, ns.SetPolicy(policy))
+
+	// Changing a policy takes effect only once it is set
+	policy.Allow("bob", "producer", 1)
+	got := ns.GetPolicy()
+	got.Allow("carol", "producer", 1)
+	got.Bindings[0].Queues[0] = 2
+	assert.NoError(t, ns.Authorize("alice", 1, queue.PermissionEnqueue))
+	assert.ErrorIs(t, ns.Authorize("bob", 1, queue.PermissionEnqueue), queue.ErrAccessDenied)
+	assert.ErrorIs(t, ns.Authorize("carol", 1, queue.PermissionEnqueue), queue.ErrAccessDenied)
+	assert.Len(t, ns.GetPolicy().Bindings, 1)
+}
+
+func TestNewNamespace_UnreadablePolicy(t *testing.T) {
+	dir := t.TempDir()
+	config := queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 23}
+	ns := newTestNamespace(t, dir, config)
+	assert.NoError(t, os.WriteFile(filepath.Join(ns.RootDir, "policy.json"), []byte("{"), 0644))
+	_, err := queue.NewNamespace(dir, config)
+	assert.Error(t, err)
+}
@@ -28,6 +28,16 @@ func setupTestQueue(t *testing.T, enableDLQ, enableInvisible bool) (*queue.Queue
 	return q, cleanup
 }
 
+// Create a queue closed when the test ends.
+func newTestQueue(t *testing.T, dir string, config queue.QueueConfiguration) *queue.Queue {
+	q, err := queue.NewQueue(dir, config)
+	if err != nil {
+		t.Fatalf("Failed to create queue: %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
 func TestNewQueueAndDelete(t *testing.T) {
 	q, cleanup := setupTestQueue(t, true, true)
 	defer cleanup()
@@ -88,10 +98,14 @@ func TestQueuePeekLockAndAck(t *testing.T) {
 	peeked, lockId, err := q.PeekLock()
 	assert.NoError(t, err)
 	assert.Equal(t, item.MessageId, peeked.MessageId)
-	assert.Equal(t, "", lockId)
+	assert.NotEmpty(t, lockId)
 
 	err = q.Ack(lockId)
 	assert.NoError(t, err)
+	assert.ErrorIs(t, q.Ack(lockId), queue.ErrLockNotFound)
+	empty, err := q.IsEmpty()
+	assert.NoError(t, err)
+	assert.True(t, empty)
 }
 
 func TestQueueDLQOperations(t *testing.T) {
@@ -136,34 +150,160 @@ func TestQueueStatsAndClear(t *testing.T) {
 func TestQueueListMessages(t *testing.T) {
 	q, cleanup := setupTestQueue(t, false, false)
 	defer cleanup()
-	items, err := q.ListMessages()
+	items, token, err := q.ListMessages(queue.ListOptions{})
 	assert.NoError(t, err)
-	assert.Nil(t, items)
+	assert.Empty(t, items)
+	assert.Equal(t, "", token)
 
-	locked, err := q.ListLockedMessages()
+	locked, token, err := q.ListLockedMessages(queue.ListOptions{})
 	assert.NoError(t, err)
-	assert.Nil(t, locked)
+	assert.Empty(t, locked)
+	assert.Equal(t, "", token)
 
-	dlq, err := q.ListDLQMessages()
+	dlq, token, err := q.ListDLQMessages(queue.ListOptions{})
 	assert.NoError(t, err)
-	assert.Nil(t, dlq)
+	assert.Empty(t, dlq)
+	assert.Equal(t, "", token)
 }
 
-func TestQueueVisibilityTimeoutMethods(t *testing.T) {
-	q, cleanup := setupTestQueue(t, false, true)
+func TestQueueListMessagesPagination(t *testing.T) {
+	q, cleanup := setupTestQueue(t, false, false)
 	defer cleanup()
-	lockId := "dummy-lock"
-	err := q.Extend(lockId, time.Second)
-	assert.NoError(t, err)
-	err = q.SetVisibilityTimeout(time.Second)
+	var expected []*queue.QueueItem
+	for _, priority := range []uint64{9, 4, 4, 4, 2} {
+		item := &queue.QueueItem{MessageId: uuid.New(), Priority: priority}
+		expected = append(expected, item)
+		assert.NoError(t, q.Enqueue(item))
+	}
+
+	var listed []*queue.QueueItem
+	token := ""
+	for pages := 0; ; pages++ {
+		items, next, err := q.ListMessages(queue.ListOptions{PageSize: 2, ContinuationToken: token})
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(items), 2)
+		listed = append(listed, items...)
+		if token = next; token == "" {
+			assert.Equal(t, 2, pages)
+			break
+		}
+	}
+	assert.Equal(t, len(expected), len(listed))
+	for i := range expected {
+		assert.Equal(t, expected[i].MessageId, listed[i].MessageId)
+		assert.Equal(t, expected[i].Priority, listed[i].Priority)
+	}
+
+	items, _, err := q.ListMessages(queue.ListOptions{Priorities: queue.PriorityRange{Min: 3, Max: 8}})
 	assert.NoError(t, err)
-	err = q.RefreshVisibilityTimeout(lockId)
+	assert.Equal(t, 3, len(items))
+	for _, item := range items {
+		assert.Equal(t, uint64(4), item.Priority)
+	}
+}
+
+func TestQueueListMessagesConcurrentDequeue(t *testing.T) {
+	q, cleanup := setupTestQueue(t, false, false)
+	defer cleanup()
+	var ids []uuid.UUID
+	for _, priority := range []uint64{5, 5, 5, 1, 1} {
+		item := &queue.QueueItem{MessageId: uuid.New(), Priority: priority}
+		ids = append(ids, item.MessageId)
+		assert.NoError(t, q.Enqueue(item))
+	}
+
+	items, token, err := q.ListMessages(queue.ListOptions{PageSize: 2})
 	assert.NoError(t, err)
-	err = q.ReleaseLock(lockId)
+	assert.Equal(t, ids[:2], []uuid.UUID{items[0].MessageId, items[1].MessageId})
+
+	// Drain priority 5 and re-create it, enqueue more of priority 1
+	for range 3 {
+		_, err = q.Dequeue()
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 5}))
+	assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}))
+
+	var rest []uuid.UUID
+	for token != "" {
+		items, token, err = q.ListMessages(queue.ListOptions{PageSize: 2, ContinuationToken: token})
+		assert.NoError(t, err)
+		for _, item := range items {
+			rest = append(rest, item.MessageId)
+		}
+	}
+	assert.Equal(t, ids[3:], rest)
+
+	_, _, err = q.ListMessages(queue.ListOptions{ContinuationToken: "not-a-token"})
+	assert.Error(t, err)
+}
+
+func TestQueueVisibilityTimeoutMethods(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	q := newTestQueue(t, t.TempDir(), queue.QueueConfiguration{QueueName: "test", QueueId: 1, VisibilityTimeout: 10 * time.Second, Clock: clock})
+	for _, lockId := range []string{"dummy-lock", uuid.New().String()} {
+		assert.ErrorIs(t, q.Extend(lockId, time.Second), queue.ErrLockNotFound)
+		assert.ErrorIs(t, q.RefreshVisibilityTimeout(lockId), queue.ErrLockNotFound)
+		assert.ErrorIs(t, q.ReleaseLock(lockId), queue.ErrLockNotFound)
+		_, err := q.IsExpired(lockId)
+		assert.ErrorIs(t, err, queue.ErrLockNotFound)
+	}
+	assert.Error(t, q.SetVisibilityTimeout(-time.Second))
+	first := &queue.QueueItem{MessageId: uuid.New(), Priority: 2}
+	assert.NoError(t, q.Enqueue(first))
+	assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}))
+
+	// Extending pushes the expiry back from where it was
+	item, lockId, err := q.PeekLock()
 	assert.NoError(t, err)
+	assert.Equal(t, first.MessageId, item.MessageId)
+	clock.Advance(6 * time.Second)
+	assert.Error(t, q.Extend(lockId, 0))
+	assert.NoError(t, q.Extend(lockId, 10*time.Second))
+	clock.Advance(13 * time.Second)
 	expired, err := q.IsExpired(lockId)
 	assert.NoError(t, err)
 	assert.False(t, expired)
+	clock.Advance(time.Second)
+	expired, err = q.IsExpired(lockId)
+	assert.NoError(t, err)
+	assert.True(t, expired)
+
+	// The expired lock returns its message to the queue
+	item, err = q.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, first.MessageId, item.MessageId)
+	assert.ErrorIs(t, q.Ack(lockId), queue.ErrLockNotFound)
+	_, err = q.IsExpired(lockId)
+	assert.ErrorIs(t, err, queue.ErrLockNotFound)
+
+	// Refreshing restarts the timeout from now
+	_, lockId, err = q.PeekLock()
+	assert.NoError(t, err)
+	clock.Advance(8 * time.Second)
+	assert.NoError(t, q.RefreshVisibilityTimeout(lockId))
+	clock.Advance(8 * time.Second)
+	expired, err = q.IsExpired(lockId)
+	assert.NoError(t, err)
+	assert.False(t, expired)
+
+	// Releasing makes the message visible right away
+	assert.NoError(t, q.ReleaseLock(lockId))
+	assert.ErrorIs(t, q.ReleaseLock(lockId), queue.ErrLockNotFound)
+	item, err = q.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, first.MessageId, item.MessageId)
+
+	// Without a timeout locks do not expire
+	assert.NoError(t, q.SetVisibilityTimeout(0))
+	_, lockId, err = q.PeekLock()
+	assert.NoError(t, err)
+	assert.NoError(t, q.Extend(lockId, time.Second))
+	clock.Advance(time.Hour)
+	expired, err = q.IsExpired(lockId)
+	assert.NoError(t, err)
+	assert.False(t, expired)
+	assert.NoError(t, q.Ack(lockId))
 }
 
 func TestQueueAutoMoveToDLQ(t *testing.T) {
@@ -173,3 +313,176 @@ func TestQueueAutoMoveToDLQ(t *testing.T) {
 	err := q.AutoMoveToDLQ(messageId, 5)
 	assert.NoError(t, err)
 }
+
+func TestQueueGetStats(t *testing.T) {
+	q, cleanup := setupTestQueue(t, true, true)
+	defer cleanup()
+	for _, priority := range []uint64{3, 3, 7} {
+		assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: priority}))
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	stats, err := q.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), stats[queue.StatVisible])
+	assert.Equal(t, uint64(0), stats[queue.StatLocked])
+	assert.Equal(t, uint64(0), stats[queue.StatDLQ])
+	assert.Equal(t, uint64(2), stats[queue.StatPriorities])
+	assert.Equal(t, uint64(2), stats[queue.StatPriorityPrefix+"3"])
+	assert.Equal(t, uint64(1), stats[queue.StatPriorityPrefix+"7"])
+	assert.GreaterOrEqual(t, stats[queue.StatOldestMessageAgeMs], uint64(5))
+	assert.Equal(t, uint64(3*(16+4+8)), stats[queue.StatIndexBytes])
+
+	_, err = q.Dequeue()
+	assert.NoError(t, err)
+	stats, err = q.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), stats[queue.StatVisible])
+	assert.Equal(t, uint64(1), stats[queue.StatPriorities])
+	_, exists := stats[queue.StatPriorityPrefix+"7"]
+	assert.False(t, exists)
+
+	_, err = q.Dequeue()
+	assert.NoError(t, err)
+	_, err = q.Dequeue()
+	assert.NoError(t, err)
+	stats, err = q.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), stats[queue.StatVisible])
+	_, exists = stats[queue.StatOldestMessageAgeMs]
+	assert.False(t, exists)
+}
+
+func TestQueueClearPurgesMessages(t *testing.T) {
+	q, cleanup := setupTestQueue(t, true, true)
+	defer cleanup()
+	for _, priority := range []uint64{1, 2, 2, 3} {
+		assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: priority}))
+	}
+
+	assert.NoError(t, q.Clear())
+	stats, err := q.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), stats[queue.StatVisible])
+	assert.Equal(t, uint64(0), stats[queue.StatIndexBytes])
+	assert.Equal(t, uint64(0), stats[queue.StatPageBytes])
+	indexes, err := os.ReadDir(filepath.Join(q.RootDir, "main", "indexes"))
+	assert.NoError(t, err)
+	assert.Empty(t, indexes)
+	_, err = q.Dequeue()
+	assert.Error(t, err)
+
+	// The queue is usable after being cleared
+	item := &queue.QueueItem{MessageId: uuid.New(), Priority: 2}
+	assert.NoError(t, q.Enqueue(item))
+	dequeued, err := q.Dequeue()
+	assert.NoError(t, err)
+	assert.Equal(t, item.MessageId, dequeued.MessageId)
+}
+
+func TestQueueClearPriorityRange(t *testing.T) {
+	q, cleanup := setupTestQueue(t, false, false)
+	defer cleanup()
+	for _, priority := range []uint64{1, 2, 3, 4, 5, 6, 4} {
+		assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: priority}))
+	}
+	_, err := q.Dequeue()
+	assert.NoError(t, err)
+
+	err = q.ClearWithOptions(queue.ClearOptions{Targets: queue.ClearTargetMain, Priorities: queue.PriorityRange{Min: 2, Max: 4}})
+	assert.NoError(t, err)
+
+	var order []uint64
+	for {
+		item, err := q.Dequeue()
+		if err != nil {
+			break
+		}
+		order = append(order, item.Priority)
+	}
+	assert.Equal(t, []uint64{5, 1}, order)
+}
+
+func TestQueueClearConcurrentProducers(t *testing.T) {
+	q, cleanup := setupTestQueue(t, false, false)
+	defer cleanup()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			_ = q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: uint64(i%8 + 1)})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, q.Clear())
+	}
+	<-done
+
+	stats, err := q.GetStats()
+	assert.NoError(t, err)
+	listed, _, err := q.ListMessages(queue.ListOptions{PageSize: 1000})
+	assert.NoError(t, err)
+	assert.Equal(t, stats[queue.StatVisible], uint64(len(listed)))
+	for range listed {
+		_, err := q.Dequeue()
+		assert.NoError(t, err)
+	}
+	_, err = q.Dequeue()
+	assert.Error(t, err)
+}
+
+func TestQueueCloseAndReopen(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := queue.QueueConfiguration{QueueName: "test", QueueId: 1}
+	q, err := queue.NewQueue(tmpDir, config)
+	assert.NoError(t, err)
+	items := []*queue.QueueItem{
+		{MessageId: uuid.New(), Priority: 2},
+		{MessageId: uuid.New(), Priority: 8},
+		{MessageId: uuid.New(), Priority: 2},
+	}
+	for _, item := range items {
+		assert.NoError(t, q.Enqueue(item))
+	}
+	_, err = q.Dequeue()
+	assert.NoError(t, err)
+	assert.NoError(t, q.Close())
+
+	_, err = q.Dequeue()
+	assert.ErrorIs(t, err, queue.ErrHeapClosed)
+	assert.ErrorIs(t, q.Enqueue(items[0]), queue.ErrHeapClosed)
+
+	reopened, err := queue.NewQueue(tmpDir, config)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	stats, err := reopened.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), stats[queue.StatVisible])
+	for _, want := range []*queue.QueueItem{items[0], items[2]} {
+		item, err := reopened.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, want.MessageId, item.MessageId)
+	}
+}
+
+func TestNewQueueClosesHeapsOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "1"), 0o755))
+	// A file where the dlq heap directory belongs fails the queue after its main heap opened
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "1", "dlq"), nil, 0o644))
+	config := queue.QueueConfiguration{QueueName: "broken", QueueId: 1, EnableDLQ: true, HeapOptions: queue.HeapOptions{PageStore: queue.PageStoreMmap}}
+	before := openDescriptors(t)
+	for range 10 {
+		_, err := queue.NewQueue(dir, config)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, before, openDescriptors(t))
+}
+
+func openDescriptors(t *testing.T) int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("open descriptors are not listed on this platform")
+	}
+	return len(entries)
+}
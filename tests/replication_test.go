@@ -0,0 +1,394 @@
+package tests
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func newReplica(t *testing.T, dir string, role queue.ReplicaRole) *queue.Queue {
+	return newTestQueue(t, dir, queue.QueueConfiguration{QueueName: "replicated", QueueId: 1, EnableDLQ: true, EnableInvisible: true, Replica: role})
+}
+
+// Connect a follower to a primary, returning a function disconnecting them
+// and waiting for both sides to stop.
+func connect(t *testing.T, primary *queue.Queue, follower *queue.Queue, id string) func() {
+	primaryEnd, followerEnd := net.Pipe()
+	served, followed := make(chan error, 1), make(chan error, 1)
+	go func() { served <- primary.ServeFollower(id, primaryEnd) }()
+	go func() { followed <- follower.Follow(followerEnd) }()
+	return func() {
+		primaryEnd.Close()
+		followerEnd.Close()
+		<-served
+		<-followed
+	}
+}
+
+func waitCaughtUp(t *testing.T, primary *queue.Queue, id string) {
+	assert.Eventually(t, func() bool {
+		status := primary.ReplicationStatus()
+		for _, follower := range status.Followers {
+			if follower.Id == id {
+				return follower.Lag == 0
+			}
+		}
+		return false
+	}, 5*time.Second, time.Millisecond)
+}
+
+// Pages and index files of every heap, which followers replicate exactly.
+func replicatedFiles(t *testing.T, root string) map[string][]byte {
+	files := make(map[string][]byte)
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || filepath.Base(filepath.Dir(path)) == "times" || entry.Name() == "replication.log" {
+			return err
+		}
+		relative, _ := filepath.Rel(root, path)
+		files[relative], err = os.ReadFile(path)
+		return err
+	})
+	assert.NoError(t, err)
+	return files
+}
+
+func mutate(t *testing.T, q *queue.Queue, count int) {
+	for i := range count {
+		assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: uint64(i%7 + 1)}))
+		if i%3 == 0 {
+			_, err := q.Dequeue()
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func TestReplicationFollowerMatchesPrimary(t *testing.T) {
+	primaryDir, followerDir := t.TempDir(), t.TempDir()
+	primary := newReplica(t, primaryDir, queue.ReplicaPrimary)
+	follower := newReplica(t, followerDir, queue.ReplicaFollower)
+	disconnect := connect(t, primary, follower, "f1")
+	defer disconnect()
+
+	mutate(t, primary, 200)
+	_, err := primary.Import(exportOf(queue.MessageDLQ, 4))
+	assert.NoError(t, err)
+	assert.NoError(t, primary.ClearWithOptions(queue.ClearOptions{Targets: queue.ClearTargetMain, Priorities: queue.PriorityRange{Min: 2, Max: 3}}))
+	waitCaughtUp(t, primary, "f1")
+
+	assert.NoError(t, primary.Flush())
+	assert.NoError(t, follower.Flush())
+	assert.Equal(t, replicatedFiles(t, primaryDir), replicatedFiles(t, followerDir))
+	assert.Equal(t, listAll(t, primary.ListMessages), listAll(t, follower.ListMessages))
+	assert.Equal(t, listAll(t, primary.ListDLQMessages), listAll(t, follower.ListDLQMessages))
+	assert.Equal(t, primary.ReplicationStatus().LastSeq, follower.ReplicationStatus().LastSeq)
+}
+
+func exportOf(state queue.MessageState, count int) io.Reader {
+	lines := []string{`{"format":"kokaq-export","version":1,"queue_id":1,"queue_name":"x"}`}
+	for i := range count {
+		lines = append(lines, fmt.Sprintf(`{"message_id":"%s","priority":%d,"state":"%s"}`, uuid.New(), i+1, state))
+	}
+	return strings.NewReader(strings.Join(lines, "\n"))
+}
+
+func TestReplicationFollowerIsReadOnly(t *testing.T) {
+	follower := newReplica(t, t.TempDir(), queue.ReplicaFollower)
+	assert.ErrorIs(t, follower.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}), queue.ErrReadOnlyReplica)
+	_, err := follower.Dequeue()
+	assert.ErrorIs(t, err, queue.ErrReadOnlyReplica)
+	assert.ErrorIs(t, follower.Clear(), queue.ErrReadOnlyReplica)
+	assert.Error(t, follower.ServeFollower("f1", nil))
+}
+
+func TestReplicationCatchUpAfterReconnect(t *testing.T) {
+	primaryDir, followerDir := t.TempDir(), t.TempDir()
+	primary := newReplica(t, primaryDir, queue.ReplicaPrimary)
+	follower := newReplica(t, followerDir, queue.ReplicaFollower)
+
+	disconnect := connect(t, primary, follower, "f1")
+	mutate(t, primary, 50)
+	waitCaughtUp(t, primary, "f1")
+	disconnect()
+	assert.Empty(t, primary.ReplicationStatus().Followers)
+
+	// Entries logged while disconnected are shipped on reconnect, also to a reopened follower
+	mutate(t, primary, 700)
+	assert.NoError(t, follower.Close())
+	follower = newReplica(t, followerDir, queue.ReplicaFollower)
+	disconnect = connect(t, primary, follower, "f1")
+	defer disconnect()
+	waitCaughtUp(t, primary, "f1")
+
+	assert.NoError(t, primary.Flush())
+	assert.NoError(t, follower.Flush())
+	assert.Equal(t, replicatedFiles(t, primaryDir), replicatedFiles(t, followerDir))
+}
+
+func TestReplicationPromotion(t *testing.T) {
+	primaryDir, followerDir := t.TempDir(), t.TempDir()
+	primary := newReplica(t, primaryDir, queue.ReplicaPrimary)
+	follower := newReplica(t, followerDir, queue.ReplicaFollower)
+	disconnect := connect(t, primary, follower, "f1")
+	mutate(t, primary, 40)
+	waitCaughtUp(t, primary, "f1")
+	disconnect()
+	assert.NoError(t, primary.Close())
+
+	assert.NoError(t, follower.Promote())
+	assert.Equal(t, queue.ReplicaPrimary, follower.ReplicationStatus().Role)
+	assert.Error(t, follower.Promote())
+	mutate(t, follower, 20)
+
+	// The promoted queue serves a new follower from the start of its log
+	next := newReplica(t, t.TempDir(), queue.ReplicaFollower)
+	disconnect = connect(t, follower, next, "f2")
+	defer disconnect()
+	waitCaughtUp(t, follower, "f2")
+	assert.Equal(t, listAll(t, follower.ListMessages), listAll(t, next.ListMessages))
+}
+
+func TestReplicationLag(t *testing.T) {
+	primary := newReplica(t, t.TempDir(), queue.ReplicaPrimary)
+	mutate(t, primary, 9) // 9 enqueues and 3 dequeues
+
+	// A follower that reads what is shipped but acknowledges on demand
+	primaryEnd, followerEnd := net.Pipe()
+	served := make(chan error, 1)
+	go func() { served <- primary.ServeFollower("slow", primaryEnd) }()
+	defer func() {
+		followerEnd.Close()
+		assert.Error(t, <-served)
+	}()
+	handshake := make([]byte, 8)
+	_, err := followerEnd.Write(handshake)
+	assert.NoError(t, err)
+	go func() {
+		buffer := make([]byte, 4096)
+		for {
+			if _, err := followerEnd.Read(buffer); err != nil {
+				return
+			}
+		}
+	}()
+	ack := func(seq uint64) {
+		binary.LittleEndian.PutUint64(handshake, seq)
+		_, err := followerEnd.Write(handshake)
+		assert.NoError(t, err)
+	}
+
+	lag := func() uint64 {
+		for _, follower := range primary.ReplicationStatus().Followers {
+			return follower.Lag
+		}
+		return 0
+	}
+	assert.Eventually(t, func() bool { return lag() == 12 }, 5*time.Second, time.Millisecond)
+	ack(5)
+	assert.Eventually(t, func() bool { return lag() == 7 }, 5*time.Second, time.Millisecond)
+	assert.NoError(t, primary.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}))
+	assert.Equal(t, uint64(8), lag())
+	ack(13)
+	assert.Eventually(t, func() bool { return lag() == 0 }, 5*time.Second, time.Millisecond)
+}
+
+func TestReplicationRejectsDivergedFollower(t *testing.T) {
+	primary := newReplica(t, t.TempDir(), queue.ReplicaPrimary)
+	follower := newReplica(t, t.TempDir(), queue.ReplicaPrimary)
+	mutate(t, follower, 5)
+	// A former primary with entries the primary never had cannot follow it
+	primaryEnd, followerEnd := net.Pipe()
+	defer followerEnd.Close()
+	go func() {
+		handshake := make([]byte, 8)
+		binary.LittleEndian.PutUint64(handshake, follower.ReplicationStatus().LastSeq)
+		followerEnd.Write(handshake)
+	}()
+	assert.ErrorIs(t, primary.ServeFollower("f1", primaryEnd), queue.ErrReplicationDiverged)
+}
+
+func TestReplicationCarriesGroups(t *testing.T) {
+	primary := newReplica(t, t.TempDir(), queue.ReplicaPrimary)
+	follower := newReplica(t, t.TempDir(), queue.ReplicaFollower)
+	disconnect := connect(t, primary, follower, "f1")
+
+	first := &queue.QueueItem{MessageId: uuid.New(), Priority: 5, GroupKey: "order-1"}
+	second := &queue.QueueItem{MessageId: uuid.New(), Priority: 5, GroupKey: "order-1"}
+	nacked := &queue.QueueItem{MessageId: uuid.New(), Priority: 3, GroupKey: "order-2"}
+	for _, item := range []*queue.QueueItem{first, second, nacked, {MessageId: uuid.New(), Priority: 1}} {
+		assert.NoError(t, primary.Enqueue(item))
+	}
+	_, lockId, err := primary.PeekLock()
+	assert.NoError(t, err)
+	_, nackId, err := primary.PeekLock()
+	assert.NoError(t, err)
+	assert.NoError(t, primary.NackWithDelay(nackId, time.Hour))
+	waitCaughtUp(t, primary, "f1")
+	disconnect()
+	assert.NoError(t, primary.Close())
+
+	stats, err := follower.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), stats[queue.StatVisible])
+	assert.Equal(t, uint64(1), stats[queue.StatLocked])
+	assert.Equal(t, uint64(1), stats[queue.StatDelayed])
+	assert.Equal(t, uint64(1), stats[queue.StatWaiting])
+
+	// Locks taken on the former primary can be acked on the promoted follower
+	assert.NoError(t, follower.Promote())
+	locked, err := follower.GetLockedMessages()
+	assert.NoError(t, err)
+	assert.Equal(t, []*queue.QueueItem{first}, locked)
+	assert.NoError(t, follower.Ack(lockId))
+	item, err := follower.Dequeue()
+	assert.NoError(t, err)
+	assert.Equal(t, second, item)
+}
+
+func TestReplicationFollowerCrashBeforeLogging(t *testing.T) {
+	for name, last := range map[string]func(*queue.Queue) error{
+		"enqueue": func(q *queue.Queue) error { return q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 4}) },
+		"dequeue": func(q *queue.Queue) error { _, err := q.Dequeue(); return err },
+		"wait": func(q *queue.Queue) error {
+			return q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 2, GroupKey: "g"})
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			primaryDir, followerDir := t.TempDir(), t.TempDir()
+			primary := newReplica(t, primaryDir, queue.ReplicaPrimary)
+			follower := newReplica(t, followerDir, queue.ReplicaFollower)
+			disconnect := connect(t, primary, follower, "f1")
+			mutate(t, primary, 50)
+			assert.NoError(t, primary.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 2, GroupKey: "g"}))
+			waitCaughtUp(t, primary, "f1")
+			logPath := filepath.Join(followerDir, "1", "replication.log")
+			info, err := os.Stat(logPath)
+			assert.NoError(t, err)
+			logged := follower.ReplicationStatus().LastSeq
+
+			// The follower applies the last entry, then crashes before logging it
+			assert.NoError(t, last(primary))
+			waitCaughtUp(t, primary, "f1")
+			disconnect()
+			assert.NoError(t, follower.Close())
+			assert.NoError(t, os.Truncate(logPath, info.Size()))
+
+			follower = newReplica(t, followerDir, queue.ReplicaFollower)
+			assert.Equal(t, logged, follower.ReplicationStatus().LastSeq)
+			assert.Equal(t, logged+1, primary.ReplicationStatus().LastSeq, "the last mutation is a single entry")
+			disconnect = connect(t, primary, follower, "f1")
+			defer disconnect()
+			waitCaughtUp(t, primary, "f1")
+
+			assert.NoError(t, primary.Flush())
+			assert.NoError(t, follower.Flush())
+			assert.Equal(t, replicatedFiles(t, primaryDir), replicatedFiles(t, followerDir))
+			assert.Equal(t, listAll(t, primary.ListMessages), listAll(t, follower.ListMessages))
+			primaryStats, err := primary.GetStats()
+			assert.NoError(t, err)
+			followerStats, err := follower.GetStats()
+			assert.NoError(t, err)
+			assert.Equal(t, primaryStats[queue.StatWaiting], followerStats[queue.StatWaiting])
+		})
+	}
+}
+
+func TestReplicationPrimaryCrashBeforeApplying(t *testing.T) {
+	primaryDir, crashedDir := t.TempDir(), t.TempDir()
+	primary := newReplica(t, primaryDir, queue.ReplicaPrimary)
+	mutate(t, primary, 20)
+	assert.NoError(t, primary.Close())
+	assert.NoError(t, os.CopyFS(crashedDir, os.DirFS(primaryDir)))
+
+	// The crashed primary logged the next mutation, then crashed before applying it
+	primary = newReplica(t, primaryDir, queue.ReplicaPrimary)
+	assert.NoError(t, primary.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 9}))
+	assert.NoError(t, primary.Flush())
+	logged, err := os.ReadFile(filepath.Join(primaryDir, "1", "replication.log"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(crashedDir, "1", "replication.log"), logged, 0644))
+
+	crashed := newReplica(t, crashedDir, queue.ReplicaPrimary)
+	assert.Equal(t, primary.ReplicationStatus().LastSeq, crashed.ReplicationStatus().LastSeq)
+	assert.Equal(t, listAll(t, primary.ListMessages), listAll(t, crashed.ListMessages))
+}
+
+func TestReplicationFailedMutationIsNotShipped(t *testing.T) {
+	primaryDir := t.TempDir()
+	primary := newReplica(t, primaryDir, queue.ReplicaPrimary)
+	follower := newReplica(t, t.TempDir(), queue.ReplicaFollower)
+	disconnect := connect(t, primary, follower, "f1")
+	defer disconnect()
+	mutate(t, primary, 10)
+	waitCaughtUp(t, primary, "f1")
+	logPath := filepath.Join(primaryDir, "1", "replication.log")
+	info, err := os.Stat(logPath)
+	assert.NoError(t, err)
+	last := primary.ReplicationStatus().LastSeq
+
+	// The main heap can no longer create index files
+	assert.NoError(t, os.RemoveAll(filepath.Join(primaryDir, "1", "main", "indexes")))
+	assert.Error(t, primary.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 42}))
+	assert.Equal(t, last, primary.ReplicationStatus().LastSeq)
+	after, err := os.Stat(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, info.Size(), after.Size(), "the entry is rolled back")
+	assert.NoError(t, primary.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}))
+	waitCaughtUp(t, primary, "f1")
+	assert.Equal(t, last+1, follower.ReplicationStatus().LastSeq)
+	assert.Equal(t, listAll(t, primary.ListMessages), listAll(t, follower.ListMessages))
+}
+
+func TestReplicationLogIsTrimmed(t *testing.T) {
+	primaryDir, followerDir := t.TempDir(), t.TempDir()
+	config := queue.QueueConfiguration{QueueName: "replicated", QueueId: 1, Replica: queue.ReplicaPrimary, ReplicationRetention: 16}
+	primary := newTestQueue(t, primaryDir, config)
+	follower := newReplica(t, followerDir, queue.ReplicaFollower)
+	disconnect := connect(t, primary, follower, "f1")
+	waitCaughtUp(t, primary, "f1")
+	mutate(t, primary, 300)
+	waitCaughtUp(t, primary, "f1")
+	disconnect()
+
+	// The log keeps less than twice the retention once every follower applied it
+	logPath := filepath.Join(primaryDir, "1", "replication.log")
+	assert.Eventually(t, func() bool {
+		return fileSize(logPath) < fileSize(filepath.Join(followerDir, "1", "replication.log"))/5
+	}, 5*time.Second, time.Millisecond)
+	mutate(t, primary, 6)
+	assert.NoError(t, follower.Close())
+	follower = newReplica(t, followerDir, queue.ReplicaFollower)
+	disconnect = connect(t, primary, follower, "f1")
+	waitCaughtUp(t, primary, "f1")
+	disconnect()
+	assert.Equal(t, listAll(t, primary.ListMessages), listAll(t, follower.ListMessages))
+
+	// A new follower cannot start from the trimmed entries, but from a copy of the primary
+	primaryEnd, followerEnd := net.Pipe()
+	defer primaryEnd.Close()
+	go func() {
+		followerEnd.Write(make([]byte, 8))
+		followerEnd.Close()
+	}()
+	assert.ErrorIs(t, primary.ServeFollower("f2", primaryEnd), queue.ErrLogTruncated)
+	assert.NoError(t, primary.Flush())
+	copyDir := t.TempDir()
+	assert.NoError(t, os.CopyFS(copyDir, os.DirFS(primaryDir)))
+	copied := newReplica(t, copyDir, queue.ReplicaFollower)
+	disconnect = connect(t, primary, copied, "f2")
+	defer disconnect()
+	waitCaughtUp(t, primary, "f2")
+	mutate(t, primary, 30)
+	waitCaughtUp(t, primary, "f2")
+	assert.Equal(t, listAll(t, primary.ListMessages), listAll(t, copied.ListMessages))
+}
@@ -0,0 +1,167 @@
+package tests
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+type manualClock struct {
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time { return c.now }
+
+func (c *manualClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newRetryQueue(t *testing.T, dir string, clock queue.Clock, policy queue.RetryPolicy) *queue.Queue {
+	return newTestQueue(t, dir, queue.QueueConfiguration{QueueName: "retry", QueueId: 1, Retry: policy, Clock: clock})
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := queue.RetryPolicy{BaseDelay: time.Second, Multiplier: 2, MaxDelay: 5 * time.Second}
+	for attempts, expected := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		assert.Equal(t, expected, policy.Delay(uint32(attempts)), "attempt %d", attempts)
+	}
+	assert.Equal(t, time.Duration(0), queue.RetryPolicy{}.Delay(3))
+	assert.Equal(t, time.Second, queue.RetryPolicy{BaseDelay: time.Second}.Delay(10), "no multiplier keeps the delay constant")
+
+	policy.Jitter = 0.5
+	for range 100 {
+		delay := policy.Delay(3)
+		assert.GreaterOrEqual(t, delay, 2*time.Second)
+		assert.LessOrEqual(t, delay, 4*time.Second)
+	}
+}
+
+func TestRetryPolicyDelaySaturates(t *testing.T) {
+	policy := queue.RetryPolicy{BaseDelay: time.Second, Multiplier: 2}
+	longest := policy.Delay(math.MaxUint32)
+	assert.Greater(t, longest, time.Duration(math.MaxInt64-1<<20))
+	previous := time.Duration(0)
+	for _, attempts := range []uint32{30, 34, 35, 36, 64, 100, 1000, math.MaxUint32} {
+		delay := policy.Delay(attempts)
+		assert.GreaterOrEqual(t, delay, previous, "attempt %d", attempts)
+		assert.LessOrEqual(t, delay, longest, "attempt %d", attempts)
+		previous = delay
+	}
+
+	// A delay past the range of the clock keeps the message delayed
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	q := newRetryQueue(t, t.TempDir(), clock, policy)
+	assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}))
+	_, lockId := peekLock(t, q)
+	assert.NoError(t, q.NackWithDelay(lockId, longest))
+	clock.Advance(100 * 365 * 24 * time.Hour)
+	_, _, err := q.PeekLock()
+	assert.Error(t, err)
+	stats, err := q.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), stats[queue.StatDelayed])
+}
+
+func TestNackBacksOff(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	q := newRetryQueue(t, t.TempDir(), clock, queue.RetryPolicy{BaseDelay: 10 * time.Second, Multiplier: 2})
+	item := &queue.QueueItem{MessageId: uuid.New(), Priority: 1}
+	assert.NoError(t, q.Enqueue(item))
+
+	for _, backoff := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second} {
+		_, lockId := peekLock(t, q)
+		assert.NoError(t, q.Nack(lockId))
+		assert.ErrorIs(t, q.Nack(lockId), queue.ErrLockNotFound)
+		stats, err := q.GetStats()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), stats[queue.StatDelayed])
+		assert.Equal(t, uint64(0), stats[queue.StatVisible])
+
+		clock.Advance(backoff - time.Millisecond)
+		_, _, err = q.PeekLock()
+		assert.Error(t, err, "the message stays hidden until its backoff elapsed")
+		clock.Advance(time.Millisecond)
+		peeked, err := q.Peek()
+		assert.NoError(t, err)
+		assert.Equal(t, item.MessageId, peeked.MessageId)
+	}
+
+	// Acking forgets the attempts, the same id starts over
+	_, lockId := peekLock(t, q)
+	assert.NoError(t, q.Ack(lockId))
+	assert.NoError(t, q.Enqueue(item))
+	_, lockId = peekLock(t, q)
+	assert.NoError(t, q.Nack(lockId))
+	clock.Advance(10 * time.Second)
+	peekLock(t, q)
+}
+
+func TestNackWithDelay(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	q := newRetryQueue(t, t.TempDir(), clock, queue.RetryPolicy{BaseDelay: time.Hour})
+	first, second := &queue.QueueItem{MessageId: uuid.New(), Priority: 1}, &queue.QueueItem{MessageId: uuid.New(), Priority: 1}
+	assert.NoError(t, q.Enqueue(first))
+	assert.NoError(t, q.Enqueue(second))
+
+	_, lockId := peekLock(t, q)
+	assert.NoError(t, q.NackWithDelay(lockId, 0))
+	item, lockId := peekLock(t, q)
+	assert.Equal(t, second.MessageId, item.MessageId, "an immediate nack goes back behind the messages already visible")
+	assert.NoError(t, q.NackWithDelay(lockId, time.Minute))
+	item, lockId = peekLock(t, q)
+	assert.Equal(t, first.MessageId, item.MessageId)
+	assert.NoError(t, q.NackWithDelay(lockId, 2*time.Minute))
+
+	clock.Advance(2 * time.Minute)
+	item, _ = peekLock(t, q)
+	assert.Equal(t, second.MessageId, item.MessageId, "delayed messages return in due order")
+	item, _ = peekLock(t, q)
+	assert.Equal(t, first.MessageId, item.MessageId)
+}
+
+func TestNackDelaySurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	policy := queue.RetryPolicy{BaseDelay: time.Minute, Multiplier: 3}
+	q := newRetryQueue(t, dir, clock, policy)
+	item := &queue.QueueItem{MessageId: uuid.New(), Priority: 1, GroupKey: "a"}
+	next := &queue.QueueItem{MessageId: uuid.New(), Priority: 9, GroupKey: "a"}
+	assert.NoError(t, q.Enqueue(item))
+	assert.NoError(t, q.Enqueue(next))
+	_, lockId := peekLock(t, q)
+	assert.NoError(t, q.Nack(lockId))
+	assert.NoError(t, q.Close())
+
+	q = newRetryQueue(t, dir, clock, policy)
+	_, _, err := q.PeekLock()
+	assert.Error(t, err, "a delayed message keeps its group waiting")
+	clock.Advance(time.Minute)
+	peeked, lockId := peekLock(t, q)
+	assert.Equal(t, item.MessageId, peeked.MessageId)
+	assert.NoError(t, q.Close())
+
+	// The lock is lost with the queue but the attempts are kept
+	q = newRetryQueue(t, dir, clock, policy)
+	_, lockId = peekLock(t, q)
+	assert.NoError(t, q.Nack(lockId))
+	clock.Advance(9*time.Minute - time.Millisecond)
+	_, _, err = q.PeekLock()
+	assert.Error(t, err)
+	clock.Advance(time.Millisecond)
+	_, lockId = peekLock(t, q)
+	assert.NoError(t, q.Ack(lockId))
+	peeked, _ = peekLock(t, q)
+	assert.Equal(t, next.MessageId, peeked.MessageId)
+}
+
+func TestOldestMessageAgeUsesClock(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	q := newRetryQueue(t, t.TempDir(), clock, queue.RetryPolicy{})
+	assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}))
+	clock.Advance(5 * time.Second)
+	stats, err := q.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5000), stats[queue.StatOldestMessageAgeMs])
+}
@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/kokaq/core/cluster"
+	"github.com/stretchr/testify/assert"
+)
+
+func ringQueues(count int) []cluster.QueueKey {
+	keys := make([]cluster.QueueKey, 0, count)
+	for i := range count {
+		keys = append(keys, cluster.QueueKey{NamespaceId: uint32(i%7 + 1), QueueId: uint32(i)})
+	}
+	return keys
+}
+
+func ownership(ring *cluster.Ring, queues []cluster.QueueKey) map[string]int {
+	owned := make(map[string]int)
+	for _, key := range queues {
+		owner, ok := ring.Owner(key)
+		if ok {
+			owned[owner]++
+		}
+	}
+	return owned
+}
+
+func TestRingDistributionFollowsWeights(t *testing.T) {
+	ring := cluster.NewRing(0)
+	assert.NoError(t, ring.Add("a", 1))
+	assert.NoError(t, ring.Add("b", 1))
+	assert.NoError(t, ring.Add("c", 2))
+	assert.Equal(t, []string{"a", "b", "c"}, ring.Members())
+
+	owned := ownership(ring, ringQueues(20000))
+	assert.InDelta(t, 5000, owned["a"], 1000)
+	assert.InDelta(t, 5000, owned["b"], 1000)
+	assert.InDelta(t, 10000, owned["c"], 1500)
+}
+
+func TestRingMinimalMovement(t *testing.T) {
+	queues := ringQueues(10000)
+	ring := cluster.NewRing(64)
+	for _, member := range []string{"a", "b", "c", "d"} {
+		assert.NoError(t, ring.Add(member, 1))
+	}
+
+	// Only queues moving to the new member migrate
+	grown := ring.Clone()
+	assert.NoError(t, grown.Add("e", 1))
+	migrations := ring.Migrations(grown, queues)
+	assert.InDelta(t, 2000, len(migrations), 600)
+	for _, migration := range migrations {
+		assert.Equal(t, "e", migration.To)
+		owner, _ := ring.Owner(migration.Queue)
+		assert.Equal(t, owner, migration.From)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d"}, ring.Members(), "planning on a clone leaves the ring as is")
+
+	// Only queues of the removed member migrate
+	shrunk := ring.Clone()
+	assert.NoError(t, shrunk.Remove("b"))
+	migrations = ring.Migrations(shrunk, queues)
+	assert.Equal(t, ownership(ring, queues)["b"], len(migrations))
+	for _, migration := range migrations {
+		assert.Equal(t, "b", migration.From)
+		assert.NotEqual(t, "b", migration.To)
+	}
+	assert.Error(t, shrunk.Remove("b"))
+}
+
+func TestRingOwners(t *testing.T) {
+	ring := cluster.NewRing(16)
+	key := cluster.QueueKey{NamespaceId: 1, QueueId: 2}
+	_, ok := ring.Owner(key)
+	assert.False(t, ok)
+	assert.Empty(t, ring.Owners(key, 3))
+	assert.Error(t, ring.Add("a", 0))
+	assert.Error(t, ring.Add("", 1))
+
+	for _, member := range []string{"a", "b", "c"} {
+		assert.NoError(t, ring.Add(member, 1))
+	}
+	owners := ring.Owners(key, 5)
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, owners)
+	owner, ok := ring.Owner(key)
+	assert.True(t, ok)
+	assert.Equal(t, owner, owners[0])
+	assert.Equal(t, owners[:2], ring.Owners(key, 2))
+
+	// Ownership depends only on the members, not on the order they joined
+	other := cluster.NewRing(16)
+	for _, member := range []string{"c", "a", "b"} {
+		assert.NoError(t, other.Add(member, 1))
+	}
+	assert.Empty(t, ring.Migrations(other, ringQueues(1000)))
+}
@@ -0,0 +1,193 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func drainQueue(t *testing.T, q *queue.Queue) []*queue.QueueItem {
+	items := make([]*queue.QueueItem, 0)
+	for {
+		if empty, _ := q.IsEmpty(); empty {
+			return items
+		}
+		item, err := q.Dequeue()
+		if err != nil {
+			t.Fatalf("Dequeue failed: %v", err)
+		}
+		items = append(items, item)
+	}
+}
+
+func TestNamespace_SnapshotAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	ns := newTestNamespace(t, dir, queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 9})
+	defer ns.Close()
+	policy := queue.NewPolicy()
+	policy.Allow("alice", "producer", 1)
+	assert.NoError(t, ns.SetPolicy(policy))
+	q, err := ns.AddQueue(&queue.QueueConfiguration{QueueName: "orders", QueueId: 1, EnableDLQ: true})
+	assert.NoError(t, err)
+	for i := range 50 {
+		assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: uint64(i%7 + 1)}))
+	}
+	_, err = q.Dequeue()
+	assert.NoError(t, err)
+
+	archive := filepath.Join(t.TempDir(), "testns.tar")
+	assert.NoError(t, ns.Snapshot(archive))
+	// Changes after the snapshot are not part of it
+	assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 100}))
+
+	restoreDir := t.TempDir()
+	restored, err := queue.RestoreNamespace(archive, restoreDir)
+	if err != nil {
+		t.Fatalf("RestoreNamespace failed: %v", err)
+	}
+	defer restored.Close()
+	assert.Equal(t, "testns", restored.Name)
+	assert.Equal(t, uint32(9), restored.Id)
+	assert.NoError(t, restored.Authorize("alice", 1, queue.PermissionEnqueue))
+	assert.Error(t, restored.Authorize("bob", 1, queue.PermissionEnqueue))
+
+	restoredQueue, err := restored.GetQueue(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "orders", restoredQueue.Name)
+	assert.True(t, restoredQueue.EnableDLQ)
+	items := drainQueue(t, restoredQueue)
+	assert.Len(t, items, 49)
+	assert.Equal(t, uint64(7), items[0].Priority)
+
+	// An existing namespace is never overwritten
+	_, err = queue.RestoreNamespace(archive, restoreDir)
+	assert.Error(t, err)
+}
+
+func TestNamespace_SnapshotKeepsQueueSettings(t *testing.T) {
+	ns := newTestNamespace(t, t.TempDir(), queue.NamespaceConfig{NamespaceName: "settings", NamespaceId: 11, Quotas: queue.NamespaceQuotas{MaxMessages: 3}})
+	defer ns.Close()
+	_, err := ns.AddQueue(&queue.QueueConfiguration{
+		QueueName:        "limited",
+		QueueId:          1,
+		Limits:           queue.QueueLimits{MaxMessages: 2},
+		Retry:            queue.RetryPolicy{BaseDelay: time.Hour},
+		DedupWindow:      time.Hour,
+		RejectDuplicates: true,
+	})
+	assert.NoError(t, err)
+	_, err = ns.AddQueue(&queue.QueueConfiguration{QueueName: "other", QueueId: 2})
+	assert.NoError(t, err)
+	archive := filepath.Join(t.TempDir(), "settings.tar")
+	assert.NoError(t, ns.Snapshot(archive))
+
+	restored, err := queue.RestoreNamespace(archive, t.TempDir())
+	if err != nil {
+		t.Fatalf("RestoreNamespace failed: %v", err)
+	}
+	defer restored.Close()
+	limited, err := restored.GetQueue(1)
+	assert.NoError(t, err)
+	other, err := restored.GetQueue(2)
+	assert.NoError(t, err)
+
+	// The dedup window, the retry policy, the queue limits and the namespace quotas all apply
+	item := &queue.QueueItem{MessageId: uuid.New(), Priority: 1}
+	assert.NoError(t, limited.Enqueue(item))
+	assert.ErrorIs(t, limited.Enqueue(item), queue.ErrDuplicateMessage)
+	_, lockId, err := limited.PeekLock()
+	assert.NoError(t, err)
+	assert.NoError(t, limited.Nack(lockId))
+	stats, err := limited.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), stats[queue.StatDelayed])
+	assert.NoError(t, limited.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}))
+	var full *queue.ErrQueueFull
+	if assert.ErrorAs(t, limited.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}), &full) {
+		assert.False(t, full.Namespace)
+	}
+	assert.NoError(t, other.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}))
+	if assert.ErrorAs(t, other.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}), &full) {
+		assert.True(t, full.Namespace)
+	}
+}
+
+func TestNamespace_SnapshotDuringEnqueues(t *testing.T) {
+	dir := t.TempDir()
+	ns := newTestNamespace(t, dir, queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 10})
+	defer ns.Close()
+	q, err := ns.AddQueue(&queue.QueueConfiguration{QueueName: "busy", QueueId: 1})
+	assert.NoError(t, err)
+
+	var mu sync.Mutex
+	enqueued := make([]uuid.UUID, 0)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			mu.Lock()
+			id := uuid.New()
+			if err := q.Enqueue(&queue.QueueItem{MessageId: id, Priority: 1}); err != nil {
+				mu.Unlock()
+				t.Errorf("Enqueue failed: %v", err)
+				return
+			}
+			enqueued = append(enqueued, id)
+			mu.Unlock()
+		}
+	}()
+	archive := filepath.Join(t.TempDir(), "busy.tar")
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(enqueued) >= 100
+	}, 5*time.Second, time.Millisecond)
+	assert.NoError(t, ns.Snapshot(archive))
+	close(stop)
+	<-done
+
+	restored, err := queue.RestoreNamespace(archive, t.TempDir())
+	if err != nil {
+		t.Fatalf("RestoreNamespace failed: %v", err)
+	}
+	defer restored.Close()
+	restoredQueue, err := restored.GetQueue(1)
+	assert.NoError(t, err)
+	items := drainQueue(t, restoredQueue)
+	// The snapshot holds exactly the messages enqueued before some point
+	assert.GreaterOrEqual(t, len(items), 100)
+	for i, item := range items {
+		assert.Equal(t, enqueued[i], item.MessageId, "message %d", i)
+	}
+}
+
+func TestRestoreNamespace_RejectsCorruptedArchive(t *testing.T) {
+	dir := t.TempDir()
+	ns := newTestNamespace(t, dir, queue.NamespaceConfig{NamespaceName: "testns", NamespaceId: 11})
+	defer ns.Close()
+	q, err := ns.AddQueue(&queue.QueueConfiguration{QueueName: "orders", QueueId: 1})
+	assert.NoError(t, err)
+	assert.NoError(t, q.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: 1}))
+	archive := filepath.Join(t.TempDir(), "testns.tar")
+	assert.NoError(t, ns.Snapshot(archive))
+
+	// The first entry's data starts after its 512 byte header
+	flipByte(t, archive, 512)
+	restoreDir := t.TempDir()
+	_, err = queue.RestoreNamespace(archive, restoreDir)
+	assert.Error(t, err)
+	entries, _ := os.ReadDir(restoreDir)
+	assert.Empty(t, entries, "nothing should be restored from a corrupted archive")
+}
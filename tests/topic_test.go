@@ -0,0 +1,100 @@
+package tests
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTopicNamespace(t *testing.T, dir string, queueIds ...uint32) *queue.Namespace {
+	ns := newTestNamespace(t, dir, queue.NamespaceConfig{NamespaceName: "topics", NamespaceId: 40})
+	t.Cleanup(func() { ns.Close() })
+	for _, queueId := range queueIds {
+		_, err := ns.LoadQueue(&queue.QueueConfiguration{QueueName: "subscriber", QueueId: queueId})
+		assert.NoError(t, err)
+	}
+	return ns
+}
+
+func TestTopicFanOut(t *testing.T) {
+	ns := newTopicNamespace(t, t.TempDir(), 1, 2, 3)
+	assert.NoError(t, ns.CreateTopic("orders"))
+	assert.Error(t, ns.CreateTopic("orders"))
+	assert.NoError(t, ns.Subscribe("orders", queue.Subscription{Name: "all", QueueId: 1}))
+	assert.NoError(t, ns.Subscribe("orders", queue.Subscription{Name: "urgent", QueueId: 2, Priorities: queue.PriorityRange{Min: 5}}))
+	assert.NoError(t, ns.Subscribe("orders", queue.Subscription{Name: "eu", QueueId: 3, Headers: map[string]string{"region": "eu"}}))
+	assert.Error(t, ns.Subscribe("orders", queue.Subscription{Name: "all", QueueId: 2}))
+	assert.Error(t, ns.Subscribe("orders", queue.Subscription{Name: "missing", QueueId: 9}))
+	assert.Error(t, ns.Subscribe("missing", queue.Subscription{Name: "all", QueueId: 1}))
+
+	item := &queue.QueueItem{MessageId: uuid.New(), Priority: 7}
+	delivered, err := ns.Publish("orders", item, map[string]string{"region": "eu"})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{1, 2, 3}, delivered)
+	delivered, err = ns.Publish("orders", &queue.QueueItem{MessageId: uuid.New(), Priority: 2}, map[string]string{"region": "us"})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{1}, delivered)
+	_, err = ns.Publish("missing", item, nil)
+	assert.Error(t, err)
+
+	for queueId, expected := range map[uint32]int{1: 2, 2: 1, 3: 1} {
+		q, err := ns.GetQueue(queueId)
+		assert.NoError(t, err)
+		stats, err := q.GetStats()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(expected), stats[queue.StatVisible], "queue %d", queueId)
+		peeked, err := q.Peek()
+		assert.NoError(t, err)
+		assert.Equal(t, item.MessageId, peeked.MessageId, "every queue gets the same message id")
+	}
+
+	// Removed subscriptions receive nothing more
+	assert.NoError(t, ns.Unsubscribe("orders", "all"))
+	assert.Error(t, ns.Unsubscribe("orders", "all"))
+	delivered, err = ns.Publish("orders", &queue.QueueItem{MessageId: uuid.New(), Priority: 9}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{2}, delivered)
+}
+
+func TestTopicsPersistInCatalog(t *testing.T) {
+	dir := t.TempDir()
+	ns := newTopicNamespace(t, dir, 1, 2)
+	assert.NoError(t, ns.CreateTopic("orders"))
+	assert.NoError(t, ns.CreateTopic("audit"))
+	assert.NoError(t, ns.Subscribe("orders", queue.Subscription{Name: "eu", QueueId: 1, Headers: map[string]string{"region": "eu"}}))
+	assert.NoError(t, ns.Subscribe("orders", queue.Subscription{Name: "archive", QueueId: 2}))
+	assert.NoError(t, ns.Subscribe("audit", queue.Subscription{Name: "archive", QueueId: 2}))
+	assert.NoError(t, ns.Close())
+
+	reopened := newTopicNamespace(t, dir, 1, 2)
+	assert.Equal(t, []string{"audit", "orders"}, reopened.Topics())
+	topic, err := reopened.GetTopic("orders")
+	assert.NoError(t, err)
+	assert.Equal(t, []queue.Subscription{
+		{Name: "eu", QueueId: 1, Headers: map[string]string{"region": "eu"}},
+		{Name: "archive", QueueId: 2},
+	}, topic.Subscriptions)
+
+	// Deleting a queue drops its subscriptions, deleting a topic keeps its queues
+	assert.NoError(t, reopened.DeleteQueue(2))
+	topic, err = reopened.GetTopic("orders")
+	assert.NoError(t, err)
+	assert.Len(t, topic.Subscriptions, 1)
+	assert.NoError(t, reopened.DeleteTopic("orders"))
+	assert.Error(t, reopened.DeleteTopic("orders"))
+	_, err = reopened.GetTopic("orders")
+	assert.Error(t, err)
+	_, err = reopened.GetQueue(1)
+	assert.NoError(t, err)
+
+	// Snapshots carry the catalog
+	archive := filepath.Join(t.TempDir(), "snapshot.tar")
+	assert.NoError(t, reopened.Snapshot(archive))
+	restored, err := queue.RestoreNamespace(archive, t.TempDir())
+	assert.NoError(t, err)
+	defer restored.Close()
+	assert.Equal(t, []string{"audit"}, restored.Topics())
+}
@@ -0,0 +1,86 @@
+package tests
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/queue"
+	"github.com/kokaq/core/utils/murmur"
+	"github.com/stretchr/testify/assert"
+)
+
+func assertHeapValid(t *testing.T, heap *queue.Heap, step int) {
+	t.Helper()
+	violations, err := heap.Verify()
+	if err != nil {
+		t.Fatalf("step %d: Verify failed: %v", step, err)
+	}
+	if len(violations) > 0 {
+		t.Fatalf("step %d: heap invariants violated: %v", step, violations)
+	}
+}
+
+func TestHeapVerifyRandomOperations(t *testing.T) {
+	for _, heapMaxSize := range []int{2, 3, 4} {
+		rng := rand.New(rand.NewSource(int64(heapMaxSize)))
+		heap, err := queue.NewHeapWithOptions(t.TempDir(), heapMaxSize, 8, 8, 16, queue.HeapOptions{PageCachePages: 2})
+		if err != nil {
+			t.Fatalf("Failed to initialize heap: %v", err)
+		}
+		for step := 0; step < 600; step++ {
+			switch op := rng.Intn(20); {
+			case op < 11:
+				assert.NoError(t, heap.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: uint64(rng.Intn(60) + 1)}))
+			case op < 19:
+				if empty, _ := heap.IsEmpty(); !empty {
+					_, err := heap.Dequeue()
+					assert.NoError(t, err)
+				}
+			default:
+				low := uint64(rng.Intn(60) + 1)
+				assert.NoError(t, heap.Clear(queue.PriorityRange{Min: low, Max: low + 5}))
+			}
+			assertHeapValid(t, heap, step)
+		}
+		assert.NoError(t, heap.Close())
+	}
+}
+
+func TestHeapVerifyReportsViolations(t *testing.T) {
+	dir := t.TempDir()
+	heap, err := queue.NewHeap(dir, 3, 8, 8, 16)
+	if err != nil {
+		t.Fatalf("Failed to initialize heap: %v", err)
+	}
+	for priority := uint64(1); priority <= 5; priority++ {
+		assert.NoError(t, heap.Enqueue(&queue.QueueItem{MessageId: uuid.New(), Priority: priority}))
+	}
+	assert.NoError(t, heap.Close())
+
+	// Swap the root with its left child and reseal the page
+	pages := filepath.Join(dir, "pages")
+	data, err := os.ReadFile(pages)
+	assert.NoError(t, err)
+	root := append([]byte(nil), data[:16]...)
+	copy(data[:16], data[16:32])
+	copy(data[16:32], root)
+	pageSize := 7*16 + 4
+	binary.LittleEndian.PutUint32(data[pageSize-4:], murmur.Sum32(data[:pageSize-4]))
+	assert.NoError(t, os.WriteFile(pages, data, 0644))
+
+	heap, err = queue.NewHeap(dir, 3, 8, 8, 16)
+	if err != nil {
+		t.Fatalf("Failed to reopen heap: %v", err)
+	}
+	defer heap.Close()
+	violations, err := heap.Verify()
+	assert.NoError(t, err)
+	if assert.Len(t, violations, 1) {
+		assert.Equal(t, queue.ViolationHeapProperty, violations[0].Kind)
+		assert.Equal(t, 2, violations[0].Node)
+	}
+}
@@ -0,0 +1,302 @@
+package utils
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const DefaultMaxOpenFiles = 64
+
+type FileManagerOptions struct {
+	MaxOpenFiles int        // defaults to 64
+	FileSystem   FileSystem // defaults to OSFileSystem
+	// Track modified files and directories whose entries changed, so Sync
+	// can fsync them. Modified files are also synced before being closed.
+	TrackSync bool
+}
+
+// FileManager keeps files open between operations, reading and writing them
+// with ReadAt/WriteAt. At most maxOpen descriptors are held; the least
+// recently used file is closed when the limit is reached.
+type FileManager struct {
+	mu        sync.Mutex
+	maxOpen   int
+	fs        FileSystem
+	trackSync bool
+	files     map[string]*list.Element
+	lru       *list.List
+	dirtyDirs map[string]bool
+	closed    bool
+}
+
+type managedFile struct {
+	path  string
+	file  File
+	size  int64
+	dirty bool
+}
+
+func NewFileManager(maxOpen int) *FileManager {
+	return NewFileManagerWithOptions(FileManagerOptions{MaxOpenFiles: maxOpen})
+}
+
+func NewFileManagerWithOptions(options FileManagerOptions) *FileManager {
+	maxOpen := options.MaxOpenFiles
+	if maxOpen <= 0 {
+		maxOpen = DefaultMaxOpenFiles
+	}
+	fs := options.FileSystem
+	if fs == nil {
+		fs = OSFileSystem
+	}
+	return &FileManager{
+		maxOpen:   maxOpen,
+		fs:        fs,
+		trackSync: options.TrackSync,
+		files:     make(map[string]*list.Element),
+		lru:       list.New(),
+		dirtyDirs: make(map[string]bool),
+	}
+}
+
+// Number of descriptors currently held open.
+func (m *FileManager) OpenFiles() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Len()
+}
+
+func (m *FileManager) get(path string, create bool) (*managedFile, error) {
+	if m.closed {
+		return nil, fmt.Errorf("file manager is closed")
+	}
+	if element, exists := m.files[path]; exists {
+		m.lru.MoveToFront(element)
+		return element.Value.(*managedFile), nil
+	}
+	flag := os.O_RDWR
+	if create {
+		if _, err := m.fs.Stat(path); os.IsNotExist(err) {
+			// The new directory entry has to be synced along with the file
+			m.markDirectory(path)
+		}
+		flag |= os.O_CREATE
+	}
+	file, err := m.fs.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat file %s: %w", path, err)
+	}
+	f := &managedFile{path: path, file: file, size: info.Size()}
+	m.files[path] = m.lru.PushFront(f)
+	for m.lru.Len() > m.maxOpen {
+		if err = m.closeElement(m.lru.Back()); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (m *FileManager) markDirectory(path string) {
+	if m.trackSync {
+		m.dirtyDirs[filepath.Dir(path)] = true
+	}
+}
+
+func (m *FileManager) markFile(f *managedFile) {
+	if m.trackSync {
+		f.dirty = true
+	}
+}
+
+func (m *FileManager) syncFile(f *managedFile) error {
+	if !f.dirty {
+		return nil
+	}
+	if err := f.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file %s: %w", f.path, err)
+	}
+	f.dirty = false
+	return nil
+}
+
+func (m *FileManager) closeElement(element *list.Element) error {
+	f := element.Value.(*managedFile)
+	syncErr := m.syncFile(f)
+	m.lru.Remove(element)
+	delete(m.files, f.path)
+	if syncErr != nil {
+		f.file.Close()
+		return syncErr
+	}
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to close file %s: %w", f.path, err)
+	}
+	return nil
+}
+
+// Read up to length bytes at offset, fewer if the file ends first.
+func (m *FileManager) ReadAt(path string, offset int64, length int) ([]byte, error) {
+	defer observeFileIO("read", time.Now())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := m.get(path, false)
+	if err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, length)
+	bytesRead, err := f.file.ReadAt(buffer, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read bytes from file %s: %w", path, err)
+	}
+	return buffer[:bytesRead], nil
+}
+
+// Write data at offset, creating the file if needed.
+func (m *FileManager) WriteAt(path string, offset int64, data []byte) error {
+	defer observeFileIO("write", time.Now())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := m.get(path, true)
+	if err != nil {
+		return err
+	}
+	if _, err = f.file.WriteAt(data, offset); err != nil {
+		return fmt.Errorf("failed to write bytes to file %s: %w", path, err)
+	}
+	m.markFile(f)
+	f.size = max(f.size, offset+int64(len(data)))
+	return nil
+}
+
+// Append data at the end of the file, creating it if needed.
+func (m *FileManager) Append(path string, data []byte) error {
+	defer observeFileIO("append", time.Now())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := m.get(path, true)
+	if err != nil {
+		return err
+	}
+	if _, err = f.file.WriteAt(data, f.size); err != nil {
+		return fmt.Errorf("failed to append bytes to file %s: %w", path, err)
+	}
+	m.markFile(f)
+	f.size += int64(len(data))
+	return nil
+}
+
+func (m *FileManager) Truncate(path string, size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := m.get(path, false)
+	if err != nil {
+		return err
+	}
+	if err = f.file.Truncate(size); err != nil {
+		return fmt.Errorf("failed to truncate file %s: %w", path, err)
+	}
+	m.markFile(f)
+	f.size = size
+	return nil
+}
+
+// Close the descriptor of path, if open, and delete the file.
+func (m *FileManager) Remove(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if element, exists := m.files[path]; exists {
+		// The contents are going away, there is no point syncing them
+		element.Value.(*managedFile).dirty = false
+		if err := m.closeElement(element); err != nil {
+			return err
+		}
+	}
+	if err := m.fs.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to delete file %s: %w", path, err)
+	}
+	m.markDirectory(path)
+	return nil
+}
+
+// Sync a directory so the entries created or removed in it are durable.
+func (m *FileManager) SyncDirectory(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.syncDirectory(path)
+}
+
+func (m *FileManager) syncDirectory(path string) error {
+	dir, err := m.fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %s: %w", path, err)
+	}
+	defer dir.Close()
+	if err = dir.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %w", path, err)
+	}
+	return nil
+}
+
+// Sync every file modified and every directory whose entries changed since
+// the last Sync. Only tracked with TrackSync.
+func (m *FileManager) Sync() error {
+	defer observeFileIO("sync", time.Now())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return fmt.Errorf("file manager is closed")
+	}
+	for element := m.lru.Front(); element != nil; element = element.Next() {
+		if err := m.syncFile(element.Value.(*managedFile)); err != nil {
+			return err
+		}
+	}
+	dirs := make([]string, 0, len(m.dirtyDirs))
+	for dir := range m.dirtyDirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		if err := m.syncDirectory(dir); err != nil {
+			return err
+		}
+		delete(m.dirtyDirs, dir)
+	}
+	return nil
+}
+
+// Close every open descriptor, syncing what is tracked as modified; the
+// manager cannot be used afterwards.
+func (m *FileManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var errs []error
+	for m.lru.Len() > 0 {
+		if err := m.closeElement(m.lru.Front()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for dir := range m.dirtyDirs {
+		if err := m.syncDirectory(dir); err != nil {
+			errs = append(errs, err)
+		}
+		delete(m.dirtyDirs, dir)
+	}
+	m.closed = true
+	return errors.Join(errs...)
+}
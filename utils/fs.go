@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"io"
+	"os"
+)
+
+// File is the subset of *os.File used by the FileManager.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Close() error
+}
+
+// FileSystem abstracts the operating system so tests can observe or fail
+// individual calls.
+type FileSystem interface {
+	OpenFile(path string, flag int, perm os.FileMode) (File, error)
+	Stat(path string) (os.FileInfo, error)
+	Remove(path string) error
+}
+
+// OSFileSystem is backed by the os package.
+var OSFileSystem FileSystem = osFileSystem{}
+
+type osFileSystem struct{}
+
+func (osFileSystem) OpenFile(path string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(path, flag, perm)
+}
+
+func (osFileSystem) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (osFileSystem) Remove(path string) error {
+	return os.Remove(path)
+}
@@ -4,8 +4,17 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
+
+	"github.com/kokaq/core/internals/metrics"
 )
 
+var fileIOLatency = metrics.Default.Histogram("kokaq_file_io_duration_seconds", "Latency of file reads, writes, appends and syncs.", nil, "operation")
+
+func observeFileIO(operation string, start time.Time) {
+	fileIOLatency.With(operation).Observe(time.Since(start).Seconds())
+}
+
 func DirectoryExists(path string) bool {
 	// This function checks if a directory exists at the given path.
 	// Returns true if it exists, false otherwise.
@@ -84,6 +93,7 @@ func EnsureFileDeleted(path string) error {
 func ReadBytesFromFile(path string, offset int64, length int) ([]byte, error) {
 	// This function reads a specified number of bytes from a file at a given offset.
 	// Returns the read bytes or an error if the operation fails.
+	defer observeFileIO("read", time.Now())
 
 	file, err := os.Open(path)
 	if err != nil {
@@ -110,6 +120,7 @@ func WriteBytesToFile(path string, offset int64, data []byte) error {
 	// This function writes a byte slice to a file at a specified offset.
 	// If the file does not exist, it creates it.
 	// Returns an error if the operation fails.
+	defer observeFileIO("write", time.Now())
 
 	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
@@ -132,6 +143,7 @@ func AppendBytesToFile(path string, data []byte) error {
 	// This function appends a byte slice to a file.
 	// If the file does not exist, it creates it.
 	// Returns an error if the operation fails.
+	defer observeFileIO("append", time.Now())
 
 	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
@@ -145,3 +157,13 @@ func AppendBytesToFile(path string, data []byte) error {
 	}
 	return nil
 }
+
+func TruncateFile(path string, size int64) error {
+	// This function truncates or extends the file at the given path to size bytes.
+	// Returns an error if the file does not exist or cannot be truncated.
+
+	if err := os.Truncate(path, size); err != nil {
+		return fmt.Errorf("failed to truncate file %s: %w", path, err)
+	}
+	return nil
+}
@@ -88,6 +88,19 @@ func New32() hash.Hash32 {
 	return SeedNew32(0)
 }
 
+// Sum32 returns the murmur3 32 bit sum of data.
+func Sum32(data []byte) uint32 {
+	return SeedSum32(0, data)
+}
+
+// SeedSum32 returns the murmur3 32 bit sum of data with the digest
+// initialized to seed.
+func SeedSum32(seed uint32, data []byte) uint32 {
+	d := SeedNew32(seed)
+	d.Write(data)
+	return d.Sum32()
+}
+
 func (d *digest32) Size() int { return 4 }
 
 func (d *digest32) reset() { d.h1 = d.seed }